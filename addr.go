@@ -0,0 +1,72 @@
+package npipe
+
+import (
+	// Standard
+	"fmt"
+	"net"
+	"strings"
+)
+
+// PipeAddr represents the address of a named pipe.
+type PipeAddr string
+
+// Network returns the address's network name, "pipe".
+func (a PipeAddr) Network() string { return "pipe" }
+
+// String returns the address of the pipe
+func (a PipeAddr) String() string {
+	return string(a)
+}
+
+// ValidatePipeAddress validates that a proper Windows named pipe path was passed in (e.g., \\.\pipe\srvsvc)
+func ValidatePipeAddress(address string) error {
+	// Split to ensure there are enough parts
+	// 0. blank
+	// 1. blank
+	// 2. is "." OR network IP
+	// 3. must be PIPE
+	// 4. must exist
+	p := strings.Split(address, "\\")
+	if len(p) < 5 {
+		return fmt.Errorf("npipe.ValidatePipeAddress(): expected at least 5 parts from pipe address \"%s\" but received %d. Example: \\\\.\\pipe\\srvsvc", address, len(p))
+	}
+
+	// A dot "." represents the local host
+	if p[2] != "." {
+		// Ensure a valid IP address was provided
+		ip := net.ParseIP(p[2])
+		if ip == nil {
+			return fmt.Errorf("npipe.ValidatePipeAddress(): invalid IP address \"%s\"", p[2])
+		}
+	}
+
+	if strings.ToLower(p[3]) != "pipe" {
+		return fmt.Errorf("npipe.ValidatePipeAddress(): expected \"pipe\" but received \"%s\"", p[3])
+	}
+
+	return nil
+}
+
+// splitPipeAddress validates the pipe address and returns the host portion (e.g., "." or an IP address) and the
+// pipe name that follows \pipe\. Pipe names may themselves contain backslashes.
+func splitPipeAddress(address string) (host, name string, err error) {
+	err = ValidatePipeAddress(address)
+	if err != nil {
+		return "", "", err
+	}
+	p := strings.Split(address, "\\")
+	name = strings.Join(p[4:], "\\")
+	if name == "" {
+		return "", "", fmt.Errorf("npipe.splitPipeAddress(): the pipe address \"%s\" does not contain a pipe name", address)
+	}
+	return p[2], name, nil
+}
+
+// isLocalHost returns true if the host portion of a pipe address refers to this computer
+func isLocalHost(host string) bool {
+	if host == "" || host == "." {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,95 @@
+//go:build windows || linux
+
+package npipe
+
+import (
+	// Standard
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// callPipeBufferSize is the size of the buffer CallPipe first reads the reply into; it grows for larger replies
+	callPipeBufferSize = 4096
+	// callPipeRetry is how long CallPipe waits for the pipe before it checks whether ctx is done
+	callPipeRetry = 250 * time.Millisecond
+)
+
+// CallPipe connects to the message pipe at address, writes req as one message, reads the whole reply, and closes the
+// connection, like CallNamedPipe. It waits for the pipe to become available like Dial until ctx is done, and the
+// deadline of ctx bounds the whole call. If ctx is done first CallPipe returns ctx.Err().
+func CallPipe(ctx context.Context, address string, req []byte) ([]byte, error) {
+	conn, err := dialContext(ctx, address)
+	if err != nil {
+		if err := contextError(ctx); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("npipe.CallPipe(): %s", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = conn.SetDeadline(deadline); err != nil {
+			return nil, fmt.Errorf("npipe.CallPipe(): %s", err)
+		}
+	}
+	if err = conn.setMessageReadMode(); err != nil {
+		return nil, fmt.Errorf("npipe.CallPipe(): %s", err)
+	}
+
+	resp := make([]byte, callPipeBufferSize)
+	n, err := conn.Transact(ctx, req, resp)
+	for err == ErrMoreData {
+		if n == len(resp) {
+			resp = append(resp, make([]byte, len(resp))...)
+		}
+		var m int
+		m, err = conn.Read(resp[n:])
+		n += m
+	}
+	if err != nil {
+		if err := contextError(ctx); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("npipe.CallPipe(): %s", err)
+	}
+	return resp[:n], nil
+}
+
+// contextError returns ctx.Err(), or context.DeadlineExceeded once the deadline of ctx passed even if ctx was not
+// marked done yet, so the I/O deadlines derived from ctx report the context's error
+func contextError(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// dialContext connects to the pipe at address, waiting for it to become available until ctx is done
+func dialContext(ctx context.Context, address string) (*PipeConn, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		wait := callPipeRetry
+		if deadline, ok := ctx.Deadline(); ok {
+			if left := time.Until(deadline); left < wait {
+				wait = left
+			}
+		}
+		if wait <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		conn, err := DialTimeout(address, wait)
+		if err == nil {
+			return conn, nil
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return nil, err
+		}
+	}
+}
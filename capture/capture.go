@@ -0,0 +1,318 @@
+// Package capture records the traffic of a pipe session to a file, exports recordings to pcapng for Wireshark, and
+// replays them as either end of the session.
+//
+// Wrap a connection to record everything read from and written to it:
+//
+//	f, err := os.Create("session.npcap")
+//	w, err := capture.NewWriter(f, capture.Header{Addr: `\\.\pipe\thirdparty`, Side: capture.Client})
+//	conn, err := npipe.Dial(`\\.\pipe\thirdparty`)
+//	rec := capture.Wrap(conn, w)
+//
+// A recording can stand in for the peer it was taken against, for example to reproduce a bug in a client without
+// the third-party server:
+//
+//	r, err := capture.NewReader(f)
+//	err = capture.Replay(serverConn, r, capture.ReplayOptions{Side: capture.Server})
+//
+// # File format
+//
+// All integers are little endian. A capture starts with a header:
+//
+//	magic    [8]byte  "NPIPECAP"
+//	version  uint16   1
+//	flags    uint16   bit 0: message mode, bit 1: recorded on the server side
+//	start    int64    Unix time in nanoseconds
+//	addrLen  uint16
+//	addr     [addrLen]byte
+//
+// followed by records until the end of the file:
+//
+//	time     int64    Unix time in nanoseconds
+//	kind     uint8    1: data, 2: close
+//	dir      uint8    1: sent by the recording side, 2: received by it
+//	flags    uint8    bit 0: the record ends a message
+//	reserved uint8    0
+//	length   uint32   at most MaxRecordSize
+//	data     [length]byte
+//
+// A close record sent by the recording side means it closed the connection; a received one means the peer did and
+// reads returned io.EOF. In message mode every record sent ends a message, received records end one unless the read
+// returned npipe.ErrMoreData.
+package capture
+
+import (
+	// Standard
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// MaxRecordSize is the largest payload of a single record; larger writes are split across several records
+const MaxRecordSize = 1 << 20
+
+const (
+	magic   = "NPIPECAP"
+	version = 1
+
+	headerFlagMessage = 1 << 0
+	headerFlagServer  = 1 << 1
+
+	recordFlagEndOfMessage = 1 << 0
+
+	// recordHeaderSize is the size of a record without its data
+	recordHeaderSize = 16
+)
+
+// Side is the end of the session a capture was recorded on, or played by a replay
+type Side uint8
+
+const (
+	// Client is the end that dialed the pipe
+	Client Side = iota
+	// Server is the end that accepted the connection
+	Server
+)
+
+// String returns the name of the side
+func (s Side) String() string {
+	if s == Server {
+		return "server"
+	}
+	return "client"
+}
+
+// Direction tells whether a record was sent or received by the recording side
+type Direction uint8
+
+const (
+	// Sent records were written by the recording side
+	Sent Direction = iota + 1
+	// Received records were read by the recording side
+	Received
+)
+
+// String returns the name of the direction
+func (d Direction) String() string {
+	switch d {
+	case Sent:
+		return "sent"
+	case Received:
+		return "received"
+	default:
+		return "unknown"
+	}
+}
+
+// Kind is the type of a record
+type Kind uint8
+
+const (
+	// Data records carry the bytes of a read or write
+	Data Kind = iota + 1
+	// Close records mark the end of the session
+	Close
+)
+
+// String returns the name of the kind
+func (k Kind) String() string {
+	switch k {
+	case Data:
+		return "data"
+	case Close:
+		return "close"
+	default:
+		return "unknown"
+	}
+}
+
+// Header describes a capture
+type Header struct {
+	// Addr is the address of the pipe
+	Addr string
+	// Side is the end of the session the capture was recorded on
+	Side Side
+	// MessageMode is true if the pipe was in message mode and records carry message boundaries
+	MessageMode bool
+	// Start is when the capture was started, time.Now() when zero
+	Start time.Time
+}
+
+// Record is a single read, write, or close
+type Record struct {
+	// Time is when the operation completed, time.Now() when zero
+	Time time.Time
+	// Kind is the type of the record
+	Kind Kind
+	// Dir is the direction relative to the recording side
+	Dir Direction
+	// EndOfMessage is true if the record ends a message; it is only meaningful in message mode
+	EndOfMessage bool
+	// Data is the payload of a Data record
+	Data []byte
+}
+
+// Writer writes a capture. It is safe for concurrent use.
+type Writer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	header Header
+	err    error
+}
+
+// NewWriter writes the capture header to w and returns a Writer for the records
+func NewWriter(w io.Writer, h Header) (*Writer, error) {
+	if h.Start.IsZero() {
+		h.Start = time.Now()
+	}
+	if len(h.Addr) > 0xffff {
+		return nil, fmt.Errorf("capture.NewWriter(): the address is %d bytes long, the limit is 65535", len(h.Addr))
+	}
+	b := make([]byte, 0, 22+len(h.Addr))
+	b = append(b, magic...)
+	b = binary.LittleEndian.AppendUint16(b, version)
+	var flags uint16
+	if h.MessageMode {
+		flags |= headerFlagMessage
+	}
+	if h.Side == Server {
+		flags |= headerFlagServer
+	}
+	b = binary.LittleEndian.AppendUint16(b, flags)
+	b = binary.LittleEndian.AppendUint64(b, uint64(h.Start.UnixNano()))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(h.Addr)))
+	b = append(b, h.Addr...)
+	if _, err := w.Write(b); err != nil {
+		return nil, fmt.Errorf("capture.NewWriter(): there was an error writing the header: %s", err)
+	}
+	return &Writer{w: w, header: h}, nil
+}
+
+// Header returns the header of the capture
+func (w *Writer) Header() Header {
+	return w.header
+}
+
+// WriteRecord appends r to the capture. Data larger than MaxRecordSize is split across several records, only the
+// last of which keeps EndOfMessage. After an error every call returns it.
+func (w *Writer) WriteRecord(r Record) error {
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	for {
+		chunk := r
+		if len(chunk.Data) > MaxRecordSize {
+			chunk.Data = chunk.Data[:MaxRecordSize]
+			chunk.EndOfMessage = false
+		}
+		if err := w.write(chunk); err != nil {
+			w.err = fmt.Errorf("capture.Writer.WriteRecord(): %s", err)
+			return w.err
+		}
+		r.Data = r.Data[len(chunk.Data):]
+		if len(r.Data) == 0 {
+			return nil
+		}
+	}
+}
+
+// write encodes a single record; the caller must hold mu
+func (w *Writer) write(r Record) error {
+	b := make([]byte, recordHeaderSize, recordHeaderSize+len(r.Data))
+	binary.LittleEndian.PutUint64(b[0:], uint64(r.Time.UnixNano()))
+	b[8] = byte(r.Kind)
+	b[9] = byte(r.Dir)
+	if r.EndOfMessage {
+		b[10] |= recordFlagEndOfMessage
+	}
+	binary.LittleEndian.PutUint32(b[12:], uint32(len(r.Data)))
+	b = append(b, r.Data...)
+	_, err := w.w.Write(b)
+	return err
+}
+
+// Reader reads a capture
+type Reader struct {
+	r      *bufio.Reader
+	header Header
+}
+
+// NewReader reads the capture header from r and returns a Reader for the records
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	b := make([]byte, 20)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return nil, fmt.Errorf("capture.NewReader(): there was an error reading the header: %s", err)
+	}
+	if string(b[:8]) != magic {
+		return nil, fmt.Errorf("capture.NewReader(): not a capture file")
+	}
+	if v := binary.LittleEndian.Uint16(b[8:]); v != version {
+		return nil, fmt.Errorf("capture.NewReader(): unsupported version %d", v)
+	}
+	flags := binary.LittleEndian.Uint16(b[10:])
+	h := Header{
+		MessageMode: flags&headerFlagMessage != 0,
+		Start:       time.Unix(0, int64(binary.LittleEndian.Uint64(b[12:]))),
+	}
+	if flags&headerFlagServer != 0 {
+		h.Side = Server
+	}
+	addr := make([]byte, 2)
+	if _, err := io.ReadFull(br, addr); err != nil {
+		return nil, fmt.Errorf("capture.NewReader(): there was an error reading the header: %s", err)
+	}
+	addr = make([]byte, binary.LittleEndian.Uint16(addr))
+	if _, err := io.ReadFull(br, addr); err != nil {
+		return nil, fmt.Errorf("capture.NewReader(): there was an error reading the header: %s", err)
+	}
+	h.Addr = string(addr)
+	return &Reader{r: br, header: h}, nil
+}
+
+// Header returns the header of the capture
+func (r *Reader) Header() Header {
+	return r.header
+}
+
+// Next returns the next record. It returns io.EOF at the end of the capture and io.ErrUnexpectedEOF if the capture
+// was truncated in the middle of a record.
+func (r *Reader) Next() (Record, error) {
+	b := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return Record{}, err
+	}
+	rec := Record{
+		Time:         time.Unix(0, int64(binary.LittleEndian.Uint64(b[0:]))),
+		Kind:         Kind(b[8]),
+		Dir:          Direction(b[9]),
+		EndOfMessage: b[10]&recordFlagEndOfMessage != 0,
+	}
+	if rec.Kind != Data && rec.Kind != Close {
+		return Record{}, fmt.Errorf("capture.Reader.Next(): unknown record kind %d", b[8])
+	}
+	if rec.Dir != Sent && rec.Dir != Received {
+		return Record{}, fmt.Errorf("capture.Reader.Next(): unknown record direction %d", b[9])
+	}
+	size := binary.LittleEndian.Uint32(b[12:])
+	if size > MaxRecordSize {
+		return Record{}, fmt.Errorf("capture.Reader.Next(): the record is %d bytes long, the limit is %d", size, MaxRecordSize)
+	}
+	if size > 0 {
+		rec.Data = make([]byte, size)
+		if _, err := io.ReadFull(r.r, rec.Data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return Record{}, err
+		}
+	}
+	return rec, nil
+}
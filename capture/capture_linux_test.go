@@ -0,0 +1,164 @@
+package capture
+
+import (
+	// Standard
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// listen creates a message mode pipe for the test
+func listen(t *testing.T, address string) *npipe.PipeListener {
+	t.Setenv("NPIPE_SOCKET_DIR", t.TempDir())
+	ln, err := npipe.NewPipeListener(address, npipe.PipeAccessDuplex, npipe.PipeTypeMessage|npipe.PipeReadModeMessage, npipe.PipeUnlimitedInstances, 512, 512, 0, nil)
+	if err != nil {
+		t.Fatalf("NewPipeListener(%q): %v", address, err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+// client sends a request and reads the reply in 4 byte reads so messages arrive in parts
+func client(conn io.ReadWriteCloser) (string, error) {
+	if _, err := conn.Write([]byte("request")); err != nil {
+		return "", err
+	}
+	var reply []byte
+	b := make([]byte, 4)
+	for {
+		n, err := conn.Read(b)
+		reply = append(reply, b[:n]...)
+		if err == npipe.ErrMoreData {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(reply), conn.Close()
+	}
+}
+
+// server reads a request and replies to it
+func server(conn io.ReadWriteCloser) error {
+	b := make([]byte, 64)
+	n, err := conn.Read(b)
+	if err != nil {
+		return err
+	}
+	if _, err = conn.Write(append([]byte("reply to "), b[:n]...)); err != nil {
+		return err
+	}
+	_, err = conn.Read(b)
+	if err != io.EOF {
+		return err
+	}
+	return conn.Close()
+}
+
+// TestRecordAndReplay records a client session against a real server, then replays the server for a new client and
+// the client for a new server
+func TestRecordAndReplay(t *testing.T) {
+	address := `\\.\pipe\TestRecordAndReplay`
+	ln := listen(t, address)
+	serverErrs := make(chan error, 1)
+	serve := func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			serverErrs <- err
+			return
+		}
+		serverErrs <- server(conn)
+	}
+
+	// Record
+	go serve()
+	var capture bytes.Buffer
+	w, err := NewWriter(&capture, Header{Addr: address, MessageMode: true})
+	if err != nil {
+		t.Fatalf("NewWriter(): %v", err)
+	}
+	conn, err := npipe.DialTimeout(address, time.Second)
+	if err != nil {
+		t.Fatalf("DialTimeout(): %v", err)
+	}
+	rec := Wrap(conn, w)
+	if reply, err := client(rec); err != nil || reply != "reply to request" {
+		t.Fatalf("client() = %q, %v", reply, err)
+	}
+	if err = <-serverErrs; err != nil {
+		t.Fatalf("server(): %v", err)
+	}
+	if err = rec.Err(); err != nil {
+		t.Fatalf("Err(): %v", err)
+	}
+
+	// Replay the server for a new client
+	replayed := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			replayed <- err
+			return
+		}
+		r, _ := NewReader(bytes.NewReader(capture.Bytes()))
+		replayed <- Replay(conn, r, ReplayOptions{Side: Server, Timing: true})
+	}()
+	conn, err = npipe.DialTimeout(address, time.Second)
+	if err != nil {
+		t.Fatalf("DialTimeout(): %v", err)
+	}
+	if reply, err := client(conn); err != nil || reply != "reply to request" {
+		t.Fatalf("client() against the replayed server = %q, %v", reply, err)
+	}
+	if err = <-replayed; err != nil {
+		t.Fatalf("Replay() as the server: %v", err)
+	}
+
+	// Replay the client for a new server
+	go serve()
+	conn, err = npipe.DialTimeout(address, time.Second)
+	if err != nil {
+		t.Fatalf("DialTimeout(): %v", err)
+	}
+	r, _ := NewReader(bytes.NewReader(capture.Bytes()))
+	if err = Replay(conn, r, ReplayOptions{Side: Client}); err != nil {
+		t.Fatalf("Replay() as the client: %v", err)
+	}
+	if err = <-serverErrs; err != nil {
+		t.Fatalf("server() against the replayed client: %v", err)
+	}
+}
+
+// TestReplayMismatch tests that a peer deviating from the recording is reported
+func TestReplayMismatch(t *testing.T) {
+	address := `\\.\pipe\TestReplayMismatch`
+	ln := listen(t, address)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Read(make([]byte, 64))
+		conn.Write([]byte("something else"))
+	}()
+
+	conn, err := npipe.DialTimeout(address, time.Second)
+	if err != nil {
+		t.Fatalf("DialTimeout(): %v", err)
+	}
+	defer conn.Close()
+	r, _ := NewReader(bytes.NewReader(writeTestCapture(t)))
+	err = Replay(conn, r, ReplayOptions{Side: Client})
+	mismatch, ok := err.(*MismatchError)
+	if !ok {
+		t.Fatalf("expected a *MismatchError but received %v", err)
+	}
+	if mismatch.Record != 1 || string(mismatch.Want) != "hi client" || string(mismatch.Got) != "something else" {
+		t.Fatalf("unexpected mismatch %+v", mismatch)
+	}
+}
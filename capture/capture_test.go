@@ -0,0 +1,155 @@
+package capture
+
+import (
+	// Standard
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+// testRecords is a short message mode session recorded on the client
+var testRecords = []Record{
+	{Kind: Data, Dir: Sent, EndOfMessage: true, Data: []byte("hello")},
+	{Kind: Data, Dir: Received, Data: []byte("hi ")},
+	{Kind: Data, Dir: Received, EndOfMessage: true, Data: []byte("client")},
+	{Kind: Close, Dir: Sent},
+}
+
+// writeTestCapture returns a capture of testRecords
+func writeTestCapture(t *testing.T) []byte {
+	var buf bytes.Buffer
+	start := time.Unix(1700000000, 0)
+	w, err := NewWriter(&buf, Header{Addr: `\\.\pipe\test`, MessageMode: true, Start: start})
+	if err != nil {
+		t.Fatalf("NewWriter(): %v", err)
+	}
+	for i, rec := range testRecords {
+		rec.Time = start.Add(time.Duration(i) * time.Millisecond)
+		if err = w.WriteRecord(rec); err != nil {
+			t.Fatalf("WriteRecord(): %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// TestRoundTrip tests that records read back the way they were written
+func TestRoundTrip(t *testing.T) {
+	data := writeTestCapture(t)
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("NewReader(): %v", err)
+	}
+	h := r.Header()
+	if h.Addr != `\\.\pipe\test` || h.Side != Client || !h.MessageMode || h.Start.Unix() != 1700000000 {
+		t.Fatalf("unexpected header %+v", h)
+	}
+	for i, want := range testRecords {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next(): %v", err)
+		}
+		if got.Kind != want.Kind || got.Dir != want.Dir || got.EndOfMessage != want.EndOfMessage || !bytes.Equal(got.Data, want.Data) {
+			t.Fatalf("record %d: expected %+v but received %+v", i, want, got)
+		}
+		if got.Time.Sub(h.Start) != time.Duration(i)*time.Millisecond {
+			t.Fatalf("record %d: unexpected time %s", i, got.Time)
+		}
+	}
+	if _, err = r.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF at the end of the capture but received %v", err)
+	}
+
+	// A capture cut in the middle of a record is reported
+	r, _ = NewReader(bytes.NewReader(data[:len(data)-recordHeaderSize-3]))
+	r.Next()
+	r.Next()
+	if _, err = r.Next(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF but received %v", err)
+	}
+}
+
+// TestSplitLargeRecords tests that data larger than MaxRecordSize is split and only the last record ends the message
+func TestSplitLargeRecords(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, Header{MessageMode: true})
+	if err != nil {
+		t.Fatalf("NewWriter(): %v", err)
+	}
+	if err = w.WriteRecord(Record{Kind: Data, Dir: Sent, EndOfMessage: true, Data: make([]byte, MaxRecordSize+1)}); err != nil {
+		t.Fatalf("WriteRecord(): %v", err)
+	}
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatalf("NewReader(): %v", err)
+	}
+	for _, want := range []struct {
+		size int
+		eom  bool
+	}{{MaxRecordSize, false}, {1, true}} {
+		rec, err := r.Next()
+		if err != nil || len(rec.Data) != want.size || rec.EndOfMessage != want.eom {
+			t.Fatalf("expected %d bytes with EndOfMessage %t but received %d, %t, %v", want.size, want.eom, len(rec.Data), rec.EndOfMessage, err)
+		}
+	}
+}
+
+// TestExportPcapng parses the exported blocks and checks the synthetic TCP stream
+func TestExportPcapng(t *testing.T) {
+	r, err := NewReader(bytes.NewReader(writeTestCapture(t)))
+	if err != nil {
+		t.Fatalf("NewReader(): %v", err)
+	}
+	var out bytes.Buffer
+	if err = ExportPcapng(&out, r); err != nil {
+		t.Fatalf("ExportPcapng(): %v", err)
+	}
+
+	b := out.Bytes()
+	var types []uint32
+	streams := map[uint16][]byte{}
+	var comments int
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated block")
+		}
+		blockType := binary.LittleEndian.Uint32(b)
+		total := binary.LittleEndian.Uint32(b[4:])
+		if total%4 != 0 || int(total) > len(b) || binary.LittleEndian.Uint32(b[total-4:]) != total {
+			t.Fatalf("invalid block length %d", total)
+		}
+		types = append(types, blockType)
+		if blockType == pcapngEnhancedPacket {
+			body := b[8 : total-4]
+			size := binary.LittleEndian.Uint32(body[12:])
+			pkt := body[20 : 20+size]
+			if checksum(pkt[:20], 0) != 0 {
+				t.Fatal("invalid IPv4 checksum")
+			}
+			if checksum(pkt[20:], uint32(0x7f00+0x0001)*2+6+uint32(len(pkt)-20)) != 0 {
+				t.Fatal("invalid TCP checksum")
+			}
+			port := binary.BigEndian.Uint16(pkt[20:])
+			streams[port] = append(streams[port], pkt[40:]...)
+			if bytes.Contains(body[20+size:], []byte("end of message")) {
+				comments++
+			}
+		}
+		b = b[total:]
+	}
+
+	// Section header, interface, three segments of handshake, three of data, and a FIN
+	if len(types) != 9 || types[0] != pcapngSectionHeader || types[1] != pcapngInterface {
+		t.Fatalf("unexpected blocks %x", types)
+	}
+	if got := string(streams[clientPort]); got != "hello" {
+		t.Fatalf("the client sent %q", got)
+	}
+	if got := string(streams[serverPort]); got != "hi client" {
+		t.Fatalf("the server sent %q", got)
+	}
+	if comments != 2 {
+		t.Fatalf("expected 2 message boundaries but found %d", comments)
+	}
+}
@@ -0,0 +1,97 @@
+//go:build windows || linux
+
+package capture
+
+import (
+	// Standard
+	"io"
+	"net"
+	"sync"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// Conn is a net.Conn that records its traffic
+type Conn struct {
+	net.Conn
+	w       *Writer
+	message bool
+
+	mu  sync.Mutex
+	err error
+	eof bool
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Wrap returns c recording every read, write, and close to w. Message boundaries are recorded if the capture header
+// has MessageMode set.
+func Wrap(c net.Conn, w *Writer) *Conn {
+	return &Conn{Conn: c, w: w, message: w.Header().MessageMode}
+}
+
+// Unwrap returns the wrapped connection, for example to reach methods specific to npipe.PipeConn
+func (c *Conn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// Err returns the first error writing to the capture. Recording errors don't fail the connection.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// record writes r to the capture and remembers the first error
+func (c *Conn) record(r Record) {
+	if err := c.w.WriteRecord(r); err != nil {
+		c.mu.Lock()
+		if c.err == nil {
+			c.err = err
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Read reads from the wrapped connection and records the data that was read
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.record(Record{
+			Kind:         Data,
+			Dir:          Received,
+			EndOfMessage: c.message && err != npipe.ErrMoreData,
+			Data:         b[:n],
+		})
+	}
+	if err == io.EOF {
+		c.mu.Lock()
+		first := !c.eof
+		c.eof = true
+		c.mu.Unlock()
+		if first {
+			c.record(Record{Kind: Close, Dir: Received})
+		}
+	}
+	return n, err
+}
+
+// Write writes to the wrapped connection and records the data that was written
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.record(Record{Kind: Data, Dir: Sent, EndOfMessage: c.message, Data: b[:n]})
+	}
+	return n, err
+}
+
+// Close closes the wrapped connection and records the close. The capture itself is left open.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.Conn.Close()
+		c.record(Record{Kind: Close, Dir: Sent})
+	})
+	return c.closeErr
+}
@@ -0,0 +1,241 @@
+package capture
+
+import (
+	// Standard
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// The pcapng export presents the session as a TCP connection so Wireshark can reassemble it with Follow TCP Stream.
+// The client is 127.0.0.1:49152 and the server is 127.0.0.1:49153; the name of the interface is the pipe address.
+// Records ending a message set PSH and carry an "end of message" comment.
+const (
+	pcapngSectionHeader   = 0x0A0D0D0A
+	pcapngInterface       = 0x00000001
+	pcapngEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic  = 0x1A2B3C4D
+	pcapngOptEnd          = 0
+	pcapngOptComment      = 1
+	pcapngOptShbUserAppl  = 4
+	pcapngOptIfName       = 2
+	pcapngOptIfTsresol    = 9
+	pcapngOptEpbFlags     = 2
+	pcapngEpbFlagInbound  = 1
+	pcapngEpbFlagOutbound = 2
+	linkTypeRaw           = 101
+
+	tcpFin = 0x01
+	tcpSyn = 0x02
+	tcpPsh = 0x08
+	tcpAck = 0x10
+
+	// maxSegment is the largest TCP payload that fits in an IPv4 packet
+	maxSegment = 0xffff - 40
+
+	clientPort = 49152
+	serverPort = 49153
+)
+
+// ExportPcapng converts the remaining records of r to pcapng and writes them to w
+func ExportPcapng(w io.Writer, r *Reader) error {
+	h := r.Header()
+	e := &pcapngExporter{w: w, side: h.Side}
+
+	shb := make([]byte, 0, 16)
+	shb = binary.LittleEndian.AppendUint32(shb, pcapngByteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	// The length of the section is unknown
+	shb = binary.LittleEndian.AppendUint64(shb, 0xffffffffffffffff)
+	shb = appendOption(shb, pcapngOptShbUserAppl, []byte("npipe capture"))
+	shb = appendOption(shb, pcapngOptEnd, nil)
+	if err := e.block(pcapngSectionHeader, shb); err != nil {
+		return fmt.Errorf("capture.ExportPcapng(): %s", err)
+	}
+
+	idb := make([]byte, 0, 8)
+	idb = binary.LittleEndian.AppendUint16(idb, linkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, 0)
+	idb = appendOption(idb, pcapngOptIfName, []byte(h.Addr))
+	// Timestamps are in nanoseconds
+	idb = appendOption(idb, pcapngOptIfTsresol, []byte{9})
+	idb = appendOption(idb, pcapngOptEnd, nil)
+	if err := e.block(pcapngInterface, idb); err != nil {
+		return fmt.Errorf("capture.ExportPcapng(): %s", err)
+	}
+
+	// Start the stream with a handshake so Wireshark tracks it from the beginning
+	if err := e.handshake(h.Start); err != nil {
+		return fmt.Errorf("capture.ExportPcapng(): %s", err)
+	}
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("capture.ExportPcapng(): there was an error reading the capture: %s", err)
+		}
+		if err = e.record(rec); err != nil {
+			return fmt.Errorf("capture.ExportPcapng(): %s", err)
+		}
+	}
+}
+
+// pcapngExporter tracks the state of the synthetic TCP connection
+type pcapngExporter struct {
+	w         io.Writer
+	side      Side
+	clientSeq uint32
+	serverSeq uint32
+	ipID      uint16
+}
+
+// handshake writes the SYN, SYN-ACK, and ACK segments opening the connection
+func (e *pcapngExporter) handshake(t time.Time) error {
+	if err := e.segment(t, true, tcpSyn, nil, ""); err != nil {
+		return err
+	}
+	if err := e.segment(t, false, tcpSyn|tcpAck, nil, ""); err != nil {
+		return err
+	}
+	return e.segment(t, true, tcpAck, nil, "")
+}
+
+// record writes the segments for a record
+func (e *pcapngExporter) record(rec Record) error {
+	// Sent by the client if it was sent by a client side recording or received by a server side one
+	fromClient := (rec.Dir == Sent) == (e.side == Client)
+	if rec.Kind == Close {
+		return e.segment(rec.Time, fromClient, tcpFin|tcpAck, nil, "")
+	}
+	data := rec.Data
+	for {
+		chunk := data
+		if len(chunk) > maxSegment {
+			chunk = chunk[:maxSegment]
+		}
+		data = data[len(chunk):]
+		flags := byte(tcpAck)
+		var comment string
+		if len(data) == 0 && rec.EndOfMessage {
+			flags |= tcpPsh
+			comment = "end of message"
+		}
+		if err := e.segment(rec.Time, fromClient, flags, chunk, comment); err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+// segment writes a TCP segment as an enhanced packet block and advances the sequence numbers
+func (e *pcapngExporter) segment(t time.Time, fromClient bool, flags byte, payload []byte, comment string) error {
+	srcPort, dstPort := uint16(clientPort), uint16(serverPort)
+	seq, ack := &e.clientSeq, e.serverSeq
+	if !fromClient {
+		srcPort, dstPort = dstPort, srcPort
+		seq, ack = &e.serverSeq, e.clientSeq
+	}
+	if flags&tcpAck == 0 {
+		ack = 0
+	}
+
+	// IPv4 header
+	pkt := make([]byte, 40, 40+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(40+len(payload)))
+	binary.BigEndian.PutUint16(pkt[4:], e.ipID)
+	e.ipID++
+	// Don't fragment
+	pkt[6] = 0x40
+	pkt[8] = 64
+	pkt[9] = 6
+	copy(pkt[12:], []byte{127, 0, 0, 1})
+	copy(pkt[16:], []byte{127, 0, 0, 1})
+	binary.BigEndian.PutUint16(pkt[10:], checksum(pkt[:20], 0))
+
+	// TCP header
+	tcp := pkt[20:40]
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], *seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+	pkt = append(pkt, payload...)
+	// The pseudo header is the addresses, the protocol, and the length of the segment
+	pseudo := uint32(0x7f00+0x0001)*2 + 6 + uint32(20+len(payload))
+	binary.BigEndian.PutUint16(pkt[36:], checksum(pkt[20:], pseudo))
+
+	*seq += uint32(len(payload))
+	if flags&(tcpSyn|tcpFin) != 0 {
+		*seq++
+	}
+
+	// The direction is relative to the recording side
+	epbFlags := uint32(pcapngEpbFlagOutbound)
+	if fromClient != (e.side == Client) {
+		epbFlags = pcapngEpbFlagInbound
+	}
+	ts := uint64(t.UnixNano())
+	epb := make([]byte, 0, 20+len(pkt)+32)
+	epb = binary.LittleEndian.AppendUint32(epb, 0)
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(pkt)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(pkt)))
+	epb = append(epb, pkt...)
+	epb = append(epb, make([]byte, pad4(len(pkt)))...)
+	epb = appendOption(epb, pcapngOptEpbFlags, binary.LittleEndian.AppendUint32(nil, epbFlags))
+	if comment != "" {
+		epb = appendOption(epb, pcapngOptComment, []byte(comment))
+	}
+	epb = appendOption(epb, pcapngOptEnd, nil)
+	return e.block(pcapngEnhancedPacket, epb)
+}
+
+// block writes a pcapng block with the body padded to 32 bits
+func (e *pcapngExporter) block(blockType uint32, body []byte) error {
+	total := uint32(12 + len(body))
+	b := make([]byte, 0, total)
+	b = binary.LittleEndian.AppendUint32(b, blockType)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	b = append(b, body...)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	_, err := e.w.Write(b)
+	return err
+}
+
+// appendOption appends a pcapng option padded to 32 bits
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, pad4(len(value)))...)
+}
+
+// pad4 returns the number of bytes needed to pad n to a multiple of 4
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
+
+// checksum returns the Internet checksum of b added to sum
+func checksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,170 @@
+//go:build windows || linux
+
+package capture
+
+import (
+	// Standard
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// ReplayOptions configures Replay
+type ReplayOptions struct {
+	// Side is the end of the session to play; the connection's peer plays the other one
+	Side Side
+	// Timing delays writes to reproduce the gaps between the recorded operations
+	Timing bool
+}
+
+// MismatchError is returned by Replay when the peer sent something other than what was recorded
+type MismatchError struct {
+	// Record is the index of the record that didn't match, counting from 0
+	Record int
+	// Want is the recorded data, nil for the end of the session
+	Want []byte
+	// Got is what the peer sent, nil for the end of the session
+	Got []byte
+}
+
+// Error returns a description of the mismatch
+func (e *MismatchError) Error() string {
+	describe := func(b []byte) string {
+		if b == nil {
+			return "the end of the session"
+		}
+		return fmt.Sprintf("%q", b)
+	}
+	return fmt.Sprintf("capture.Replay(): record %d: expected %s but received %s", e.Record, describe(e.Want), describe(e.Got))
+}
+
+// Replay plays one end of the session recorded in r over conn. Data of the played side is written, data of the other
+// side is read and compared to the recording, which returns a *MismatchError when they differ. In message mode whole
+// messages are written and compared. Replay closes conn when the played side closed it in the recording and returns
+// when the recording ends.
+func Replay(conn net.Conn, r *Reader, opts ReplayOptions) error {
+	h := r.Header()
+	var pending []byte
+	var pendingIndex int
+	var last time.Time
+	for i := 0; ; i++ {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("capture.Replay(): there was an error reading the capture: %s", err)
+		}
+		// The recording side sent the records of the played side if it is the played side
+		ours := (rec.Dir == Sent) == (h.Side == opts.Side)
+
+		if opts.Timing && ours && !last.IsZero() {
+			time.Sleep(rec.Time.Sub(last))
+		}
+		last = rec.Time
+
+		if rec.Kind == Close {
+			if ours {
+				return conn.Close()
+			}
+			if err = expectEOF(conn, i); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Byte mode doesn't have boundaries to keep
+		if !h.MessageMode {
+			if ours {
+				_, err = conn.Write(rec.Data)
+			} else {
+				err = expect(conn, i, rec.Data)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if len(pending) == 0 {
+			pendingIndex = i
+		}
+		pending = append(pending, rec.Data...)
+		if !rec.EndOfMessage {
+			continue
+		}
+		if ours {
+			_, err = conn.Write(pending)
+			if err != nil {
+				err = fmt.Errorf("capture.Replay(): record %d: there was an error writing: %s", pendingIndex, err)
+			}
+		} else {
+			err = expectMessage(conn, pendingIndex, pending)
+		}
+		if err != nil {
+			return err
+		}
+		pending = nil
+	}
+}
+
+// expect reads len(want) bytes from conn and compares them to want
+func expect(conn net.Conn, record int, want []byte) error {
+	got := make([]byte, len(want))
+	n, err := io.ReadFull(conn, got)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if n == 0 {
+			return &MismatchError{Record: record, Want: want}
+		}
+		return &MismatchError{Record: record, Want: want, Got: got[:n]}
+	}
+	if err != nil {
+		return fmt.Errorf("capture.Replay(): record %d: there was an error reading: %s", record, err)
+	}
+	if !bytes.Equal(got, want) {
+		return &MismatchError{Record: record, Want: want, Got: got}
+	}
+	return nil
+}
+
+// expectMessage reads a whole message from conn and compares it to want
+func expectMessage(conn net.Conn, record int, want []byte) error {
+	var got []byte
+	buf := make([]byte, len(want)+1)
+	for {
+		n, err := conn.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == npipe.ErrMoreData {
+			continue
+		}
+		if err == io.EOF && len(got) == 0 {
+			return &MismatchError{Record: record, Want: want}
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("capture.Replay(): record %d: there was an error reading: %s", record, err)
+		}
+		break
+	}
+	if !bytes.Equal(got, want) {
+		return &MismatchError{Record: record, Want: want, Got: got}
+	}
+	return nil
+}
+
+// expectEOF reads from conn and expects the peer to have closed it
+func expectEOF(conn net.Conn, record int) error {
+	b := make([]byte, 512)
+	n, err := conn.Read(b)
+	if n > 0 {
+		return &MismatchError{Record: record, Got: b[:n]}
+	}
+	if err != io.EOF {
+		return fmt.Errorf("capture.Replay(): record %d: expected the end of the session but received %v", record, err)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+//go:build windows || linux
+
+// Command npipebench measures named pipe round trip latency, bulk throughput, connections per second through Accept,
+// and concurrency scaling, and prints the results in the format of go test -bench so they can be compared with
+// benchstat:
+//
+//	npipebench -count 10 > old.txt
+//	# change the code
+//	npipebench -count 10 > new.txt
+//	benchstat old.txt new.txt
+//
+// The pipe transport uses the platform backend, named pipes on Windows and Unix domain sockets on Linux. The memory
+// transport runs the Windows named pipe code on the simulated kernel, which needs no operating system resources and
+// works on every platform. It is only available when the command is built with the npipesim tag:
+//
+//	go build -tags npipesim ./cmd/npipebench
+package main
+
+import (
+	// Standard
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"runtime"
+	"testing"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+	"github.com/Ne0nd0g/npipe/internal/bench"
+	"github.com/Ne0nd0g/npipe/internal/simpipe"
+	"github.com/Ne0nd0g/npipe/internal/winapi"
+)
+
+// pipeTransport runs the workloads on the platform backend
+type pipeTransport struct{}
+
+func (pipeTransport) Listen(address string) (net.Listener, error) {
+	ln, err := npipe.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	return ln, nil
+}
+
+func (pipeTransport) Dial(address string) (net.Conn, error) {
+	c, err := npipe.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func main() {
+	transport := flag.String("transport", "pipe", "the transport to measure: pipe or memory")
+	filter := flag.String("bench", ".", "run only the benchmarks matching the regular expression, like RoundTrip or Throughput/buf=4096")
+	count := flag.Int("count", 1, "run every benchmark `n` times")
+	benchtime := flag.String("benchtime", "1s", "run every benchmark for the duration or, with an x suffix, the number of iterations like 1000x")
+	list := flag.Bool("list", false, "list the benchmarks and exit")
+	flag.Parse()
+
+	if *list {
+		for _, bm := range bench.Suite() {
+			fmt.Println(bm.Name)
+		}
+		return
+	}
+
+	re, err := regexp.Compile(*filter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "npipebench: invalid -bench expression: %s\n", err)
+		os.Exit(2)
+	}
+	// testing.Benchmark reads the benchmark time from the flags of the testing package
+	testing.Init()
+	if err = flag.Set("test.benchtime", *benchtime); err != nil {
+		fmt.Fprintf(os.Stderr, "npipebench: invalid -benchtime: %s\n", err)
+		os.Exit(2)
+	}
+
+	var t bench.Transport
+	switch *transport {
+	case "pipe":
+		t = pipeTransport{}
+	case "memory":
+		if simpipe.Listen == nil {
+			fmt.Fprintln(os.Stderr, "npipebench: the memory transport needs a build with -tags npipesim")
+			os.Exit(2)
+		}
+		t = simpipe.Transport{Sim: winapi.NewSim()}
+	default:
+		fmt.Fprintf(os.Stderr, "npipebench: unknown transport %q, use pipe or memory\n", *transport)
+		os.Exit(2)
+	}
+
+	// The configuration lines let benchstat tell results of different machines and transports apart
+	fmt.Printf("goos: %s\n", runtime.GOOS)
+	fmt.Printf("goarch: %s\n", runtime.GOARCH)
+	fmt.Printf("pkg: github.com/Ne0nd0g/npipe\n")
+	fmt.Printf("transport: %s\n", *transport)
+
+	var suite []bench.Benchmark
+	width := 0
+	for _, bm := range bench.Suite() {
+		if !re.MatchString(bm.Name) {
+			continue
+		}
+		suite = append(suite, bm)
+		if n := len(benchName(bm.Name)); n > width {
+			width = n
+		}
+	}
+
+	address := fmt.Sprintf(`\\.\pipe\npipebench-%d`, os.Getpid())
+	failed := false
+	for _, bm := range suite {
+		for i := 0; i < *count; i++ {
+			bm := bm
+			r := testing.Benchmark(func(b *testing.B) {
+				bm.F(b, t, address)
+			})
+			if r.N == 0 {
+				// testing.Benchmark returns an empty result when the benchmark failed
+				fmt.Fprintf(os.Stderr, "npipebench: %s failed\n", benchName(bm.Name))
+				failed = true
+				break
+			}
+			fmt.Printf("%-*s\t%s\t%s\n", width, benchName(bm.Name), r.String(), memString(r))
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// memString formats the memory statistics of r like testing.BenchmarkResult.MemString but without truncating the
+// allocations per operation, which testing rounds down to 0 when fewer than one allocation happens per operation
+func memString(r testing.BenchmarkResult) string {
+	var allocs float64
+	if r.N > 0 {
+		allocs = float64(r.MemAllocs) / float64(r.N)
+	}
+	return fmt.Sprintf("%8d B/op\t%8.2f allocs/op", r.AllocedBytesPerOp(), allocs)
+}
+
+// benchName returns the name go test would print for the benchmark, including the GOMAXPROCS suffix
+func benchName(name string) string {
+	name = "Benchmark" + name
+	if procs := runtime.GOMAXPROCS(0); procs > 1 {
+		name = fmt.Sprintf("%s-%d", name, procs)
+	}
+	return name
+}
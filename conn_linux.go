@@ -0,0 +1,585 @@
+//go:build linux
+
+package npipe
+
+import (
+	// Standard
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	// X Package
+	"golang.org/x/sys/unix"
+)
+
+// ErrMoreData is returned by Read on a message mode pipe when the buffer was too small to hold the whole message.
+// The rest of the message is returned by subsequent calls to Read.
+var ErrMoreData error = PipeError{"More data is available.", false}
+
+// PipeConn is the implementation of the net.Conn interface for named pipe connections.
+type PipeConn struct {
+	conn     *net.UnixConn // conn is the Unix domain socket backing the named pipe
+	addr     PipeAddr      // addr is the named pipe network (pipe) and address
+	message  bool          // message is true for message mode pipes backed by SOCK_SEQPACKET sockets
+	listener *PipeListener // listener is the listener that accepted this server side connection, nil for clients
+	closed   sync.Once
+
+	// rmu guards rmsg, the unread remainder of a message that did not fit in the caller's buffer, and rframe, the number
+	// of data bytes of a byte mode frame read by RecvHandles that are still unread. It is not held while waiting for
+	// data, so Peek and Available don't wait for a pending Read.
+	rmu    sync.Mutex
+	rmsg   []byte
+	rframe int
+
+	// disconnected is set once Disconnect returned the instance to the listener; it is only written by closed
+	disconnected bool
+
+	// mu guards the deadlines set by the caller, which are restored after a context interrupted Transact, and the
+	// read mode
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// readBytes is set when SetReadMode switched a message pipe to byte read mode
+	readBytes bool
+
+	// stats counts the I/O of the connection
+	stats connCounters
+}
+
+// aLongTimeAgo is a deadline in the past that interrupts pending I/O
+var aLongTimeAgo = time.Unix(1, 0)
+
+const (
+	// flushPollMin and flushPollMax bound the interval at which Flush checks whether the peer read the data
+	flushPollMin = time.Millisecond
+	flushPollMax = 20 * time.Millisecond
+)
+
+// newPipeConn wraps the Unix domain socket in a PipeConn
+func newPipeConn(conn *net.UnixConn, addr PipeAddr, message bool, listener *PipeListener) *PipeConn {
+	c := &PipeConn{conn: conn, addr: addr, message: message, listener: listener}
+	if listener != nil {
+		c.stats.listener = &listener.stats
+	}
+	return c
+}
+
+// convertError maps socket errors to the errors returned by the Windows implementation
+func (c *PipeConn) convertError(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return timeout(c.addr.String())
+	}
+	return err
+}
+
+// Read implements the net.Conn Read method.
+// In message mode a message larger than b is returned across several calls; all but the last return ErrMoreData
+// unless the pipe was switched to byte read mode with SetReadMode.
+func (c *PipeConn) Read(b []byte) (int, error) {
+	n, err := c.read(b)
+	c.stats.read(n, err)
+	return n, err
+}
+
+// read reads the next part of the data or message into b
+func (c *PipeConn) read(b []byte) (int, error) {
+	if !c.message {
+		c.rmu.Lock()
+		frame := c.rframe
+		c.rmu.Unlock()
+		if frame == 0 {
+			n, err := c.conn.Read(b)
+			return n, c.convertError(err)
+		}
+		// Stop at the end of the frame RecvHandles started so the caller can tell where it ends
+		if len(b) > frame {
+			b = b[:frame]
+		}
+		n, err := c.conn.Read(b)
+		c.rmu.Lock()
+		c.rframe -= n
+		frame = c.rframe
+		c.rmu.Unlock()
+		if err == nil && frame > 0 {
+			return n, ErrMoreData
+		}
+		return n, c.convertError(err)
+	}
+
+	readMode := c.readMode()
+	c.rmu.Lock()
+	if len(c.rmsg) == 0 {
+		c.rmu.Unlock()
+		size, err := c.nextMessageSize()
+		if err != nil {
+			return 0, c.convertError(err)
+		}
+		if size <= len(b) {
+			n, err := c.conn.Read(b)
+			return n, c.convertError(err)
+		}
+		msg := make([]byte, size)
+		n, err := c.conn.Read(msg)
+		if err != nil {
+			return 0, c.convertError(err)
+		}
+		c.rmu.Lock()
+		c.rmsg = msg[:n]
+	}
+
+	n := copy(b, c.rmsg)
+	c.rmsg = c.rmsg[n:]
+	left := len(c.rmsg)
+	if left == 0 {
+		c.rmsg = nil
+	}
+	c.rmu.Unlock()
+	if left > 0 && readMode != PipeReadModeByte {
+		return n, ErrMoreData
+	}
+	return n, nil
+}
+
+// buffered reports whether part of a message or of a frame read by RecvHandles is waiting to be read, which must be
+// read before the socket can be used directly
+func (c *PipeConn) buffered() bool {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	return len(c.rmsg) > 0 || c.rframe > 0
+}
+
+// nextMessageSize blocks until a message is available and returns its size without consuming it
+func (c *PipeConn) nextMessageSize() (int, error) {
+	rc, err := c.conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var size int
+	var serr error
+	err = rc.Read(func(fd uintptr) bool {
+		size, _, serr = unix.Recvfrom(int(fd), nil, unix.MSG_PEEK|unix.MSG_TRUNC)
+		return serr != unix.EAGAIN
+	})
+	if err != nil {
+		return 0, err
+	}
+	if serr != nil {
+		return 0, fmt.Errorf("npipe.PipeConn.nextMessageSize(): there was an error calling recvfrom: %s", serr)
+	}
+	return size, nil
+}
+
+// Transact writes req as one message and reads the reply into resp, like TransactNamedPipe does on Windows. The pipe
+// must be a message pipe in message read mode with no unread data. A reply larger than resp returns ErrMoreData and the rest of it is
+// returned by Read. The transaction is bounded by the deadlines and by ctx; if ctx is done first Transact returns
+// ctx.Err().
+func (c *PipeConn) Transact(ctx context.Context, req, resp []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if !c.message {
+		return 0, fmt.Errorf("npipe.PipeConn.Transact(): the pipe is not a message mode pipe")
+	}
+	if c.readMode() == PipeReadModeByte {
+		return 0, fmt.Errorf("npipe.PipeConn.Transact(): the pipe is not in message read mode")
+	}
+	total, _, err := c.Available()
+	if err != nil && err != io.EOF {
+		return 0, fmt.Errorf("npipe.PipeConn.Transact(): %s", err)
+	}
+	if total > 0 {
+		return 0, fmt.Errorf("npipe.PipeConn.Transact(): the pipe has %d bytes of unread data", total)
+	}
+
+	// The I/O is counted here so an interruption by ctx does not count as a timeout
+	stop := c.watchContext(ctx)
+	var n int
+	written, err := c.conn.Write(req)
+	err = c.convertError(err)
+	if err == nil {
+		n, err = c.read(resp)
+	}
+	if stop() && err != nil && isTimeout(err) {
+		err = ctx.Err()
+	}
+	c.stats.wrote(written, err)
+	c.stats.read(n, nil)
+	return n, err
+}
+
+// setMessageReadMode prepares a client for Transact. Message pipes start in message read mode on Linux.
+func (c *PipeConn) setMessageReadMode() error {
+	return c.SetReadMode(PipeReadModeMessage)
+}
+
+// SetReadMode switches the connection between byte and message read mode at runtime; mode is PipeReadModeByte or
+// PipeReadModeMessage. Only message pipes can be read in message mode, which is their initial read mode on Linux.
+// In byte read mode the part of a message that did not fit in the buffer is returned by the next Read without
+// ErrMoreData, but unlike on Windows a single Read never returns data from more than one message.
+func (c *PipeConn) SetReadMode(mode uint32) error {
+	if mode&^PipeReadModeMessage != 0 {
+		return fmt.Errorf("npipe.PipeConn.SetReadMode(): invalid read mode 0x%x", mode)
+	}
+	if mode == PipeReadModeMessage && !c.message {
+		return fmt.Errorf("npipe.PipeConn.SetReadMode(): byte mode pipes can't be read in message mode")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readBytes = mode == PipeReadModeByte
+	return nil
+}
+
+// readMode returns the PipeReadModeByte or PipeReadModeMessage read mode of the connection
+func (c *PipeConn) readMode() uint32 {
+	if !c.message {
+		return PipeReadModeByte
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.readBytes {
+		return PipeReadModeByte
+	}
+	return PipeReadModeMessage
+}
+
+// Info returns the type, read mode, and buffer sizes of the connection's socket, and the instance counts ListPipes
+// reports for the pipe
+func (c *PipeConn) Info() (HandleInfo, error) {
+	info := HandleInfo{
+		Server:      c.listener != nil,
+		Message:     c.message,
+		ReadMessage: c.readMode() == PipeReadModeMessage,
+	}
+	err := c.control(func(fd int) error {
+		return socketBufferSizes(fd, &info)
+	})
+	if err != nil {
+		return info, fmt.Errorf("npipe.PipeConn.Info(): %s", err)
+	}
+	path, err := socketPath(c.addr.String())
+	if err != nil {
+		return info, fmt.Errorf("npipe.PipeConn.Info(): %s", err)
+	}
+	if err = pipeInstances(path, &info); err != nil {
+		return info, fmt.Errorf("npipe.PipeConn.Info(): %s", err)
+	}
+	return info, nil
+}
+
+// watchContext interrupts the pending I/O by moving the deadlines into the past once ctx is done. The returned
+// function stops watching, restores the caller's deadlines if they were moved, and reports whether ctx interrupted
+// the I/O.
+func (c *PipeConn) watchContext(ctx context.Context) func() bool {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+	stop := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(aLongTimeAgo)
+			interrupted <- true
+		case <-stop:
+			interrupted <- false
+		}
+	}()
+	return func() bool {
+		close(stop)
+		if !<-interrupted {
+			return false
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.conn.SetReadDeadline(c.readDeadline)
+		c.conn.SetWriteDeadline(c.writeDeadline)
+		return true
+	}
+}
+
+// Flush waits until the peer read all data written to the pipe, like FlushFileBuffers does on Windows, by polling the
+// bytes the socket has outstanding. It returns ctx.Err() if ctx is done first and a timeout error once the write
+// deadline passes. Data discarded because the peer closed its end can't be told apart from data it read.
+func (c *PipeConn) Flush(ctx context.Context) error {
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	wait := flushPollMin
+	for {
+		var outstanding int
+		err := c.control(func(fd int) error {
+			var err error
+			outstanding, err = unix.IoctlGetInt(fd, unix.SIOCOUTQ)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("npipe.PipeConn.Flush(): %s", err)
+		}
+		if outstanding == 0 {
+			return nil
+		}
+
+		poll := time.NewTimer(wait)
+		select {
+		case <-poll.C:
+		case <-ctx.Done():
+			poll.Stop()
+			return ctx.Err()
+		case <-expired:
+			poll.Stop()
+			return timeout(c.addr.String())
+		}
+		if wait *= 2; wait > flushPollMax {
+			wait = flushPollMax
+		}
+	}
+}
+
+// CloseGracefully flushes the connection and closes it. The connection is closed even if the flush fails, in which
+// case the flush error is returned and the peer may not have read all data.
+func (c *PipeConn) CloseGracefully(ctx context.Context) error {
+	err := c.Flush(ctx)
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Peek copies the data waiting to be read into b without consuming it and without waiting for data to arrive. In
+// message mode only the current message is copied, and ErrMoreData is returned if it does not fit in b. Peek returns
+// io.EOF once the peer closed its end and all of its data was read.
+func (c *PipeConn) Peek(b []byte) (int, error) {
+	c.rmu.Lock()
+	if len(c.rmsg) > 0 {
+		n := copy(b, c.rmsg)
+		left := len(c.rmsg) - n
+		c.rmu.Unlock()
+		if left > 0 {
+			return n, ErrMoreData
+		}
+		return n, nil
+	}
+	c.rmu.Unlock()
+	if len(b) == 0 && !c.message {
+		return 0, nil
+	}
+
+	flags := unix.MSG_PEEK | unix.MSG_DONTWAIT
+	if c.message {
+		// MSG_TRUNC returns the size of the whole message
+		flags |= unix.MSG_TRUNC
+	}
+	var n int
+	var hangup bool
+	err := c.control(func(fd int) error {
+		var err error
+		n, _, err = unix.Recvfrom(fd, b, flags)
+		if err == unix.EAGAIN {
+			n, err = 0, nil
+		}
+		if err == nil && n == 0 {
+			hangup, err = peerClosed(fd)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("npipe.PipeConn.Peek(): %s", err)
+	}
+	if hangup {
+		return 0, io.EOF
+	}
+	if n > len(b) {
+		return len(b), ErrMoreData
+	}
+	return n, nil
+}
+
+// Available returns the number of bytes that can be read without blocking and, in message mode, the number of bytes
+// left in the current message, which is the size of the next message unless it was partially read. In byte mode the
+// number of bytes left in a frame RecvHandles returned ErrMoreData for is reported as the message. It returns io.EOF
+// once the peer closed its end and all of its data was read.
+func (c *PipeConn) Available() (total, message int, err error) {
+	c.rmu.Lock()
+	rmsg, frame := len(c.rmsg), c.rframe
+	c.rmu.Unlock()
+
+	var hangup bool
+	err = c.control(func(fd int) error {
+		var err error
+		if total, err = unix.IoctlGetInt(fd, unix.SIOCINQ); err != nil {
+			return err
+		}
+		if c.message && rmsg == 0 && total > 0 {
+			message, _, err = unix.Recvfrom(fd, nil, unix.MSG_PEEK|unix.MSG_DONTWAIT|unix.MSG_TRUNC)
+			if err == unix.EAGAIN {
+				message, err = 0, nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if total == 0 && rmsg == 0 {
+			hangup, err = peerClosed(fd)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("npipe.PipeConn.Available(): %s", err)
+	}
+	if hangup {
+		return 0, 0, io.EOF
+	}
+	if rmsg > 0 {
+		total += rmsg
+		message = rmsg
+	}
+	if frame > 0 {
+		message = frame
+	}
+	return total, message, nil
+}
+
+// SyscallConn returns a raw connection to the socket backing the pipe for issuing custom system calls. The net
+// package coordinates the callbacks with pending I/O and Close. Data read through it bypasses the remainder of a
+// partially read message that Read keeps in message mode.
+func (c *PipeConn) SyscallConn() (syscall.RawConn, error) {
+	rc, err := c.conn.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("npipe.PipeConn.SyscallConn(): %s", err)
+	}
+	return rc, nil
+}
+
+// control runs f on the socket's descriptor without waiting for it to become readable
+func (c *PipeConn) control(f func(fd int) error) error {
+	rc, err := c.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	err = rc.Control(func(fd uintptr) {
+		ferr = f(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return ferr
+}
+
+// peerClosed reports whether the peer closed or half-closed its end, so nothing more will arrive
+func peerClosed(fd int) (bool, error) {
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN | unix.POLLRDHUP}}
+	if _, err := unix.Poll(fds, 0); err != nil {
+		return false, err
+	}
+	return fds[0].Revents&(unix.POLLRDHUP|unix.POLLHUP) != 0, nil
+}
+
+// Write implements the net.Conn Write method.
+// In message mode every call to Write sends a single message.
+func (c *PipeConn) Write(b []byte) (int, error) {
+	n, err := c.conn.Write(b)
+	err = c.convertError(err)
+	c.stats.wrote(n, err)
+	return n, err
+}
+
+// Stats returns the number of bytes read and written, the I/O that timed out, and the times Dial waited for the pipe
+func (c *PipeConn) Stats() ConnStats {
+	return c.stats.snapshot()
+}
+
+// Close closes the connection. It does nothing once the connection was disconnected.
+func (c *PipeConn) Close() error {
+	err := c.conn.Close()
+	c.closed.Do(func() {
+		if c.listener != nil {
+			c.listener.release(false)
+		}
+	})
+	if c.disconnected {
+		return nil
+	}
+	return err
+}
+
+// Disconnect disconnects the client and returns the pipe instance to the listener that accepted the connection, like
+// DisconnectNamedPipe does on Windows, so the next Accept reuses it. The socket is closed, so unlike on Windows the
+// client still reads the data written before the disconnect and then io.EOF. The connection must not be used
+// afterwards; a later Close does nothing. Only server side connections can be disconnected.
+func (c *PipeConn) Disconnect() error {
+	if c.listener == nil {
+		return fmt.Errorf("npipe.PipeConn.Disconnect(): only connections accepted by a PipeListener can be disconnected")
+	}
+	err := fmt.Errorf("npipe.PipeConn.Disconnect(): the connection was already closed or disconnected")
+	c.closed.Do(func() {
+		c.disconnected = true
+		err = c.conn.Close()
+		c.listener.release(true)
+	})
+	if err != nil {
+		return fmt.Errorf("npipe.PipeConn.Disconnect(): %s", err)
+	}
+	return nil
+}
+
+// CloseWrite shuts down the writing side of the connection. The peer reads io.EOF once it received everything that
+// was written, and can keep writing to this end.
+func (c *PipeConn) CloseWrite() error {
+	err := c.conn.CloseWrite()
+	if err != nil {
+		return fmt.Errorf("npipe.PipeConn.CloseWrite(): %s", err)
+	}
+	return nil
+}
+
+// LocalAddr returns the local network address.
+func (c *PipeConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// RemoteAddr returns the remote network address.
+func (c *PipeConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline implements the net.Conn SetDeadline method.
+func (c *PipeConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	err := c.conn.SetDeadline(t)
+	if err != nil {
+		return fmt.Errorf("npipe.PipeConn.SetDeadline(): %s", err)
+	}
+	return nil
+}
+
+// SetReadDeadline implements the net.Conn SetReadDeadline method.
+func (c *PipeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements the net.Conn SetWriteDeadline method.
+func (c *PipeConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,410 @@
+// Package conntest is a conformance suite for net.Conn implementations, in the spirit of
+// golang.org/x/net/nettest.TestConn but without dependencies.
+//
+// Every backend of this module runs the suite so behavioral differences between them are caught on any platform:
+//
+//	func TestConformance(t *testing.T) {
+//		conntest.TestConn(t, func() (net.Conn, net.Conn) {
+//			return connectedPair(t)
+//		})
+//	}
+//
+// The suite treats the connections as byte streams; pipes in message mode are out of scope.
+package conntest
+
+import (
+	// Standard
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// MakePipe returns a pair of connected connections. The suite closes both of them at the end of each test; factories
+// that hold other resources can release them with testing.T.Cleanup. A factory that fails should report the error
+// with testing.T.Errorf and return nil connections.
+type MakePipe func() (c1, c2 net.Conn)
+
+// TestConn runs the conformance suite against the connections returned by mp
+func TestConn(t *testing.T, mp MakePipe) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, c1, c2 net.Conn)
+	}{
+		{"BasicIO", testBasicIO},
+		{"PingPong", testPingPong},
+		{"ReadAfterPeerClose", testReadAfterPeerClose},
+		{"WriteAfterPeerClose", testWriteAfterPeerClose},
+		{"RacyRead", testRacyRead},
+		{"RacyWrite", testRacyWrite},
+		{"ReadTimeout", testReadTimeout},
+		{"WriteTimeout", testWriteTimeout},
+		{"PastTimeout", testPastTimeout},
+		{"PresentTimeout", testPresentTimeout},
+		{"FutureTimeout", testFutureTimeout},
+		{"ResetDeadline", testResetDeadline},
+		{"CloseDuringRead", testCloseDuringRead},
+		{"ConcurrentMethods", testConcurrentMethods},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2 := mp()
+			if c1 == nil || c2 == nil {
+				t.Fatal("MakePipe did not return a pair of connections")
+			}
+			defer c1.Close()
+			defer c2.Close()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				tt.fn(t, c1, c2)
+			}()
+			select {
+			case <-done:
+			case <-time.After(30 * time.Second):
+				// Unblock whatever is stuck so the goroutine can report and exit
+				c1.Close()
+				c2.Close()
+				<-done
+				t.Fatal("the test timed out")
+			}
+		})
+	}
+}
+
+// testBasicIO tests that data written to one end arrives unmodified at the other end
+func testBasicIO(t *testing.T, c1, c2 net.Conn) {
+	want := make([]byte, 1<<18)
+	rand.New(rand.NewSource(0)).Read(want)
+
+	errs := make(chan error, 1)
+	go func() {
+		rng := rand.New(rand.NewSource(1))
+		for b := want; len(b) > 0; {
+			n := 1 + rng.Intn(1<<14)
+			if n > len(b) {
+				n = len(b)
+			}
+			m, err := c1.Write(b[:n])
+			if err != nil {
+				errs <- err
+				return
+			}
+			b = b[m:]
+		}
+		errs <- nil
+	}()
+
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(c2, got); err != nil {
+		t.Errorf("io.ReadFull(): %v", err)
+		return
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("Write(): %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("the received data does not match the written data")
+	}
+}
+
+// testPingPong tests alternating requests and responses
+func testPingPong(t *testing.T, c1, c2 net.Conn) {
+	errs := make(chan error, 1)
+	go func() {
+		b := make([]byte, 8)
+		for {
+			if _, err := io.ReadFull(c2, b); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				errs <- err
+				return
+			}
+			binary.LittleEndian.PutUint64(b, binary.LittleEndian.Uint64(b)+1)
+			if _, err := c2.Write(b); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	b := make([]byte, 8)
+	for i := uint64(0); i < 1000; i += 2 {
+		binary.LittleEndian.PutUint64(b, i)
+		if _, err := c1.Write(b); err != nil {
+			t.Errorf("Write(): %v", err)
+			return
+		}
+		if _, err := io.ReadFull(c1, b); err != nil {
+			t.Errorf("io.ReadFull(): %v", err)
+			return
+		}
+		if got := binary.LittleEndian.Uint64(b); got != i+1 {
+			t.Errorf("expected %d but received %d", i+1, got)
+			return
+		}
+	}
+	c1.Close()
+	if err := <-errs; err != nil {
+		t.Errorf("the peer failed: %v", err)
+	}
+}
+
+// testReadAfterPeerClose tests that data written before the peer closed can be read, followed by io.EOF
+func testReadAfterPeerClose(t *testing.T, c1, c2 net.Conn) {
+	go func() {
+		c1.Write([]byte("last words"))
+		c1.Close()
+	}()
+	got, err := io.ReadAll(c2)
+	if err != nil {
+		t.Errorf("io.ReadAll(): %v", err)
+	}
+	if string(got) != "last words" {
+		t.Errorf("expected \"last words\" but received %q", got)
+	}
+}
+
+// testWriteAfterPeerClose tests that writing to a connection whose peer closed eventually fails
+func testWriteAfterPeerClose(t *testing.T, c1, c2 net.Conn) {
+	c2.Close()
+	b := make([]byte, 1024)
+	for i := 0; i < 1024; i++ {
+		if _, err := c1.Write(b); err != nil {
+			return
+		}
+	}
+	t.Error("writes kept succeeding after the peer closed")
+}
+
+// testRacyRead tests concurrent reads with deadlines changing underneath them
+func testRacyRead(t *testing.T, c1, c2 net.Conn) {
+	go chunkedCopy(c2, rand.New(rand.NewSource(0)))
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	c1.SetReadDeadline(time.Now().Add(time.Millisecond))
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(i)))
+			b := make([]byte, 1024)
+			for j := 0; j < 100; j++ {
+				_, err := c1.Read(b[:rng.Intn(len(b))+1])
+				c1.SetReadDeadline(time.Now().Add(time.Millisecond))
+				if err != nil && !isTimeout(err) {
+					t.Errorf("Read(): %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+}
+
+// testRacyWrite tests concurrent writes with deadlines changing underneath them
+func testRacyWrite(t *testing.T, c1, c2 net.Conn) {
+	go io.Copy(io.Discard, c2)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	c1.SetWriteDeadline(time.Now().Add(time.Millisecond))
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(i)))
+			b := make([]byte, 1024)
+			for j := 0; j < 100; j++ {
+				_, err := c1.Write(b[:rng.Intn(len(b))+1])
+				c1.SetWriteDeadline(time.Now().Add(time.Millisecond))
+				if err != nil && !isTimeout(err) {
+					t.Errorf("Write(): %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+}
+
+// testReadTimeout tests that a blocked read times out
+func testReadTimeout(t *testing.T, c1, c2 net.Conn) {
+	c1.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := c1.Read(make([]byte, 1))
+	checkTimeout(t, "Read()", err)
+}
+
+// testWriteTimeout tests that a write blocked by a peer that does not read times out
+func testWriteTimeout(t *testing.T, c1, c2 net.Conn) {
+	c1.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	b := make([]byte, 1<<16)
+	for i := 0; i < 1024; i++ {
+		if _, err := c1.Write(b); err != nil {
+			checkTimeout(t, "Write()", err)
+			return
+		}
+	}
+	t.Error("the writes never timed out")
+}
+
+// testPastTimeout tests that a deadline in the past fails reads and writes immediately, even if they could complete
+func testPastTimeout(t *testing.T, c1, c2 net.Conn) {
+	go c2.Write([]byte("data"))
+	time.Sleep(10 * time.Millisecond)
+
+	c1.SetDeadline(time.Now().Add(-time.Second))
+	_, err := c1.Read(make([]byte, 16))
+	checkTimeout(t, "Read()", err)
+	_, err = c1.Write([]byte("x"))
+	checkTimeout(t, "Write()", err)
+}
+
+// testPresentTimeout tests that setting a deadline unblocks reads and writes that are already waiting
+func testPresentTimeout(t *testing.T, c1, c2 net.Conn) {
+	errs := make(chan error, 2)
+	go func() {
+		_, err := c1.Read(make([]byte, 1))
+		errs <- err
+	}()
+	go func() {
+		b := make([]byte, 1<<16)
+		for {
+			if _, err := c1.Write(b); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c1.SetDeadline(time.Now())
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			checkTimeout(t, "Read() or Write()", err)
+		case <-time.After(5 * time.Second):
+			t.Error("setting the deadline did not unblock the pending operations")
+			return
+		}
+	}
+}
+
+// testFutureTimeout tests that a read waits until the deadline and not longer
+func testFutureTimeout(t *testing.T, c1, c2 net.Conn) {
+	const wait = 50 * time.Millisecond
+	start := time.Now()
+	c1.SetReadDeadline(start.Add(wait))
+	_, err := c1.Read(make([]byte, 1))
+	checkTimeout(t, "Read()", err)
+	if elapsed := time.Since(start); elapsed < wait-5*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("the read timed out after %s instead of %s", elapsed, wait)
+	}
+}
+
+// testResetDeadline tests that clearing an expired deadline makes the connection usable again
+func testResetDeadline(t *testing.T, c1, c2 net.Conn) {
+	c1.SetReadDeadline(time.Now().Add(-time.Second))
+	_, err := c1.Read(make([]byte, 1))
+	checkTimeout(t, "Read()", err)
+
+	c1.SetReadDeadline(time.Time{})
+	go c2.Write([]byte("x"))
+	b := make([]byte, 1)
+	if _, err = c1.Read(b); err != nil || b[0] != 'x' {
+		t.Errorf("Read() = %q, %v", b, err)
+	}
+}
+
+// testCloseDuringRead tests that closing a connection unblocks its pending read
+func testCloseDuringRead(t *testing.T, c1, c2 net.Conn) {
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c1.Read(make([]byte, 1))
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	c1.Close()
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("Read() returned no error after Close()")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Close() did not unblock the pending read")
+	}
+}
+
+// testConcurrentMethods calls every method concurrently while the peer echoes the data back, then closes both ends
+func testConcurrentMethods(t *testing.T, c1, c2 net.Conn) {
+	go io.Copy(c2, c2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(7)
+		go func() {
+			defer wg.Done()
+			c1.Read(make([]byte, 1024))
+		}()
+		go func() {
+			defer wg.Done()
+			c1.Write(make([]byte, 1024))
+		}()
+		go func() {
+			defer wg.Done()
+			c1.SetDeadline(time.Now().Add(10 * time.Millisecond))
+		}()
+		go func() {
+			defer wg.Done()
+			c1.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		}()
+		go func() {
+			defer wg.Done()
+			c1.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+		}()
+		go func() {
+			defer wg.Done()
+			c1.LocalAddr()
+		}()
+		go func() {
+			defer wg.Done()
+			c1.RemoteAddr()
+		}()
+	}
+	// Reads and writes that started before the deadlines were set may block indefinitely, so both ends are closed to
+	// release them before waiting for the goroutines
+	time.Sleep(50 * time.Millisecond)
+	c1.Close()
+	c2.Close()
+	wg.Wait()
+}
+
+// chunkedCopy writes random chunks to w until it fails
+func chunkedCopy(w io.Writer, rng *rand.Rand) {
+	b := make([]byte, 1024)
+	for {
+		if _, err := w.Write(b[:rng.Intn(len(b))+1]); err != nil {
+			return
+		}
+	}
+}
+
+// isTimeout reports whether err is a net.Error that timed out
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// checkTimeout fails the test unless err is a timeout
+func checkTimeout(t *testing.T, op string, err error) {
+	t.Helper()
+	if !isTimeout(err) {
+		t.Errorf("%s: expected a timeout error but received %v", op, err)
+	}
+}
@@ -0,0 +1,56 @@
+package npipe
+
+import (
+	// Standard
+	"io"
+	"net"
+)
+
+// copyBufferSize is the size of the buffer ReadFrom and WriteTo move data through when the data has to be copied
+const copyBufferSize = 64 * 1024
+
+// writerOnly and readerOnly hide the ReadFrom and WriteTo methods of a PipeConn from io.Copy when they fall back to
+// copying through a buffer
+type writerOnly struct{ io.Writer }
+type readerOnly struct{ io.Reader }
+
+// copyPipe copies the data returned by read, a pipe's Read method, to w until read returns io.EOF. The parts of a
+// message that did not fit in the buffer are copied as they arrive, so moreData, the ErrMoreData of the backend, is
+// not an error.
+func copyPipe(w io.Writer, read func([]byte) (int, error), moreData error) (int64, error) {
+	buf := make([]byte, copyBufferSize)
+	var written int64
+	for {
+		n, err := read(buf)
+		if n > 0 {
+			m, werr := w.Write(buf[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+			if m != n {
+				return written, io.ErrShortWrite
+			}
+		}
+		switch err {
+		case nil, moreData:
+		case io.EOF:
+			return written, nil
+		default:
+			return written, err
+		}
+	}
+}
+
+// consumeBuffers removes the first n bytes from v like net.Buffers.WriteTo does for the data it wrote
+func consumeBuffers(v *net.Buffers, n int64) {
+	for len(*v) > 0 {
+		if int64(len((*v)[0])) > n {
+			(*v)[0] = (*v)[0][n:]
+			return
+		}
+		n -= int64(len((*v)[0]))
+		(*v)[0] = nil
+		*v = (*v)[1:]
+	}
+}
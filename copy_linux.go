@@ -0,0 +1,283 @@
+//go:build linux
+
+package npipe
+
+import (
+	// Standard
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	// X Package
+	"golang.org/x/sys/unix"
+)
+
+// maxSpliceSize is the most data a single sendfile or splice call is asked to move, the default capacity of a pipe
+const maxSpliceSize = 64 * 1024
+
+// ReadFrom implements io.ReaderFrom. In byte mode regular files are sent with sendfile and data from stream sockets,
+// including other byte mode PipeConns, is moved with splice, so it is not copied through user space; other readers
+// are copied through a buffer. In message mode every Read of r is written as one message.
+func (c *PipeConn) ReadFrom(r io.Reader) (int64, error) {
+	if !c.message {
+		if n, handled, err := c.spliceFrom(r); handled {
+			return n, err
+		}
+	}
+	return io.CopyBuffer(writerOnly{c}, readerOnly{r}, make([]byte, copyBufferSize))
+}
+
+// WriteTo implements io.WriterTo. In byte mode data for stream sockets, including other byte mode PipeConns, and
+// regular files is moved with splice, so it is not copied through user space; data for other writers is copied
+// through a buffer. Messages larger than the buffer are copied as they arrive, so ErrMoreData is not returned.
+func (c *PipeConn) WriteTo(w io.Writer) (int64, error) {
+	if !c.message && !c.buffered() {
+		if n, handled, err := c.spliceTo(w); handled {
+			return n, err
+		}
+	}
+	return copyPipe(w, c.Read, ErrMoreData)
+}
+
+// WriteBuffers writes the contents of v and removes the written data from it like net.Buffers.WriteTo. In byte mode
+// the buffers are written with writev; in message mode every buffer is written as one message.
+func (c *PipeConn) WriteBuffers(v *net.Buffers) (int64, error) {
+	if !c.message {
+		n, err := v.WriteTo(c.conn)
+		err = c.convertError(err)
+		c.stats.wrote(int(n), err)
+		return n, err
+	}
+	var written int64
+	for len(*v) > 0 {
+		n, err := c.Write((*v)[0])
+		written += int64(n)
+		consumeBuffers(v, int64(n))
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// spliceFrom moves the data of r, which may be limited by an io.LimitedReader, into the socket without copying it
+// through user space. handled is false if r is not a regular file or stream socket, or the kernel refused to move its
+// data before any was moved.
+func (c *PipeConn) spliceFrom(r io.Reader) (written int64, handled bool, err error) {
+	remain := int64(1<<63 - 1)
+	lr, limited := r.(*io.LimitedReader)
+	if limited {
+		remain, r = lr.N, lr.R
+		if remain <= 0 {
+			return 0, true, nil
+		}
+	}
+
+	var src syscall.RawConn
+	sendfile := false
+	switch s := r.(type) {
+	case *os.File:
+		fi, err := s.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return 0, false, nil
+		}
+		src, err = s.SyscallConn()
+		if err != nil {
+			return 0, false, nil
+		}
+		sendfile = true
+	default:
+		src = streamRawConn(r)
+		if src == nil {
+			return 0, false, nil
+		}
+	}
+	dst, err := c.conn.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+
+	if sendfile {
+		written, err = sendfileTo(dst, src, remain)
+	} else {
+		written, err = splice(dst, src, remain)
+	}
+	if limited {
+		lr.N -= written
+	}
+	if written == 0 && (errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOSYS)) {
+		return 0, false, nil
+	}
+	err = c.convertError(err)
+	c.stats.wrote(int(written), err)
+	return written, true, err
+}
+
+// spliceTo moves the data read from the socket to w without copying it through user space. handled is false if w
+// is not a regular file or stream socket, or the kernel refused to move the data before any was moved.
+func (c *PipeConn) spliceTo(w io.Writer) (written int64, handled bool, err error) {
+	var dst syscall.RawConn
+	switch d := w.(type) {
+	case *os.File:
+		fi, err := d.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return 0, false, nil
+		}
+		dst, err = d.SyscallConn()
+		if err != nil {
+			return 0, false, nil
+		}
+	default:
+		dst = streamRawConn(w)
+		if dst == nil {
+			return 0, false, nil
+		}
+	}
+	src, err := c.conn.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+
+	written, err = splice(dst, src, 1<<63-1)
+	if written == 0 && (errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOSYS)) {
+		return 0, false, nil
+	}
+	err = c.convertError(err)
+	c.stats.read(int(written), err)
+	return written, true, err
+}
+
+// streamRawConn returns the raw connection of a stream socket, or nil if v is not one. Byte mode PipeConns, TCP
+// connections, and stream Unix domain socket connections qualify.
+func streamRawConn(v interface{}) syscall.RawConn {
+	var rc syscall.RawConn
+	var err error
+	switch conn := v.(type) {
+	case *PipeConn:
+		if conn.message || conn.buffered() {
+			return nil
+		}
+		rc, err = conn.conn.SyscallConn()
+	case *net.TCPConn:
+		rc, err = conn.SyscallConn()
+	case *net.UnixConn:
+		if conn.LocalAddr().Network() != "unix" {
+			return nil
+		}
+		rc, err = conn.SyscallConn()
+	default:
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+	return rc
+}
+
+// sendfileTo sends up to remain bytes from the regular file behind src to the socket behind dst, starting at the
+// file's offset, until the end of the file
+func sendfileTo(dst, src syscall.RawConn, remain int64) (int64, error) {
+	var written int64
+	var serr error
+	err := src.Control(func(sfd uintptr) {
+		serr = dst.Write(func(dfd uintptr) bool {
+			for remain > 0 {
+				size := remain
+				if size > maxSpliceSize {
+					size = maxSpliceSize
+				}
+				n, err := unix.Sendfile(int(dfd), int(sfd), nil, int(size))
+				if n > 0 {
+					written += int64(n)
+					remain -= int64(n)
+				}
+				switch err {
+				case nil:
+					if n == 0 {
+						// The end of the file
+						return true
+					}
+				case unix.EINTR:
+				case unix.EAGAIN:
+					// Wait for the socket to become writable
+					return false
+				default:
+					serr = err
+					return true
+				}
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return written, err
+	}
+	return written, serr
+}
+
+// splice moves up to remain bytes from src to dst through a pipe until src reaches the end of its data. At least
+// one of them must be a pipe or socket for the kernel to accept the transfer.
+func splice(dst, src syscall.RawConn, remain int64) (int64, error) {
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return 0, fmt.Errorf("there was an error creating the splice pipe: %s", err)
+	}
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+
+	var written int64
+	for remain > 0 {
+		size := remain
+		if size > maxSpliceSize {
+			size = maxSpliceSize
+		}
+		var in int64
+		var serr error
+		err := src.Read(func(fd uintptr) bool {
+			for {
+				in, serr = unix.Splice(int(fd), nil, p[1], nil, int(size), unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+				if serr != unix.EINTR {
+					// EAGAIN waits for src to become readable; the pipe is empty
+					return serr != unix.EAGAIN
+				}
+			}
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			return written, err
+		}
+		if in == 0 {
+			// The end of src
+			return written, nil
+		}
+		remain -= in
+
+		for in > 0 {
+			var out int64
+			err = dst.Write(func(fd uintptr) bool {
+				for {
+					out, serr = unix.Splice(p[0], nil, int(fd), nil, int(in), unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+					if serr != unix.EINTR {
+						return serr != unix.EAGAIN
+					}
+				}
+			})
+			if err == nil {
+				err = serr
+			}
+			if out > 0 {
+				written += out
+				in -= out
+			}
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
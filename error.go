@@ -1,11 +1,20 @@
-//go:build windows
-
 package npipe
 
+import (
+	// Standard
+	"errors"
+	"fmt"
+	"net"
+)
+
 // ErrClosed is the error returned by PipeListener.Accept when Close is called
 // on the PipeListener.
 var ErrClosed = PipeError{"Pipe has been closed.", false}
 
+// ErrNotSupported is returned by operations the platform's named pipes don't support, such as PipeConn.CloseWrite
+// on Windows.
+var ErrNotSupported = PipeError{"Operation not supported by named pipes.", false}
+
 // PipeError is an error related to a call to a pipe
 type PipeError struct {
 	msg     string
@@ -26,3 +35,16 @@ func (e PipeError) Timeout() bool {
 func (e PipeError) Temporary() bool {
 	return false
 }
+
+func badAddr(addr string) PipeError {
+	return PipeError{fmt.Sprintf("Invalid pipe address '%s'.", addr), false}
+}
+func timeout(addr string) PipeError {
+	return PipeError{fmt.Sprintf("Pipe IO timed out waiting for '%s'", addr), true}
+}
+
+// isTimeout reports whether err is the error of I/O that hit its deadline
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,356 @@
+// Package faultconn wraps connections and listeners with scriptable faults so tests can prove a service survives
+// latency, slow peers, partial reads and writes, injected errors, abrupt disconnects, and clients that connect and
+// vanish before they send anything.
+//
+// Any net.Conn or net.Listener can be wrapped, including npipe.PipeConn and npipe.PipeListener:
+//
+//	ln, err := npipe.Listen(`\\.\pipe\mypipe`)
+//	faulty := faultconn.WrapListener(ln, faultconn.Config{
+//		Seed:        1,
+//		ShortWrites: 0.5,
+//		Faults: []faultconn.Fault{
+//			{Op: faultconn.OpAccept, Count: 2, Disconnect: true}, // the second client vanishes
+//			{Op: faultconn.OpRead, Count: 3, Err: io.ErrUnexpectedEOF},
+//		},
+//	})
+//	go serve(faulty)
+//
+// Random faults draw from a source seeded with Config.Seed, so a failing run can be reproduced by reusing its seed.
+package faultconn
+
+import (
+	// Standard
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrInjected is returned by operations that fail because of a Fault without an Err
+var ErrInjected = errors.New("faultconn: injected fault")
+
+// ErrDisconnected is returned by every operation once a fault disconnected the connection
+var ErrDisconnected = errors.New("faultconn: connection disconnected by fault injection")
+
+// Op is an operation faults apply to
+type Op int
+
+const (
+	// OpRead is a call to Conn.Read
+	OpRead Op = iota + 1
+	// OpWrite is a call to Conn.Write
+	OpWrite
+	// OpAccept is a call to Listener.Accept
+	OpAccept
+)
+
+// String returns the name of the operation
+func (o Op) String() string {
+	switch o {
+	case OpRead:
+		return "read"
+	case OpWrite:
+		return "write"
+	case OpAccept:
+		return "accept"
+	default:
+		return "unknown"
+	}
+}
+
+// Fault is a scripted fault that fires on a specific call of an operation
+type Fault struct {
+	// Op is the operation the fault applies to
+	Op Op
+	// Count is the call the fault fires on, counting from 1 for each operation; 0 fires on every call
+	Count int
+	// Err is returned instead of performing the operation, ErrInjected if nil
+	Err error
+	// Disconnect closes the underlying connection, every later operation returns ErrDisconnected. For OpAccept the
+	// client is accepted and the connection is returned with its peer gone: reads return io.EOF and writes return
+	// io.ErrClosedPipe, like a client that connected and vanished.
+	Disconnect bool
+}
+
+// Config describes the faults injected into a connection. The zero value injects nothing.
+type Config struct {
+	// Seed seeds the source of every random decision
+	Seed int64
+	// Latency delays every Read and Write
+	Latency time.Duration
+	// Jitter adds a random delay of up to Jitter to Latency
+	Jitter time.Duration
+	// ReadBandwidth and WriteBandwidth cap the throughput in bytes per second; 0 is unlimited
+	ReadBandwidth  int
+	WriteBandwidth int
+	// ShortReads is the probability that a Read is limited to a random part of the buffer
+	ShortReads float64
+	// ShortWrites is the probability that a Write only writes a random part of the buffer and returns
+	// io.ErrShortWrite
+	ShortWrites float64
+	// DisconnectAfter closes the underlying connection once this many bytes were read and written in total; 0
+	// disables it. The operation crossing the limit is truncated to it.
+	DisconnectAfter int64
+	// Faults are fired by operation count
+	Faults []Fault
+}
+
+// Conn is a net.Conn with injected faults
+type Conn struct {
+	net.Conn
+	cfg Config
+
+	mu           sync.Mutex
+	rng          *rand.Rand
+	calls        map[Op]int
+	transferred  int64
+	disconnected bool
+	vanished     bool
+
+	closeOnce sync.Once
+	closeErr  error
+	closed    chan struct{}
+}
+
+// Wrap returns c with the faults described by cfg. Faults for OpAccept are ignored.
+func Wrap(c net.Conn, cfg Config) *Conn {
+	return &Conn{
+		Conn:   c,
+		cfg:    cfg,
+		rng:    rand.New(rand.NewSource(cfg.Seed)),
+		calls:  make(map[Op]int),
+		closed: make(chan struct{}),
+	}
+}
+
+// Unwrap returns the wrapped connection, for example to reach methods specific to npipe.PipeConn
+func (c *Conn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// plan is what begin decided for an operation
+type plan struct {
+	size  int
+	short bool
+	delay time.Duration
+}
+
+// begin counts the operation, fires its faults, and decides how much of the buffer it transfers
+func (c *Conn) begin(op Op, size int, shortRate float64) (plan, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.disconnected {
+		return plan{}, ErrDisconnected
+	}
+	if c.vanished {
+		if op == OpRead {
+			return plan{}, io.EOF
+		}
+		return plan{}, io.ErrClosedPipe
+	}
+
+	c.calls[op]++
+	for _, f := range c.cfg.Faults {
+		if f.Op != op || (f.Count != 0 && f.Count != c.calls[op]) {
+			continue
+		}
+		if f.Disconnect {
+			c.disconnectLocked()
+		}
+		if f.Err != nil {
+			return plan{}, f.Err
+		}
+		if f.Disconnect {
+			return plan{}, ErrDisconnected
+		}
+		return plan{}, ErrInjected
+	}
+
+	p := plan{size: size, delay: c.cfg.Latency}
+	if c.cfg.Jitter > 0 {
+		p.delay += time.Duration(c.rng.Int63n(int64(c.cfg.Jitter)))
+	}
+	if size > 1 && shortRate > 0 && c.rng.Float64() < shortRate {
+		p.size = 1 + c.rng.Intn(size-1)
+		p.short = true
+	}
+	if c.cfg.DisconnectAfter > 0 {
+		if left := c.cfg.DisconnectAfter - c.transferred; int64(p.size) > left {
+			p.size = int(left)
+		}
+	}
+	return p, nil
+}
+
+// end accounts for n transferred bytes and disconnects once DisconnectAfter was reached
+func (c *Conn) end(n int) (disconnected bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.transferred += int64(n)
+	if c.cfg.DisconnectAfter > 0 && c.transferred >= c.cfg.DisconnectAfter && !c.disconnected {
+		c.disconnectLocked()
+	}
+	return c.disconnected
+}
+
+// disconnectLocked closes the underlying connection; the caller must hold mu
+func (c *Conn) disconnectLocked() {
+	c.disconnected = true
+	c.closeUnderlying()
+}
+
+// closeUnderlying closes the wrapped connection once
+func (c *Conn) closeUnderlying() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.closeErr = c.Conn.Close()
+	})
+}
+
+// sleep waits for d or until the connection is closed
+func (c *Conn) sleep(d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-c.closed:
+		return net.ErrClosed
+	}
+}
+
+// throttle waits as long as transferring n bytes takes at bandwidth bytes per second
+func (c *Conn) throttle(n, bandwidth int) error {
+	if bandwidth <= 0 || n <= 0 {
+		return nil
+	}
+	return c.sleep(time.Duration(n) * time.Second / time.Duration(bandwidth))
+}
+
+// Read reads from the wrapped connection after applying the read faults
+func (c *Conn) Read(b []byte) (int, error) {
+	p, err := c.begin(OpRead, len(b), c.cfg.ShortReads)
+	if err != nil {
+		return 0, err
+	}
+	err = c.sleep(p.delay)
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(b[:p.size])
+	if c.end(n) && err != nil {
+		// Another operation crossed DisconnectAfter while this one was blocked
+		err = ErrDisconnected
+	}
+	if terr := c.throttle(n, c.cfg.ReadBandwidth); terr != nil && err == nil {
+		err = terr
+	}
+	return n, err
+}
+
+// Write writes to the wrapped connection after applying the write faults
+func (c *Conn) Write(b []byte) (int, error) {
+	p, err := c.begin(OpWrite, len(b), c.cfg.ShortWrites)
+	if err != nil {
+		return 0, err
+	}
+	err = c.sleep(p.delay)
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Write(b[:p.size])
+	disconnected := c.end(n)
+	if terr := c.throttle(n, c.cfg.WriteBandwidth); terr != nil && err == nil {
+		err = terr
+	}
+	if err != nil && disconnected {
+		err = ErrDisconnected
+	}
+	if err == nil && n < len(b) {
+		if disconnected {
+			err = ErrDisconnected
+		} else if p.short {
+			err = io.ErrShortWrite
+		}
+	}
+	return n, err
+}
+
+// Close closes the wrapped connection. It returns nil if a fault already closed it.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	injected := c.disconnected || c.vanished
+	c.mu.Unlock()
+
+	c.closeUnderlying()
+	if injected {
+		return nil
+	}
+	return c.closeErr
+}
+
+// vanish closes the underlying connection and makes the connection behave as if its peer disappeared
+func (c *Conn) vanish() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.vanished = true
+	c.closeUnderlying()
+}
+
+// Listener is a net.Listener with injected faults
+type Listener struct {
+	net.Listener
+	cfg Config
+
+	mu      sync.Mutex
+	accepts int
+}
+
+// WrapListener returns ln with the OpAccept faults described by cfg. Every accepted connection is wrapped with cfg;
+// the n-th connection is seeded with cfg.Seed+n so each one is deterministic.
+func WrapListener(ln net.Listener, cfg Config) *Listener {
+	return &Listener{Listener: ln, cfg: cfg}
+}
+
+// Accept waits for the next connection after applying the accept faults. Errors are returned before a client is
+// accepted, so it stays queued for the next call.
+func (l *Listener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	l.accepts++
+	n := l.accepts
+	var vanish bool
+	for _, f := range l.cfg.Faults {
+		if f.Op != OpAccept || (f.Count != 0 && f.Count != n) {
+			continue
+		}
+		if !f.Disconnect {
+			l.mu.Unlock()
+			if f.Err != nil {
+				return nil, f.Err
+			}
+			return nil, ErrInjected
+		}
+		vanish = true
+		break
+	}
+	l.mu.Unlock()
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	cfg := l.cfg
+	cfg.Seed += int64(n)
+	c := Wrap(conn, cfg)
+	if vanish {
+		c.vanish()
+	}
+	return c, nil
+}
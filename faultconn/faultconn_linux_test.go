@@ -0,0 +1,66 @@
+package faultconn
+
+import (
+	// Standard
+	"io"
+	"testing"
+	"time"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// TestListenerFaults wraps a pipe listener so the first client vanishes and the second call to Accept fails before
+// the next client is accepted
+func TestListenerFaults(t *testing.T) {
+	t.Setenv("NPIPE_SOCKET_DIR", t.TempDir())
+	address := `\\.\pipe\TestListenerFaults`
+	ln, err := npipe.Listen(address)
+	if err != nil {
+		t.Fatalf("Listen(%q): %v", address, err)
+	}
+	l := WrapListener(ln, Config{Faults: []Fault{
+		{Op: OpAccept, Count: 1, Disconnect: true},
+		{Op: OpAccept, Count: 2},
+	}})
+	defer l.Close()
+
+	first, err := npipe.DialTimeout(address, time.Second)
+	if err != nil {
+		t.Fatalf("DialTimeout(): %v", err)
+	}
+	defer first.Close()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept(): %v", err)
+	}
+	if _, err = c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected io.EOF from a vanished client but received %v", err)
+	}
+	if _, err = c.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("expected io.ErrClosedPipe from a vanished client but received %v", err)
+	}
+	if _, err = first.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the client to see io.EOF but received %v", err)
+	}
+	c.Close()
+
+	second, err := npipe.DialTimeout(address, time.Second)
+	if err != nil {
+		t.Fatalf("DialTimeout(): %v", err)
+	}
+	defer second.Close()
+	if _, err = l.Accept(); err != ErrInjected {
+		t.Fatalf("expected ErrInjected but received %v", err)
+	}
+	c, err = l.Accept()
+	if err != nil {
+		t.Fatalf("Accept(): %v", err)
+	}
+	defer c.Close()
+	go second.Write([]byte("hi"))
+	b := make([]byte, 2)
+	if _, err = io.ReadFull(c, b); err != nil || string(b) != "hi" {
+		t.Fatalf("io.ReadFull() = %q, %v", b, err)
+	}
+}
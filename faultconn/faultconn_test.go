@@ -0,0 +1,129 @@
+package faultconn
+
+import (
+	// Standard
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestFaultByCount tests that a fault only fires on the configured call
+func TestFaultByCount(t *testing.T) {
+	errBoom := errors.New("boom")
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	c := Wrap(c1, Config{Faults: []Fault{{Op: OpRead, Count: 2, Err: errBoom}}})
+	defer c.Close()
+
+	go c2.Write([]byte("abc"))
+	b := make([]byte, 1)
+	for i, want := range []error{nil, errBoom, nil} {
+		_, err := c.Read(b)
+		if err != want {
+			t.Fatalf("read %d: expected %v but received %v", i+1, want, err)
+		}
+	}
+}
+
+// TestDisconnectAfter tests that the write crossing DisconnectAfter is truncated, the peer sees EOF, and the
+// connection is unusable afterwards
+func TestDisconnectAfter(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	c := Wrap(c1, Config{DisconnectAfter: 4})
+	defer c.Close()
+
+	received := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(c2)
+		received <- data
+	}()
+	n, err := c.Write([]byte("0123456789"))
+	if n != 4 || err != ErrDisconnected {
+		t.Fatalf("expected 4, ErrDisconnected but received %d, %v", n, err)
+	}
+	if data := <-received; string(data) != "0123" {
+		t.Fatalf("the peer received %q", data)
+	}
+	if _, err = c.Write([]byte("x")); err != ErrDisconnected {
+		t.Fatalf("expected ErrDisconnected but received %v", err)
+	}
+	if err = c.Close(); err != nil {
+		t.Fatalf("Close(): %v", err)
+	}
+}
+
+// TestShortWritesSeed tests that short writes return io.ErrShortWrite and are reproducible with the same seed
+func TestShortWritesSeed(t *testing.T) {
+	sizes := func() []int {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		c := Wrap(c1, Config{Seed: 42, ShortWrites: 1})
+		defer c.Close()
+		go io.Copy(io.Discard, c2)
+
+		var sizes []int
+		for i := 0; i < 5; i++ {
+			n, err := c.Write(make([]byte, 100))
+			if err != io.ErrShortWrite || n < 1 || n >= 100 {
+				t.Fatalf("expected a short write but received %d, %v", n, err)
+			}
+			sizes = append(sizes, n)
+		}
+		return sizes
+	}
+	first, second := sizes(), sizes()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("the same seed produced %v and %v", first, second)
+		}
+	}
+}
+
+// TestShortReads tests that short reads return part of the available data
+func TestShortReads(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	c := Wrap(c1, Config{Seed: 1, ShortReads: 1})
+	defer c.Close()
+
+	msg := "hello world"
+	go c2.Write([]byte(msg))
+	b := make([]byte, len(msg))
+	n, err := c.Read(b)
+	if err != nil || n < 1 || n >= len(msg) {
+		t.Fatalf("expected a short read but received %d, %v", n, err)
+	}
+	if _, err = io.ReadFull(c, b[n:]); err != nil || string(b) != msg {
+		t.Fatalf("io.ReadFull() = %q, %v", b, err)
+	}
+}
+
+// TestLatencyAndBandwidth tests that latency and bandwidth caps slow operations down and that Close interrupts them
+func TestLatencyAndBandwidth(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	c := Wrap(c1, Config{Latency: 20 * time.Millisecond, WriteBandwidth: 1000})
+	go io.Copy(io.Discard, c2)
+
+	start := time.Now()
+	if _, err := c.Write(make([]byte, 50)); err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+	// 20ms of latency and 50ms to send 50 bytes at 1000 bytes per second
+	if elapsed := time.Since(start); elapsed < 70*time.Millisecond {
+		t.Fatalf("the write took %s", elapsed)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		c.Close()
+	}()
+	start = time.Now()
+	c.Write(make([]byte, 1000))
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Close did not interrupt the throttled write, it took %s", elapsed)
+	}
+}
@@ -2,4 +2,4 @@ module github.com/Ne0nd0g/npipe
 
 go 1.19
 
-require golang.org/x/sys v0.7.0 // indirect
+require golang.org/x/sys v0.7.0
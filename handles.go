@@ -0,0 +1,50 @@
+package npipe
+
+import (
+	// Standard
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// Every SendHandles call writes a single frame that RecvHandles decodes:
+//
+//	uint32  number of handles
+//	uint32  length of the data
+//	uint64  handle values in the receiving process (Windows only, one per handle)
+//	[]byte  data
+//
+// On Linux the handles travel as SCM_RIGHTS ancillary data attached to the frame header instead of in-band.
+const (
+	// handleHeaderSize is the size of the frame header written by SendHandles
+	handleHeaderSize = 8
+	// MaxHandles is the maximum number of handles that can be sent with a single call to SendHandles, the kernel's
+	// SCM_MAX_FD limit for SCM_RIGHTS messages on Linux
+	MaxHandles = 253
+)
+
+// appendHandleHeader appends the frame header for count handles and dataLen bytes of data to b
+func appendHandleHeader(b []byte, count, dataLen int) []byte {
+	b = binary.LittleEndian.AppendUint32(b, uint32(count))
+	return binary.LittleEndian.AppendUint32(b, uint32(dataLen))
+}
+
+// parseHandleHeader decodes the frame header written by SendHandles
+func parseHandleHeader(b []byte) (count, dataLen int, err error) {
+	if len(b) < handleHeaderSize {
+		return 0, 0, fmt.Errorf("npipe.parseHandleHeader(): expected %d bytes but received %d", handleHeaderSize, len(b))
+	}
+	count = int(binary.LittleEndian.Uint32(b[0:4]))
+	dataLen = int(binary.LittleEndian.Uint32(b[4:8]))
+	if count > MaxHandles {
+		return 0, 0, fmt.Errorf("npipe.parseHandleHeader(): received %d handles, the maximum is %d", count, MaxHandles)
+	}
+	return count, dataLen, nil
+}
+
+// closeFiles closes files that were received but can't be handed to the caller
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
@@ -0,0 +1,172 @@
+//go:build linux
+
+package npipe
+
+import (
+	// Standard
+	"fmt"
+	"io"
+	"os"
+
+	// X Package
+	"golang.org/x/sys/unix"
+)
+
+// SendHandles writes b to the peer together with the files' descriptors, which the peer receives with RecvHandles.
+// The descriptors are passed as SCM_RIGHTS ancillary data, so the caller keeps ownership of files and may close them
+// as soon as SendHandles returns; the peer owns the duplicates it receives. Frames written by SendHandles must be read
+// with RecvHandles, a plain Read discards the descriptors.
+func (c *PipeConn) SendHandles(b []byte, files ...*os.File) (int, error) {
+	if len(files) > MaxHandles {
+		return 0, fmt.Errorf("npipe.PipeConn.SendHandles(): %d handles exceeds the maximum of %d", len(files), MaxHandles)
+	}
+
+	// Duplicate the descriptors instead of using File.Fd, which would put the caller's files in blocking mode
+	fds := make([]int, 0, len(files))
+	defer func() {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}()
+	for _, f := range files {
+		rc, err := f.SyscallConn()
+		if err != nil {
+			return 0, fmt.Errorf("npipe.PipeConn.SendHandles(): %s", err)
+		}
+		var dupErr error
+		err = rc.Control(func(fd uintptr) {
+			var dup int
+			dup, dupErr = unix.FcntlInt(fd, unix.F_DUPFD_CLOEXEC, 0)
+			if dupErr == nil {
+				fds = append(fds, dup)
+			}
+		})
+		if err == nil {
+			err = dupErr
+		}
+		if err != nil {
+			return 0, fmt.Errorf("npipe.PipeConn.SendHandles(): there was an error duplicating %s: %s", f.Name(), err)
+		}
+	}
+
+	frame := appendHandleHeader(make([]byte, 0, handleHeaderSize+len(b)), len(files), len(b))
+	frame = append(frame, b...)
+	var rights []byte
+	if len(fds) > 0 {
+		rights = unix.UnixRights(fds...)
+	}
+	n, _, err := c.conn.WriteMsgUnix(frame, rights, nil)
+	if err == nil && n < len(frame) {
+		// A stream socket may accept part of the frame, the descriptors went with the first byte
+		var m int
+		m, err = c.conn.Write(frame[n:])
+		n += m
+	}
+	if err != nil {
+		if n < handleHeaderSize {
+			return 0, c.convertError(err)
+		}
+		return n - handleHeaderSize, c.convertError(err)
+	}
+	return len(b), nil
+}
+
+// RecvHandles reads a frame written by SendHandles. The data is copied into b and the received descriptors are
+// returned as files owned by the caller, who must close them. If the data does not fit in b, ErrMoreData is returned
+// with the files and the rest of the data is returned by subsequent calls to Read, which return ErrMoreData until the
+// end of the frame; Available reports the number of bytes left in it.
+func (c *PipeConn) RecvHandles(b []byte) (int, []*os.File, error) {
+	if c.buffered() {
+		return 0, nil, fmt.Errorf("npipe.PipeConn.RecvHandles(): the rest of a partially read message must be read first")
+	}
+	oob := make([]byte, unix.CmsgSpace(MaxHandles*4))
+
+	var frame []byte
+	var oobn int
+	if c.message {
+		size, err := c.nextMessageSize()
+		if err != nil {
+			return 0, nil, c.convertError(err)
+		}
+		frame = make([]byte, size)
+		var n int
+		n, oobn, _, _, err = c.conn.ReadMsgUnix(frame, oob)
+		if err != nil {
+			return 0, nil, c.convertError(err)
+		}
+		frame = frame[:n]
+	} else {
+		frame = make([]byte, handleHeaderSize)
+		n, m, _, _, err := c.conn.ReadMsgUnix(frame, oob)
+		oobn = m
+		if err == nil && n < len(frame) {
+			_, err = io.ReadFull(c.conn, frame[n:])
+		}
+		if err != nil {
+			files, _ := parseRights(oob[:oobn])
+			closeFiles(files)
+			return 0, nil, c.convertError(err)
+		}
+	}
+
+	files, err := parseRights(oob[:oobn])
+	if err != nil {
+		return 0, nil, fmt.Errorf("npipe.PipeConn.RecvHandles(): %s", err)
+	}
+	count, dataLen, err := parseHandleHeader(frame)
+	if err == nil && count != len(files) {
+		err = fmt.Errorf("expected %d descriptors but received %d", count, len(files))
+	}
+	if err != nil {
+		closeFiles(files)
+		return 0, nil, fmt.Errorf("npipe.PipeConn.RecvHandles(): %s", err)
+	}
+
+	if c.message {
+		data := frame[handleHeaderSize:]
+		n := copy(b, data)
+		if n < len(data) {
+			c.rmu.Lock()
+			c.rmsg = data[n:]
+			c.rmu.Unlock()
+			return n, files, ErrMoreData
+		}
+		return n, files, nil
+	}
+
+	if dataLen < len(b) {
+		b = b[:dataLen]
+	}
+	n, err := io.ReadFull(c.conn, b)
+	if err != nil {
+		closeFiles(files)
+		return 0, nil, c.convertError(err)
+	}
+	if n < dataLen {
+		c.rmu.Lock()
+		c.rframe = dataLen - n
+		c.rmu.Unlock()
+		return n, files, ErrMoreData
+	}
+	return n, files, nil
+}
+
+// parseRights returns the descriptors in the SCM_RIGHTS control messages as files
+func parseRights(oob []byte) ([]*os.File, error) {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, fmt.Errorf("there was an error parsing the control messages: %s", err)
+	}
+	var files []*os.File
+	for _, m := range messages {
+		fds, err := unix.ParseUnixRights(&m)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			unix.CloseOnExec(fd)
+			files = append(files, os.NewFile(uintptr(fd), fmt.Sprintf("fd-%d", fd)))
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,25 @@
+package npipe
+
+import "testing"
+
+// TestHandleHeader tests that the SendHandles frame header round trips and rejects too many handles
+func TestHandleHeader(t *testing.T) {
+	header := appendHandleHeader(nil, 3, 1024)
+	if len(header) != handleHeaderSize {
+		t.Fatalf("Expected a %d byte header, got %d", handleHeaderSize, len(header))
+	}
+	count, dataLen, err := parseHandleHeader(header)
+	if err != nil {
+		t.Fatalf("parseHandleHeader(): %v", err)
+	}
+	if count != 3 || dataLen != 1024 {
+		t.Fatalf("Unexpected header values %d and %d", count, dataLen)
+	}
+
+	if _, _, err := parseHandleHeader(header[:4]); err == nil {
+		t.Error("parseHandleHeader() accepted a truncated header")
+	}
+	if _, _, err := parseHandleHeader(appendHandleHeader(nil, MaxHandles+1, 0)); err == nil {
+		t.Error("parseHandleHeader() accepted too many handles")
+	}
+}
@@ -0,0 +1,40 @@
+//go:build windows
+
+package npipe
+
+import (
+	// Standard
+	"fmt"
+	"os"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe/internal/winapi"
+)
+
+// SendHandles writes b to the peer together with the files' handles, which the peer receives with RecvHandles.
+// The handles are duplicated into the peer process, whose identifier the pipe reports, with DuplicateHandle, so the
+// caller needs PROCESS_DUP_HANDLE access to the peer but the peer needs no access to the caller. The caller keeps
+// ownership of files and may close them as soon as SendHandles returns; the duplicates belong to the peer from then
+// on, which must close them, and stay open in the peer process if it never reads the frame. Frames written by
+// SendHandles must be read with RecvHandles.
+func (c *PipeConn) SendHandles(b []byte, files ...*os.File) (int, error) {
+	handles := make([]winapi.Handle, len(files))
+	for i, f := range files {
+		handles[i] = winapi.Handle(f.Fd())
+	}
+	return c.sendHandles(b, handles)
+}
+
+// RecvHandles reads a frame written by SendHandles. The handles the peer duplicated into this process are returned as
+// files owned by the caller, who must close them. The handle values are taken as the peer sent them, so only receive
+// handles from peers that are trusted to send handles they duplicated for this process. The data is copied into b. If
+// it does not fit in b, ErrMoreData is returned with the files and the rest of the data is returned by subsequent
+// calls to Read, which return ErrMoreData until the end of the frame; Available reports the number of bytes left in it.
+func (c *PipeConn) RecvHandles(b []byte) (int, []*os.File, error) {
+	n, handles, err := c.recvHandles(b)
+	var files []*os.File
+	for _, h := range handles {
+		files = append(files, os.NewFile(uintptr(h), fmt.Sprintf("handle-%d", h)))
+	}
+	return n, files, err
+}
@@ -0,0 +1,266 @@
+// Package bench holds the workloads behind the Benchmark functions of this module and cmd/npipebench: small message
+// round trip latency, bulk throughput at several buffer sizes, connections per second through Accept, and round trips
+// over a growing number of concurrent connections. The workloads only see a Transport, so the same code measures the
+// platform backend and the simulated kernel.
+package bench
+
+import (
+	// Standard
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Transport creates the listeners and clients a workload runs on
+type Transport interface {
+	Listen(address string) (net.Listener, error)
+	Dial(address string) (net.Conn, error)
+}
+
+// Benchmark is one workload of the suite; Name is the benchmark name without the Benchmark prefix
+type Benchmark struct {
+	Name string
+	F    func(b *testing.B, t Transport, address string)
+}
+
+var (
+	// RoundTripSizes are the message sizes of the round trip benchmarks
+	RoundTripSizes = []int{64, 1024, 16 * 1024}
+	// ThroughputSizes are the buffer sizes of the throughput benchmarks
+	ThroughputSizes = []int{512, 4 * 1024, 64 * 1024, 1024 * 1024}
+	// Concurrency are the connection counts of the concurrency benchmarks
+	Concurrency = []int{1, 2, 4, 8, 16}
+)
+
+// concurrentSize is the message size of the concurrency benchmarks
+const concurrentSize = 64
+
+// Suite returns every benchmark in the order they run
+func Suite() []Benchmark {
+	var suite []Benchmark
+	for _, size := range RoundTripSizes {
+		size := size
+		suite = append(suite, Benchmark{fmt.Sprintf("RoundTrip/size=%d", size), func(b *testing.B, t Transport, address string) {
+			RoundTrip(b, t, address, size)
+		}})
+	}
+	for _, size := range ThroughputSizes {
+		size := size
+		suite = append(suite, Benchmark{fmt.Sprintf("Throughput/buf=%d", size), func(b *testing.B, t Transport, address string) {
+			Throughput(b, t, address, size)
+		}})
+	}
+	suite = append(suite, Benchmark{"Accept", Accept})
+	for _, conns := range Concurrency {
+		conns := conns
+		suite = append(suite, Benchmark{fmt.Sprintf("Concurrent/conns=%d", conns), func(b *testing.B, t Transport, address string) {
+			Concurrent(b, t, address, conns, concurrentSize)
+		}})
+	}
+	return suite
+}
+
+// Run runs the benchmarks of the suite whose name starts with group as sub-benchmarks of b
+func Run(b *testing.B, group string, t Transport, address string) {
+	for _, bm := range Suite() {
+		if bm.Name != group && !strings.HasPrefix(bm.Name, group+"/") {
+			continue
+		}
+		bm := bm
+		name := strings.TrimPrefix(strings.TrimPrefix(bm.Name, group), "/")
+		if name == "" {
+			bm.F(b, t, address)
+			continue
+		}
+		b.Run(name, func(b *testing.B) {
+			bm.F(b, t, address)
+		})
+	}
+}
+
+// seq makes the address of every run unique, since a benchmark function runs several times and a pipe may linger
+// until its last instance is closed
+var seq uint64
+
+// uniqueAddress returns address with a suffix no other run in this process uses
+func uniqueAddress(address string) string {
+	return fmt.Sprintf("%s-%d", address, atomic.AddUint64(&seq, 1))
+}
+
+// RoundTrip measures the latency of writing a message of size bytes to an echo server and reading the reply
+func RoundTrip(b *testing.B, t Transport, address string, size int) {
+	Concurrent(b, t, address, 1, size)
+}
+
+// Concurrent measures round trips of size byte messages spread over conns connections to an echo server, each
+// driven by its own goroutine. ns/op is the time per round trip across all connections.
+func Concurrent(b *testing.B, t Transport, address string, conns, size int) {
+	ln, err := t.Listen(uniqueAddress(address))
+	if err != nil {
+		b.Fatalf("Listen(): %v", err)
+	}
+	defer ln.Close()
+	go serve(ln, echo)
+
+	clients := make([]net.Conn, conns)
+	for i := range clients {
+		clients[i], err = t.Dial(ln.Addr().String())
+		if err != nil {
+			b.Fatalf("Dial(): %v", err)
+		}
+		defer clients[i].Close()
+	}
+
+	msgs := make([][]byte, conns)
+	bufs := make([][]byte, conns)
+	for i := range clients {
+		msgs[i], bufs[i] = make([]byte, size), make([]byte, size)
+	}
+
+	var next int64
+	var wg sync.WaitGroup
+	errs := make(chan error, conns)
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i, c := range clients {
+		wg.Add(1)
+		go func(c net.Conn, msg, buf []byte) {
+			defer wg.Done()
+			for atomic.AddInt64(&next, 1) <= int64(b.N) {
+				if _, err := c.Write(msg); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := io.ReadFull(c, buf); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(c, msgs[i], bufs[i])
+	}
+	wg.Wait()
+	b.StopTimer()
+	select {
+	case err := <-errs:
+		b.Fatalf("round trip: %v", err)
+	default:
+	}
+}
+
+// Throughput measures writing b.N buffers of size bytes to a server that reads them with a buffer of the same size
+func Throughput(b *testing.B, t Transport, address string, size int) {
+	ln, err := t.Listen(uniqueAddress(address))
+	if err != nil {
+		b.Fatalf("Listen(): %v", err)
+	}
+	defer ln.Close()
+
+	want := int64(size) * int64(b.N)
+	received := make(chan error, 1)
+	go serve(ln, func(c net.Conn) {
+		buf := make([]byte, size)
+		var total int64
+		for total < want {
+			n, err := c.Read(buf)
+			total += int64(n)
+			if err != nil {
+				received <- fmt.Errorf("the server received %d of %d bytes: %v", total, want, err)
+				return
+			}
+		}
+		received <- nil
+	})
+
+	c, err := t.Dial(ln.Addr().String())
+	if err != nil {
+		b.Fatalf("Dial(): %v", err)
+	}
+	defer c.Close()
+
+	buf := make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = c.Write(buf); err != nil {
+			b.Fatalf("Write(): %v", err)
+		}
+	}
+	if err = <-received; err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+}
+
+// Accept measures the rate at which clients connect, are accepted, and receive a byte from the server before both
+// ends close, and reports it as conns/s
+func Accept(b *testing.B, t Transport, address string) {
+	ln, err := t.Listen(uniqueAddress(address))
+	if err != nil {
+		b.Fatalf("Listen(): %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte{1})
+			c.Close()
+		}
+	}()
+
+	buf := make([]byte, 1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		c, err := t.Dial(ln.Addr().String())
+		if err != nil {
+			b.Fatalf("Dial(): %v", err)
+		}
+		if _, err = io.ReadFull(c, buf); err != nil {
+			b.Fatalf("Read(): %v", err)
+		}
+		c.Close()
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "conns/s")
+}
+
+// serve runs handle for every connection the listener accepts until it is closed, closing the connections after
+func serve(ln net.Listener, handle func(net.Conn)) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			handle(c)
+		}()
+	}
+}
+
+// echo writes back everything it reads until the client closes the connection
+func echo(c net.Conn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := c.Read(buf)
+		if n > 0 {
+			if _, werr := c.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,35 @@
+// Package simpipe gives the tools of this module access to the Windows named pipe code running on the simulated
+// kernel of internal/winapi, an in-memory transport that works on every platform. The npipe package only registers
+// Listen and Dial in its tests and in builds with the npipesim tag, which keeps the simulated kernel out of the programs
+// that import npipe; otherwise they are nil.
+package simpipe
+
+import (
+	// Standard
+	"net"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe/internal/winapi"
+)
+
+var (
+	// Listen creates the first instance of a byte mode pipe in sim and returns a listener for it
+	Listen func(sim *winapi.Sim, address string) (net.Listener, error)
+	// Dial connects to a pipe in sim, waiting for an instance to become available
+	Dial func(sim *winapi.Sim, address string) (net.Conn, error)
+)
+
+// Transport creates listeners and clients in one simulated kernel
+type Transport struct {
+	Sim *winapi.Sim
+}
+
+// Listen creates a listener in the simulated kernel
+func (t Transport) Listen(address string) (net.Listener, error) {
+	return Listen(t.Sim, address)
+}
+
+// Dial connects a client in the simulated kernel
+func (t Transport) Dial(address string) (net.Conn, error) {
+	return Dial(t.Sim, address)
+}
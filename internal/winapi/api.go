@@ -0,0 +1,146 @@
+// Package winapi defines the subset of the Win32 API used by the named pipe implementation as an interface, so the
+// listener and connection state machines can run against either the real kernel on Windows or the simulated kernel
+// returned by NewSim on any platform.
+package winapi
+
+import (
+	// Standard
+	"syscall"
+)
+
+// Handle is a Win32 handle
+type Handle uintptr
+
+// InvalidHandle is the INVALID_HANDLE_VALUE returned by failing Win32 functions
+const InvalidHandle = ^Handle(0)
+
+// CurrentProcess is the pseudo handle GetCurrentProcess returns for the calling process
+const CurrentProcess = ^Handle(0)
+
+// Overlapped has the same memory layout as the Win32 OVERLAPPED structure and golang.org/x/sys/windows.Overlapped
+// https://learn.microsoft.com/en-us/windows/win32/api/minwinbase/ns-minwinbase-overlapped
+type Overlapped struct {
+	Internal     uintptr
+	InternalHigh uintptr
+	Offset       uint32
+	OffsetHigh   uint32
+	HEvent       Handle
+}
+
+// Win32 error codes returned by the named pipe functions. The values are syscall.Errno so they compare equal to the
+// errors returned by golang.org/x/sys/windows on Windows.
+// https://learn.microsoft.com/en-us/windows/win32/debug/system-error-codes
+const (
+	ERROR_INVALID_FUNCTION   = syscall.Errno(1)
+	ERROR_FILE_NOT_FOUND     = syscall.Errno(2)
+	ERROR_ACCESS_DENIED      = syscall.Errno(5)
+	ERROR_INVALID_HANDLE     = syscall.Errno(6)
+	ERROR_NOT_SUPPORTED      = syscall.Errno(50)
+	ERROR_INVALID_PARAMETER  = syscall.Errno(87)
+	ERROR_BROKEN_PIPE        = syscall.Errno(109)
+	ERROR_SEM_TIMEOUT        = syscall.Errno(121)
+	ERROR_INVALID_NAME       = syscall.Errno(123)
+	ERROR_BAD_PATHNAME       = syscall.Errno(161)
+	ERROR_BAD_PIPE           = syscall.Errno(230)
+	ERROR_PIPE_BUSY          = syscall.Errno(231)
+	ERROR_NO_DATA            = syscall.Errno(232)
+	ERROR_PIPE_NOT_CONNECTED = syscall.Errno(233)
+	ERROR_MORE_DATA          = syscall.Errno(234)
+	ERROR_PIPE_CONNECTED     = syscall.Errno(535)
+	ERROR_PIPE_LISTENING     = syscall.Errno(536)
+	ERROR_OPERATION_ABORTED  = syscall.Errno(995)
+	ERROR_IO_INCOMPLETE      = syscall.Errno(996)
+	ERROR_IO_PENDING         = syscall.Errno(997)
+	ERROR_NOT_FOUND          = syscall.Errno(1168)
+)
+
+// Flags and constants accepted by the named pipe functions
+// https://learn.microsoft.com/en-us/windows/win32/api/winbase/nf-winbase-createnamedpipea
+const (
+	PIPE_ACCESS_INBOUND           = 0x00000001
+	PIPE_ACCESS_OUTBOUND          = 0x00000002
+	PIPE_ACCESS_DUPLEX            = 0x00000003
+	FILE_FLAG_FIRST_PIPE_INSTANCE = 0x00080000
+	FILE_FLAG_OVERLAPPED          = 0x40000000
+
+	PIPE_TYPE_BYTE        = 0x00000000
+	PIPE_TYPE_MESSAGE     = 0x00000004
+	PIPE_READMODE_BYTE    = 0x00000000
+	PIPE_READMODE_MESSAGE = 0x00000002
+
+	PIPE_UNLIMITED_INSTANCES = 255
+
+	PIPE_SERVER_END = 0x00000001
+
+	GENERIC_READ     = 0x80000000
+	GENERIC_WRITE    = 0x40000000
+	FILE_SHARE_READ  = 0x00000001
+	FILE_SHARE_WRITE = 0x00000002
+	OPEN_EXISTING    = 3
+
+	NMPWAIT_USE_DEFAULT_WAIT = 0x00000000
+	NMPWAIT_WAIT_FOREVER     = 0xFFFFFFFF
+)
+
+// Flags accepted by OpenProcess and DuplicateHandle
+// https://learn.microsoft.com/en-us/windows/win32/api/handleapi/nf-handleapi-duplicatehandle
+const (
+	PROCESS_DUP_HANDLE = 0x00000040
+
+	DUPLICATE_CLOSE_SOURCE = 0x00000001
+	DUPLICATE_SAME_ACCESS  = 0x00000002
+)
+
+// API is the subset of the Win32 API used by the named pipe implementation. Errors are returned as syscall.Errno
+// values like the functions in golang.org/x/sys/windows.
+type API interface {
+	// CreateNamedPipe creates an instance of a named pipe; sa is a *windows.SecurityAttributes on Windows and is
+	// ignored by the simulated kernel
+	CreateNamedPipe(name string, openMode, pipeMode, maxInstances, outBufferSize, inBufferSize, defaultTimeout uint32, sa interface{}) (Handle, error)
+	// ConnectNamedPipe enables a named pipe server process to wait for a client process to connect
+	ConnectNamedPipe(pipe Handle, overlapped *Overlapped) error
+	// DisconnectNamedPipe disconnects the server end of a named pipe instance from a client process
+	DisconnectNamedPipe(pipe Handle) error
+	// WaitNamedPipe waits until an instance of the named pipe is available for connection
+	WaitNamedPipe(name string, timeout uint32) error
+	// CreateFile opens the client end of a named pipe
+	CreateFile(name string, access, mode, createMode, attrs uint32) (Handle, error)
+	// ReadFile reads data from the pipe
+	ReadFile(handle Handle, buf []byte, done *uint32, overlapped *Overlapped) error
+	// WriteFile writes data to the pipe
+	WriteFile(handle Handle, buf []byte, done *uint32, overlapped *Overlapped) error
+	// CancelIoEx cancels the pending I/O operation identified by overlapped, or every operation including
+	// FlushFileBuffers if it is nil
+	CancelIoEx(handle Handle, overlapped *Overlapped) error
+	// CreateEvent creates an event object
+	CreateEvent(manualReset, initialState bool) (Handle, error)
+	// GetOverlappedResult retrieves the result of an overlapped operation, waiting for it to complete if wait is true
+	GetOverlappedResult(handle Handle, overlapped *Overlapped, done *uint32, wait bool) error
+	// CloseHandle closes the handle
+	CloseHandle(handle Handle) error
+	// TransactNamedPipe writes in as one message and reads the reply into out; the handle must be in message read mode
+	// and have no unread data
+	TransactNamedPipe(handle Handle, in, out []byte, done *uint32, overlapped *Overlapped) error
+	// SetNamedPipeHandleState sets the read mode of the handle to one of the PIPE_READMODE_* values
+	SetNamedPipeHandleState(handle Handle, mode uint32) error
+	// GetNamedPipeInfo returns the PIPE_SERVER_END and PIPE_TYPE_* flags, buffer sizes, and maximum number of instances
+	// of the pipe; every pointer may be nil
+	GetNamedPipeInfo(handle Handle, flags, outBufferSize, inBufferSize, maxInstances *uint32) error
+	// GetNamedPipeHandleState returns the PIPE_READMODE_* state of the handle and the current number of instances of
+	// the pipe; every pointer may be nil
+	GetNamedPipeHandleState(handle Handle, state, curInstances *uint32) error
+	// FlushFileBuffers waits until the peer read all data written to the pipe
+	FlushFileBuffers(handle Handle) error
+	// PeekNamedPipe copies data from the pipe into buf without removing it and returns the number of bytes copied,
+	// available, and left in the current message after the copied bytes; buf may be empty
+	PeekNamedPipe(handle Handle, buf []byte, read, available, leftThisMessage *uint32) error
+	// GetNamedPipeClientProcessId returns the process identifier of the client end of the pipe
+	GetNamedPipeClientProcessId(handle Handle, pid *uint32) error
+	// GetNamedPipeServerProcessId returns the process identifier of the server end of the pipe
+	GetNamedPipeServerProcessId(handle Handle, pid *uint32) error
+	// OpenProcess opens a handle to the process with the requested PROCESS_* access
+	OpenProcess(access uint32, pid uint32) (Handle, error)
+	// DuplicateHandle duplicates source, a handle of sourceProcess, into targetProcess; CurrentProcess refers to the
+	// calling process. With DUPLICATE_CLOSE_SOURCE and a zero targetProcess it only closes source.
+	DuplicateHandle(sourceProcess, source, targetProcess Handle, target *Handle, access uint32, inherit bool, options uint32) error
+}
@@ -0,0 +1,1101 @@
+package winapi
+
+import (
+	// Standard
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// simDefaultBufferSize is the buffer quota of a pipe created with a buffer size of zero
+	simDefaultBufferSize = 4096
+	// simDefaultTimeout is the NMPWAIT_USE_DEFAULT_WAIT timeout of a pipe created with a timeout of zero
+	simDefaultTimeout = 50 * time.Millisecond
+)
+
+// SimProcessID is the process identifier of the process that owns the handles created through Sim itself
+const SimProcessID = 4
+
+// Sim is a simulated named pipe kernel implementing API in pure Go. It models the parts of the named pipe file system
+// the listener and connection code depend on: pipe instances and their states, FILE_FLAG_FIRST_PIPE_INSTANCE, busy
+// pipes, byte and message pipes with ERROR_MORE_DATA, buffer quotas that make writes pend until the reader catches up,
+// overlapped completion, and cancellation. Only overlapped I/O is supported and every pipe is local. Handles belong
+// to the process that created them, Sim itself or one of the processes returned by Process, and can only be moved
+// between processes with DuplicateHandle.
+type Sim struct {
+	mu        sync.Mutex
+	next      Handle
+	handles   map[Handle]interface{}
+	owners    map[Handle]uint32
+	processes map[uint32]*SimProcess
+	pipes     map[string]*simPipe
+	ops       map[*Overlapped]*simOp
+	// changed is closed and replaced whenever an instance becomes available to clients
+	changed chan struct{}
+}
+
+// NewSim returns an empty simulated kernel
+func NewSim() *Sim {
+	s := &Sim{
+		next:      4,
+		handles:   make(map[Handle]interface{}),
+		owners:    make(map[Handle]uint32),
+		processes: make(map[uint32]*SimProcess),
+		pipes:     make(map[string]*simPipe),
+		ops:       make(map[*Overlapped]*simOp),
+		changed:   make(chan struct{}),
+	}
+	s.processes[SimProcessID] = &SimProcess{Sim: s, pid: SimProcessID}
+	return s
+}
+
+// SimProcess is another process using the simulated kernel. The handles it creates belong to it, and a sandboxed
+// process, like a low integrity process on Windows, can only open other sandboxed processes with OpenProcess.
+type SimProcess struct {
+	*Sim
+	pid       uint32
+	sandboxed bool
+}
+
+// Process returns the process with the identifier pid, creating it if it does not exist yet
+func (s *Sim) Process(pid uint32, sandboxed bool) *SimProcess {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.processes[pid]
+	if p == nil {
+		p = &SimProcess{Sim: s, pid: pid, sandboxed: sandboxed}
+		s.processes[pid] = p
+	}
+	return p
+}
+
+// simProcessObject is the object behind a handle returned by OpenProcess
+type simProcessObject struct {
+	pid    uint32
+	access uint32
+}
+
+// simPipe is a named pipe and its instances
+type simPipe struct {
+	name           string
+	message        bool
+	maxInstances   int
+	outBufferSize  int
+	inBufferSize   int
+	defaultTimeout time.Duration
+	instances      []*simInstance
+}
+
+// simState is the state of a pipe instance as seen from its server end
+type simState int
+
+const (
+	// simListening instances are available to clients
+	simListening simState = iota
+	// simConnected instances have a client
+	simConnected
+	// simClosing instances had a client that closed its end
+	simClosing
+	// simDisconnected instances were disconnected by the server and need ConnectNamedPipe before clients can connect
+	simDisconnected
+)
+
+// simInstance is one instance of a named pipe
+type simInstance struct {
+	pipe    *simPipe
+	state   simState
+	server  *simEnd
+	client  *simEnd
+	connect *simOp
+}
+
+// simEnd is the server or client end of a pipe instance, the object behind a pipe handle
+type simEnd struct {
+	inst        *simInstance
+	server      bool
+	readMessage bool
+	// pid is the process that owns the end
+	pid uint32
+	// in holds the data this end reads and out the data it writes, the peer's in
+	in, out *simQueue
+	peer    *simEnd
+	// gone is returned by reads once in is drained and by writes while there is no peer
+	gone  error
+	reads []*simOp
+	ops   []*simOp
+}
+
+// simQueue holds the data written to one end of an instance that was not read yet
+type simQueue struct {
+	capacity int
+	chunks   []*simChunk
+	// flushes are the FlushFileBuffers calls waiting for the queue to be drained
+	flushes []*simFlush
+}
+
+// simFlush is a FlushFileBuffers call waiting for the reader; err is set before done is closed
+type simFlush struct {
+	err  error
+	done chan struct{}
+}
+
+// simChunk is the unread part of a single write; op is set while the write is pending
+type simChunk struct {
+	data []byte
+	size int
+	op   *simOp
+}
+
+// simOp is a pending overlapped operation
+type simOp struct {
+	end       *simEnd
+	buf       []byte
+	chunk     *simChunk
+	queue     *simQueue
+	n         uint32
+	err       error
+	completed bool
+	done      chan struct{}
+}
+
+// simEvent is an event object; the simulator tracks operations directly, so events only need to exist
+type simEvent struct{}
+
+// OpenHandles returns the number of open handles, which lets tests detect leaked pipe ends and events
+func (s *Sim) OpenHandles() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.handles)
+}
+
+// CreateNamedPipe creates an instance of a named pipe
+func (s *Sim) CreateNamedPipe(name string, openMode, pipeMode, maxInstances, outBufferSize, inBufferSize, defaultTimeout uint32, sa interface{}) (Handle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := simPipeName(name)
+	if !ok {
+		return InvalidHandle, ERROR_INVALID_NAME
+	}
+	if maxInstances == 0 || maxInstances > PIPE_UNLIMITED_INSTANCES {
+		return InvalidHandle, ERROR_INVALID_PARAMETER
+	}
+	message := pipeMode&PIPE_TYPE_MESSAGE != 0
+	if !message && pipeMode&PIPE_READMODE_MESSAGE != 0 {
+		return InvalidHandle, ERROR_INVALID_PARAMETER
+	}
+
+	p := s.pipes[key]
+	if p != nil {
+		if openMode&FILE_FLAG_FIRST_PIPE_INSTANCE != 0 || p.message != message {
+			return InvalidHandle, ERROR_ACCESS_DENIED
+		}
+		if p.maxInstances > 0 && len(p.instances) >= p.maxInstances {
+			return InvalidHandle, ERROR_PIPE_BUSY
+		}
+	} else {
+		p = &simPipe{
+			name:           name,
+			message:        message,
+			outBufferSize:  int(outBufferSize),
+			inBufferSize:   int(inBufferSize),
+			defaultTimeout: time.Duration(defaultTimeout) * time.Millisecond,
+		}
+		if maxInstances != PIPE_UNLIMITED_INSTANCES {
+			p.maxInstances = int(maxInstances)
+		}
+		if p.outBufferSize == 0 {
+			p.outBufferSize = simDefaultBufferSize
+		}
+		if p.inBufferSize == 0 {
+			p.inBufferSize = simDefaultBufferSize
+		}
+		if p.defaultTimeout == 0 {
+			p.defaultTimeout = simDefaultTimeout
+		}
+		s.pipes[key] = p
+	}
+
+	inst := &simInstance{pipe: p, state: simListening}
+	inst.server = &simEnd{inst: inst, server: true, readMessage: pipeMode&PIPE_READMODE_MESSAGE != 0, gone: ERROR_PIPE_LISTENING}
+	p.instances = append(p.instances, inst)
+	s.notify()
+	return s.newHandle(inst.server), nil
+}
+
+// ConnectNamedPipe waits for a client to connect to the instance
+func (s *Sim) ConnectNamedPipe(pipe Handle, overlapped *Overlapped) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.end(pipe)
+	if err != nil {
+		return err
+	}
+	if !e.server {
+		return ERROR_INVALID_FUNCTION
+	}
+	if overlapped == nil {
+		return ERROR_INVALID_PARAMETER
+	}
+	inst := e.inst
+	switch inst.state {
+	case simConnected:
+		return ERROR_PIPE_CONNECTED
+	case simClosing:
+		return ERROR_NO_DATA
+	case simDisconnected:
+		inst.state = simListening
+		e.gone = ERROR_PIPE_LISTENING
+		s.notify()
+	}
+	if inst.connect != nil {
+		return ERROR_INVALID_PARAMETER
+	}
+	inst.connect = s.start(e, overlapped)
+	return ERROR_IO_PENDING
+}
+
+// DisconnectNamedPipe disconnects the client from the instance, discarding unread data
+func (s *Sim) DisconnectNamedPipe(pipe Handle) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.end(pipe)
+	if err != nil {
+		return err
+	}
+	if !e.server {
+		return ERROR_INVALID_FUNCTION
+	}
+	inst := e.inst
+	switch inst.state {
+	case simDisconnected:
+		return ERROR_PIPE_NOT_CONNECTED
+	case simListening:
+		if inst.connect != nil {
+			s.abort(inst.connect, ERROR_PIPE_NOT_CONNECTED)
+		}
+	case simConnected:
+		client := inst.client
+		inst.client = nil
+		client.inst = nil
+		s.peerGone(client, ERROR_PIPE_NOT_CONNECTED, true)
+	}
+	inst.state = simDisconnected
+	s.peerGone(e, ERROR_PIPE_NOT_CONNECTED, true)
+	return nil
+}
+
+// WaitNamedPipe waits until an instance of the pipe is available to clients
+func (s *Sim) WaitNamedPipe(name string, timeout uint32) error {
+	key, ok := simPipeName(name)
+	if !ok {
+		return ERROR_BAD_PATHNAME
+	}
+
+	var expired <-chan time.Time
+	for {
+		s.mu.Lock()
+		p := s.pipes[key]
+		if p == nil {
+			s.mu.Unlock()
+			return ERROR_FILE_NOT_FOUND
+		}
+		if p.listening() != nil {
+			s.mu.Unlock()
+			return nil
+		}
+		if expired == nil && timeout != NMPWAIT_WAIT_FOREVER {
+			wait := time.Duration(timeout) * time.Millisecond
+			if timeout == NMPWAIT_USE_DEFAULT_WAIT {
+				wait = p.defaultTimeout
+			}
+			expired = time.After(wait)
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-expired:
+			return ERROR_SEM_TIMEOUT
+		}
+	}
+}
+
+// CreateFile connects to an instance of the pipe that is available to clients
+func (s *Sim) CreateFile(name string, access, mode, createMode, attrs uint32) (Handle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := simPipeName(name)
+	if !ok {
+		return InvalidHandle, ERROR_FILE_NOT_FOUND
+	}
+	p := s.pipes[key]
+	if p == nil {
+		return InvalidHandle, ERROR_FILE_NOT_FOUND
+	}
+	inst := p.listening()
+	if inst == nil {
+		return InvalidHandle, ERROR_PIPE_BUSY
+	}
+
+	server := inst.server
+	client := &simEnd{inst: inst, peer: server}
+	server.in = &simQueue{capacity: p.inBufferSize}
+	server.out = &simQueue{capacity: p.outBufferSize}
+	client.in, client.out = server.out, server.in
+	server.peer = client
+	server.gone = nil
+	inst.client = client
+	inst.state = simConnected
+	if inst.connect != nil {
+		op := inst.connect
+		inst.connect = nil
+		s.complete(op, 0, nil)
+	}
+	return s.newHandle(client), nil
+}
+
+// ReadFile reads from the pipe. A read that can't complete immediately returns ERROR_IO_PENDING.
+func (s *Sim) ReadFile(handle Handle, buf []byte, done *uint32, overlapped *Overlapped) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.end(handle)
+	if err != nil {
+		return err
+	}
+	if overlapped == nil {
+		return ERROR_INVALID_PARAMETER
+	}
+	*done = 0
+	if len(e.reads) == 0 && e.in != nil && len(e.in.chunks) > 0 {
+		n, err := s.read(e.in, buf, e.readMessage)
+		*done = uint32(n)
+		return err
+	}
+	if e.peer == nil {
+		return e.gone
+	}
+	op := s.start(e, overlapped)
+	op.buf = buf
+	e.reads = append(e.reads, op)
+	return ERROR_IO_PENDING
+}
+
+// WriteFile writes to the pipe. A write that exceeds the reader's buffer quota returns ERROR_IO_PENDING and
+// completes once enough of the data was read.
+func (s *Sim) WriteFile(handle Handle, buf []byte, done *uint32, overlapped *Overlapped) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.end(handle)
+	if err != nil {
+		return err
+	}
+	if overlapped == nil {
+		return ERROR_INVALID_PARAMETER
+	}
+	*done = 0
+	if e.peer == nil {
+		if e.gone == ERROR_BROKEN_PIPE {
+			return ERROR_NO_DATA
+		}
+		return e.gone
+	}
+	if len(buf) == 0 && !e.inst.pipe.message {
+		return nil
+	}
+
+	chunk := &simChunk{data: append([]byte(nil), buf...), size: len(buf)}
+	e.out.chunks = append(e.out.chunks, chunk)
+	s.deliver(e.peer)
+	if e.out.unread() <= e.out.capacity || !e.out.contains(chunk) {
+		*done = uint32(len(buf))
+		return nil
+	}
+	op := s.start(e, overlapped)
+	op.chunk = chunk
+	op.queue = e.out
+	chunk.op = op
+	return ERROR_IO_PENDING
+}
+
+// CancelIoEx cancels the pending operations on the handle that use overlapped, or all of them including the waiting
+// FlushFileBuffers calls if it is nil
+func (s *Sim) CancelIoEx(handle Handle, overlapped *Overlapped) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.end(handle)
+	if err != nil {
+		return err
+	}
+	var cancel []*simOp
+	for _, op := range e.ops {
+		if overlapped == nil || s.ops[overlapped] == op {
+			cancel = append(cancel, op)
+		}
+	}
+	var flushes int
+	if overlapped == nil && e.out != nil {
+		flushes = len(e.out.flushes)
+		e.out.finishFlushes(ERROR_OPERATION_ABORTED)
+	}
+	if len(cancel) == 0 && flushes == 0 {
+		return ERROR_NOT_FOUND
+	}
+	for _, op := range cancel {
+		s.abort(op, ERROR_OPERATION_ABORTED)
+	}
+	return nil
+}
+
+// CreateEvent creates an event object
+func (s *Sim) CreateEvent(manualReset, initialState bool) (Handle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.newHandle(&simEvent{}), nil
+}
+
+// GetOverlappedResult returns the result of the last operation started with overlapped
+func (s *Sim) GetOverlappedResult(handle Handle, overlapped *Overlapped, done *uint32, wait bool) error {
+	s.mu.Lock()
+	op := s.ops[overlapped]
+	if op == nil {
+		s.mu.Unlock()
+		return ERROR_INVALID_PARAMETER
+	}
+	if !op.completed {
+		if !wait {
+			s.mu.Unlock()
+			return ERROR_IO_INCOMPLETE
+		}
+		s.mu.Unlock()
+		<-op.done
+		s.mu.Lock()
+	}
+	if s.ops[overlapped] == op {
+		delete(s.ops, overlapped)
+	}
+	s.mu.Unlock()
+
+	*done = op.n
+	return op.err
+}
+
+// CloseHandle closes the handle. Pending operations on a pipe end are aborted and its peer sees a broken pipe.
+func (s *Sim) CloseHandle(handle Handle) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.handles[handle]
+	if !ok {
+		return ERROR_INVALID_HANDLE
+	}
+	delete(s.handles, handle)
+	delete(s.owners, handle)
+	e, ok := obj.(*simEnd)
+	if !ok {
+		return nil
+	}
+
+	for len(e.ops) > 0 {
+		s.abort(e.ops[0], ERROR_OPERATION_ABORTED)
+	}
+	if e.out != nil {
+		e.out.finishFlushes(ERROR_INVALID_HANDLE)
+	}
+	inst := e.inst
+	if inst == nil {
+		// A client that was disconnected by the server
+		return nil
+	}
+	if e.server {
+		if inst.client != nil {
+			inst.client.inst = nil
+			s.peerGone(inst.client, ERROR_BROKEN_PIPE, false)
+		}
+		p := inst.pipe
+		for i, other := range p.instances {
+			if other == inst {
+				p.instances = append(p.instances[:i], p.instances[i+1:]...)
+				break
+			}
+		}
+		if len(p.instances) == 0 {
+			key, _ := simPipeName(p.name)
+			delete(s.pipes, key)
+		}
+		return nil
+	}
+	inst.client = nil
+	inst.state = simClosing
+	s.peerGone(inst.server, ERROR_BROKEN_PIPE, false)
+	return nil
+}
+
+// TransactNamedPipe writes in as one message and starts a read of the reply, which completes like a ReadFile
+func (s *Sim) TransactNamedPipe(handle Handle, in, out []byte, done *uint32, overlapped *Overlapped) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.end(handle)
+	if err != nil {
+		return err
+	}
+	if overlapped == nil {
+		return ERROR_INVALID_PARAMETER
+	}
+	*done = 0
+	if !e.readMessage {
+		return ERROR_BAD_PIPE
+	}
+	if e.in != nil && len(e.in.chunks) > 0 || len(e.reads) > 0 {
+		return ERROR_PIPE_BUSY
+	}
+	if e.peer == nil {
+		if e.gone == ERROR_BROKEN_PIPE {
+			return ERROR_NO_DATA
+		}
+		return e.gone
+	}
+
+	e.out.chunks = append(e.out.chunks, &simChunk{data: append([]byte(nil), in...), size: len(in)})
+	s.deliver(e.peer)
+	op := s.start(e, overlapped)
+	op.buf = out
+	e.reads = append(e.reads, op)
+	return ERROR_IO_PENDING
+}
+
+// SetNamedPipeHandleState switches the handle between byte and message read mode
+func (s *Sim) SetNamedPipeHandleState(handle Handle, mode uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.end(handle)
+	if err != nil {
+		return err
+	}
+	if e.inst == nil {
+		return ERROR_PIPE_NOT_CONNECTED
+	}
+	message := mode&PIPE_READMODE_MESSAGE != 0
+	if message && !e.inst.pipe.message {
+		return ERROR_INVALID_PARAMETER
+	}
+	e.readMessage = message
+	return nil
+}
+
+// GetNamedPipeInfo returns the type, buffer sizes, and instance limit of the pipe. The buffer sizes are reported from
+// the perspective of the handle, so a client's outgoing buffer is the server's incoming buffer.
+func (s *Sim) GetNamedPipeInfo(handle Handle, flags, outBufferSize, inBufferSize, maxInstances *uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.end(handle)
+	if err != nil {
+		return err
+	}
+	if e.inst == nil {
+		return ERROR_PIPE_NOT_CONNECTED
+	}
+	p := e.inst.pipe
+	if flags != nil {
+		*flags = 0
+		if e.server {
+			*flags |= PIPE_SERVER_END
+		}
+		if p.message {
+			*flags |= PIPE_TYPE_MESSAGE
+		}
+	}
+	out, in := p.outBufferSize, p.inBufferSize
+	if !e.server {
+		out, in = in, out
+	}
+	if outBufferSize != nil {
+		*outBufferSize = uint32(out)
+	}
+	if inBufferSize != nil {
+		*inBufferSize = uint32(in)
+	}
+	if maxInstances != nil {
+		*maxInstances = PIPE_UNLIMITED_INSTANCES
+		if p.maxInstances > 0 {
+			*maxInstances = uint32(p.maxInstances)
+		}
+	}
+	return nil
+}
+
+// GetNamedPipeHandleState returns the read mode of the handle and the number of instances of the pipe
+func (s *Sim) GetNamedPipeHandleState(handle Handle, state, curInstances *uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.end(handle)
+	if err != nil {
+		return err
+	}
+	if e.inst == nil {
+		return ERROR_PIPE_NOT_CONNECTED
+	}
+	if state != nil {
+		*state = PIPE_READMODE_BYTE
+		if e.readMessage {
+			*state = PIPE_READMODE_MESSAGE
+		}
+	}
+	if curInstances != nil {
+		*curInstances = uint32(len(e.inst.pipe.instances))
+	}
+	return nil
+}
+
+// FlushFileBuffers waits until the peer read everything written to the handle. It fails if the peer closes or is
+// disconnected first, or if the handle is closed.
+func (s *Sim) FlushFileBuffers(handle Handle) error {
+	s.mu.Lock()
+	e, err := s.end(handle)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if e.out == nil {
+		gone := e.gone
+		s.mu.Unlock()
+		if gone == ERROR_BROKEN_PIPE {
+			return ERROR_NO_DATA
+		}
+		return gone
+	}
+	if e.out.unread() == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	f := &simFlush{done: make(chan struct{})}
+	e.out.flushes = append(e.out.flushes, f)
+	s.mu.Unlock()
+	<-f.done
+	return f.err
+}
+
+// PeekNamedPipe copies the unread data into buf without consuming it. In message read mode only the current message
+// is copied and the rest of it is reported as left in the message.
+func (s *Sim) PeekNamedPipe(handle Handle, buf []byte, read, available, leftThisMessage *uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.end(handle)
+	if err != nil {
+		return err
+	}
+	*read, *available, *leftThisMessage = 0, 0, 0
+	if e.in == nil || len(e.in.chunks) == 0 {
+		if e.peer == nil {
+			return e.gone
+		}
+		return nil
+	}
+	var n int
+	for _, c := range e.in.chunks {
+		m := copy(buf[n:], c.data)
+		n += m
+		if e.readMessage {
+			*leftThisMessage = uint32(len(c.data) - m)
+			break
+		}
+		if n == len(buf) {
+			break
+		}
+	}
+	*read = uint32(n)
+	*available = uint32(e.in.unread())
+	return nil
+}
+
+// GetNamedPipeClientProcessId returns the process identifier of the client end of the pipe
+func (s *Sim) GetNamedPipeClientProcessId(handle Handle, pid *uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.end(handle)
+	if err != nil {
+		return err
+	}
+	if e.server {
+		e = e.peer
+	}
+	if e == nil || e.inst == nil {
+		return ERROR_PIPE_NOT_CONNECTED
+	}
+	*pid = e.pid
+	return nil
+}
+
+// GetNamedPipeServerProcessId returns the process identifier of the server end of the pipe
+func (s *Sim) GetNamedPipeServerProcessId(handle Handle, pid *uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.end(handle)
+	if err != nil {
+		return err
+	}
+	if e.inst == nil {
+		return ERROR_PIPE_NOT_CONNECTED
+	}
+	*pid = e.inst.server.pid
+	return nil
+}
+
+// OpenProcess opens a handle to the process for SimProcessID
+func (s *Sim) OpenProcess(access uint32, pid uint32) (Handle, error) {
+	return s.caller().OpenProcess(access, pid)
+}
+
+// DuplicateHandle duplicates source for SimProcessID
+func (s *Sim) DuplicateHandle(sourceProcess, source, targetProcess Handle, target *Handle, access uint32, inherit bool, options uint32) error {
+	return s.caller().DuplicateHandle(sourceProcess, source, targetProcess, target, access, inherit, options)
+}
+
+// caller returns the process the methods of Sim itself run in
+func (s *Sim) caller() *SimProcess {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.processes[SimProcessID]
+}
+
+// CreateNamedPipe creates an instance of a named pipe owned by the process
+func (p *SimProcess) CreateNamedPipe(name string, openMode, pipeMode, maxInstances, outBufferSize, inBufferSize, defaultTimeout uint32, sa interface{}) (Handle, error) {
+	h, err := p.Sim.CreateNamedPipe(name, openMode, pipeMode, maxInstances, outBufferSize, inBufferSize, defaultTimeout, sa)
+	return p.adopt(h, err)
+}
+
+// CreateFile connects the process to an instance of the pipe
+func (p *SimProcess) CreateFile(name string, access, mode, createMode, attrs uint32) (Handle, error) {
+	h, err := p.Sim.CreateFile(name, access, mode, createMode, attrs)
+	return p.adopt(h, err)
+}
+
+// CreateEvent creates an event object owned by the process
+func (p *SimProcess) CreateEvent(manualReset, initialState bool) (Handle, error) {
+	h, err := p.Sim.CreateEvent(manualReset, initialState)
+	return p.adopt(h, err)
+}
+
+// adopt gives a handle that was just created to the process
+func (p *SimProcess) adopt(handle Handle, err error) (Handle, error) {
+	if err != nil {
+		return handle, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.own(handle, p.pid)
+	return handle, nil
+}
+
+// OpenProcess opens a handle to another process. A sandboxed process is denied access to processes that are not.
+func (p *SimProcess) OpenProcess(access uint32, pid uint32) (Handle, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	target := p.processes[pid]
+	if target == nil {
+		return 0, ERROR_INVALID_PARAMETER
+	}
+	if p.sandboxed && !target.sandboxed {
+		return 0, ERROR_ACCESS_DENIED
+	}
+	h := p.newHandle(&simProcessObject{pid: pid, access: access})
+	p.own(h, p.pid)
+	return h, nil
+}
+
+// DuplicateHandle duplicates source, a handle of sourceProcess, into targetProcess. Only events and process handles
+// can be duplicated.
+func (p *SimProcess) DuplicateHandle(sourceProcess, source, targetProcess Handle, target *Handle, access uint32, inherit bool, options uint32) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	from, err := p.process(sourceProcess)
+	if err != nil {
+		return err
+	}
+	obj, ok := p.handles[source]
+	if !ok || p.owners[source] != from {
+		return ERROR_INVALID_HANDLE
+	}
+	switch obj.(type) {
+	case *simEvent, *simProcessObject:
+	default:
+		return ERROR_NOT_SUPPORTED
+	}
+	if targetProcess != 0 {
+		to, err := p.process(targetProcess)
+		if err != nil {
+			return err
+		}
+		h := p.newHandle(obj)
+		p.own(h, to)
+		*target = h
+	}
+	if options&DUPLICATE_CLOSE_SOURCE != 0 {
+		delete(p.handles, source)
+		delete(p.owners, source)
+	}
+	return nil
+}
+
+// process returns the identifier of the process behind a process handle of p, which must allow PROCESS_DUP_HANDLE
+func (p *SimProcess) process(handle Handle) (uint32, error) {
+	if handle == CurrentProcess {
+		return p.pid, nil
+	}
+	obj, ok := p.handles[handle].(*simProcessObject)
+	if !ok || p.owners[handle] != p.pid {
+		return 0, ERROR_INVALID_HANDLE
+	}
+	if obj.access&PROCESS_DUP_HANDLE == 0 {
+		return 0, ERROR_ACCESS_DENIED
+	}
+	return obj.pid, nil
+}
+
+// HandleOwner returns the identifier of the process that owns handle
+func (s *Sim) HandleOwner(handle Handle) (uint32, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pid, ok := s.owners[handle]
+	return pid, ok
+}
+
+// newHandle allocates a handle for obj, owned by SimProcessID until own gives it to another process
+func (s *Sim) newHandle(obj interface{}) Handle {
+	h := s.next
+	s.next += 4
+	s.handles[h] = obj
+	s.own(h, SimProcessID)
+	return h
+}
+
+// own makes pid the owner of handle and of the pipe end behind it
+func (s *Sim) own(handle Handle, pid uint32) {
+	s.owners[handle] = pid
+	if e, ok := s.handles[handle].(*simEnd); ok {
+		e.pid = pid
+	}
+}
+
+// end returns the pipe end behind handle
+func (s *Sim) end(handle Handle) (*simEnd, error) {
+	e, ok := s.handles[handle].(*simEnd)
+	if !ok {
+		return nil, ERROR_INVALID_HANDLE
+	}
+	return e, nil
+}
+
+// notify wakes the callers of WaitNamedPipe
+func (s *Sim) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// start registers a pending operation on e
+func (s *Sim) start(e *simEnd, overlapped *Overlapped) *simOp {
+	op := &simOp{end: e, done: make(chan struct{})}
+	e.ops = append(e.ops, op)
+	s.ops[overlapped] = op
+	return op
+}
+
+// complete records the result of op and wakes its waiters
+func (s *Sim) complete(op *simOp, n int, err error) {
+	if op.completed {
+		return
+	}
+	op.n = uint32(n)
+	op.err = err
+	op.completed = true
+	close(op.done)
+	ops := op.end.ops
+	for i, other := range ops {
+		if other == op {
+			op.end.ops = append(ops[:i], ops[i+1:]...)
+			break
+		}
+	}
+}
+
+// abort detaches op from whatever it was waiting for and completes it with err
+func (s *Sim) abort(op *simOp, err error) {
+	e := op.end
+	switch {
+	case op.chunk != nil:
+		op.queue.remove(op.chunk)
+		op.chunk.op = nil
+	case e.inst != nil && e.inst.connect == op:
+		e.inst.connect = nil
+	default:
+		for i, other := range e.reads {
+			if other == op {
+				e.reads = append(e.reads[:i], e.reads[i+1:]...)
+				break
+			}
+		}
+	}
+	s.complete(op, 0, err)
+}
+
+// peerGone updates e after its peer closed or was disconnected. Writes e had pending can never be read; unread data
+// is discarded when the instance was disconnected and can still be read when the peer closed its end.
+func (s *Sim) peerGone(e *simEnd, gone error, discard bool) {
+	writeErr := gone
+	if gone == ERROR_BROKEN_PIPE {
+		writeErr = ERROR_NO_DATA
+	}
+	if e.out != nil {
+		for _, c := range e.out.chunks {
+			if c.op != nil {
+				op := c.op
+				c.op = nil
+				s.complete(op, 0, writeErr)
+			}
+		}
+		e.out.finishFlushes(writeErr)
+	}
+	e.out = nil
+	if discard {
+		e.in = nil
+	}
+	e.peer = nil
+	e.gone = gone
+	s.deliver(e)
+}
+
+// deliver completes the pending reads of e that can be satisfied
+func (s *Sim) deliver(e *simEnd) {
+	for len(e.reads) > 0 {
+		op := e.reads[0]
+		if e.in != nil && len(e.in.chunks) > 0 {
+			e.reads = e.reads[1:]
+			n, err := s.read(e.in, op.buf, e.readMessage)
+			s.complete(op, n, err)
+			continue
+		}
+		if e.peer == nil {
+			e.reads = e.reads[1:]
+			s.complete(op, 0, e.gone)
+			continue
+		}
+		return
+	}
+}
+
+// read copies data from q into b, completing the writes whose data fits in the buffer quota afterwards. A message
+// that does not fit in b returns ERROR_MORE_DATA and the rest stays in q.
+func (s *Sim) read(q *simQueue, b []byte, message bool) (int, error) {
+	var n int
+	var err error
+	for len(q.chunks) > 0 {
+		c := q.chunks[0]
+		m := copy(b[n:], c.data)
+		n += m
+		c.data = c.data[m:]
+		if len(c.data) > 0 {
+			if message {
+				err = ERROR_MORE_DATA
+			}
+			break
+		}
+		q.chunks = q.chunks[1:]
+		if c.op != nil {
+			op := c.op
+			c.op = nil
+			s.complete(op, c.size, nil)
+		}
+		if message || n == len(b) {
+			break
+		}
+	}
+
+	unread := 0
+	for _, c := range q.chunks {
+		unread += len(c.data)
+		if c.op != nil && unread <= q.capacity {
+			op := c.op
+			c.op = nil
+			s.complete(op, c.size, nil)
+		}
+	}
+	if unread == 0 {
+		q.finishFlushes(nil)
+	}
+	return n, err
+}
+
+// listening returns an instance that is available to clients
+func (p *simPipe) listening() *simInstance {
+	for _, inst := range p.instances {
+		if inst.state == simListening {
+			return inst
+		}
+	}
+	return nil
+}
+
+// unread returns the number of bytes in q
+func (q *simQueue) unread() int {
+	var n int
+	for _, c := range q.chunks {
+		n += len(c.data)
+	}
+	return n
+}
+
+// finishFlushes completes the FlushFileBuffers calls waiting for q with err
+func (q *simQueue) finishFlushes(err error) {
+	for _, f := range q.flushes {
+		f.err = err
+		close(f.done)
+	}
+	q.flushes = nil
+}
+
+// contains reports whether c was not read completely yet
+func (q *simQueue) contains(c *simChunk) bool {
+	for _, other := range q.chunks {
+		if other == c {
+			return true
+		}
+	}
+	return false
+}
+
+// remove drops c from q
+func (q *simQueue) remove(c *simChunk) {
+	for i, other := range q.chunks {
+		if other == c {
+			q.chunks = append(q.chunks[:i], q.chunks[i+1:]...)
+			return
+		}
+	}
+}
+
+// simPipeName returns the case-insensitive key for a local pipe name
+func simPipeName(name string) (string, bool) {
+	const prefix = `\\.\pipe\`
+	key := strings.ToLower(name)
+	if !strings.HasPrefix(key, prefix) || len(key) == len(prefix) {
+		return "", false
+	}
+	return key, true
+}
@@ -0,0 +1,510 @@
+//go:build windows || linux
+
+package jsonrpc2
+
+import (
+	// Standard
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// readBufferSize is the size of the buffer a Conn reads messages into
+const readBufferSize = 64 * 1024
+
+// ErrClosed is returned by the calls of a Conn that was closed or whose peer hung up; Err tells which
+var ErrClosed = errors.New("jsonrpc2: connection closed")
+
+// Handler answers a request or notification received from the peer. The result is encoded as the response's result;
+// returning an *Error sends it as is, returning an error wrapping context.Canceled after the request's context was
+// cancelled sends CodeRequestCancelled, and any other error sends CodeInternalError with the error's text. The
+// return values of notifications are discarded.
+//
+// A Conn runs every request and notification in a goroutine of its own, so handlers run concurrently and in no
+// particular order. The context is cancelled when the peer cancels the request or the connection closes.
+type Handler func(ctx context.Context, conn *Conn, req *Request) (interface{}, error)
+
+// BatchCall is one entry of a batch sent with Conn.Batch
+type BatchCall struct {
+	Method string
+	Params interface{}
+	// Result receives the decoded result, unless it is nil
+	Result interface{}
+	// Notify sends the entry as a notification, which the peer doesn't answer
+	Notify bool
+	// Error is set after Batch returned: an *Error if the peer answered with one, or the error decoding the result
+	Error error
+
+	id       json.RawMessage
+	response chan *message
+}
+
+// Conn is a JSON-RPC connection to a peer. Both ends can send requests, and the requests received are passed to the
+// connection's handler.
+type Conn struct {
+	rwc     io.ReadWriteCloser
+	framing Framing
+	handler Handler
+
+	// writeMu serializes the frames written to rwc
+	writeMu sync.Mutex
+
+	mu     sync.Mutex
+	nextID int64
+	// pending holds the calls waiting for a response, running the cancel functions of the requests being handled,
+	// both by idKey
+	pending map[string]chan *message
+	running map[string]context.CancelFunc
+	err     error
+
+	// ctx is the parent of the handlers' contexts and is cancelled when the connection closes
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewConn starts a JSON-RPC connection over rwc, reading messages delimited by framing and passing the requests to
+// handler. A nil handler answers every request with CodeMethodNotFound. The connection owns rwc and closes it when
+// it closes.
+func NewConn(rwc io.ReadWriteCloser, framing Framing, handler Handler) *Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Conn{
+		rwc:     rwc,
+		framing: framing,
+		handler: handler,
+		pending: make(map[string]chan *message),
+		running: make(map[string]context.CancelFunc),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// Call sends a request and decodes the result of the response into result, unless it is nil. If the peer answers
+// with an error Call returns it as an *Error. If ctx is done before the response arrives Call sends a
+// "$/cancelRequest" notification for the request and returns ctx.Err().
+func (c *Conn) Call(ctx context.Context, method string, params, result interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	id, response, err := c.register()
+	if err != nil {
+		return err
+	}
+	msg, err := newRequest(id, method, params)
+	if err == nil {
+		err = c.send(msg)
+	}
+	if err != nil {
+		c.unregister(id)
+		return fmt.Errorf("jsonrpc2.Conn.Call(): %s", err)
+	}
+
+	select {
+	case resp := <-response:
+		return callResult(method, resp, result)
+	case <-ctx.Done():
+		c.unregister(id)
+		go c.cancelRequests(id)
+		return ctx.Err()
+	case <-c.done:
+		c.unregister(id)
+		// The response may have arrived just before the connection closed
+		select {
+		case resp := <-response:
+			return callResult(method, resp, result)
+		default:
+			return ErrClosed
+		}
+	}
+}
+
+// callResult returns the error of the response to a Call or decodes its result into result
+func callResult(method string, resp *message, result interface{}) error {
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if err := decodeResult(resp, result); err != nil {
+		return fmt.Errorf("jsonrpc2.Conn.Call(): decoding the result of %s failed: %s", method, err)
+	}
+	return nil
+}
+
+// Notify sends a notification, which the peer doesn't answer. It returns ctx.Err() if ctx is done before the
+// notification is sent.
+func (c *Conn) Notify(ctx context.Context, method string, params interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	msg, err := newRequest(nil, method, params)
+	if err == nil {
+		err = c.send(msg)
+	}
+	if err != nil {
+		return fmt.Errorf("jsonrpc2.Conn.Notify(): %s", err)
+	}
+	return nil
+}
+
+// Batch sends calls as one batch and waits for the responses to all of its requests. The outcome of every entry is
+// stored in its Result and Error; Batch itself only returns an error if the batch couldn't be sent, ctx is done before
+// all responses arrived, or the connection closed.
+func (c *Conn) Batch(ctx context.Context, calls []*BatchCall) error {
+	if len(calls) == 0 {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var ids []json.RawMessage
+	defer func() {
+		for _, id := range ids {
+			c.unregister(id)
+		}
+	}()
+	batch := make([]*message, len(calls))
+	for i, call := range calls {
+		call.id, call.response, call.Error = nil, nil, nil
+		if !call.Notify {
+			id, response, err := c.register()
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+			call.id, call.response = id, response
+		}
+		msg, err := newRequest(call.id, call.Method, call.Params)
+		if err != nil {
+			return fmt.Errorf("jsonrpc2.Conn.Batch(): %s", err)
+		}
+		batch[i] = msg
+	}
+	if err := c.send(batch); err != nil {
+		return fmt.Errorf("jsonrpc2.Conn.Batch(): %s", err)
+	}
+
+	for i, call := range calls {
+		if call.Notify {
+			continue
+		}
+		select {
+		case resp := <-call.response:
+			if resp.Error != nil {
+				call.Error = resp.Error
+			} else if err := decodeResult(resp, call.Result); err != nil {
+				call.Error = fmt.Errorf("decoding the result of %s failed: %s", call.Method, err)
+			}
+		case <-ctx.Done():
+			var outstanding []json.RawMessage
+			for _, call := range calls[i:] {
+				if !call.Notify {
+					outstanding = append(outstanding, call.id)
+				}
+			}
+			go c.cancelRequests(outstanding...)
+			return ctx.Err()
+		case <-c.done:
+			return ErrClosed
+		}
+	}
+	return nil
+}
+
+// decodeResult decodes the result of a response into result, unless it is nil
+func decodeResult(resp *message, result interface{}) error {
+	if result == nil || resp.Result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// cancelRequests asks the peer to cancel the requests with the provided IDs
+func (c *Conn) cancelRequests(ids ...json.RawMessage) {
+	for _, id := range ids {
+		msg, err := newRequest(nil, cancelMethod, struct {
+			ID json.RawMessage `json:"id"`
+		}{id})
+		if err != nil || c.send(msg) != nil {
+			return
+		}
+	}
+}
+
+// Close closes the connection and its ReadWriteCloser. Pending calls return ErrClosed and the contexts of the running
+// handlers are cancelled.
+func (c *Conn) Close() error {
+	if !c.shutdown(ErrClosed) {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Done returns a channel that is closed once the connection closed
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection closed: ErrClosed after Close, io.EOF if the peer hung up, or the error that broke
+// the connection. It returns nil while the connection is open.
+func (c *Conn) Err() error {
+	select {
+	case <-c.done:
+	default:
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// shutdown closes the connection for the provided reason and returns false if it was already closed
+func (c *Conn) shutdown(err error) bool {
+	closed := false
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		close(c.done)
+		c.cancel()
+		c.rwc.Close()
+		closed = true
+	})
+	return closed
+}
+
+// register allocates the ID of a request and the channel its response is delivered to
+func (c *Conn) register() (json.RawMessage, chan *message, error) {
+	select {
+	case <-c.done:
+		return nil, nil, ErrClosed
+	default:
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	id := json.RawMessage(strconv.FormatInt(c.nextID, 10))
+	response := make(chan *message, 1)
+	c.pending[idKey(id)] = response
+	return id, response, nil
+}
+
+// unregister stops waiting for the response to a request
+func (c *Conn) unregister(id json.RawMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, idKey(id))
+}
+
+// send encodes v, a message or a batch of them, and writes it as one frame. A failed write closes the connection
+// because the peer may have received part of the frame.
+func (c *Conn) send(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	frame := appendFrame(nil, c.framing, b)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	if _, err := c.rwc.Write(frame); err != nil {
+		c.shutdown(err)
+		return err
+	}
+	return nil
+}
+
+// readLoop reads and dispatches the messages from the peer until the connection closes
+func (c *Conn) readLoop() {
+	r := bufio.NewReaderSize(streamReader{c.rwc}, readBufferSize)
+	for {
+		b, err := readFrame(r, c.framing)
+		if err != nil {
+			if err != io.EOF {
+				err = fmt.Errorf("jsonrpc2: reading a message failed: %s", err)
+			}
+			c.shutdown(err)
+			return
+		}
+		c.dispatch(b)
+	}
+}
+
+// dispatch handles a message or batch read from the peer. Responses are delivered to the waiting calls right away;
+// requests are registered for cancellation and then handled in a goroutine. Nothing is written from the read loop so
+// it keeps reading while the peer's buffer is full.
+func (c *Conn) dispatch(b []byte) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 || b[0] != '[' {
+		if !json.Valid(b) {
+			go c.send(newResponse(nullID, nil, &Error{Code: CodeParseError, Message: "parse error"}))
+			return
+		}
+		if run := c.prepare(b); run != nil {
+			go func() {
+				if resp := run(); resp != nil {
+					c.send(resp)
+				}
+			}()
+		}
+		return
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(b, &batch); err != nil {
+		go c.send(newResponse(nullID, nil, &Error{Code: CodeParseError, Message: "parse error"}))
+		return
+	}
+	if len(batch) == 0 {
+		go c.send(newResponse(nullID, nil, &Error{Code: CodeInvalidRequest, Message: "empty batch"}))
+		return
+	}
+	var runs []func() *message
+	for _, raw := range batch {
+		if run := c.prepare(raw); run != nil {
+			runs = append(runs, run)
+		}
+	}
+	if len(runs) == 0 {
+		return
+	}
+	go func() {
+		responses := make([]*message, len(runs))
+		var wg sync.WaitGroup
+		for i, run := range runs {
+			wg.Add(1)
+			go func(i int, run func() *message) {
+				defer wg.Done()
+				responses[i] = run()
+			}(i, run)
+		}
+		wg.Wait()
+		var batch []*message
+		for _, resp := range responses {
+			if resp != nil {
+				batch = append(batch, resp)
+			}
+		}
+		if len(batch) > 0 {
+			c.send(batch)
+		}
+	}()
+}
+
+// prepare handles a single message of the peer. Responses and cancellations are handled right away and return nil;
+// for requests and notifications it returns the function that runs the handler and returns the response to send,
+// nil for notifications. Invalid requests return a function that returns the error response.
+func (c *Conn) prepare(raw json.RawMessage) func() *message {
+	invalid := func(id json.RawMessage, text string) func() *message {
+		if id == nil {
+			id = nullID
+		}
+		return func() *message {
+			return newResponse(id, nil, &Error{Code: CodeInvalidRequest, Message: text})
+		}
+	}
+
+	var m message
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return invalid(nil, "invalid request: the message is not a request object")
+	}
+	if m.ID != nil && !validID(m.ID) {
+		return invalid(nil, "invalid request: the id must be a string, a number, or null")
+	}
+	if m.JSONRPC != Version {
+		return invalid(m.ID, fmt.Sprintf("invalid request: unsupported version %q", m.JSONRPC))
+	}
+	if m.isResponse() {
+		c.deliver(&m)
+		return nil
+	}
+	if m.Method == "" {
+		return invalid(m.ID, "invalid request: the method is missing")
+	}
+
+	req := &Request{Method: m.Method, Params: m.Params, ID: m.ID}
+	if req.IsNotification() && req.Method == cancelMethod {
+		var params struct {
+			ID json.RawMessage `json:"id"`
+		}
+		if json.Unmarshal(req.Params, &params) == nil && params.ID != nil {
+			c.mu.Lock()
+			cancel := c.running[idKey(params.ID)]
+			c.mu.Unlock()
+			if cancel != nil {
+				cancel()
+			}
+		}
+		return nil
+	}
+
+	// The cancel function is registered before the handler runs so a cancellation that arrives right after the
+	// request can't be missed
+	ctx, cancel := context.WithCancel(c.ctx)
+	if !req.IsNotification() {
+		c.mu.Lock()
+		c.running[idKey(req.ID)] = cancel
+		c.mu.Unlock()
+	}
+	return func() *message {
+		defer func() {
+			if !req.IsNotification() {
+				c.mu.Lock()
+				delete(c.running, idKey(req.ID))
+				c.mu.Unlock()
+			}
+			cancel()
+		}()
+		var result interface{}
+		var err error
+		if c.handler == nil {
+			err = ErrMethodNotFound
+		} else {
+			result, err = c.handler(ctx, c, req)
+		}
+		if req.IsNotification() {
+			return nil
+		}
+		if err != nil && ctx.Err() != nil && errors.Is(err, context.Canceled) {
+			err = &Error{Code: CodeRequestCancelled, Message: "request cancelled"}
+		}
+		return newResponse(req.ID, result, err)
+	}
+}
+
+// deliver passes a response to the call waiting for it; responses nobody waits for are dropped
+func (c *Conn) deliver(m *message) {
+	c.mu.Lock()
+	response := c.pending[idKey(m.ID)]
+	delete(c.pending, idKey(m.ID))
+	c.mu.Unlock()
+	if response != nil {
+		response <- m
+	}
+}
+
+// validID reports whether id is a string, a number, or null as JSON-RPC requires
+func validID(id json.RawMessage) bool {
+	var v interface{}
+	if json.Unmarshal(id, &v) != nil {
+		return false
+	}
+	switch v.(type) {
+	case nil, string, float64:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,269 @@
+//go:build windows || linux
+
+// Package jsonrpc2 speaks JSON-RPC 2.0 over pipes, for clients that can't use the gob codec of net/rpc.
+//
+// Both ends of a Conn are peers: either can send requests and notifications, and the requests each end receives are
+// passed to its Handler. A server serves every client of a pipe with one handler:
+//
+//	err := jsonrpc2.ListenAndServe(`\\.\pipe\rpc`, jsonrpc2.Lines, func(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (interface{}, error) {
+//		switch req.Method {
+//		case "add":
+//			var args [2]int
+//			if err := json.Unmarshal(req.Params, &args); err != nil {
+//				return nil, &jsonrpc2.Error{Code: jsonrpc2.CodeInvalidParams, Message: err.Error()}
+//			}
+//			return args[0] + args[1], nil
+//		}
+//		return nil, jsonrpc2.ErrMethodNotFound
+//	})
+//
+// and a client calls it:
+//
+//	conn, err := jsonrpc2.Dial(`\\.\pipe\rpc`, jsonrpc2.Lines, nil)
+//	var sum int
+//	err = conn.Call(ctx, "add", []int{1, 2}, &sum)
+//
+// Messages are delimited by newlines (Lines) or preceded by a Content-Length header like the Language Server
+// Protocol uses (ContentLength). Cancelling the context of a call sends a "$/cancelRequest" notification, which
+// cancels the context of the handler serving the request on the other end.
+package jsonrpc2
+
+import (
+	// Standard
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// Version is the protocol version sent in every message
+const Version = "2.0"
+
+// MaxMessageSize is the largest message a Conn reads
+const MaxMessageSize = 16 << 20
+
+// cancelMethod is the notification that cancels a request, as in the Language Server Protocol
+const cancelMethod = "$/cancelRequest"
+
+// Error codes defined by JSON-RPC 2.0, and CodeRequestCancelled of the Language Server Protocol
+const (
+	CodeParseError       = -32700
+	CodeInvalidRequest   = -32600
+	CodeMethodNotFound   = -32601
+	CodeInvalidParams    = -32602
+	CodeInternalError    = -32603
+	CodeRequestCancelled = -32800
+)
+
+// Error is a JSON-RPC error object. Handlers return it to send a specific code; calls return it when the peer
+// answers with an error.
+type Error struct {
+	Code    int64           `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	return fmt.Sprintf("jsonrpc2: error %d: %s", e.Code, e.Message)
+}
+
+// ErrMethodNotFound is the error handlers return for methods they don't implement
+var ErrMethodNotFound = &Error{Code: CodeMethodNotFound, Message: "method not found"}
+
+// Framing selects how messages are delimited on the stream
+type Framing int
+
+const (
+	// Lines puts every message on a line of its own, like JSON Lines
+	Lines Framing = iota
+	// ContentLength precedes every message with a Content-Length header and a blank line, like the Language Server
+	// Protocol
+	ContentLength
+)
+
+// String returns the name of the framing
+func (f Framing) String() string {
+	switch f {
+	case Lines:
+		return "lines"
+	case ContentLength:
+		return "content-length"
+	default:
+		return "Framing(" + strconv.Itoa(int(f)) + ")"
+	}
+}
+
+// streamReader reads a pipe as a stream of bytes, ignoring the message boundaries of message mode pipes
+type streamReader struct {
+	r io.Reader
+}
+
+// Read implements the io.Reader interface
+func (s streamReader) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	if err == npipe.ErrMoreData {
+		err = nil
+	}
+	return n, err
+}
+
+// readFrame reads the next message from r
+func readFrame(r *bufio.Reader, framing Framing) ([]byte, error) {
+	switch framing {
+	case Lines:
+		for {
+			line, err := readLine(r)
+			if err != nil {
+				return nil, err
+			}
+			if line = bytes.TrimSpace(line); len(line) > 0 {
+				return line, nil
+			}
+		}
+	case ContentLength:
+		length := -1
+		for {
+			line, err := readLine(r)
+			if err != nil {
+				return nil, err
+			}
+			line = bytes.TrimRight(line, "\r\n")
+			if len(line) == 0 {
+				break
+			}
+			name, value, ok := strings.Cut(string(line), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid header line %q", line)
+			}
+			if strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+				if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil || length < 0 {
+					return nil, fmt.Errorf("invalid Content-Length %q", value)
+				}
+			}
+		}
+		if length < 0 {
+			return nil, fmt.Errorf("the message has no Content-Length header")
+		}
+		if length > MaxMessageSize {
+			return nil, fmt.Errorf("the %d byte message exceeds the limit of %d bytes", length, MaxMessageSize)
+		}
+		msg := make([]byte, length)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		return msg, nil
+	}
+	return nil, fmt.Errorf("unknown framing %s", framing)
+}
+
+// readLine reads a line of at most MaxMessageSize bytes including the newline. A final line without a newline is
+// returned too.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > MaxMessageSize {
+			return nil, fmt.Errorf("the line exceeds the limit of %d bytes", MaxMessageSize)
+		}
+		line = append(line, chunk...)
+		switch {
+		case err == nil:
+			return line, nil
+		case err == io.EOF && len(line) > 0:
+			return line, nil
+		case err != bufio.ErrBufferFull:
+			return nil, err
+		}
+	}
+}
+
+// appendFrame appends the framed message to b
+func appendFrame(b []byte, framing Framing, msg []byte) []byte {
+	if framing == ContentLength {
+		b = append(b, "Content-Length: "...)
+		b = strconv.AppendInt(b, int64(len(msg)), 10)
+		b = append(b, "\r\n\r\n"...)
+		return append(b, msg...)
+	}
+	b = append(b, msg...)
+	return append(b, '\n')
+}
+
+// Request is a request or a notification received from the peer
+type Request struct {
+	Method string
+	Params json.RawMessage
+	// ID is the request's ID, nil for notifications
+	ID json.RawMessage
+}
+
+// IsNotification reports whether the peer expects no response
+func (r *Request) IsNotification() bool {
+	return r.ID == nil
+}
+
+// message is any JSON-RPC message; which fields are set tells requests, notifications, and responses apart
+type message struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// isResponse reports whether the message answers a request
+func (m *message) isResponse() bool {
+	return m.Method == "" && (m.Result != nil || m.Error != nil)
+}
+
+// nullID is the ID of responses to requests whose ID couldn't be read
+var nullID = json.RawMessage("null")
+
+// newRequest encodes a request, or a notification if id is nil
+func newRequest(id json.RawMessage, method string, params interface{}) (*message, error) {
+	m := &message{JSONRPC: Version, ID: id, Method: method}
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return nil, fmt.Errorf("encoding the parameters of %s failed: %s", method, err)
+		}
+		m.Params = b
+	}
+	return m, nil
+}
+
+// newResponse encodes the result or the error of a handler
+func newResponse(id json.RawMessage, result interface{}, err error) *message {
+	m := &message{JSONRPC: Version, ID: id}
+	if err == nil {
+		b, merr := json.Marshal(result)
+		if merr == nil {
+			m.Result = b
+			return m
+		}
+		err = fmt.Errorf("encoding the result failed: %s", merr)
+	}
+	var rpcErr *Error
+	if !errors.As(err, &rpcErr) {
+		rpcErr = &Error{Code: CodeInternalError, Message: err.Error()}
+	}
+	m.Error = rpcErr
+	return m
+}
+
+// idKey returns the key of an ID in the maps of pending calls and running handlers
+func idKey(id json.RawMessage) string {
+	return string(bytes.TrimSpace(id))
+}
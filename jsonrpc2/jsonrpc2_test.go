@@ -0,0 +1,454 @@
+//go:build windows || linux
+
+package jsonrpc2
+
+import (
+	// Standard
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// framings are the framings every test runs with
+var framings = []Framing{Lines, ContentLength}
+
+// arith answers add, fail, and slow requests and records the notifications it receives
+func arith(notes chan<- string) Handler {
+	return func(ctx context.Context, conn *Conn, req *Request) (interface{}, error) {
+		if req.IsNotification() {
+			if notes != nil {
+				notes <- req.Method + " " + string(req.Params)
+			}
+			return nil, nil
+		}
+		switch req.Method {
+		case "add":
+			var args [2]int
+			if err := json.Unmarshal(req.Params, &args); err != nil {
+				return nil, &Error{Code: CodeInvalidParams, Message: err.Error()}
+			}
+			return args[0] + args[1], nil
+		case "fail":
+			return nil, errors.New("it broke")
+		case "nothing":
+			return nil, nil
+		case "slow":
+			<-ctx.Done()
+			if notes != nil {
+				notes <- "cancelled " + string(req.ID)
+			}
+			return nil, ctx.Err()
+		}
+		return nil, ErrMethodNotFound
+	}
+}
+
+// pair connects a client and a server Conn over net.Pipe
+func pair(t *testing.T, framing Framing, client, server Handler) (*Conn, *Conn) {
+	a, b := net.Pipe()
+	cc := NewConn(a, framing, client)
+	sc := NewConn(b, framing, server)
+	t.Cleanup(func() {
+		cc.Close()
+		sc.Close()
+	})
+	return cc, sc
+}
+
+// raw connects a server Conn to a net.Conn the test writes frames to and reads frames from
+func raw(t *testing.T, framing Framing, server Handler) (net.Conn, *bufio.Reader) {
+	a, b := net.Pipe()
+	sc := NewConn(b, framing, server)
+	t.Cleanup(func() {
+		a.Close()
+		sc.Close()
+	})
+	return a, bufio.NewReader(a)
+}
+
+// exchange writes a frame to conn and returns the next frame read from r
+func exchange(t *testing.T, conn net.Conn, r *bufio.Reader, framing Framing, msg string) string {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(appendFrame(nil, framing, []byte(msg))); err != nil {
+		t.Fatalf("writing %s: %v", msg, err)
+	}
+	b, err := readFrame(r, framing)
+	if err != nil {
+		t.Fatalf("reading the response to %s: %v", msg, err)
+	}
+	return string(b)
+}
+
+// TestCall calls methods that succeed, fail, and don't exist
+func TestCall(t *testing.T) {
+	for _, framing := range framings {
+		t.Run(framing.String(), func(t *testing.T) {
+			client, _ := pair(t, framing, nil, arith(nil))
+			ctx := context.Background()
+
+			var sum int
+			if err := client.Call(ctx, "add", []int{2, 3}, &sum); err != nil || sum != 5 {
+				t.Errorf("Call(add) = %d, %v; want 5", sum, err)
+			}
+			if err := client.Call(ctx, "nothing", nil, nil); err != nil {
+				t.Errorf("Call(nothing): %v", err)
+			}
+
+			tests := []struct {
+				method string
+				params interface{}
+				code   int64
+			}{
+				{"add", "two and three", CodeInvalidParams},
+				{"fail", nil, CodeInternalError},
+				{"missing", nil, CodeMethodNotFound},
+			}
+			for _, test := range tests {
+				err := client.Call(ctx, test.method, test.params, &sum)
+				var rpcErr *Error
+				if !errors.As(err, &rpcErr) || rpcErr.Code != test.code {
+					t.Errorf("Call(%s) = %v; want error code %d", test.method, err, test.code)
+				}
+			}
+
+			var s string
+			if err := client.Call(ctx, "add", []int{1, 1}, &s); err == nil {
+				t.Error("Call(add) decoded a number into a string")
+			}
+		})
+	}
+}
+
+// TestConcurrentCalls runs calls from many goroutines over one connection
+func TestConcurrentCalls(t *testing.T) {
+	client, _ := pair(t, Lines, nil, arith(nil))
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var sum int
+			if err := client.Call(context.Background(), "add", []int{i, i}, &sum); err != nil || sum != 2*i {
+				t.Errorf("Call(add, %d, %d) = %d, %v", i, i, sum, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// TestNotify sends notifications, which reach the handler and aren't answered
+func TestNotify(t *testing.T) {
+	for _, framing := range framings {
+		t.Run(framing.String(), func(t *testing.T) {
+			notes := make(chan string, 1)
+			client, _ := pair(t, framing, nil, arith(notes))
+			if err := client.Notify(context.Background(), "progress", map[string]int{"percent": 50}); err != nil {
+				t.Fatalf("Notify(): %v", err)
+			}
+			if note := <-notes; note != `progress {"percent":50}` {
+				t.Errorf("the handler received %q", note)
+			}
+			var sum int
+			if err := client.Call(context.Background(), "add", []int{1, 2}, &sum); err != nil || sum != 3 {
+				t.Errorf("Call(add) after Notify() = %d, %v", sum, err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if err := client.Notify(ctx, "progress", nil); err != context.Canceled {
+				t.Errorf("Notify() with a cancelled context = %v; want %v", err, context.Canceled)
+			}
+		})
+	}
+}
+
+// TestBatch sends a batch of calls and notifications
+func TestBatch(t *testing.T) {
+	for _, framing := range framings {
+		t.Run(framing.String(), func(t *testing.T) {
+			notes := make(chan string, 1)
+			client, _ := pair(t, framing, nil, arith(notes))
+			var sum1, sum2 int
+			calls := []*BatchCall{
+				{Method: "add", Params: []int{1, 2}, Result: &sum1},
+				{Method: "done", Params: "batch", Notify: true},
+				{Method: "missing"},
+				{Method: "add", Params: []int{3, 4}, Result: &sum2},
+			}
+			if err := client.Batch(context.Background(), calls); err != nil {
+				t.Fatalf("Batch(): %v", err)
+			}
+			if sum1 != 3 || sum2 != 7 || calls[0].Error != nil || calls[3].Error != nil {
+				t.Errorf("Batch() results are %d (%v) and %d (%v); want 3 and 7", sum1, calls[0].Error, sum2, calls[3].Error)
+			}
+			var rpcErr *Error
+			if !errors.As(calls[2].Error, &rpcErr) || rpcErr.Code != CodeMethodNotFound {
+				t.Errorf("the missing method's error is %v", calls[2].Error)
+			}
+			if calls[1].Error != nil {
+				t.Errorf("the notification's error is %v", calls[1].Error)
+			}
+			if note := <-notes; note != `done "batch"` {
+				t.Errorf("the handler received %q", note)
+			}
+
+			if err := client.Batch(context.Background(), []*BatchCall{{Method: "done", Notify: true}}); err != nil {
+				t.Errorf("Batch() of a notification: %v", err)
+			}
+			<-notes
+			if err := client.Batch(context.Background(), nil); err != nil {
+				t.Errorf("Batch(nil): %v", err)
+			}
+		})
+	}
+}
+
+// TestServerToClient calls back into the client from the handler of the client's request
+func TestServerToClient(t *testing.T) {
+	clientHandler := func(ctx context.Context, conn *Conn, req *Request) (interface{}, error) {
+		if req.Method != "name" {
+			return nil, ErrMethodNotFound
+		}
+		return "client", nil
+	}
+	serverHandler := func(ctx context.Context, conn *Conn, req *Request) (interface{}, error) {
+		var name string
+		if err := conn.Call(ctx, "name", nil, &name); err != nil {
+			return nil, err
+		}
+		return "hello " + name, nil
+	}
+	client, server := pair(t, Lines, clientHandler, serverHandler)
+
+	var greeting string
+	if err := client.Call(context.Background(), "greet", nil, &greeting); err != nil || greeting != "hello client" {
+		t.Errorf("Call(greet) = %q, %v; want hello client", greeting, err)
+	}
+	var name string
+	if err := server.Call(context.Background(), "name", nil, &name); err != nil || name != "client" {
+		t.Errorf("Call(name) from the server = %q, %v", name, err)
+	}
+}
+
+// TestCancel cancels calls and checks that the handlers' contexts are cancelled
+func TestCancel(t *testing.T) {
+	notes := make(chan string, 4)
+	client, _ := pair(t, Lines, nil, arith(notes))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.Call(ctx, "slow", nil, nil); err != context.DeadlineExceeded {
+		t.Errorf("Call(slow) = %v; want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case note := <-notes:
+		if note != "cancelled 1" {
+			t.Errorf("the handler reported %q", note)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler's context wasn't cancelled")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	calls := []*BatchCall{{Method: "add", Params: []int{1, 1}}, {Method: "slow"}, {Method: "slow"}}
+	if err := client.Batch(ctx, calls); err != context.DeadlineExceeded {
+		t.Errorf("Batch() = %v; want %v", err, context.DeadlineExceeded)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-notes:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the batch's handlers weren't cancelled")
+		}
+	}
+}
+
+// TestCancelledResponse checks that a handler returning the cancellation error answers CodeRequestCancelled
+func TestCancelledResponse(t *testing.T) {
+	conn, r := raw(t, Lines, arith(nil))
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(`{"jsonrpc":"2.0","id":"a","method":"slow"}` + "\n" +
+		`{"jsonrpc":"2.0","method":"$/cancelRequest","params":{"id":"a"}}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := readFrame(r, Lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf(`{"jsonrpc":"2.0","id":"a","error":{"code":%d,"message":"request cancelled"}}`, CodeRequestCancelled)
+	if string(b) != want {
+		t.Errorf("the response is %s; want %s", b, want)
+	}
+}
+
+// TestClose closes connections with calls in flight
+func TestClose(t *testing.T) {
+	client, server := pair(t, Lines, nil, arith(nil))
+	failed := make(chan error, 1)
+	go func() {
+		failed <- client.Call(context.Background(), "slow", nil, nil)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := server.Close(); err != nil {
+		t.Fatalf("Close(): %v", err)
+	}
+	if err := server.Close(); err != ErrClosed {
+		t.Errorf("the second Close() = %v; want %v", err, ErrClosed)
+	}
+	if err := <-failed; err != ErrClosed {
+		t.Errorf("the pending Call() = %v; want %v", err, ErrClosed)
+	}
+	<-client.Done()
+	if err := client.Err(); err != io.EOF {
+		t.Errorf("the client's Err() = %v; want %v", err, io.EOF)
+	}
+	if err := server.Err(); err != ErrClosed {
+		t.Errorf("the server's Err() = %v; want %v", err, ErrClosed)
+	}
+	if err := client.Call(context.Background(), "add", []int{1, 2}, nil); err != ErrClosed {
+		t.Errorf("Call() after the peer closed = %v; want %v", err, ErrClosed)
+	}
+}
+
+// closedAfterWrite is a connection whose writes return only once the Conn using it was closed, so a Call finds its
+// response and the closed connection at the same time
+type closedAfterWrite struct {
+	net.Conn
+	done <-chan struct{}
+}
+
+func (c *closedAfterWrite) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	<-c.done
+	return n, err
+}
+
+// TestResponseBeforeClose tests that a Call returns the response the peer sent right before it closed the connection
+func TestResponseBeforeClose(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		a, b := net.Pipe()
+		done := make(chan struct{})
+		client := NewConn(&closedAfterWrite{Conn: a, done: done}, Lines, nil)
+		go func() {
+			<-client.Done()
+			close(done)
+		}()
+		go func() {
+			if _, err := readFrame(bufio.NewReader(b), Lines); err == nil {
+				b.Write(appendFrame(nil, Lines, []byte(`{"jsonrpc":"2.0","id":1,"result":3}`)))
+			}
+			b.Close()
+		}()
+
+		var sum int
+		if err := client.Call(context.Background(), "add", []int{1, 2}, &sum); err != nil || sum != 3 {
+			t.Fatalf("Call() answered right before the peer closed = %d, %v; want 3", sum, err)
+		}
+	}
+}
+
+// TestProtocolErrors sends malformed messages and checks the error responses
+func TestProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		want string
+	}{
+		{"parse error", `{"jsonrpc":"2.0",`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"parse error"}}`},
+		{"parse error in batch", `[{"jsonrpc":"2.0"},`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"parse error"}}`},
+		{"empty batch", `[]`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"empty batch"}}`},
+		{"not an object", `1`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"invalid request: the message is not a request object"}}`},
+		{"version", `{"jsonrpc":"1.0","id":1,"method":"add"}`, `{"jsonrpc":"2.0","id":1,"error":{"code":-32600,"message":"invalid request: unsupported version \"1.0\""}}`},
+		{"method", `{"jsonrpc":"2.0","id":2}`, `{"jsonrpc":"2.0","id":2,"error":{"code":-32600,"message":"invalid request: the method is missing"}}`},
+		{"id", `{"jsonrpc":"2.0","id":{},"method":"add"}`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"invalid request: the id must be a string, a number, or null"}}`},
+		{"batch", `[1,{"jsonrpc":"2.0","method":"note"},{"jsonrpc":"2.0","id":"x","method":"add","params":[1,2]}]`,
+			`[{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"invalid request: the message is not a request object"}},{"jsonrpc":"2.0","id":"x","result":3}]`},
+		{"null id", `{"jsonrpc":"2.0","id":null,"method":"nothing"}`, `{"jsonrpc":"2.0","id":null,"result":null}`},
+	}
+	for _, framing := range framings {
+		t.Run(framing.String(), func(t *testing.T) {
+			conn, r := raw(t, framing, arith(nil))
+			for _, test := range tests {
+				if got := exchange(t, conn, r, framing, test.msg); got != test.want {
+					t.Errorf("%s: the response is %s; want %s", test.name, got, test.want)
+				}
+			}
+			// A batch of notifications isn't answered, so the next frame answers the following request
+			if _, err := conn.Write(appendFrame(nil, framing, []byte(`[{"jsonrpc":"2.0","method":"a"},{"jsonrpc":"2.0","method":"b"}]`))); err != nil {
+				t.Fatal(err)
+			}
+			got := exchange(t, conn, r, framing, `{"jsonrpc":"2.0","id":3,"method":"add","params":[1,1]}`)
+			if want := `{"jsonrpc":"2.0","id":3,"result":2}`; got != want {
+				t.Errorf("the response after a batch of notifications is %s; want %s", got, want)
+			}
+		})
+	}
+}
+
+// TestReadFrame reads frames in both framings
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		framing Framing
+		input   string
+		want    []string
+		err     string
+	}{
+		{Lines, "{}\n\r\n  \n[1]\r\n{\"a\":1}", []string{"{}", "[1]", `{"a":1}`}, ""},
+		{ContentLength, "Content-Length: 2\r\n\r\n{}content-length:3\r\nContent-Type: application/json\r\n\r\n[1]", []string{"{}", "[1]"}, ""},
+		{ContentLength, "Content-Length: 2\n\n{}", []string{"{}"}, ""},
+		{ContentLength, "Content-Type: x\r\n\r\n{}", nil, "the message has no Content-Length header"},
+		{ContentLength, "Content-Length: -1\r\n\r\n", nil, `invalid Content-Length " -1"`},
+		{ContentLength, "Content-Length 2\r\n\r\n{}", nil, `invalid header line "Content-Length 2"`},
+		{ContentLength, fmt.Sprintf("Content-Length: %d\r\n\r\n", MaxMessageSize+1), nil, "exceeds the limit"},
+		{ContentLength, "Content-Length: 5\r\n\r\n{}", nil, io.ErrUnexpectedEOF.Error()},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.input))
+		var got []string
+		var err error
+		for {
+			var b []byte
+			if b, err = readFrame(r, test.framing); err != nil {
+				break
+			}
+			got = append(got, string(b))
+		}
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("readFrame(%s, %q) read %q; want %q", test.framing, test.input, got, test.want)
+		}
+		if test.err == "" && err != io.EOF || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("readFrame(%s, %q) failed with %v; want %q", test.framing, test.input, err, test.err)
+		}
+	}
+
+	long := strings.Repeat("x", MaxMessageSize+1)
+	if _, err := readFrame(bufio.NewReader(strings.NewReader(long)), Lines); err == nil {
+		t.Error("readFrame() read a line longer than MaxMessageSize")
+	}
+}
+
+// TestBrokenFrame closes the connection when the peer sends a frame that can't be read
+func TestBrokenFrame(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	c := NewConn(b, ContentLength, nil)
+	go a.Write([]byte("garbage\r\n\r\n"))
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection didn't close")
+	}
+	if err := c.Err(); err == nil || !strings.Contains(err.Error(), "invalid header line") {
+		t.Errorf("Err() = %v", err)
+	}
+}
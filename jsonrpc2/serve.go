@@ -0,0 +1,44 @@
+//go:build windows || linux
+
+package jsonrpc2
+
+import (
+	// Standard
+	"fmt"
+	"net"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// Dial connects to the pipe at address and starts a JSON-RPC connection over it. The handler answers the requests
+// the server sends; it may be nil if the server sends none.
+func Dial(address string, framing Framing, handler Handler) (*Conn, error) {
+	pipe, err := npipe.Dial(address)
+	if err != nil {
+		return nil, fmt.Errorf("jsonrpc2.Dial(): %s", err)
+	}
+	return NewConn(pipe, framing, handler), nil
+}
+
+// Serve starts a JSON-RPC connection with handler for every client accepted from ln, such as an npipe.PipeListener,
+// until Accept fails, and returns the error of Accept. Every connection closes when its client hangs up.
+func Serve(ln net.Listener, framing Framing, handler Handler) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		NewConn(conn, framing, handler)
+	}
+}
+
+// ListenAndServe listens on the pipe at address and serves its clients with handler until the listener fails
+func ListenAndServe(address string, framing Framing, handler Handler) error {
+	ln, err := npipe.Listen(address)
+	if err != nil {
+		return fmt.Errorf("jsonrpc2.ListenAndServe(): %s", err)
+	}
+	defer ln.Close()
+	return Serve(ln, framing, handler)
+}
@@ -0,0 +1,128 @@
+package jsonrpc2
+
+import (
+	// Standard
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// serve serves arith on a new pipe in the provided mode and returns its address
+func serve(t *testing.T, pipeMode uint32, framing Framing) string {
+	t.Setenv("NPIPE_SOCKET_DIR", t.TempDir())
+	address := `\\.\pipe\jsonrpc2`
+	ln, err := npipe.NewPipeListener(address, npipe.PipeAccessDuplex, pipeMode, npipe.PipeUnlimitedInstances, 512, 512, 0, nil)
+	if err != nil {
+		t.Fatalf("NewPipeListener(%q): %v", address, err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ln, framing, func(ctx context.Context, conn *Conn, req *Request) (interface{}, error) {
+			if req.Method == "echo" {
+				var s string
+				err := conn.Call(ctx, "upper", req.Params, &s)
+				return s, err
+			}
+			return arith(nil)(ctx, conn, req)
+		})
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		if err := <-served; err != npipe.ErrClosed {
+			t.Errorf("Serve() = %v; want %v", err, npipe.ErrClosed)
+		}
+	})
+	return address
+}
+
+// upper answers the server's upper requests
+func upper(ctx context.Context, conn *Conn, req *Request) (interface{}, error) {
+	return strings.ToUpper(string(req.Params[1 : len(req.Params)-1])), nil
+}
+
+// TestServe serves clients over message and byte mode pipes, with messages larger than the pipe buffers
+func TestServe(t *testing.T) {
+	modes := []struct {
+		name string
+		mode uint32
+	}{
+		{"message", npipe.PipeTypeMessage | npipe.PipeReadModeMessage},
+		{"byte", npipe.PipeTypeByte | npipe.PipeReadModeByte},
+	}
+	for _, mode := range modes {
+		for _, framing := range framings {
+			t.Run(mode.name+"/"+framing.String(), func(t *testing.T) {
+				address := serve(t, mode.mode, framing)
+				var wg sync.WaitGroup
+				for i := 0; i < 4; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						conn, err := Dial(address, framing, upper)
+						if err != nil {
+							t.Errorf("Dial(): %v", err)
+							return
+						}
+						defer conn.Close()
+						ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+						defer cancel()
+
+						var sum int
+						if err := conn.Call(ctx, "add", []int{i, 40}, &sum); err != nil || sum != i+40 {
+							t.Errorf("Call(add) = %d, %v", sum, err)
+						}
+						long := strings.Repeat("pipe", 50000)
+						var echo string
+						if err := conn.Call(ctx, "echo", long, &echo); err != nil || echo != strings.ToUpper(long) {
+							t.Errorf("Call(echo) returned %d bytes, %v; want %d bytes", len(echo), err, len(long))
+						}
+						calls := []*BatchCall{{Method: "add", Params: []int{1, 2}}, {Method: "note", Notify: true}, {Method: "missing"}}
+						if err := conn.Batch(ctx, calls); err != nil || calls[0].Error != nil || calls[2].Error == nil {
+							t.Errorf("Batch() = %v, %v, %v", err, calls[0].Error, calls[2].Error)
+						}
+					}(i)
+				}
+				wg.Wait()
+			})
+		}
+	}
+}
+
+// TestListenAndServe serves a pipe address and hangs up on the server
+func TestListenAndServe(t *testing.T) {
+	t.Setenv("NPIPE_SOCKET_DIR", t.TempDir())
+	address := `\\.\pipe\jsonrpc2`
+	served := make(chan error, 1)
+	go func() {
+		served <- ListenAndServe(address, Lines, arith(nil))
+	}()
+
+	// Dial waits for the pipe to be created like it does on Windows
+	conn, err := Dial(address, Lines, nil)
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	var sum int
+	if err := conn.Call(context.Background(), "add", []int{1, 2}, &sum); err != nil || sum != 3 {
+		t.Errorf("Call(add) = %d, %v", sum, err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("Close(): %v", err)
+	}
+	if _, err := Dial(`\\remote\pipe\jsonrpc2`, Lines, nil); err == nil {
+		t.Error("Dial() connected to a remote address")
+	}
+	if err := ListenAndServe(`\\remote\pipe\jsonrpc2`, Lines, nil); err == nil {
+		t.Error("ListenAndServe() listened on a remote address")
+	}
+	select {
+	case err := <-served:
+		t.Errorf("ListenAndServe() returned %v", err)
+	default:
+	}
+}
@@ -0,0 +1,465 @@
+//go:build linux
+
+package npipe
+
+import (
+	// Standard
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	// X Package
+	"golang.org/x/sys/unix"
+)
+
+// SecurityAttributes controls access to the socket file backing a pipe created by NewPipeListener
+type SecurityAttributes struct {
+	// Mode is the permission mode applied to the socket file; only the owner can connect by default
+	Mode os.FileMode
+}
+
+// pipeMeta is the metadata the listener records next to its socket so other processes can learn about the pipe
+type pipeMeta struct {
+	PID          int  `json:"pid"`
+	MaxInstances int  `json:"max_instances"`
+	Message      bool `json:"message"`
+}
+
+// PipeListener is a named pipe listener. Clients should typically use variables of type net.Listener instead of assuming named pipe.
+type PipeListener struct {
+	mu     sync.Mutex
+	addr   PipeAddr
+	ln     *net.UnixListener
+	path   string
+	closed bool
+
+	// message is true when the pipe was created with PipeTypeMessage
+	message bool
+	// maxInstances is the maximum number of simultaneously connected instances, 0 means unlimited
+	maxInstances int
+	// instances is the number of accepted connections that have not been closed
+	instances int
+	// accepting is the number of AcceptPipe calls waiting for a client, each of which holds a free instance
+	accepting int
+	// free is closed and replaced when an instance becomes free or the listener is closed, waking the AcceptPipe calls
+	// that wait while every instance is in use
+	free chan struct{}
+	// placeholder is the listener's own connection that takes the last backlog slot while every instance is in use,
+	// see refuse
+	placeholder *net.UnixConn
+	// idle is the number of instances returned by PipeConn.Disconnect that the next Accept reuses
+	idle int
+	// handedOff is true once the socket was handed to another process with File; Close then leaves the socket file
+	// and metadata for the new owner
+	handedOff bool
+
+	// stats counts the accepted connections and their I/O
+	stats listenerCounters
+}
+
+// NewPipeListener is a factory that creates and returns a pointer to a PipeListener.
+// The arguments mirror the Windows CreateNamedPipe function; outBuffer, inBuffer, and timeout are accepted for
+// compatibility and ignored by the socket backend.
+func NewPipeListener(name string, openMode, pipeMode, maxInstances, outBuffer, inBuffer, timeout uint32, sa *SecurityAttributes) (*PipeListener, error) {
+	path, err := socketPath(name)
+	if err != nil {
+		return nil, fmt.Errorf("npipe.NewPipeListener(): %s", err)
+	}
+
+	if maxInstances == 0 || maxInstances > PipeUnlimitedInstances {
+		return nil, fmt.Errorf("npipe.NewPipeListener(): invalid maximum number of instances %d", maxInstances)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("npipe.NewPipeListener(): there was an error creating the socket directory: %s", err)
+	}
+
+	// A socket file that nobody is listening on was left behind by a process that exited without closing its
+	// listener, remove it so the pipe can be created again
+	if _, err = os.Stat(path); err == nil {
+		c, err := net.Dial("unix", path)
+		if errors.Is(err, syscall.EPROTOTYPE) {
+			c, err = net.Dial("unixpacket", path)
+		}
+		// EAGAIN means every instance of a live pipe is in use
+		if err == nil || errors.Is(err, syscall.EAGAIN) {
+			if c != nil {
+				c.Close()
+			}
+			if openMode&FileFlagFirstPipeInstance != 0 {
+				return nil, fmt.Errorf("npipe.NewPipeListener(): the pipe %s already exists: %s", name, syscall.EADDRINUSE)
+			}
+			return nil, fmt.Errorf("npipe.NewPipeListener(): the pipe %s is already being served by another process: %s", name, syscall.EADDRINUSE)
+		}
+		os.Remove(path)
+	}
+
+	network := "unix"
+	message := pipeMode&PipeTypeMessage != 0
+	if message {
+		network = "unixpacket"
+	}
+	ln, err := net.ListenUnix(network, &net.UnixAddr{Name: path, Net: network})
+	if err != nil {
+		return nil, fmt.Errorf("npipe.NewPipeListener(): there was an error listening on the socket %s: %s", path, err)
+	}
+
+	mode := os.FileMode(0600)
+	if sa != nil {
+		mode = sa.Mode
+	}
+	err = os.Chmod(path, mode)
+	if err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("npipe.NewPipeListener(): there was an error setting the socket permissions: %s", err)
+	}
+
+	pl := PipeListener{
+		mu:           sync.Mutex{},
+		addr:         PipeAddr(name),
+		ln:           ln,
+		path:         path,
+		closed:       false,
+		message:      message,
+		maxInstances: int(maxInstances),
+		free:         make(chan struct{}),
+	}
+	if maxInstances == PipeUnlimitedInstances {
+		pl.maxInstances = 0
+	}
+
+	err = pl.writeMeta()
+	if err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("npipe.NewPipeListener(): %s", err)
+	}
+	return &pl, nil
+}
+
+// NewPipeListenerQuick creates a named pipe in a default configuration where
+// The pipe mode will be type BYTE
+// An unlimited number of instances can be created for this pipe
+// Only the current user can connect to the pipe
+func NewPipeListenerQuick(name string, first bool) (*PipeListener, error) {
+	mode := PipeAccessDuplex | FileFlagOverlapped
+	if first {
+		mode |= FileFlagFirstPipeInstance
+	}
+
+	listener, err := NewPipeListener(name, uint32(mode), PipeTypeByte, PipeUnlimitedInstances, 512, 512, 0, nil)
+	if err != nil {
+		err = fmt.Errorf("\"npipe.NewPipeListenerQuick(): %s\"", err)
+	}
+	return listener, err
+}
+
+// metaPath returns the path of the file that holds the listener's metadata
+func metaPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path))
+}
+
+// writeMeta records the listener's metadata next to its socket
+func (l *PipeListener) writeMeta() error {
+	data, err := json.Marshal(pipeMeta{PID: os.Getpid(), MaxInstances: l.maxInstances, Message: l.message})
+	if err != nil {
+		return fmt.Errorf("npipe.PipeListener.writeMeta(): there was an error encoding the pipe metadata: %s", err)
+	}
+	err = os.WriteFile(metaPath(l.path), data, 0600)
+	if err != nil {
+		return fmt.Errorf("npipe.PipeListener.writeMeta(): there was an error writing the pipe metadata: %s", err)
+	}
+	return nil
+}
+
+// readMeta reads the metadata recorded by the listener that owns the socket at path
+func readMeta(path string) (pipeMeta, error) {
+	var meta pipeMeta
+	data, err := os.ReadFile(metaPath(path))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// Accept implements the Accept method in the net.Listener interface; it
+// waits for the next call and returns a generic net.Conn.
+func (l *PipeListener) Accept() (net.Conn, error) {
+	c, err := l.AcceptPipe()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// AcceptPipe accepts the next incoming call and returns the new connection.
+func (l *PipeListener) AcceptPipe() (*PipeConn, error) {
+	if l == nil {
+		return nil, fmt.Errorf("npipe.PipeListener.AcceptPipe(): the PipeListener is nil")
+	}
+
+	l.mu.Lock()
+	if l.addr == "" || l.closed {
+		l.mu.Unlock()
+		return nil, fmt.Errorf("npipe.PipeListener.AcceptPipe(): the address is empty or the listener is closed")
+	}
+	l.mu.Unlock()
+
+	for {
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			return nil, ErrClosed
+		}
+		if l.maxInstances > 0 && l.instances+l.accepting >= l.maxInstances {
+			// All instances are busy, wait for one to be released
+			free := l.free
+			l.mu.Unlock()
+			<-free
+			continue
+		}
+		l.accepting++
+		l.mu.Unlock()
+
+		conn, err := l.ln.AcceptUnix()
+		l.mu.Lock()
+		l.accepting--
+		if err != nil {
+			l.mu.Unlock()
+			if errors.Is(err, net.ErrClosed) {
+				// Return error compatible to net.Listener.Accept() in case the
+				// listener was closed.
+				return nil, ErrClosed
+			}
+			return nil, err
+		}
+		if l.isPlaceholder(conn) {
+			l.placeholder.Close()
+			l.placeholder = nil
+			l.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		if l.idle > 0 {
+			l.idle--
+		}
+		l.instances++
+		if l.maxInstances > 0 && l.instances >= l.maxInstances {
+			l.refuse()
+		}
+		l.mu.Unlock()
+		l.stats.accepts.Add(1)
+		l.stats.active.Add(1)
+		return newPipeConn(conn, l.addr, l.message, l), nil
+	}
+}
+
+// placeholders numbers the addresses of the listeners' placeholder connections
+var placeholders atomic.Uint64
+
+// refuse makes the kernel turn clients away with EAGAIN, which Dial retries like ERROR_PIPE_BUSY on Windows, once
+// every instance is in use. Cutting the backlog to zero still leaves room for one client in the accept queue, so the
+// listener takes that slot with a connection of its own, which Accept discards once an instance is free again. A
+// client that got there first waits in the queue for the next free instance instead. l.mu must be held.
+func (l *PipeListener) refuse() {
+	l.setBacklog(0)
+	if l.placeholder != nil {
+		return
+	}
+	network := "unix"
+	if l.message {
+		network = "unixpacket"
+	}
+	// The placeholder is bound to an abstract address so Accept can tell it from clients
+	local := &net.UnixAddr{Name: fmt.Sprintf("@npipe-busy-%d-%d", os.Getpid(), placeholders.Add(1)), Net: network}
+	c, err := net.DialUnix(network, local, &net.UnixAddr{Name: l.path, Net: network})
+	if err == nil {
+		l.placeholder = c
+	}
+}
+
+// isPlaceholder reports whether conn is the server end of the placeholder connection. l.mu must be held.
+func (l *PipeListener) isPlaceholder(conn *net.UnixConn) bool {
+	if l.placeholder == nil || conn.RemoteAddr() == nil {
+		return false
+	}
+	return conn.RemoteAddr().String() == l.placeholder.LocalAddr().String()
+}
+
+// setBacklog changes the length of the accept queue of the listening socket; the kernel caps it at somaxconn
+func (l *PipeListener) setBacklog(backlog int) {
+	rc, err := l.ln.SyscallConn()
+	if err != nil {
+		return
+	}
+	rc.Control(func(fd uintptr) {
+		unix.Listen(int(fd), backlog)
+	})
+}
+
+// release returns an instance to the listener after an accepted connection was closed. A disconnected instance is
+// kept for reuse by the next Accept unless the listener was closed.
+func (l *PipeListener) release(disconnected bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.instances--
+	l.stats.active.Add(-1)
+	if l.closed {
+		return
+	}
+	if disconnected {
+		l.idle++
+	}
+	if l.maxInstances > 0 && l.instances == l.maxInstances-1 {
+		// Let clients queue again; the placeholder is ahead of them and discarded by the next Accept
+		l.setBacklog(unix.SOMAXCONN)
+		close(l.free)
+		l.free = make(chan struct{})
+	}
+}
+
+// Stats returns the number of accepted, rejected, and open connections and the I/O of the accepted connections
+func (l *PipeListener) Stats() ListenerStats {
+	return l.stats.snapshot()
+}
+
+// Info returns the type and buffer sizes of the listening socket and the instance counts ListPipes reports for the pipe
+func (l *PipeListener) Info() (HandleInfo, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return HandleInfo{}, fmt.Errorf("npipe.PipeListener.Info(): the listener is closed")
+	}
+	info := HandleInfo{Server: true, Message: l.message, ReadMessage: l.message}
+	rc, err := l.ln.SyscallConn()
+	if err != nil {
+		return info, fmt.Errorf("npipe.PipeListener.Info(): %s", err)
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = socketBufferSizes(int(fd), &info)
+	})
+	if err == nil {
+		err = serr
+	}
+	if err == nil {
+		err = pipeInstances(l.path, &info)
+	}
+	if err != nil {
+		return info, fmt.Errorf("npipe.PipeListener.Info(): %s", err)
+	}
+	if l.placeholder != nil {
+		// The queued placeholder is not an instance
+		info.CurrentInstances--
+	}
+	return info, nil
+}
+
+// SyscallConn returns a raw connection to the listening socket. Only Control is supported; Read and Write return
+// syscall.EINVAL.
+func (l *PipeListener) SyscallConn() (syscall.RawConn, error) {
+	rc, err := l.ln.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("npipe.PipeListener.SyscallConn(): %s", err)
+	}
+	return rc, nil
+}
+
+// Close stops listening on the address.
+// Already Accepted connections are not closed.
+func (l *PipeListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	l.idle = 0
+	close(l.free)
+	if l.placeholder != nil {
+		l.placeholder.Close()
+		l.placeholder = nil
+	}
+	if !l.handedOff {
+		os.Remove(metaPath(l.path))
+	}
+	return l.ln.Close()
+}
+
+// File returns a duplicate of the listening socket so it can be handed to another process, for example through
+// exec.Cmd.ExtraFiles, and turned back into a PipeListener with FileListener. Once File was called, closing this
+// listener no longer removes the socket file so the pipe stays available to the new owner.
+// It is the caller's responsibility to close the returned file.
+func (l *PipeListener) File() (*os.File, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil, fmt.Errorf("npipe.PipeListener.File(): the listener is closed")
+	}
+	f, err := l.ln.File()
+	if err != nil {
+		return nil, fmt.Errorf("npipe.PipeListener.File(): %s", err)
+	}
+	l.handedOff = true
+	l.ln.SetUnlinkOnClose(false)
+	return f, nil
+}
+
+// FileListener returns a PipeListener for the listening socket f returned by PipeListener.File, typically in a
+// child process that inherited it. The pipe address is recovered from the socket's path.
+// It is the caller's responsibility to close f when finished; closing the listener does not affect f, and closing f
+// does not affect the listener.
+func FileListener(f *os.File) (*PipeListener, error) {
+	soType, err := unix.GetsockoptInt(int(f.Fd()), unix.SOL_SOCKET, unix.SO_TYPE)
+	if err != nil {
+		return nil, fmt.Errorf("npipe.FileListener(): there was an error getting the socket type: %s", err)
+	}
+	fl, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("npipe.FileListener(): %s", err)
+	}
+	ln, ok := fl.(*net.UnixListener)
+	if !ok {
+		fl.Close()
+		return nil, fmt.Errorf("npipe.FileListener(): expected a Unix domain socket but received %T", fl)
+	}
+	path := ln.Addr().String()
+	name, err := unescapePipeName(filepath.Base(path))
+	if err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("npipe.FileListener(): %s", err)
+	}
+	// The new owner removes the socket file when it is done with the pipe
+	ln.SetUnlinkOnClose(true)
+
+	pl := PipeListener{
+		mu:      sync.Mutex{},
+		addr:    PipeAddr(`\\.\pipe\` + name),
+		ln:      ln,
+		path:    path,
+		message: soType == unix.SOCK_SEQPACKET,
+		free:    make(chan struct{}),
+	}
+	if meta, err := readMeta(path); err == nil {
+		pl.maxInstances = meta.MaxInstances
+	}
+	err = pl.writeMeta()
+	if err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("npipe.FileListener(): %s", err)
+	}
+	return &pl, nil
+}
+
+// Addr returns the listener's network address, a PipeAddr.
+func (l *PipeListener) Addr() net.Addr { return l.addr }
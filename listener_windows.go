@@ -4,27 +4,24 @@ package npipe
 
 import (
 	// Standard
+	"encoding/binary"
 	"fmt"
 	"net"
+	"os"
 	"sync"
+	"unicode/utf16"
+	"unsafe"
 
 	// X Package
 	"golang.org/x/sys/windows"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe/internal/winapi"
 )
 
 // PipeListener is a named pipe listener. Clients should typically use variables of type net.Listener instead of assuming named pipe.
 type PipeListener struct {
-	mu     sync.Mutex
-	addr   PipeAddr
-	handle windows.Handle
-	closed bool
-
-	// acceptHandle contains the current handle waiting for
-	// an incoming connection or nil.
-	acceptHandle windows.Handle
-	// acceptOverlapped is set before waiting on a connection.
-	// If not waiting, it is nil.
-	acceptOverlapped *windows.Overlapped
+	winListener
 }
 
 // NewPipeListener is a factory that creates and returns a pointer to a PipeListener
@@ -48,25 +45,23 @@ func NewPipeListener(name string, openMode, pipeMode, maxInstances, outBuffer, i
 		return nil, fmt.Errorf("npipe.NewPipeListener(): %s", err)
 	}
 
-	// Convert the pipe name to a UTF-16 string pointer
-	lpName, err := windows.UTF16PtrFromString(name)
-	if err != nil {
-		return nil, fmt.Errorf("npipe.NewPipeListener(): there was an error converting \"%s\" to a UTF16 pointer: %s", name, err)
-	}
-
 	// Create the named pipe
-	handle, err := windows.CreateNamedPipe(lpName, openMode, pipeMode, maxInstances, outBuffer, inBuffer, timeout, sa)
+	handle, err := sysAPI.CreateNamedPipe(name, openMode, pipeMode, maxInstances, outBuffer, inBuffer, timeout, sa)
 	if err != nil {
 		return nil, fmt.Errorf("npipe.NewPipeListener(): there was an error calling the WINAPI CreateNamedPipe function: %s", err)
 	}
 
 	pl := PipeListener{
-		mu:               sync.Mutex{},
-		addr:             PipeAddr(name),
-		handle:           handle,
-		closed:           false,
-		acceptHandle:     0,
-		acceptOverlapped: nil,
+		winListener: winListener{
+			api:              sysAPI,
+			mu:               sync.Mutex{},
+			addr:             PipeAddr(name),
+			handle:           handle,
+			closed:           false,
+			acceptHandle:     0,
+			acceptOverlapped: nil,
+			config:           newPipeConfig(openMode, pipeMode, maxInstances, outBuffer, inBuffer, timeout, sa),
+		},
 	}
 	return &pl, nil
 }
@@ -97,15 +92,14 @@ func NewPipeListenerQuick(name string, first bool) (*PipeListener, error) {
 // Accept implements the Accept method in the net.Listener interface; it
 // waits for the next call and returns a generic net.Conn.
 func (l *PipeListener) Accept() (net.Conn, error) {
-	c, err := l.AcceptPipe()
-	for err == windows.ERROR_NO_DATA {
-		// Ignore clients that connect and immediately disconnect.
-		c, err = l.AcceptPipe()
+	if l == nil {
+		return nil, fmt.Errorf("npipe.PipeListener.Accept(): the PipeListener is nil")
 	}
+	c, err := l.accept()
 	if err != nil {
 		return nil, err
 	}
-	return c, nil
+	return &PipeConn{winConn: c}, nil
 }
 
 // AcceptPipe accepts the next incoming call and returns the new connection.
@@ -115,116 +109,156 @@ func (l *PipeListener) AcceptPipe() (*PipeConn, error) {
 	if l == nil {
 		return nil, fmt.Errorf("npipe.PipeListener.AcceptPipe(): the PipeListener is nil")
 	}
+	c, err := l.acceptPipe()
+	if err != nil {
+		return nil, err
+	}
+	return &PipeConn{winConn: c}, nil
+}
 
+// Handle returns the Windows Handle to
+func (l *PipeListener) Handle() windows.Handle {
+	return windows.Handle(l.handle)
+}
+
+// File transfers the pipe instance that is waiting for the next client to an inheritable handle so it can be handed
+// to another process, for example through syscall.SysProcAttr.AdditionalInheritedHandles, and turned back into a
+// PipeListener with FileListener. Because the transferred instance keeps existing, clients never see
+// ERROR_FILE_NOT_FOUND while the new process starts. This listener keeps working and creates new instances for
+// subsequent calls to Accept.
+// It is the caller's responsibility to close the returned file once the other process has started.
+func (l *PipeListener) File() (*os.File, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	if l.addr == "" || l.closed {
-		return nil, fmt.Errorf("npipe.PipeListener.AcceptPipe(): the address is empty or the listener is closed")
+	if l.closed {
+		return nil, fmt.Errorf("npipe.PipeListener.File(): the listener is closed")
 	}
 
-	// the first time we call accept, the handle will have been created by the Listen
-	// call. This is to prevent race conditions where the client thinks the server
-	// isn't listening because it hasn't actually called create yet. After the first time, we'll
-	// have to create a new handle each time
 	handle := l.handle
 	if handle == 0 {
 		var err error
-		// Convert the pipe name to a UTF-16 string pointer
-		lpName, err := windows.UTF16PtrFromString(l.addr.String())
+		handle, err = l.nextInstance()
 		if err != nil {
-			return nil, fmt.Errorf("npipe.PipeListener.AcceptPipe(): there was an error converting \"%s\" to a UTF16 pointer: %s", l.addr, err)
+			return nil, fmt.Errorf("npipe.PipeListener.File(): there was an error calling the WINAPI CreateNamedPipe function: %s", err)
 		}
-		handle, err = windows.CreateNamedPipe(lpName, windows.PIPE_ACCESS_DUPLEX|windows.FILE_FLAG_OVERLAPPED, windows.PIPE_TYPE_BYTE, windows.PIPE_UNLIMITED_INSTANCES, 512, 512, 0, nil)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		l.handle = 0
 	}
+	l.handle = 0
 
-	overlapped, err := newOverlapped()
+	// https://learn.microsoft.com/en-us/windows/win32/api/handleapi/nf-handleapi-duplicatehandle
+	var inheritable windows.Handle
+	process := windows.CurrentProcess()
+	err := windows.DuplicateHandle(process, windows.Handle(handle), process, &inheritable, 0, true, windows.DUPLICATE_SAME_ACCESS|windows.DUPLICATE_CLOSE_SOURCE)
 	if err != nil {
-		return nil, err
-	}
-	defer windows.CloseHandle(overlapped.HEvent)
-	err = windows.ConnectNamedPipe(handle, overlapped)
-	if err == nil || err == windows.ERROR_PIPE_CONNECTED {
-		return &PipeConn{handle: handle, addr: l.addr}, nil
-	}
-
-	if err == windows.ERROR_IO_INCOMPLETE || err == windows.ERROR_IO_PENDING {
-		l.acceptOverlapped = overlapped
-		l.acceptHandle = handle
-		// unlock here so close can function correctly while we wait (we'll
-		// get relocked via the defer below, before the original defer
-		// unlock happens.)
-		l.mu.Unlock()
-		defer func() {
-			l.mu.Lock()
-			l.acceptOverlapped = nil
-			l.acceptHandle = 0
-			// unlock is via defer above.
-		}()
-		_, err = waitForCompletion(handle, overlapped)
-	}
-	if err == windows.ERROR_OPERATION_ABORTED {
-		// Return error compatible to net.Listener.Accept() in case the
-		// listener was closed.
-		return nil, ErrClosed
-	}
-	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("npipe.PipeListener.File(): there was an error calling the WINAPI DuplicateHandle function: %s", err)
 	}
-	return &PipeConn{handle: handle, addr: l.addr}, nil
+	return os.NewFile(uintptr(inheritable), l.addr.String()), nil
 }
 
-// Close stops listening on the address.
-// Already Accepted connections are not closed.
-func (l *PipeListener) Close() error {
-	l.mu.Lock()
-	defer l.mu.Unlock()
+// FileListener returns a PipeListener for the pipe instance f returned by PipeListener.File, typically in a child
+// process that inherited it. The pipe address, type, buffer sizes, and security descriptor are recovered from the
+// handle, so the instances Accept creates match the ones of the original listener.
+// It is the caller's responsibility to close f when finished; closing the listener does not affect f, and closing f
+// does not affect the listener.
+func FileListener(f *os.File) (*PipeListener, error) {
+	var handle windows.Handle
+	process := windows.CurrentProcess()
+	err := windows.DuplicateHandle(process, windows.Handle(f.Fd()), process, &handle, 0, false, windows.DUPLICATE_SAME_ACCESS)
+	if err != nil {
+		return nil, fmt.Errorf("npipe.FileListener(): there was an error calling the WINAPI DuplicateHandle function: %s", err)
+	}
 
-	if l.closed {
-		return nil
+	// The pipe file system reports the name relative to the pipe directory, e.g. \mypipe
+	// https://learn.microsoft.com/en-us/windows/win32/api/winbase/ns-winbase-file_name_info
+	buf := make([]byte, 4+2*windows.MAX_LONG_PATH)
+	err = windows.GetFileInformationByHandleEx(handle, windows.FileNameInfo, &buf[0], uint32(len(buf)))
+	if err != nil {
+		windows.CloseHandle(handle)
+		return nil, fmt.Errorf("npipe.FileListener(): there was an error calling the WINAPI GetFileInformationByHandleEx function: %s", err)
 	}
-	l.closed = true
-	if l.handle != 0 {
-		err := disconnectNamedPipe(l.handle)
-		if err != nil {
-			return err
-		}
-		err = windows.CloseHandle(l.handle)
-		if err != nil {
-			return err
-		}
-		l.handle = 0
+	length := binary.LittleEndian.Uint32(buf[0:4])
+	name := make([]uint16, length/2)
+	for i := range name {
+		name[i] = binary.LittleEndian.Uint16(buf[4+i*2:])
 	}
-	if l.acceptOverlapped != nil && l.acceptHandle != 0 {
-		// Cancel the pending IO. This call does not block, so it is safe
-		// to hold onto the mutex above.
 
-		if err := windows.CancelIoEx(l.acceptHandle, l.acceptOverlapped); err != nil {
-			return err
-		}
-		err := windows.CloseHandle(l.acceptOverlapped.HEvent)
-		if err != nil {
-			return err
-		}
-		l.acceptOverlapped.HEvent = 0
-		err = windows.CloseHandle(l.acceptHandle)
-		if err != nil {
-			return err
-		}
-		l.acceptHandle = 0
+	config, err := filePipeConfig(handle)
+	if err != nil {
+		windows.CloseHandle(handle)
+		return nil, fmt.Errorf("npipe.FileListener(): %s", err)
 	}
-	return nil
+
+	pl := PipeListener{
+		winListener: winListener{
+			api:    sysAPI,
+			mu:     sync.Mutex{},
+			addr:   PipeAddr(`\\.\pipe` + string(utf16.Decode(name))),
+			handle: winapi.Handle(handle),
+			config: config,
+		},
+	}
+	return &pl, nil
 }
 
-// Addr returns the listener's network address, a PipeAddr.
-func (l *PipeListener) Addr() net.Addr { return l.addr }
+// filePipeLocalInformationClass is the FILE_INFORMATION_CLASS value for FILE_PIPE_LOCAL_INFORMATION
+const filePipeLocalInformationClass = 24
 
-// Handle returns the Windows Handle to
-func (l *PipeListener) Handle() windows.Handle {
-	return l.handle
+// filePipeLocalInformation is the FILE_PIPE_LOCAL_INFORMATION structure returned by NtQueryInformationFile
+// https://learn.microsoft.com/en-us/windows-hardware/drivers/ddi/ntifs/ns-ntifs-_file_pipe_local_information
+type filePipeLocalInformation struct {
+	NamedPipeType          uint32
+	NamedPipeConfiguration uint32
+	MaximumInstances       uint32
+	CurrentInstances       uint32
+	InboundQuota           uint32
+	ReadDataAvailable      uint32
+	OutboundQuota          uint32
+	WriteQuotaAvailable    uint32
+	NamedPipeState         uint32
+	NamedPipeEnd           uint32
+}
+
+// filePipeConfig recovers the configuration of the pipe from the instance handed over by PipeListener.File, so the
+// instances FileListener creates match the ones of the listener that called File. The default timeout is not reported
+// by the pipe file system and is left 0; it is fixed by the first instance of the pipe anyway.
+func filePipeConfig(handle windows.Handle) (pipeConfig, error) {
+	var info filePipeLocalInformation
+	err := ntQueryInformationFile(handle, unsafe.Pointer(&info), uint32(unsafe.Sizeof(info)), filePipeLocalInformationClass)
+	if err != nil {
+		return pipeConfig{}, fmt.Errorf("there was an error calling the WINAPI NtQueryInformationFile function: %s", err)
+	}
+	var state uint32
+	err = windows.GetNamedPipeHandleState(handle, &state, nil, nil, nil, nil, 0)
+	if err != nil {
+		return pipeConfig{}, fmt.Errorf("there was an error calling the WINAPI GetNamedPipeHandleState function: %s", err)
+	}
+	sd, err := windows.GetSecurityInfo(handle, windows.SE_KERNEL_OBJECT, windows.OWNER_SECURITY_INFORMATION|windows.GROUP_SECURITY_INFORMATION|windows.DACL_SECURITY_INFORMATION)
+	if err != nil {
+		return pipeConfig{}, fmt.Errorf("there was an error calling the WINAPI GetSecurityInfo function: %s", err)
+	}
+
+	openMode := uint32(windows.FILE_FLAG_OVERLAPPED)
+	switch info.NamedPipeConfiguration {
+	case windows.FILE_PIPE_INBOUND:
+		openMode |= windows.PIPE_ACCESS_INBOUND
+	case windows.FILE_PIPE_OUTBOUND:
+		openMode |= windows.PIPE_ACCESS_OUTBOUND
+	default:
+		openMode |= windows.PIPE_ACCESS_DUPLEX
+	}
+	pipeMode := state & windows.PIPE_READMODE_MESSAGE
+	if info.NamedPipeType&windows.FILE_PIPE_MESSAGE_TYPE != 0 {
+		pipeMode |= windows.PIPE_TYPE_MESSAGE
+	}
+	if info.NamedPipeType&windows.FILE_PIPE_REJECT_REMOTE_CLIENTS != 0 {
+		pipeMode |= windows.PIPE_REJECT_REMOTE_CLIENTS
+	}
+	// The pipe file system reports unlimited instances as -1
+	maxInstances := info.MaximumInstances
+	if maxInstances > windows.PIPE_UNLIMITED_INSTANCES {
+		maxInstances = windows.PIPE_UNLIMITED_INSTANCES
+	}
+	sa := &windows.SecurityAttributes{SecurityDescriptor: sd}
+	sa.Length = uint32(unsafe.Sizeof(*sa))
+	return newPipeConfig(openMode, pipeMode, maxInstances, info.OutboundQuota, info.InboundQuota, 0, sa), nil
 }
@@ -0,0 +1,19 @@
+package npipe
+
+// Pipe open modes, pipe modes, and instance limits accepted by NewPipeListener. The values match their Win32
+// counterparts (e.g., PIPE_TYPE_MESSAGE) so the same flags can be passed on every platform.
+// https://learn.microsoft.com/en-us/windows/win32/api/winbase/nf-winbase-createnamedpipea
+const (
+	PipeAccessInbound         = 0x00000001
+	PipeAccessOutbound        = 0x00000002
+	PipeAccessDuplex          = 0x00000003
+	FileFlagFirstPipeInstance = 0x00080000
+	FileFlagOverlapped        = 0x40000000
+
+	PipeTypeByte        = 0x00000000
+	PipeTypeMessage     = 0x00000004
+	PipeReadModeByte    = 0x00000000
+	PipeReadModeMessage = 0x00000002
+
+	PipeUnlimitedInstances = 255
+)
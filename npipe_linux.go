@@ -0,0 +1,184 @@
+//go:build linux
+
+// Package npipe provides wrapper functions to more easily interact with Windows named pipes.
+//
+// On Linux the package is backed by Unix domain sockets: every local pipe address \\.\pipe\<name> maps to a socket
+// file in the directory returned by SocketDir. Byte mode pipes use SOCK_STREAM sockets and message mode pipes use
+// SOCK_SEQPACKET sockets so that message boundaries are preserved.
+package npipe
+
+import (
+	// Standard
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SocketDir returns the directory that holds the sockets backing local named pipes. The NPIPE_SOCKET_DIR
+// environment variable takes precedence, followed by $XDG_RUNTIME_DIR/npipe, and finally a per-user directory in the
+// system's temporary directory.
+func SocketDir() string {
+	if dir := os.Getenv("NPIPE_SOCKET_DIR"); dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "npipe")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("npipe-%d", os.Getuid()))
+}
+
+// Dial connects to a named pipe with the given address. If the specified pipe is not available,
+// it will wait indefinitely for the pipe to become available.
+//
+// The address must be of the form \\.\\pipe\<name>. Remote pipes are not supported by the Linux backend.
+//
+// Examples:
+//
+//	// local pipe
+//	conn, err := Dial(`\\.\pipe\mypipename`)
+func Dial(address string) (*PipeConn, error) {
+	var retries uint64
+	for {
+		conn, err := dial(address, 0)
+		if err == nil {
+			conn.stats.dialRetries.Store(retries)
+			return conn, nil
+		}
+		if isPipeNotReady(err) {
+			<-time.After(100 * time.Millisecond)
+			retries++
+			continue
+		}
+		return nil, fmt.Errorf("npipe.Dial(): %s", err)
+	}
+}
+
+// DialTimeout acts like Dial, but will time out after the duration of timeout
+func DialTimeout(address string, timeout time.Duration) (*PipeConn, error) {
+	deadline := time.Now().Add(timeout)
+
+	var retries uint64
+	now := time.Now()
+	for now.Before(deadline) {
+		conn, err := dial(address, deadline.Sub(now))
+		if err == nil {
+			conn.stats.dialRetries.Store(retries)
+			return conn, nil
+		}
+		if isPipeNotReady(err) {
+			left := deadline.Sub(time.Now())
+			retry := 100 * time.Millisecond
+			if left > retry {
+				<-time.After(retry)
+			} else if left > 0 {
+				<-time.After(left)
+			}
+			retries++
+			now = time.Now()
+			continue
+		}
+		return nil, err
+	}
+	return nil, PipeError{fmt.Sprintf(
+		"npipe.DialTimeout(): timed out waiting for pipe '%s' to come available", address), true}
+}
+
+// isPipeNotReady checks the error to see if it indicates the pipe is not ready
+func isPipeNotReady(err error) bool {
+	// ENOENT means the server hasn't created the pipe yet.
+	// ECONNREFUSED means a stale socket file was left behind and the server hasn't replaced it yet.
+	// EAGAIN means the listen backlog is full, the equivalent of ERROR_PIPE_BUSY.
+	// None of them are fatal errors.
+	return errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EAGAIN)
+}
+
+// dial is a helper to initiate a connection to a named pipe that has been started by a server.
+// A zero timeout means the connection attempt will not time out.
+func dial(address string, timeout time.Duration) (*PipeConn, error) {
+	path, err := socketPath(address)
+	if err != nil {
+		return nil, err
+	}
+
+	// The socket type is not known ahead of time; byte mode pipes are the most common so try those first
+	message := false
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if errors.Is(err, syscall.EPROTOTYPE) {
+		message = true
+		conn, err = net.DialTimeout("unixpacket", path, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newPipeConn(conn.(*net.UnixConn), PipeAddr(address), message, nil), nil
+}
+
+// Listen returns a new PipeListener that will listen on a pipe with the given address
+// The address must be of the form \\.\pipe\<name>
+// A PipeError for an incorrectly formatted pipe name
+func Listen(address string) (*PipeListener, error) {
+	pl, err := NewPipeListenerQuick(address, true)
+	if err != nil {
+		err = fmt.Errorf("npipe.Listen(): %s", err)
+	}
+	return pl, err
+}
+
+// socketPath returns the path of the Unix domain socket backing the provided local pipe address
+func socketPath(address string) (string, error) {
+	host, name, err := splitPipeAddress(address)
+	if err != nil {
+		return "", badAddr(address)
+	}
+	if !isLocalHost(host) {
+		return "", PipeError{fmt.Sprintf("Remote pipe address '%s' is not supported by the socket backend.", address), false}
+	}
+	return filepath.Join(SocketDir(), escapePipeName(name)), nil
+}
+
+// escapePipeName converts a pipe name into a file name that can be used in the socket directory. Any byte that is
+// not an ASCII letter, digit, '-', '_', or a non-leading '.' is percent-encoded; escaped names therefore never start
+// with a dot, which leaves dot files free for the backend's own metadata.
+func escapePipeName(name string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.' && i > 0:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&0x0F])
+		}
+	}
+	return b.String()
+}
+
+// unescapePipeName reverses escapePipeName
+func unescapePipeName(file string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(file); i++ {
+		if file[i] != '%' {
+			b.WriteByte(file[i])
+			continue
+		}
+		if i+2 >= len(file) {
+			return "", fmt.Errorf("npipe.unescapePipeName(): truncated escape sequence in \"%s\"", file)
+		}
+		var c byte
+		_, err := fmt.Sscanf(file[i+1:i+3], "%02X", &c)
+		if err != nil {
+			return "", fmt.Errorf("npipe.unescapePipeName(): invalid escape sequence in \"%s\": %s", file, err)
+		}
+		b.WriteByte(c)
+		i += 2
+	}
+	return b.String(), nil
+}
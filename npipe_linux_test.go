@@ -0,0 +1,1628 @@
+package npipe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Ne0nd0g/npipe/conntest"
+	"github.com/Ne0nd0g/npipe/internal/bench"
+	"golang.org/x/sys/unix"
+)
+
+// useSocketDir points the socket backend at a temporary directory for the duration of the test
+func useSocketDir(t testing.TB) string {
+	dir := t.TempDir()
+	t.Setenv("NPIPE_SOCKET_DIR", dir)
+	return dir
+}
+
+// TestBadListen tests that if you listen on a bad or remote address, that we get back an error
+func TestBadListen(t *testing.T) {
+	useSocketDir(t)
+	addrs := []string{"not a valid pipe address", `\\10.0.0.1\pipe\TestBadListen`, `\\.\pipe\`}
+	for _, address := range addrs {
+		ln, err := Listen(address)
+		if err == nil {
+			t.Errorf("Listening on '%s' did not result in an error", address)
+		}
+		if ln != nil {
+			t.Errorf("Listening on '%s' returned non-nil listener.", address)
+		}
+	}
+}
+
+// TestDoubleListen makes sure we can't listen to the same address twice.
+func TestDoubleListen(t *testing.T) {
+	useSocketDir(t)
+	address := `\\.\pipe\TestDoubleListen`
+	ln1, err := Listen(address)
+	if err != nil {
+		t.Fatalf("Listen(%q): %v", address, err)
+	}
+	defer ln1.Close()
+
+	ln2, err := Listen(address)
+	if err == nil {
+		ln2.Close()
+		t.Fatalf("second Listen on %q succeeded.", address)
+	}
+}
+
+// TestListenCloseListen tests whether Close() actually closes a named pipe properly.
+func TestListenCloseListen(t *testing.T) {
+	useSocketDir(t)
+	address := `\\.\pipe\TestListenCloseListen`
+	ln1, err := Listen(address)
+	if err != nil {
+		t.Fatalf("Listen(%q): %v", address, err)
+	}
+	ln1.Close()
+
+	ln2, err := Listen(address)
+	if err != nil {
+		t.Fatalf("second Listen on %q failed: %v", address, err)
+	}
+	ln2.Close()
+}
+
+// TestStaleSocket tests that a socket file left behind by a crashed server does not prevent listening
+func TestStaleSocket(t *testing.T) {
+	useSocketDir(t)
+	address := `\\.\pipe\TestStaleSocket`
+	path, err := socketPath(address)
+	if err != nil {
+		t.Fatalf("socketPath(%q): %v", address, err)
+	}
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("ListenUnix(%q): %v", path, err)
+	}
+	ln.SetUnlinkOnClose(false)
+	ln.Close()
+
+	pl, err := Listen(address)
+	if err != nil {
+		t.Fatalf("Listen(%q) on a stale socket: %v", address, err)
+	}
+	pl.Close()
+}
+
+// TestCancelAccept tests whether Accept() can be cancelled by closing the listener.
+func TestCancelAccept(t *testing.T) {
+	useSocketDir(t)
+	address := `\\.\pipe\TestCancelAccept`
+	ln, err := Listen(address)
+	if err != nil {
+		t.Fatalf("Listen(%q): %v", address, err)
+	}
+
+	cancelled := make(chan error)
+	go func() {
+		_, err := ln.Accept()
+		cancelled <- err
+	}()
+	time.AfterFunc(20*time.Millisecond, func() {
+		ln.Close()
+	})
+	select {
+	case err := <-cancelled:
+		if err != ErrClosed {
+			t.Fatalf("Expected ErrClosed, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout trying to cancel accept.")
+	}
+}
+
+// TestCommonUseCase creates a listener and dials into it with several clients in succession
+func TestCommonUseCase(t *testing.T) {
+	useSocketDir(t)
+	address := `\\.\pipe\TestCommonUseCase`
+	ln, err := Listen(address)
+	if err != nil {
+		t.Fatalf("Listen(%q) failed: %v", address, err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	for _, address := range []string{address, `\\127.0.0.1\pipe\TestCommonUseCase`} {
+		for x := 0; x < 5; x++ {
+			conn, err := Dial(address)
+			if err != nil {
+				t.Fatalf("Dial(%q): %v", address, err)
+			}
+			msg := fmt.Sprintf("Hi server %d!\n", x)
+			if _, err := fmt.Fprint(conn, msg); err != nil {
+				t.Fatalf("Error writing to pipe: %v", err)
+			}
+			reply, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				t.Fatalf("Error reading from pipe: %v", err)
+			}
+			if reply != msg {
+				t.Fatalf("Read incorrect message from server. Expected '%s', got '%s'", msg, reply)
+			}
+			conn.Close()
+		}
+	}
+}
+
+// TestDialBeforeListen tests that you can dial before a pipe is available,
+// and that it'll pick up the pipe once it's ready
+func TestDialBeforeListen(t *testing.T) {
+	useSocketDir(t)
+	address := `\\.\pipe\TestDialBeforeListen`
+	done := make(chan error)
+	go func() {
+		conn, err := Dial(address)
+		if err == nil {
+			conn.Close()
+		}
+		done <- err
+	}()
+
+	<-time.After(50 * time.Millisecond)
+	ln, err := Listen(address)
+	if err != nil {
+		t.Fatalf("Listen(%q): %v", address, err)
+	}
+	defer ln.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept(): %v", err)
+	}
+	conn.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("Dial(%q): %v", address, err)
+	}
+}
+
+// TestDialTimeout tests that the DialTimeout function will actually timeout correctly
+func TestDialTimeout(t *testing.T) {
+	useSocketDir(t)
+	timeout := time.Millisecond * 150
+	deadline := time.Now().Add(timeout)
+	c, err := DialTimeout(`\\.\pipe\TestDialTimeout`, timeout)
+	end := time.Now()
+	if c != nil {
+		t.Errorf("DialTimeout returned non-nil connection: %v", c)
+	}
+	pe, ok := err.(PipeError)
+	if !ok || !pe.Timeout() {
+		t.Fatalf("Expected a timeout PipeError, got: %v", err)
+	}
+	if end.Before(deadline) || end.Sub(deadline) > 500*time.Millisecond {
+		t.Fatalf("DialTimeout ended %v from the deadline", end.Sub(deadline))
+	}
+}
+
+// TestReadDeadline tests that PipeConn's read deadline returns a timeout PipeError
+func TestReadDeadline(t *testing.T) {
+	useSocketDir(t)
+	address := `\\.\pipe\TestReadDeadline`
+	ln, err := Listen(address)
+	if err != nil {
+		t.Fatalf("Listen(%q): %v", address, err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(500 * time.Millisecond)
+		}
+	}()
+
+	c, err := Dial(address)
+	if err != nil {
+		t.Fatalf("Dial(%q): %v", address, err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = c.Read(make([]byte, 10))
+	pe, ok := err.(PipeError)
+	if !ok || !pe.Timeout() {
+		t.Fatalf("Expected a timeout PipeError, got: %v", err)
+	}
+}
+
+// TestMessageMode tests that message boundaries are preserved and that a short buffer returns ErrMoreData
+func TestMessageMode(t *testing.T) {
+	useSocketDir(t)
+	address := `\\.\pipe\TestMessageMode`
+	ln, err := NewPipeListener(address, PipeAccessDuplex, PipeTypeMessage|PipeReadModeMessage, PipeUnlimitedInstances, 512, 512, 0, nil)
+	if err != nil {
+		t.Fatalf("NewPipeListener(%q): %v", address, err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("first message"))
+		conn.Write([]byte("second"))
+		io.Copy(io.Discard, conn)
+	}()
+
+	c, err := Dial(address)
+	if err != nil {
+		t.Fatalf("Dial(%q): %v", address, err)
+	}
+	defer c.Close()
+
+	buf := make([]byte, 5)
+	var msg []byte
+	for {
+		n, err := c.Read(buf)
+		msg = append(msg, buf[:n]...)
+		if err == nil {
+			break
+		}
+		if err != ErrMoreData {
+			t.Fatalf("Read(): %v", err)
+		}
+	}
+	if string(msg) != "first message" {
+		t.Fatalf("Unexpected first message: %q", msg)
+	}
+
+	buf = make([]byte, 64)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("Read(): %v", err)
+	}
+	if string(buf[:n]) != "second" {
+		t.Fatalf("Unexpected second message: %q", buf[:n])
+	}
+}
+
+// TestMaxInstances tests that clients beyond the maximum number of instances are refused as busy, and that Dial
+// retries until an instance is released
+func TestMaxInstances(t *testing.T) {
+	useSocketDir(t)
+	for name, mode := range map[string]uint32{"byte": PipeTypeByte, "message": PipeTypeMessage | PipeReadModeMessage} {
+		t.Run(name, func(t *testing.T) {
+			address := `\\.\pipe\TestMaxInstances-` + name
+			ln, err := NewPipeListener(address, PipeAccessDuplex, mode, 1, 512, 512, 0, nil)
+			if err != nil {
+				t.Fatalf("NewPipeListener(%q): %v", address, err)
+			}
+			defer ln.Close()
+
+			c1, err := Dial(address)
+			if err != nil {
+				t.Fatalf("Dial(%q): %v", address, err)
+			}
+			defer c1.Close()
+			s1, err := ln.Accept()
+			if err != nil {
+				t.Fatalf("Accept(): %v", err)
+			}
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err == nil {
+					accepted <- conn
+				}
+			}()
+
+			// The only instance is in use, so the second client is busy instead of connected and dropped
+			c2, err := DialTimeout(address, 300*time.Millisecond)
+			if err == nil {
+				c2.SetReadDeadline(time.Now().Add(time.Second))
+				_, err = c2.Read(make([]byte, 1))
+				c2.Close()
+				t.Fatalf("DialTimeout() connected while the only instance was in use; Read() = %v", err)
+			}
+			if perr, ok := err.(PipeError); !ok || !perr.Timeout() {
+				t.Fatalf("DialTimeout() = %v; want a timeout waiting for the busy pipe", err)
+			}
+			// The listening socket and the connected instance, but not the placeholder holding the accept queue
+			if info, err := ln.Info(); err != nil || info.CurrentInstances != 2 {
+				t.Errorf("Info() = %+v, %v; want 2 instances", info, err)
+			}
+
+			// Once the instance is released the waiting client is accepted
+			dialed := make(chan *PipeConn, 1)
+			go func() {
+				c, err := Dial(address)
+				if err != nil {
+					t.Errorf("Dial(%q): %v", address, err)
+				}
+				dialed <- c
+			}()
+			time.Sleep(150 * time.Millisecond)
+			s1.Close()
+			c3 := <-dialed
+			if c3 == nil {
+				t.FailNow()
+			}
+			defer c3.Close()
+			if c3.Stats().DialRetries == 0 {
+				t.Error("Dial() connected without retrying while the only instance was in use")
+			}
+			select {
+			case s3 := <-accepted:
+				defer s3.Close()
+				if _, err = c3.Write([]byte("hello")); err != nil {
+					t.Fatalf("Write(): %v", err)
+				}
+				b := make([]byte, 8)
+				if n, err := s3.Read(b); err != nil || string(b[:n]) != "hello" {
+					t.Fatalf("Read() = %q, %v", b[:n], err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Timeout waiting for the released instance to accept a client")
+			}
+		})
+	}
+}
+
+// TestListPipes tests that pipes created by the socket backend are listed with their instance counts
+func TestListPipes(t *testing.T) {
+	dir := useSocketDir(t)
+	address := `\\.\pipe\TestListPipes\sub`
+	ln, err := NewPipeListener(address, PipeAccessDuplex, PipeTypeByte, 4, 512, 512, 0, nil)
+	if err != nil {
+		t.Fatalf("NewPipeListener(%q): %v", address, err)
+	}
+	defer ln.Close()
+
+	// A stale socket and an unrelated file must not be listed
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(dir, "stale"), Net: "unix"})
+	if err != nil {
+		t.Fatalf("ListenUnix(): %v", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	os.WriteFile(filepath.Join(dir, "regular"), nil, 0600)
+
+	c, err := Dial(address)
+	if err != nil {
+		t.Fatalf("Dial(%q): %v", address, err)
+	}
+	defer c.Close()
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept(): %v", err)
+	}
+	defer s.Close()
+
+	pipes, err := ListPipes(".")
+	if err != nil {
+		t.Fatalf("ListPipes(): %v", err)
+	}
+	if len(pipes) != 1 {
+		t.Fatalf("Expected 1 pipe, got %+v", pipes)
+	}
+	expected := PipeInfo{Name: `TestListPipes\sub`, CurrentInstances: 2, MaxInstances: 4}
+	if pipes[0] != expected {
+		t.Fatalf("Unexpected result (expected: %+v, got: %+v)", expected, pipes[0])
+	}
+
+	if _, err := ListPipes("10.0.0.1"); err == nil {
+		t.Fatal("ListPipes() for a remote host did not return an error")
+	}
+}
+
+// TestEscapePipeName tests that pipe names round trip through the socket file name encoding
+func TestEscapePipeName(t *testing.T) {
+	names := []string{"srvsvc", `a\b/c`, "..", ".hidden", "100%", "spaces and\ttabs", "ünïcødé"}
+	for _, name := range names {
+		file := escapePipeName(name)
+		if strings.ContainsAny(file, `/\`) || strings.HasPrefix(file, ".") {
+			t.Errorf("escapePipeName(%q) returned unsafe file name %q", name, file)
+		}
+		got, err := unescapePipeName(file)
+		if err != nil {
+			t.Errorf("unescapePipeName(%q): %v", file, err)
+		}
+		if got != name {
+			t.Errorf("Round trip of %q returned %q", name, got)
+		}
+	}
+}
+
+// TestParseUnixSocketCounts tests that sockets are counted per bound path
+func TestParseUnixSocketCounts(t *testing.T) {
+	table := `Num       RefCount Protocol Flags    Type St Inode Path
+0000000098420c0c: 00000003 00000000 00000000 0001 03  6782
+0000000057f2580d: 00000002 00000000 00010000 0001 01  2102 /run/npipe/srvsvc
+000000009a93f8ab: 00000003 00000000 00000000 0001 03  2110 /run/npipe/srvsvc
+00000000114a3f4b: 00000002 00000000 00010000 0005 01  2200 /run/npipe/with space
+`
+	counts, err := parseUnixSocketCounts(strings.NewReader(table))
+	if err != nil {
+		t.Fatalf("parseUnixSocketCounts(): %v", err)
+	}
+	if counts["/run/npipe/srvsvc"] != 2 || counts["/run/npipe/with space"] != 1 || len(counts) != 2 {
+		t.Fatalf("Unexpected counts: %v", counts)
+	}
+}
+
+// TestWatchPipes tests that existing, created, and removed pipes are reported through inotify
+func TestWatchPipes(t *testing.T) {
+	useSocketDir(t)
+	existing, err := Listen(`\\.\pipe\TestWatchPipes-existing`)
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	defer existing.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := WatchPipes(ctx, "TestWatchPipes-*")
+	if err != nil {
+		t.Fatalf("WatchPipes(): %v", err)
+	}
+
+	next := func() PipeEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for a pipe event")
+		}
+		return PipeEvent{}
+	}
+
+	if e := next(); e != (PipeEvent{PipeCreated, "TestWatchPipes-existing"}) {
+		t.Fatalf("Unexpected event for the existing pipe: %v", e)
+	}
+
+	// A pipe that does not match the pattern must not be reported
+	other, err := Listen(`\\.\pipe\Other`)
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	other.Close()
+
+	ln, err := Listen(`\\.\pipe\TestWatchPipes-new`)
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	if e := next(); e != (PipeEvent{PipeCreated, "TestWatchPipes-new"}) {
+		t.Fatalf("Unexpected event for the new pipe: %v", e)
+	}
+	ln.Close()
+	if e := next(); e != (PipeEvent{PipeRemoved, "TestWatchPipes-new"}) {
+		t.Fatalf("Unexpected event for the closed pipe: %v", e)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("Unexpected event after the context was cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The event channel was not closed after the context was cancelled")
+	}
+}
+
+// TestFileListener tests that a listener handed off with File keeps the pipe available after the original is closed
+func TestFileListener(t *testing.T) {
+	useSocketDir(t)
+	address := `\\.\pipe\TestFileListener`
+	ln, err := NewPipeListener(address, PipeAccessDuplex, PipeTypeMessage, 3, 512, 512, 0, nil)
+	if err != nil {
+		t.Fatalf("NewPipeListener(%q): %v", address, err)
+	}
+	f, err := ln.File()
+	if err != nil {
+		t.Fatalf("File(): %v", err)
+	}
+	inherited, err := FileListener(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("FileListener(): %v", err)
+	}
+	defer inherited.Close()
+	if inherited.Addr().String() != address || !inherited.message || inherited.maxInstances != 3 {
+		t.Fatalf("Unexpected inherited listener %s (message %t, max instances %d)", inherited.Addr(), inherited.message, inherited.maxInstances)
+	}
+
+	// Closing the original listener must not remove the pipe
+	ln.Close()
+	go func() {
+		conn, err := inherited.Accept()
+		if err == nil {
+			conn.Write([]byte("inherited"))
+			conn.Close()
+		}
+	}()
+	c, err := DialTimeout(address, time.Second)
+	if err != nil {
+		t.Fatalf("Dial(%q): %v", address, err)
+	}
+	defer c.Close()
+	buf := make([]byte, 64)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "inherited" {
+		t.Fatalf("Unexpected read %q: %v", buf[:n], err)
+	}
+}
+
+// connPair returns both ends of a connection to a new pipe created with the provided pipe mode
+func connPair(t testing.TB, address string, pipeMode uint32) (client, server *PipeConn) {
+	ln, err := NewPipeListener(address, PipeAccessDuplex, pipeMode, PipeUnlimitedInstances, 512, 512, 0, nil)
+	if err != nil {
+		t.Fatalf("NewPipeListener(%q): %v", address, err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	client, err = Dial(address)
+	if err != nil {
+		t.Fatalf("Dial(%q): %v", address, err)
+	}
+	server, err = ln.AcceptPipe()
+	if err != nil {
+		t.Fatalf("AcceptPipe(): %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// TestSendHandles tests that descriptors sent with SendHandles are usable by the receiver in both pipe modes
+func TestSendHandles(t *testing.T) {
+	useSocketDir(t)
+	for name, mode := range map[string]uint32{"byte": PipeTypeByte, "message": PipeTypeMessage} {
+		t.Run(name, func(t *testing.T) {
+			client, server := connPair(t, `\\.\pipe\TestSendHandles-`+name, mode)
+
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatalf("Pipe(): %v", err)
+			}
+			defer r.Close()
+			tmp, err := os.CreateTemp(t.TempDir(), "handle")
+			if err != nil {
+				t.Fatalf("CreateTemp(): %v", err)
+			}
+			tmp.WriteString("file contents")
+
+			n, err := client.SendHandles([]byte("take these"), w, tmp)
+			if err != nil || n != len("take these") {
+				t.Fatalf("SendHandles() = %d, %v", n, err)
+			}
+			// The sender keeps ownership of its files and may close them right away
+			w.Close()
+			tmp.Close()
+
+			buf := make([]byte, 64)
+			n, files, err := server.RecvHandles(buf)
+			if err != nil {
+				t.Fatalf("RecvHandles(): %v", err)
+			}
+			if string(buf[:n]) != "take these" {
+				t.Fatalf("Unexpected data %q", buf[:n])
+			}
+			if len(files) != 2 {
+				t.Fatalf("Expected 2 files, got %d", len(files))
+			}
+			defer files[1].Close()
+
+			files[0].Write([]byte("through the pipe"))
+			files[0].Close()
+			got, err := io.ReadAll(r)
+			if err != nil || string(got) != "through the pipe" {
+				t.Fatalf("Unexpected data from the received pipe %q: %v", got, err)
+			}
+			contents := make([]byte, 64)
+			n, err = files[1].ReadAt(contents, 0)
+			if string(contents[:n]) != "file contents" {
+				t.Fatalf("Unexpected data from the received file %q: %v", contents[:n], err)
+			}
+		})
+	}
+}
+
+// TestRecvHandlesShortBuffer tests that data that doesn't fit in the buffer returns ErrMoreData and that a receiver
+// that doesn't know the length of the data can read the rest of the frame without reading past it
+func TestRecvHandlesShortBuffer(t *testing.T) {
+	useSocketDir(t)
+	for name, mode := range map[string]uint32{"byte": PipeTypeByte, "message": PipeTypeMessage} {
+		t.Run(name, func(t *testing.T) {
+			client, server := connPair(t, `\\.\pipe\TestRecvHandlesShortBuffer-`+name, mode)
+			if _, err := client.SendHandles([]byte("0123456789")); err != nil {
+				t.Fatalf("SendHandles(): %v", err)
+			}
+			client.Write([]byte("tail"))
+
+			buf := make([]byte, 4)
+			n, files, err := server.RecvHandles(buf)
+			if err != ErrMoreData || n != 4 || len(files) != 0 {
+				t.Fatalf("RecvHandles() = %d, %d files, %v; want 4, 0 files, ErrMoreData", n, len(files), err)
+			}
+			if _, message, err := server.Available(); message != 6 || err != nil {
+				t.Fatalf("Available() = %d, %v; want 6 bytes left in the frame", message, err)
+			}
+			if _, _, err := server.RecvHandles(buf); err == nil {
+				t.Fatal("RecvHandles() before the rest of the frame was read did not return an error")
+			}
+			data := append([]byte(nil), buf[:n]...)
+			for err == ErrMoreData {
+				n, err = server.Read(buf)
+				data = append(data, buf[:n]...)
+			}
+			if err != nil || string(data) != "0123456789" {
+				t.Fatalf("Unexpected frame data %q: %v", data, err)
+			}
+			n, err = server.Read(buf)
+			if err != nil || string(buf[:n]) != "tail" {
+				t.Fatalf("Unexpected data after the frame %q: %v", buf[:n], err)
+			}
+		})
+	}
+}
+
+// TestConformance runs the net.Conn conformance suite against the socket backend
+func TestConformance(t *testing.T) {
+	useSocketDir(t)
+	var pairs int
+	conntest.TestConn(t, func() (net.Conn, net.Conn) {
+		pairs++
+		address := fmt.Sprintf(`\\.\pipe\TestConformance%d`, pairs)
+		ln, err := Listen(address)
+		if err != nil {
+			t.Errorf("Listen(%q): %v", address, err)
+			return nil, nil
+		}
+		t.Cleanup(func() { ln.Close() })
+		client, err := Dial(address)
+		if err != nil {
+			t.Errorf("Dial(%q): %v", address, err)
+			return nil, nil
+		}
+		server, err := ln.Accept()
+		if err != nil {
+			client.Close()
+			t.Errorf("Accept(): %v", err)
+			return nil, nil
+		}
+		return client, server
+	})
+}
+
+// TestCloseWrite tests that the peer reads io.EOF after CloseWrite and can still reply in both pipe modes
+func TestCloseWrite(t *testing.T) {
+	useSocketDir(t)
+	for name, mode := range map[string]uint32{"byte": PipeTypeByte, "message": PipeTypeMessage} {
+		t.Run(name, func(t *testing.T) {
+			client, server := connPair(t, `\\.\pipe\TestCloseWrite-`+name, mode)
+
+			if _, err := client.Write([]byte("request")); err != nil {
+				t.Fatalf("Write(): %v", err)
+			}
+			if err := client.CloseWrite(); err != nil {
+				t.Fatalf("CloseWrite(): %v", err)
+			}
+			request, err := io.ReadAll(server)
+			if err != nil || string(request) != "request" {
+				t.Fatalf("io.ReadAll() = %q, %v", request, err)
+			}
+			if _, err = server.Write([]byte("reply")); err != nil {
+				t.Fatalf("Write() after the peer's CloseWrite: %v", err)
+			}
+			server.Close()
+			reply, err := io.ReadAll(client)
+			if err != nil || string(reply) != "reply" {
+				t.Fatalf("io.ReadAll() = %q, %v", reply, err)
+			}
+		})
+	}
+}
+
+// TestPeek tests that Peek and Available look at buffered data without consuming it in both pipe modes
+func TestPeek(t *testing.T) {
+	useSocketDir(t)
+	t.Run("byte", func(t *testing.T) {
+		client, server := connPair(t, `\\.\pipe\TestPeek-byte`, PipeTypeByte)
+
+		b := make([]byte, 16)
+		if n, err := server.Peek(b); n != 0 || err != nil {
+			t.Fatalf("Peek() with nothing buffered = %d, %v", n, err)
+		}
+		client.Write([]byte("hello "))
+		client.Write([]byte("world"))
+		waitAvailable(t, server, 11)
+		if total, message, err := server.Available(); total != 11 || message != 0 || err != nil {
+			t.Fatalf("Available() = %d, %d, %v; want 11, 0", total, message, err)
+		}
+		n, err := server.Peek(b[:8])
+		if err != nil || string(b[:n]) != "hello wo" {
+			t.Fatalf("Peek() = %q, %v", b[:n], err)
+		}
+		n, err = server.Read(b)
+		if err != nil || string(b[:n]) != "hello world" {
+			t.Fatalf("Read() after Peek() = %q, %v", b[:n], err)
+		}
+
+		client.Close()
+		if n, err := server.Peek(b); n != 0 || err != io.EOF {
+			t.Errorf("Peek() after the peer closed = %d, %v; want %v", n, err, io.EOF)
+		}
+		if _, _, err := server.Available(); err != io.EOF {
+			t.Errorf("Available() after the peer closed = %v; want %v", err, io.EOF)
+		}
+	})
+
+	t.Run("message", func(t *testing.T) {
+		client, server := connPair(t, `\\.\pipe\TestPeek-message`, PipeTypeMessage|PipeReadModeMessage)
+
+		if total, message, err := server.Available(); total != 0 || message != 0 || err != nil {
+			t.Fatalf("Available() with nothing buffered = %d, %d, %v", total, message, err)
+		}
+		client.Write([]byte("first message"))
+		client.Write([]byte("second"))
+		waitAvailable(t, server, 19)
+		if total, message, err := server.Available(); total != 19 || message != 13 || err != nil {
+			t.Fatalf("Available() = %d, %d, %v; want 19, 13", total, message, err)
+		}
+		b := make([]byte, 64)
+		n, err := server.Peek(b)
+		if err != nil || string(b[:n]) != "first message" {
+			t.Fatalf("Peek() = %q, %v", b[:n], err)
+		}
+		n, err = server.Peek(b[:5])
+		if err != ErrMoreData || string(b[:n]) != "first" {
+			t.Fatalf("Peek() into a short buffer = %q, %v; want %v", b[:n], err, ErrMoreData)
+		}
+
+		// The rest of a partially read message is peeked and counted until it is read
+		n, err = server.Read(b[:6])
+		if err != ErrMoreData || string(b[:n]) != "first " {
+			t.Fatalf("Read() = %q, %v", b[:n], err)
+		}
+		if total, message, err := server.Available(); total != 13 || message != 7 || err != nil {
+			t.Fatalf("Available() after a partial Read() = %d, %d, %v; want 13, 7", total, message, err)
+		}
+		n, err = server.Peek(b)
+		if err != nil || string(b[:n]) != "message" {
+			t.Fatalf("Peek() after a partial Read() = %q, %v", b[:n], err)
+		}
+		server.Read(b)
+		n, err = server.Peek(b)
+		if err != nil || string(b[:n]) != "second" {
+			t.Fatalf("Peek() of the second message = %q, %v", b[:n], err)
+		}
+		server.Read(b)
+
+		client.Close()
+		if n, err := server.Peek(b); n != 0 || err != io.EOF {
+			t.Errorf("Peek() after the peer closed = %d, %v; want %v", n, err, io.EOF)
+		}
+		if _, _, err := server.Available(); err != io.EOF {
+			t.Errorf("Available() after the peer closed = %v; want %v", err, io.EOF)
+		}
+	})
+}
+
+// TestPeekConcurrentRead tests that Peek and Available can run while Read consumes partially read messages, which
+// the race detector checks
+func TestPeekConcurrentRead(t *testing.T) {
+	useSocketDir(t)
+	client, server := connPair(t, `\\.\pipe\TestPeekConcurrentRead`, PipeTypeMessage|PipeReadModeMessage)
+
+	const messages = 200
+	go func() {
+		for i := 0; i < messages; i++ {
+			client.Write([]byte("a message that spans several reads"))
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b := make([]byte, 8)
+		for read := 0; read < messages; {
+			_, err := server.Read(b)
+			if err == nil {
+				read++
+			} else if err != ErrMoreData {
+				t.Errorf("Read(): %v", err)
+				return
+			}
+		}
+	}()
+
+	b := make([]byte, 16)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if _, err := server.Peek(b); err != nil && err != ErrMoreData {
+			t.Fatalf("Peek(): %v", err)
+		}
+		if _, _, err := server.Available(); err != nil {
+			t.Fatalf("Available(): %v", err)
+		}
+	}
+}
+
+// waitAvailable waits until n bytes can be read from conn
+func waitAvailable(t *testing.T, conn *PipeConn, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if total, _, err := conn.Available(); err != nil || total >= n {
+			return
+		}
+	}
+	t.Fatalf("%d bytes never became available", n)
+}
+
+// TestTransact tests request/reply transactions on message pipes, including long replies, busy pipes, deadlines, and
+// cancellation
+func TestTransact(t *testing.T) {
+	useSocketDir(t)
+	client, server := connPair(t, `\\.\pipe\TestTransact`, PipeTypeMessage|PipeReadModeMessage)
+	go func() {
+		b := make([]byte, 64)
+		for {
+			n, err := server.Read(b)
+			if err != nil {
+				return
+			}
+			switch string(b[:n]) {
+			case "ignore":
+			case "long":
+				server.Write([]byte(strings.Repeat("x", 100)))
+			default:
+				server.Write([]byte(strings.ToUpper(string(b[:n]))))
+			}
+		}
+	}()
+	ctx := context.Background()
+
+	b := make([]byte, 64)
+	n, err := client.Transact(ctx, []byte("hello"), b)
+	if err != nil || string(b[:n]) != "HELLO" {
+		t.Fatalf("Transact() = %q, %v", b[:n], err)
+	}
+	n, err = client.Transact(ctx, []byte("long"), b)
+	if err != ErrMoreData || n != 64 {
+		t.Fatalf("Transact() of a long reply = %d, %v; want 64, %v", n, err, ErrMoreData)
+	}
+	if _, err = client.Transact(ctx, []byte("busy"), b); err == nil {
+		t.Fatal("Transact() with unread data succeeded")
+	}
+	if n, err = client.Read(b); err != nil || n != 36 {
+		t.Fatalf("Read() of the rest of the reply = %d, %v", n, err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err = client.Transact(ctx, []byte("ignore"), b)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Transact() past the read deadline = %v; want a timeout", err)
+	}
+	client.SetReadDeadline(time.Time{})
+
+	cctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err = client.Transact(cctx, []byte("ignore"), b); err != context.DeadlineExceeded {
+		t.Fatalf("Transact() with an expiring context = %v; want %v", err, context.DeadlineExceeded)
+	}
+	// The context's interruption must not leave a deadline behind
+	n, err = client.Transact(ctx, []byte("again"), b)
+	if err != nil || string(b[:n]) != "AGAIN" {
+		t.Fatalf("Transact() after a cancelled one = %q, %v", b[:n], err)
+	}
+
+	byteClient, _ := connPair(t, `\\.\pipe\TestTransact-byte`, PipeTypeByte)
+	if _, err = byteClient.Transact(ctx, []byte("hello"), b); err == nil {
+		t.Error("Transact() on a byte mode pipe succeeded")
+	}
+}
+
+// TestCallPipe tests one-shot transactions with CallPipe
+func TestCallPipe(t *testing.T) {
+	useSocketDir(t)
+	address := `\\.\pipe\TestCallPipe`
+	ln, err := NewPipeListener(address, PipeAccessDuplex, PipeTypeMessage|PipeReadModeMessage, PipeUnlimitedInstances, 512, 512, 0, nil)
+	if err != nil {
+		t.Fatalf("NewPipeListener(%q): %v", address, err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b := make([]byte, 64)
+				n, err := conn.Read(b)
+				if err != nil {
+					return
+				}
+				if string(b[:n]) == "ignore" {
+					io.Copy(io.Discard, conn)
+					return
+				}
+				conn.Write(bytes.Repeat(b[:n], 1000))
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := CallPipe(ctx, address, []byte("echo"))
+	if err != nil || string(reply) != strings.Repeat("echo", 1000) {
+		t.Fatalf("CallPipe() = %d bytes, %v; want 4000 bytes", len(reply), err)
+	}
+
+	short, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = CallPipe(short, address, []byte("ignore")); err != context.DeadlineExceeded {
+		t.Errorf("CallPipe() without a reply = %v; want %v", err, context.DeadlineExceeded)
+	}
+	short, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = CallPipe(short, `\\.\pipe\TestCallPipe-missing`, nil); err != context.DeadlineExceeded {
+		t.Errorf("CallPipe() of a missing pipe = %v; want %v", err, context.DeadlineExceeded)
+	}
+	if _, err = CallPipe(ctx, "not a pipe", nil); err == nil || err == context.DeadlineExceeded {
+		t.Errorf("CallPipe() of a bad address = %v", err)
+	}
+}
+
+// TestFlush waits for the client to read the server's data and closes the server gracefully
+func TestFlush(t *testing.T) {
+	useSocketDir(t)
+	for i, mode := range []uint32{PipeTypeByte, PipeTypeMessage | PipeReadModeMessage} {
+		client, server := connPair(t, fmt.Sprintf(`\\.\pipe\TestFlush%d`, i), mode)
+		ctx := context.Background()
+		if err := server.Flush(ctx); err != nil {
+			t.Fatalf("Flush() with no data written: %v", err)
+		}
+		if _, err := server.Write([]byte("hello")); err != nil {
+			t.Fatalf("Write(): %v", err)
+		}
+
+		cctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		err := server.Flush(cctx)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Fatalf("Flush() of unread data with an expiring context = %v; want %v", err, context.DeadlineExceeded)
+		}
+		server.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+		err = server.Flush(ctx)
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("Flush() past the write deadline = %v; want a timeout", err)
+		}
+		server.SetWriteDeadline(time.Time{})
+
+		flushed := make(chan error, 1)
+		go func() {
+			flushed <- server.Flush(ctx)
+		}()
+		time.Sleep(10 * time.Millisecond)
+		b := make([]byte, 16)
+		if n, err := client.Read(b); err != nil || string(b[:n]) != "hello" {
+			t.Fatalf("Read() = %q, %v", b[:n], err)
+		}
+		if err := <-flushed; err != nil {
+			t.Fatalf("Flush() after the client read the data: %v", err)
+		}
+
+		server.Write([]byte("bye"))
+		closed := make(chan error, 1)
+		go func() {
+			closed <- server.CloseGracefully(ctx)
+		}()
+		if n, err := client.Read(b); err != nil || string(b[:n]) != "bye" {
+			t.Fatalf("Read() = %q, %v", b[:n], err)
+		}
+		if err := <-closed; err != nil {
+			t.Fatalf("CloseGracefully(): %v", err)
+		}
+		if _, err := client.Read(b); err != io.EOF {
+			t.Fatalf("Read() after CloseGracefully() = %v; want %v", err, io.EOF)
+		}
+	}
+}
+
+// TestDisconnect returns instances to the listener's pool and checks that Accept reuses them
+func TestDisconnect(t *testing.T) {
+	useSocketDir(t)
+	address := `\\.\pipe\TestDisconnect`
+	ln, err := NewPipeListener(address, PipeAccessDuplex, PipeTypeByte, 2, 512, 512, 0, nil)
+	if err != nil {
+		t.Fatalf("NewPipeListener(%q): %v", address, err)
+	}
+	defer ln.Close()
+	pool := func(instances, idle int) {
+		t.Helper()
+		ln.mu.Lock()
+		defer ln.mu.Unlock()
+		if ln.instances != instances || ln.idle != idle {
+			t.Fatalf("the listener has %d instances and %d idle; want %d and %d", ln.instances, ln.idle, instances, idle)
+		}
+	}
+	accept := func() (client, server *PipeConn) {
+		t.Helper()
+		client, err := Dial(address)
+		if err != nil {
+			t.Fatalf("Dial(%q): %v", address, err)
+		}
+		t.Cleanup(func() { client.Close() })
+		server, err = ln.AcceptPipe()
+		if err != nil {
+			t.Fatalf("AcceptPipe(): %v", err)
+		}
+		return client, server
+	}
+
+	c1, s1 := accept()
+	_, s2 := accept()
+	defer s2.Close()
+	pool(2, 0)
+
+	s1.Write([]byte("bye"))
+	if err := s1.Disconnect(); err != nil {
+		t.Fatalf("Disconnect(): %v", err)
+	}
+	pool(1, 1)
+	b := make([]byte, 8)
+	if n, err := c1.Read(b); err != nil || string(b[:n]) != "bye" {
+		t.Fatalf("Read() = %q, %v", b[:n], err)
+	}
+	if _, err := c1.Read(b); err != io.EOF {
+		t.Fatalf("Read() after Disconnect() = %v; want %v", err, io.EOF)
+	}
+	if err := s1.Disconnect(); err == nil {
+		t.Error("Disconnect() of a disconnected connection succeeded")
+	}
+	if err := s1.Close(); err != nil {
+		t.Errorf("Close() after Disconnect() = %v", err)
+	}
+	if err := c1.Disconnect(); err == nil {
+		t.Error("Disconnect() of a client succeeded")
+	}
+	pool(1, 1)
+
+	// The next client takes the idle instance even though the listener allows only two
+	_, s3 := accept()
+	pool(2, 0)
+	if err := s3.Close(); err != nil {
+		t.Fatalf("Close(): %v", err)
+	}
+	if err := s3.Disconnect(); err == nil {
+		t.Error("Disconnect() of a closed connection succeeded")
+	}
+	pool(1, 0)
+
+	// Instances disconnected after the listener was closed are not kept
+	ln.Close()
+	if err := s2.Disconnect(); err != nil {
+		t.Fatalf("Disconnect() after the listener was closed: %v", err)
+	}
+	pool(0, 0)
+}
+
+// TestInfo describes listeners and connections and switches a client between read modes
+func TestInfo(t *testing.T) {
+	useSocketDir(t)
+	address := `\\.\pipe\TestInfo`
+	ln, err := NewPipeListener(address, PipeAccessDuplex, PipeTypeMessage|PipeReadModeMessage, 3, 512, 512, 0, nil)
+	if err != nil {
+		t.Fatalf("NewPipeListener(%q): %v", address, err)
+	}
+	defer ln.Close()
+	info, err := ln.Info()
+	if err != nil {
+		t.Fatalf("PipeListener.Info(): %v", err)
+	}
+	if !info.Server || !info.Message || info.CurrentInstances != 1 || info.MaxInstances != 3 || info.OutBufferSize <= 0 || info.InBufferSize <= 0 {
+		t.Fatalf("PipeListener.Info() = %+v", info)
+	}
+
+	client, err := Dial(address)
+	if err != nil {
+		t.Fatalf("Dial(%q): %v", address, err)
+	}
+	defer client.Close()
+	server, err := ln.AcceptPipe()
+	if err != nil {
+		t.Fatalf("AcceptPipe(): %v", err)
+	}
+	defer server.Close()
+	if info, err = ln.Info(); err != nil || info.CurrentInstances != 2 {
+		t.Fatalf("PipeListener.Info() with a client = %+v, %v", info, err)
+	}
+	if info, err = server.Info(); err != nil || !info.Server || !info.ReadMessage || info.MaxInstances != 3 {
+		t.Fatalf("server Info() = %+v, %v", info, err)
+	}
+	if info, err = client.Info(); err != nil || info.Server || !info.Message || !info.ReadMessage || info.CurrentInstances != 2 {
+		t.Fatalf("client Info() = %+v, %v", info, err)
+	}
+
+	// The kernel doubles the buffer sizes set with setsockopt; Info reports the sizes that were set
+	rc, _ := client.SyscallConn()
+	rc.Control(func(fd uintptr) {
+		unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, 32768)
+		unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, 16384)
+	})
+	if info, err = client.Info(); err != nil || info.OutBufferSize != 32768 || info.InBufferSize != 16384 {
+		t.Fatalf("client Info() after setting the buffer sizes = %+v, %v; want 32768 and 16384", info, err)
+	}
+
+	// In byte read mode the rest of a long message is returned without ErrMoreData
+	if err = client.SetReadMode(PipeReadModeByte); err != nil {
+		t.Fatalf("SetReadMode(PipeReadModeByte): %v", err)
+	}
+	if info, err = client.Info(); err != nil || info.ReadMessage {
+		t.Fatalf("Info() in byte read mode = %+v, %v", info, err)
+	}
+	server.Write([]byte("0123456789"))
+	b := make([]byte, 6)
+	if n, err := client.Read(b); err != nil || string(b[:n]) != "012345" {
+		t.Fatalf("Read() in byte read mode = %q, %v", b[:n], err)
+	}
+	if n, err := client.Read(b); err != nil || string(b[:n]) != "6789" {
+		t.Fatalf("Read() of the rest in byte read mode = %q, %v", b[:n], err)
+	}
+	if _, err = client.Transact(context.Background(), []byte("hello"), b); err == nil {
+		t.Error("Transact() in byte read mode succeeded")
+	}
+	if err = client.SetReadMode(PipeReadModeMessage); err != nil {
+		t.Fatalf("SetReadMode(PipeReadModeMessage): %v", err)
+	}
+	server.Write([]byte("0123456789"))
+	if n, err := client.Read(b); err != ErrMoreData || n != 6 {
+		t.Fatalf("Read() in message read mode = %d, %v; want 6, %v", n, err, ErrMoreData)
+	}
+	if err = client.SetReadMode(0x1); err == nil {
+		t.Error("SetReadMode() with an invalid mode succeeded")
+	}
+
+	byteClient, _ := connPair(t, `\\.\pipe\TestInfo-byte`, PipeTypeByte)
+	if err = byteClient.SetReadMode(PipeReadModeMessage); err == nil {
+		t.Error("SetReadMode(PipeReadModeMessage) on a byte mode pipe succeeded")
+	}
+	if info, err = byteClient.Info(); err != nil || info.Message || info.ReadMessage || info.MaxInstances != -1 {
+		t.Errorf("Info() of a byte mode pipe = %+v, %v", info, err)
+	}
+	ln.Close()
+	if _, err = ln.Info(); err == nil {
+		t.Error("PipeListener.Info() of a closed listener succeeded")
+	}
+}
+
+// TestSyscallConn issues system calls on the sockets behind a connection and a listener
+func TestSyscallConn(t *testing.T) {
+	useSocketDir(t)
+	address := `\\.\pipe\TestSyscallConn`
+	client, server := connPair(t, address, PipeTypeByte)
+
+	rc, err := client.SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn(): %v", err)
+	}
+	var soType int
+	var serr error
+	if err = rc.Control(func(fd uintptr) {
+		soType, serr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TYPE)
+	}); err != nil || serr != nil || soType != unix.SOCK_STREAM {
+		t.Fatalf("Control() = %v, %v, type %d", err, serr, soType)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		server.Write([]byte("raw"))
+	}()
+	b := make([]byte, 8)
+	var n int
+	err = rc.Read(func(fd uintptr) bool {
+		n, serr = unix.Read(int(fd), b)
+		return serr != unix.EAGAIN
+	})
+	if err != nil || serr != nil || string(b[:n]) != "raw" {
+		t.Fatalf("Read() = %v, %v, %q", err, serr, b[:n])
+	}
+
+	client.Close()
+	if err = rc.Control(func(fd uintptr) {}); err == nil {
+		t.Error("Control() after Close() succeeded")
+	}
+
+	ln, err := NewPipeListener(`\\.\pipe\TestSyscallConn-listener`, PipeAccessDuplex, PipeTypeByte, PipeUnlimitedInstances, 512, 512, 0, nil)
+	if err != nil {
+		t.Fatalf("NewPipeListener(): %v", err)
+	}
+	defer ln.Close()
+	lrc, err := ln.SyscallConn()
+	if err != nil {
+		t.Fatalf("PipeListener.SyscallConn(): %v", err)
+	}
+	var accepting int
+	if err = lrc.Control(func(fd uintptr) {
+		accepting, serr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ACCEPTCONN)
+	}); err != nil || serr != nil || accepting != 1 {
+		t.Fatalf("PipeListener Control() = %v, %v, accepting %d", err, serr, accepting)
+	}
+	if err = lrc.Read(func(fd uintptr) bool { return true }); err != syscall.EINVAL {
+		t.Errorf("PipeListener Read() = %v; want %v", err, syscall.EINVAL)
+	}
+}
+
+// tempData writes size bytes of data to a temporary file and returns it positioned at the start with its contents
+func tempData(t testing.TB, size int) (*os.File, []byte) {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	f, err := os.CreateTemp(t.TempDir(), "data")
+	if err != nil {
+		t.Fatalf("CreateTemp(): %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if _, err = f.Write(data); err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek(): %v", err)
+	}
+	return f, data
+}
+
+// TestReadFromWriteTo moves data between pipes, files, and buffers with ReadFrom, WriteTo, and WriteBuffers
+func TestReadFromWriteTo(t *testing.T) {
+	useSocketDir(t)
+	f, data := tempData(t, 1<<20)
+
+	// sendfile from a file, limited to part of it
+	client, server := connPair(t, `\\.\pipe\TestReadFrom-file`, PipeTypeByte)
+	received := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(client)
+		received <- b
+	}()
+	n, err := server.ReadFrom(&io.LimitedReader{R: f, N: 300000})
+	if err != nil || n != 300000 {
+		t.Fatalf("ReadFrom() of a limited file = %d, %v", n, err)
+	}
+	if n, err = server.ReadFrom(f); err != nil || n != int64(len(data)-300000) {
+		t.Fatalf("ReadFrom() of the rest of the file = %d, %v", n, err)
+	}
+	server.Close()
+	if b := <-received; !bytes.Equal(b, data) {
+		t.Fatalf("the client received %d bytes; want the %d bytes of the file", len(b), len(data))
+	}
+
+	// splice from one pipe into another, then into a file
+	c1, s1 := connPair(t, `\\.\pipe\TestReadFrom-pipe1`, PipeTypeByte)
+	c2, s2 := connPair(t, `\\.\pipe\TestReadFrom-pipe2`, PipeTypeByte)
+	go func() {
+		c1.Write(data)
+		c1.Close()
+	}()
+	relayed := make(chan error, 1)
+	go func() {
+		_, err := s2.ReadFrom(s1)
+		s2.Close()
+		relayed <- err
+	}()
+	out, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatalf("Create(): %v", err)
+	}
+	defer out.Close()
+	if n, err = c2.WriteTo(out); err != nil || n != int64(len(data)) {
+		t.Fatalf("WriteTo() of a file = %d, %v", n, err)
+	}
+	if err = <-relayed; err != nil {
+		t.Fatalf("ReadFrom() of a pipe: %v", err)
+	}
+	if b, _ := os.ReadFile(out.Name()); !bytes.Equal(b, data) {
+		t.Fatalf("the file has %d bytes; want %d", len(b), len(data))
+	}
+
+	// Messages larger than the copy buffer are copied whole
+	mc, ms := connPair(t, `\\.\pipe\TestReadFrom-message`, PipeTypeMessage|PipeReadModeMessage)
+	go func() {
+		ms.ReadFrom(bytes.NewReader(data[:100000]))
+		ms.Close()
+	}()
+	var buf bytes.Buffer
+	if n, err = mc.WriteTo(&buf); err != nil || !bytes.Equal(buf.Bytes(), data[:100000]) {
+		t.Fatalf("WriteTo() of a message pipe = %d, %v", n, err)
+	}
+
+	// Vectored writes
+	bc, bs := connPair(t, `\\.\pipe\TestWriteBuffers-byte`, PipeTypeByte)
+	v := net.Buffers{[]byte("a"), []byte("bc"), []byte("def")}
+	if n, err = bs.WriteBuffers(&v); err != nil || n != 6 || len(v) != 0 {
+		t.Fatalf("WriteBuffers() = %d, %v with %d buffers left", n, err, len(v))
+	}
+	b := make([]byte, 16)
+	if n, err := io.ReadAtLeast(bc, b, 6); err != nil || string(b[:n]) != "abcdef" {
+		t.Fatalf("Read() after WriteBuffers() = %q, %v", b[:n], err)
+	}
+	vc, vs := connPair(t, `\\.\pipe\TestWriteBuffers-message`, PipeTypeMessage|PipeReadModeMessage)
+	v = net.Buffers{[]byte("a"), []byte("bc"), []byte("def")}
+	if n, err = vs.WriteBuffers(&v); err != nil || n != 6 || len(v) != 0 {
+		t.Fatalf("WriteBuffers() in message mode = %d, %v with %d buffers left", n, err, len(v))
+	}
+	for _, want := range []string{"a", "bc", "def"} {
+		if n, err := vc.Read(b); err != nil || string(b[:n]) != want {
+			t.Fatalf("Read() = %q, %v; want the message %q", b[:n], err, want)
+		}
+	}
+}
+
+// benchPair returns a byte mode pipe whose client discards everything it reads until the benchmark ends. The pipes
+// of every run of a benchmark are only closed when it ends, so b.N distinguishes their addresses.
+func benchPair(b *testing.B, address string) *PipeConn {
+	useSocketDir(b)
+	client, server := connPair(b, fmt.Sprintf("%s-%d", address, b.N), PipeTypeByte)
+	go io.Copy(io.Discard, readerOnly{client})
+	return server
+}
+
+// BenchmarkReadFrom compares sendfile and splice with copying through a buffer
+func BenchmarkReadFrom(b *testing.B) {
+	const size = 4 << 20
+	b.Run("file/sendfile", func(b *testing.B) {
+		server := benchPair(b, `\\.\pipe\BenchmarkReadFrom`)
+		f, _ := tempData(b, size)
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			f.Seek(0, io.SeekStart)
+			if _, err := server.ReadFrom(f); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("file/buffer", func(b *testing.B) {
+		server := benchPair(b, `\\.\pipe\BenchmarkReadFrom`)
+		f, _ := tempData(b, size)
+		buf := make([]byte, 32*1024)
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			f.Seek(0, io.SeekStart)
+			if _, err := io.CopyBuffer(writerOnly{server}, readerOnly{f}, buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	relay := func(b *testing.B, copy func(dst, src *PipeConn) error) {
+		server := benchPair(b, `\\.\pipe\BenchmarkReadFrom`)
+		client, source := connPair(b, fmt.Sprintf(`\\.\pipe\BenchmarkReadFrom-source-%d`, b.N), PipeTypeByte)
+		chunk := make([]byte, 64*1024)
+		go func() {
+			for i := 0; i < b.N*size/len(chunk); i++ {
+				client.Write(chunk)
+			}
+			client.Close()
+		}()
+		b.SetBytes(size)
+		if err := copy(server, source); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.Run("pipe/splice", func(b *testing.B) {
+		relay(b, func(dst, src *PipeConn) error {
+			_, err := dst.ReadFrom(src)
+			return err
+		})
+	})
+	b.Run("pipe/buffer", func(b *testing.B) {
+		relay(b, func(dst, src *PipeConn) error {
+			_, err := io.CopyBuffer(writerOnly{dst}, readerOnly{src}, make([]byte, 32*1024))
+			return err
+		})
+	})
+}
+
+// BenchmarkWriteBuffers compares a vectored write with writing every buffer on its own
+func BenchmarkWriteBuffers(b *testing.B) {
+	buffers := make(net.Buffers, 64)
+	for i := range buffers {
+		buffers[i] = make([]byte, 512)
+	}
+	b.Run("writev", func(b *testing.B) {
+		server := benchPair(b, `\\.\pipe\BenchmarkWriteBuffers`)
+		b.SetBytes(64 * 512)
+		for i := 0; i < b.N; i++ {
+			v := append(net.Buffers(nil), buffers...)
+			if _, err := server.WriteBuffers(&v); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("write", func(b *testing.B) {
+		server := benchPair(b, `\\.\pipe\BenchmarkWriteBuffers`)
+		b.SetBytes(64 * 512)
+		for i := 0; i < b.N; i++ {
+			for _, buf := range buffers {
+				if _, err := server.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+// TestStats tests the listener and connection counters and their expvar and Prometheus exports
+func TestStats(t *testing.T) {
+	useSocketDir(t)
+	address := `\\.\pipe\TestStats`
+
+	// A client that dials before the pipe exists waits for it
+	dialed := make(chan *PipeConn, 1)
+	go func() {
+		c, err := Dial(address)
+		if err != nil {
+			t.Errorf("Dial(): %v", err)
+		}
+		dialed <- c
+	}()
+	time.Sleep(150 * time.Millisecond)
+	ln, err := NewPipeListener(address, PipeAccessDuplex, PipeTypeByte, 1, 512, 512, 0, nil)
+	if err != nil {
+		t.Fatalf("NewPipeListener(): %v", err)
+	}
+	defer ln.Close()
+	server, err := ln.AcceptPipe()
+	if err != nil {
+		t.Fatalf("AcceptPipe(): %v", err)
+	}
+	client := <-dialed
+	if client == nil {
+		t.FailNow()
+	}
+	defer client.Close()
+	if got := client.Stats().DialRetries; got == 0 {
+		t.Errorf("DialRetries = 0; want the retries of a client that dialed before the pipe existed")
+	}
+
+	if _, err = client.Write([]byte("hello")); err != nil {
+		t.Fatalf("client.Write(): %v", err)
+	}
+	b := make([]byte, 16)
+	if _, err = io.ReadFull(server, b[:5]); err != nil {
+		t.Fatalf("server.Read(): %v", err)
+	}
+	if _, err = server.Write([]byte("hi")); err != nil {
+		t.Fatalf("server.Write(): %v", err)
+	}
+	if _, err = io.ReadFull(client, b[:2]); err != nil {
+		t.Fatalf("client.Read(): %v", err)
+	}
+	server.SetReadDeadline(time.Now())
+	if _, err = server.Read(b); !isTimeout(err) {
+		t.Fatalf("server.Read() past the deadline = %v; want a timeout", err)
+	}
+
+	if got, want := client.Stats(), (ConnStats{BytesIn: 2, BytesOut: 5, DialRetries: client.Stats().DialRetries}); got != want {
+		t.Errorf("client.Stats() = %+v; want %+v", got, want)
+	}
+	if got, want := server.Stats(), (ConnStats{BytesIn: 5, BytesOut: 2, Timeouts: 1}); got != want {
+		t.Errorf("server.Stats() = %+v; want %+v", got, want)
+	}
+
+	// The listener turns away a client beyond its single instance
+	accepted := make(chan *PipeConn, 1)
+	go func() {
+		c, _ := ln.AcceptPipe()
+		accepted <- c
+	}()
+	if extra, err := DialTimeout(address, 200*time.Millisecond); err == nil {
+		extra.Close()
+		t.Fatal("DialTimeout() connected a client beyond the single instance")
+	}
+	if got, want := ln.Stats(), (ListenerStats{Accepts: 1, ActiveConns: 1, BytesIn: 5, BytesOut: 2, Timeouts: 1}); got != want {
+		t.Errorf("ln.Stats() = %+v; want %+v", got, want)
+	}
+	server.Close()
+	late, err := Dial(address)
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	defer late.Close()
+	if c := <-accepted; c != nil {
+		defer c.Close()
+	}
+	stats := ln.Stats()
+	if stats.Accepts != 2 || stats.ActiveConns != 1 {
+		t.Errorf("ln.Stats() = %+v; want 2 accepts and 1 active connection", stats)
+	}
+
+	// expvar names can't be published twice, as happens with -count
+	name := fmt.Sprintf("npipe.TestStats.%d", time.Now().UnixNano())
+	expvar.Publish(name, ln.StatsVar())
+	var published ListenerStats
+	if err = json.Unmarshal([]byte(expvar.Get(name).String()), &published); err != nil {
+		t.Fatalf("the expvar variable is not JSON: %v", err)
+	}
+	if published != stats {
+		t.Errorf("the expvar variable reports %+v; want %+v", published, stats)
+	}
+
+	var exposition bytes.Buffer
+	if err = WritePrometheus(&exposition, ln); err != nil {
+		t.Fatalf("WritePrometheus(): %v", err)
+	}
+	for _, want := range []string{
+		"# TYPE npipe_listener_accepts_total counter\n",
+		`npipe_listener_accepts_total{pipe="\\\\.\\pipe\\TestStats"} 2` + "\n",
+		"# TYPE npipe_listener_active_connections gauge\n",
+		`npipe_listener_rejected_total{pipe="\\\\.\\pipe\\TestStats"} 0` + "\n",
+		`npipe_listener_timeouts_total{pipe="\\\\.\\pipe\\TestStats"} 1` + "\n",
+	} {
+		if !strings.Contains(exposition.String(), want) {
+			t.Errorf("the exposition lacks %q:\n%s", want, exposition.String())
+		}
+	}
+}
+
+// pipeTransport runs the bench workloads on the socket backend
+type pipeTransport struct{}
+
+func (pipeTransport) Listen(address string) (net.Listener, error) {
+	ln, err := Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	return ln, nil
+}
+
+func (pipeTransport) Dial(address string) (net.Conn, error) {
+	c, err := Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// BenchmarkRoundTrip measures the latency of small request and reply exchanges
+func BenchmarkRoundTrip(b *testing.B) {
+	useSocketDir(b)
+	bench.Run(b, "RoundTrip", pipeTransport{}, `\\.\pipe\BenchmarkRoundTrip`)
+}
+
+// BenchmarkThroughput measures bulk writes at several buffer sizes
+func BenchmarkThroughput(b *testing.B) {
+	useSocketDir(b)
+	bench.Run(b, "Throughput", pipeTransport{}, `\\.\pipe\BenchmarkThroughput`)
+}
+
+// BenchmarkAccept measures the number of connections per second a listener accepts
+func BenchmarkAccept(b *testing.B) {
+	useSocketDir(b)
+	bench.Run(b, "Accept", pipeTransport{}, `\\.\pipe\BenchmarkAccept`)
+}
+
+// BenchmarkConcurrent measures how round trips scale with the number of concurrent connections
+func BenchmarkConcurrent(b *testing.B) {
+	useSocketDir(b)
+	bench.Run(b, "Concurrent", pipeTransport{}, `\\.\pipe\BenchmarkConcurrent`)
+}
@@ -13,6 +13,8 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/Ne0nd0g/npipe/conntest"
 )
 
 const (
@@ -641,3 +643,30 @@ func checkDeadline(deadline, end time.Time, t *testing.T) {
 		t.Fatalf("Ended significantly (%v) after deadline", diff)
 	}
 }
+
+// TestConformance runs the net.Conn conformance suite against named pipe connections
+func TestConformance(t *testing.T) {
+	var pairs int
+	conntest.TestConn(t, func() (net.Conn, net.Conn) {
+		pairs++
+		address := fmt.Sprintf(`\\.\pipe\TestConformance%d`, pairs)
+		ln, err := Listen(address)
+		if err != nil {
+			t.Errorf("Listen(%q): %v", address, err)
+			return nil, nil
+		}
+		t.Cleanup(func() { ln.Close() })
+		client, err := Dial(address)
+		if err != nil {
+			t.Errorf("Dial(%q): %v", address, err)
+			return nil, nil
+		}
+		server, err := ln.Accept()
+		if err != nil {
+			client.Close()
+			t.Errorf("Accept(): %v", err)
+			return nil, nil
+		}
+		return client, server
+	})
+}
@@ -0,0 +1,106 @@
+package npipe
+
+import (
+	// Standard
+	"encoding/binary"
+	"fmt"
+	"unicode/utf16"
+)
+
+// PipeInfo describes a named pipe returned by ListPipes
+type PipeInfo struct {
+	// Name is the name of the pipe without the \\<host>\pipe\ prefix
+	Name string
+	// CurrentInstances is the number of instances of the pipe that currently exist
+	CurrentInstances int
+	// MaxInstances is the maximum number of instances that can be created for the pipe, -1 if unlimited
+	MaxInstances int
+}
+
+// HandleInfo describes one end of a named pipe returned by PipeConn.Info and PipeListener.Info
+type HandleInfo struct {
+	// Server is true for the server end of the pipe
+	Server bool
+	// Message is true for pipes created with PipeTypeMessage
+	Message bool
+	// ReadMessage is true while the end reads in message mode, see PipeConn.SetReadMode
+	ReadMessage bool
+	// OutBufferSize and InBufferSize are the sizes in bytes of the buffers for outgoing and incoming data. On Linux they
+	// are the socket buffer sizes without the kernel's bookkeeping overhead, half of what SO_SNDBUF and SO_RCVBUF report.
+	OutBufferSize int
+	InBufferSize  int
+	// CurrentInstances is the number of instances of the pipe that currently exist
+	CurrentInstances int
+	// MaxInstances is the maximum number of instances that can be created for the pipe, -1 if unlimited
+	MaxInstances int
+}
+
+// fileDirectoryInformationSize is the size of the fixed portion of the FILE_DIRECTORY_INFORMATION structure
+// https://learn.microsoft.com/en-us/windows-hardware/drivers/ddi/ntifs/ns-ntifs-_file_directory_information
+// typedef struct _FILE_DIRECTORY_INFORMATION {
+//
+//	ULONG         NextEntryOffset;
+//	ULONG         FileIndex;
+//	LARGE_INTEGER CreationTime;
+//	LARGE_INTEGER LastAccessTime;
+//	LARGE_INTEGER LastWriteTime;
+//	LARGE_INTEGER ChangeTime;
+//	LARGE_INTEGER EndOfFile;
+//	LARGE_INTEGER AllocationSize;
+//	ULONG         FileAttributes;
+//	ULONG         FileNameLength;
+//	WCHAR         FileName[1];
+//
+// } FILE_DIRECTORY_INFORMATION, *PFILE_DIRECTORY_INFORMATION;
+const fileDirectoryInformationSize = 64
+
+// fileDirectoryInformationClass is the FILE_INFORMATION_CLASS value for FILE_DIRECTORY_INFORMATION
+const fileDirectoryInformationClass = 1
+
+// parseDirectoryInformation parses the FILE_DIRECTORY_INFORMATION entries NtQueryDirectoryFile returns for the named
+// pipe file system. The pipe file system reports the current number of instances in EndOfFile and the maximum number
+// of instances in AllocationSize.
+func parseDirectoryInformation(buf []byte) ([]PipeInfo, error) {
+	var pipes []PipeInfo
+	if len(buf) == 0 {
+		return pipes, nil
+	}
+
+	offset := 0
+	for {
+		if len(buf)-offset < fileDirectoryInformationSize {
+			return nil, fmt.Errorf("npipe.parseDirectoryInformation(): entry at offset %d is %d bytes, expected at least %d", offset, len(buf)-offset, fileDirectoryInformationSize)
+		}
+		entry := buf[offset:]
+		next := binary.LittleEndian.Uint32(entry[0:4])
+		endOfFile := int64(binary.LittleEndian.Uint64(entry[40:48]))
+		allocationSize := int64(binary.LittleEndian.Uint64(entry[48:56]))
+		nameLength := int(binary.LittleEndian.Uint32(entry[60:64]))
+
+		if nameLength%2 != 0 || fileDirectoryInformationSize+nameLength > len(entry) {
+			return nil, fmt.Errorf("npipe.parseDirectoryInformation(): entry at offset %d has an invalid file name length of %d", offset, nameLength)
+		}
+		name := make([]uint16, nameLength/2)
+		for i := range name {
+			name[i] = binary.LittleEndian.Uint16(entry[fileDirectoryInformationSize+i*2:])
+		}
+
+		maxInstances := int(allocationSize)
+		if allocationSize < 0 {
+			maxInstances = -1
+		}
+		pipes = append(pipes, PipeInfo{
+			Name:             string(utf16.Decode(name)),
+			CurrentInstances: int(endOfFile),
+			MaxInstances:     maxInstances,
+		})
+
+		if next == 0 {
+			return pipes, nil
+		}
+		if int(next) < fileDirectoryInformationSize+nameLength {
+			return nil, fmt.Errorf("npipe.parseDirectoryInformation(): entry at offset %d has an invalid next entry offset of %d", offset, next)
+		}
+		offset += int(next)
+	}
+}
@@ -0,0 +1,130 @@
+//go:build linux
+
+package npipe
+
+import (
+	// Standard
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	// X Package
+	"golang.org/x/sys/unix"
+)
+
+// ListPipes returns the named pipes that exist on the provided host. Use "." or an empty string for the local host;
+// the socket backend does not support remote hosts.
+// The socket directory is scanned and the number of instances of each pipe is counted from /proc/net/unix, where
+// the listening socket and every accepted connection share the pipe's socket path.
+func ListPipes(host string) ([]PipeInfo, error) {
+	if !isLocalHost(host) {
+		return nil, fmt.Errorf("npipe.ListPipes(): remote host \"%s\" is not supported by the socket backend", host)
+	}
+
+	dir := SocketDir()
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("npipe.ListPipes(): there was an error reading the socket directory: %s", err)
+	}
+
+	counts, err := readUnixSocketCounts()
+	if err != nil {
+		return nil, fmt.Errorf("npipe.ListPipes(): %s", err)
+	}
+
+	var pipes []PipeInfo
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || entry.Type()&os.ModeSocket == 0 {
+			continue
+		}
+		name, err := unescapePipeName(entry.Name())
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		instances, ok := counts[path]
+		if !ok {
+			// Nobody is listening on the socket, the pipe no longer exists
+			continue
+		}
+
+		maxInstances := -1
+		if meta, err := readMeta(path); err == nil && meta.MaxInstances > 0 {
+			maxInstances = meta.MaxInstances
+		}
+		pipes = append(pipes, PipeInfo{Name: name, CurrentInstances: instances, MaxInstances: maxInstances})
+	}
+	return pipes, nil
+}
+
+// readUnixSocketCounts returns the number of Unix domain sockets bound to each path from /proc/net/unix
+func readUnixSocketCounts() (map[string]int, error) {
+	f, err := os.Open("/proc/net/unix")
+	if err != nil {
+		return nil, fmt.Errorf("npipe.readUnixSocketCounts(): there was an error opening /proc/net/unix: %s", err)
+	}
+	defer f.Close()
+	return parseUnixSocketCounts(f)
+}
+
+// parseUnixSocketCounts parses the /proc/net/unix table and counts the sockets bound to each path
+//
+//	Num       RefCount Protocol Flags    Type St Inode Path
+//	0000000057f2580d: 00000002 00000000 00010000 0001 01  2102 /run/npipe/srvsvc
+func parseUnixSocketCounts(r io.Reader) (map[string]int, error) {
+	counts := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	header := true
+	for scanner.Scan() {
+		if header {
+			header = false
+			continue
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			// Unbound socket
+			continue
+		}
+		counts[strings.Join(fields[7:], " ")]++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("npipe.parseUnixSocketCounts(): %s", err)
+	}
+	return counts, nil
+}
+
+// socketBufferSizes sets the buffer sizes of info from the SO_SNDBUF and SO_RCVBUF options of the socket. The kernel
+// reports them doubled to account for its bookkeeping overhead, so they are halved to the sizes available for data.
+func socketBufferSizes(fd int, info *HandleInfo) error {
+	sndbuf, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF)
+	if err != nil {
+		return fmt.Errorf("npipe.socketBufferSizes(): there was an error getting the send buffer size: %s", err)
+	}
+	rcvbuf, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF)
+	if err != nil {
+		return fmt.Errorf("npipe.socketBufferSizes(): there was an error getting the receive buffer size: %s", err)
+	}
+	info.OutBufferSize = sndbuf / 2
+	info.InBufferSize = rcvbuf / 2
+	return nil
+}
+
+// pipeInstances sets the instance counts of info for the pipe whose socket is at path the same way ListPipes does
+func pipeInstances(path string, info *HandleInfo) error {
+	counts, err := readUnixSocketCounts()
+	if err != nil {
+		return fmt.Errorf("npipe.pipeInstances(): %s", err)
+	}
+	info.CurrentInstances = counts[path]
+	info.MaxInstances = -1
+	if meta, err := readMeta(path); err == nil && meta.MaxInstances > 0 {
+		info.MaxInstances = meta.MaxInstances
+	}
+	return nil
+}
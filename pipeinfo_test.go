@@ -0,0 +1,74 @@
+package npipe
+
+import (
+	"reflect"
+	"testing"
+)
+
+// directoryInformationFixture holds three FILE_DIRECTORY_INFORMATION entries as returned by NtQueryDirectoryFile
+// for \\.\pipe\: InitShutdown and srvsvc with unlimited instances, and lsass limited to 10 instances.
+var directoryInformationFixture = []byte{
+	0x58, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xb0, 0xa3, 0xc7, 0xc1, 0xa0, 0xd9, 0x01,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x80, 0x00, 0x00, 0x00, 0x18, 0x00, 0x00, 0x00,
+	0x49, 0x00, 0x6e, 0x00, 0x69, 0x00, 0x74, 0x00, 0x53, 0x00, 0x68, 0x00, 0x75, 0x00, 0x74, 0x00,
+	0x64, 0x00, 0x6f, 0x00, 0x77, 0x00, 0x6e, 0x00, 0x50, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0xb0, 0xa3, 0xc7, 0xc1, 0xa0, 0xd9, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+	0x80, 0x00, 0x00, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x73, 0x00, 0x72, 0x00, 0x76, 0x00, 0x73, 0x00,
+	0x76, 0x00, 0x63, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0xb0, 0xa3, 0xc7, 0xc1, 0xa0, 0xd9, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0a, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x80, 0x00, 0x00, 0x00, 0x0a, 0x00, 0x00, 0x00, 0x6c, 0x00, 0x73, 0x00, 0x61, 0x00, 0x73, 0x00,
+	0x73, 0x00,
+}
+
+// TestParseDirectoryInformation tests that the pipe name and instance counts are read from every entry
+func TestParseDirectoryInformation(t *testing.T) {
+	pipes, err := parseDirectoryInformation(directoryInformationFixture)
+	if err != nil {
+		t.Fatalf("parseDirectoryInformation(): %v", err)
+	}
+	expected := []PipeInfo{
+		{Name: "InitShutdown", CurrentInstances: 3, MaxInstances: -1},
+		{Name: "srvsvc", CurrentInstances: 4, MaxInstances: -1},
+		{Name: "lsass", CurrentInstances: 2, MaxInstances: 10},
+	}
+	if !reflect.DeepEqual(pipes, expected) {
+		t.Fatalf("Unexpected result (expected: %+v, got: %+v)", expected, pipes)
+	}
+}
+
+// TestParseDirectoryInformationEmpty tests that an empty buffer returns no pipes
+func TestParseDirectoryInformationEmpty(t *testing.T) {
+	pipes, err := parseDirectoryInformation(nil)
+	if err != nil {
+		t.Fatalf("parseDirectoryInformation(): %v", err)
+	}
+	if len(pipes) != 0 {
+		t.Fatalf("Expected no pipes, got %+v", pipes)
+	}
+}
+
+// TestParseDirectoryInformationMalformed tests that truncated or corrupt buffers return an error instead of panicking
+func TestParseDirectoryInformationMalformed(t *testing.T) {
+	badNext := append([]byte{}, directoryInformationFixture...)
+	badNext[0] = 0x10
+	oddName := append([]byte{}, directoryInformationFixture...)
+	oddName[60] = 0x17
+	tests := map[string][]byte{
+		"truncated header": directoryInformationFixture[:40],
+		"truncated name":   directoryInformationFixture[:70],
+		"truncated chain":  directoryInformationFixture[:0x58+10],
+		"next too small":   badNext,
+		"odd name length":  oddName,
+	}
+	for name, buf := range tests {
+		if _, err := parseDirectoryInformation(buf); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
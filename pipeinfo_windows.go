@@ -0,0 +1,56 @@
+//go:build windows
+
+package npipe
+
+import (
+	// Standard
+	"fmt"
+
+	// X Package
+	"golang.org/x/sys/windows"
+)
+
+// ListPipes returns the named pipes that exist on the provided host. Use "." or an empty string for the local host.
+// The pipe directory \\<host>\pipe\ is enumerated with NtQueryDirectoryFile.
+func ListPipes(host string) ([]PipeInfo, error) {
+	if host == "" {
+		host = "."
+	}
+	dir := `\\` + host + `\pipe\`
+	pathp, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return nil, fmt.Errorf("npipe.ListPipes(): there was an error converting \"%s\" to a UTF16 pointer: %s", dir, err)
+	}
+	handle, err := windows.CreateFile(
+		pathp,
+		windows.GENERIC_READ,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE,
+		nil,
+		windows.OPEN_EXISTING,
+		0,
+		0,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("npipe.ListPipes(): there was an error calling WINAPI CreateFile for %s: %s", dir, err)
+	}
+	defer windows.CloseHandle(handle)
+
+	var pipes []PipeInfo
+	buf := make([]byte, 64*1024)
+	restart := true
+	for {
+		n, err := ntQueryDirectoryFile(handle, buf, restart)
+		if err == windows.STATUS_NO_MORE_FILES {
+			return pipes, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("npipe.ListPipes(): there was an error calling NtQueryDirectoryFile: %s", err)
+		}
+		entries, err := parseDirectoryInformation(buf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("npipe.ListPipes(): %s", err)
+		}
+		pipes = append(pipes, entries...)
+		restart = false
+	}
+}
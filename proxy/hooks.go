@@ -0,0 +1,57 @@
+//go:build windows || linux
+
+package proxy
+
+import (
+	// Standard
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// Log logs the session, direction, and size of every chunk to l, the standard logger if nil
+func Log(l *log.Logger) Hook {
+	if l == nil {
+		l = log.Default()
+	}
+	return func(c *Chunk) error {
+		l.Printf("session %d %s %d bytes", c.Session, c.Dir, len(c.Data))
+		return nil
+	}
+}
+
+// HexDump writes a header line and a hex dump of every chunk to w. Dumps of concurrent sessions are not interleaved.
+func HexDump(w io.Writer) Hook {
+	var mu sync.Mutex
+	return func(c *Chunk) error {
+		dump := fmt.Sprintf("session %d %s %d bytes\n%s", c.Session, c.Dir, len(c.Data), hex.Dump(c.Data))
+		mu.Lock()
+		defer mu.Unlock()
+		_, err := io.WriteString(w, dump)
+		return err
+	}
+}
+
+// Rewrite replaces every occurrence of old with new. In byte mode a chunk is whatever a single read returned, so an
+// occurrence split across two reads is not replaced.
+func Rewrite(old, new []byte) Hook {
+	return func(c *Chunk) error {
+		if bytes.Contains(c.Data, old) {
+			c.Data = bytes.ReplaceAll(c.Data, old, new)
+		}
+		return nil
+	}
+}
+
+// Drop discards the chunks match returns true for
+func Drop(match func(c *Chunk) bool) Hook {
+	return func(c *Chunk) error {
+		if match(c) {
+			c.Drop = true
+		}
+		return nil
+	}
+}
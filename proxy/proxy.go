@@ -0,0 +1,306 @@
+//go:build windows || linux
+
+// Package proxy sits between pipe clients and a pipe server to observe or modify their traffic.
+//
+// The proxy listens on one pipe address and, for every client, dials the real target and relays the data in both
+// directions. Each chunk passes through the hooks in order, which can log it, dump it, rewrite it, or drop it:
+//
+//	p := &proxy.Proxy{
+//		Addr:   `\\.\pipe\inspect`,
+//		Target: `\\.\pipe\service`,
+//		Hooks: []proxy.Hook{
+//			proxy.HexDump(os.Stdout),
+//			proxy.Rewrite([]byte("guest"), []byte("admin")),
+//		},
+//	}
+//	err := p.ListenAndServe()
+//
+// In message mode every message is read whole and forwarded as a single message. When one side finishes writing,
+// the other side's connection is half-closed so replies still flow back; connections that can't be half-closed, such
+// as named pipes on Windows, are closed instead.
+package proxy
+
+import (
+	// Standard
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// bufferSize is the size of the buffer each direction reads into
+const bufferSize = 64 * 1024
+
+// errNoHalfClose ends a session when one direction finished and the other end can't be half-closed
+var errNoHalfClose = errors.New("the connection can't be half-closed")
+
+// Direction is the direction a chunk travels in
+type Direction uint8
+
+const (
+	// ClientToServer chunks were read from the client and are written to the target
+	ClientToServer Direction = iota + 1
+	// ServerToClient chunks were read from the target and are written to the client
+	ServerToClient
+)
+
+// String returns the direction as an arrow between the ends
+func (d Direction) String() string {
+	switch d {
+	case ClientToServer:
+		return "client->server"
+	case ServerToClient:
+		return "server->client"
+	default:
+		return "unknown"
+	}
+}
+
+// Chunk is data read from one end on its way to the other
+type Chunk struct {
+	// Session identifies the client connection, counting from 1
+	Session uint64
+	// Dir is the direction the chunk travels in
+	Dir Direction
+	// Message is true if the proxy relays whole messages
+	Message bool
+	// Data is written to the other end after the hooks ran. Hooks may replace it; the original is only valid for the
+	// duration of the call.
+	Data []byte
+	// Drop discards the chunk and skips the remaining hooks
+	Drop bool
+}
+
+// Hook inspects or modifies a chunk. Returning an error closes the session.
+type Hook func(c *Chunk) error
+
+// Proxy relays connections from clients on Addr to the pipe server on Target
+type Proxy struct {
+	// Addr is the pipe address the proxy listens on
+	Addr string
+	// Target is the pipe address of the real server
+	Target string
+	// PipeMode is the mode of the pipe the proxy listens on and should match the target's, for example
+	// npipe.PipeTypeMessage|npipe.PipeReadModeMessage to relay whole messages
+	PipeMode uint32
+	// Hooks run on every chunk in order
+	Hooks []Hook
+	// DialTimeout limits how long dialing the target may take, 5 seconds if zero
+	DialTimeout time.Duration
+	// ErrorLog receives the errors that end sessions, the standard logger if nil
+	ErrorLog *log.Logger
+
+	mu       sync.Mutex
+	ln       net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	sessions uint64
+}
+
+// ListenAndServe listens on Addr and serves clients until Close is called
+func (p *Proxy) ListenAndServe() error {
+	ln, err := npipe.NewPipeListener(p.Addr, npipe.PipeAccessDuplex, p.PipeMode, npipe.PipeUnlimitedInstances, 512, 512, 0, nil)
+	if err != nil {
+		return fmt.Errorf("proxy.Proxy.ListenAndServe(): %s", err)
+	}
+	return p.Serve(ln)
+}
+
+// Serve accepts clients on ln and relays each one to Target until Close is called, after which it returns nil.
+// Serve takes ownership of ln.
+func (p *Proxy) Serve(ln net.Listener) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	p.ln = ln
+	p.mu.Unlock()
+
+	for {
+		client, err := ln.Accept()
+		if err != nil {
+			p.mu.Lock()
+			closed := p.closed
+			p.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return fmt.Errorf("proxy.Proxy.Serve(): %s", err)
+		}
+		go func() {
+			if err := p.ServeConn(client); err != nil {
+				p.logf("%s", err)
+			}
+		}()
+	}
+}
+
+// ServeConn dials Target and relays client to it until both directions finished or either failed
+func (p *Proxy) ServeConn(client net.Conn) error {
+	p.mu.Lock()
+	p.sessions++
+	session := p.sessions
+	p.mu.Unlock()
+	if !p.track(client) {
+		client.Close()
+		return nil
+	}
+	defer p.untrack(client)
+	defer client.Close()
+
+	timeout := p.DialTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	target, err := npipe.DialTimeout(p.Target, timeout)
+	if err != nil {
+		return fmt.Errorf("proxy.Proxy.ServeConn(): session %d: there was an error dialing %s: %s", session, p.Target, err)
+	}
+	if !p.track(target) {
+		target.Close()
+		return nil
+	}
+	defer p.untrack(target)
+	defer target.Close()
+
+	message := p.PipeMode&npipe.PipeReadModeMessage != 0
+	errs := make(chan error, 2)
+	go func() {
+		errs <- p.relay(session, ClientToServer, target, client, message)
+	}()
+	go func() {
+		errs <- p.relay(session, ServerToClient, client, target, message)
+	}()
+	var stopped bool
+	var first error
+	for i := 0; i < 2; i++ {
+		err = <-errs
+		if err == nil || stopped {
+			// Errors after the session was stopped come from closing the connections
+			continue
+		}
+		// Unblock the other direction
+		stopped = true
+		client.Close()
+		target.Close()
+		if err != errNoHalfClose {
+			first = fmt.Errorf("proxy.Proxy.ServeConn(): session %d: %s", session, err)
+		}
+	}
+	return first
+}
+
+// relay copies chunks from src to dst through the hooks and half-closes dst once src reached the end
+func (p *Proxy) relay(session uint64, dir Direction, dst, src net.Conn, message bool) error {
+	buf := make([]byte, bufferSize)
+	var msg []byte
+	for {
+		n, err := src.Read(buf)
+		if message && err == npipe.ErrMoreData {
+			msg = append(msg, buf[:n]...)
+			continue
+		}
+		data := buf[:n]
+		if msg != nil {
+			data = append(msg, data...)
+			msg = nil
+		}
+		if len(data) > 0 {
+			c := &Chunk{Session: session, Dir: dir, Message: message, Data: data}
+			if herr := p.runHooks(c); herr != nil {
+				return fmt.Errorf("%s hook: %s", dir, herr)
+			}
+			if !c.Drop {
+				if _, werr := dst.Write(c.Data); werr != nil {
+					return fmt.Errorf("%s write: %s", dir, werr)
+				}
+			}
+		}
+		if err == io.EOF {
+			return closeWrite(dst)
+		}
+		if err != nil {
+			return fmt.Errorf("%s read: %s", dir, err)
+		}
+	}
+}
+
+// runHooks passes c through the hooks until one drops it
+func (p *Proxy) runHooks(c *Chunk) error {
+	for _, hook := range p.Hooks {
+		if err := hook(c); err != nil {
+			return err
+		}
+		if c.Drop {
+			return nil
+		}
+	}
+	return nil
+}
+
+// closeWrite half-closes conn or returns errNoHalfClose if it can't be half-closed
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		if err := cw.CloseWrite(); err == nil {
+			return nil
+		}
+	}
+	return errNoHalfClose
+}
+
+// Close stops accepting clients and closes every session
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	var err error
+	if p.ln != nil {
+		err = p.ln.Close()
+	}
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+	return err
+}
+
+// track registers conn so Close can close it; it returns false if the proxy is closed
+func (p *Proxy) track(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	if p.conns == nil {
+		p.conns = make(map[net.Conn]struct{})
+	}
+	p.conns[conn] = struct{}{}
+	return true
+}
+
+// untrack removes conn from the connections Close closes
+func (p *Proxy) untrack(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, conn)
+}
+
+// logf logs to ErrorLog or the standard logger
+func (p *Proxy) logf(format string, args ...interface{}) {
+	if p.ErrorLog != nil {
+		p.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	// Standard
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// startProxy serves p on a new pipe in front of a target pipe served by handle
+func startProxy(t *testing.T, p *Proxy, handle func(conn *npipe.PipeConn)) {
+	t.Setenv("NPIPE_SOCKET_DIR", t.TempDir())
+	target, err := npipe.NewPipeListener(p.Target, npipe.PipeAccessDuplex, p.PipeMode, npipe.PipeUnlimitedInstances, 512, 512, 0, nil)
+	if err != nil {
+		t.Fatalf("NewPipeListener(%q): %v", p.Target, err)
+	}
+	t.Cleanup(func() { target.Close() })
+	go func() {
+		for {
+			conn, err := target.AcceptPipe()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+
+	ln, err := npipe.NewPipeListener(p.Addr, npipe.PipeAccessDuplex, p.PipeMode, npipe.PipeUnlimitedInstances, 512, 512, 0, nil)
+	if err != nil {
+		t.Fatalf("NewPipeListener(%q): %v", p.Addr, err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- p.Serve(ln)
+	}()
+	t.Cleanup(func() {
+		p.Close()
+		if err := <-served; err != nil {
+			t.Errorf("Serve(): %v", err)
+		}
+	})
+}
+
+// readMessages reads whole messages until the end of the session
+func readMessages(conn io.Reader) ([]string, error) {
+	var msgs []string
+	var msg []byte
+	b := make([]byte, 1024)
+	for {
+		n, err := conn.Read(b)
+		msg = append(msg, b[:n]...)
+		if err == npipe.ErrMoreData {
+			continue
+		}
+		if err == io.EOF {
+			return msgs, nil
+		}
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, string(msg))
+		msg = nil
+	}
+}
+
+// TestProxyMessageMode relays messages through rewrite, drop, and hex dump hooks and half-closes the target when
+// the client finished writing
+func TestProxyMessageMode(t *testing.T) {
+	dump := &syncBuffer{}
+	p := &Proxy{
+		Addr:     `\\.\pipe\TestProxyMessageMode`,
+		Target:   `\\.\pipe\TestProxyMessageModeTarget`,
+		PipeMode: npipe.PipeTypeMessage | npipe.PipeReadModeMessage,
+		Hooks: []Hook{
+			Drop(func(c *Chunk) bool { return string(c.Data) == "secret" }),
+			Rewrite([]byte("guest"), []byte("admin")),
+			HexDump(dump),
+		},
+	}
+	received := make(chan []string, 1)
+	startProxy(t, p, func(conn *npipe.PipeConn) {
+		defer conn.Close()
+		msgs, err := readMessages(conn)
+		if err != nil {
+			t.Errorf("readMessages(): %v", err)
+		}
+		received <- msgs
+		// The client half-closed its end, replies still reach it
+		for _, msg := range msgs {
+			conn.Write([]byte(strings.ToUpper(msg[:5])))
+		}
+	})
+
+	conn, err := npipe.DialTimeout(p.Addr, time.Second)
+	if err != nil {
+		t.Fatalf("DialTimeout(): %v", err)
+	}
+	defer conn.Close()
+	large := strings.Repeat("x", 70000)
+	for _, msg := range []string{"hello guest", "secret", large} {
+		if _, err = conn.Write([]byte(msg)); err != nil {
+			t.Fatalf("Write(): %v", err)
+		}
+	}
+	if err = conn.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite(): %v", err)
+	}
+
+	msgs := <-received
+	if len(msgs) != 2 || msgs[0] != "hello admin" || msgs[1] != large {
+		t.Fatalf("the target received %d messages, the first is %.20q", len(msgs), msgs)
+	}
+	replies, err := readMessages(conn)
+	if err != nil || len(replies) != 2 || replies[0] != "HELLO" || replies[1] != "XXXXX" {
+		t.Fatalf("readMessages() = %q, %v", replies, err)
+	}
+	if !strings.Contains(dump.String(), "session 1 client->server 11 bytes\n00000000  68 65 6c 6c 6f 20 61 64") {
+		t.Fatalf("unexpected hex dump:\n%.200s", dump)
+	}
+}
+
+// TestProxyByteMode relays a byte stream in both directions and logs the chunks
+func TestProxyByteMode(t *testing.T) {
+	logs := &syncBuffer{}
+	p := &Proxy{
+		Addr:   `\\.\pipe\TestProxyByteMode`,
+		Target: `\\.\pipe\TestProxyByteModeTarget`,
+		Hooks:  []Hook{Log(log.New(logs, "", 0))},
+	}
+	startProxy(t, p, func(conn *npipe.PipeConn) {
+		defer conn.Close()
+		request, _ := io.ReadAll(conn)
+		conn.Write(bytes.ToUpper(request))
+	})
+
+	conn, err := npipe.DialTimeout(p.Addr, time.Second)
+	if err != nil {
+		t.Fatalf("DialTimeout(): %v", err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+	conn.CloseWrite()
+	reply, err := io.ReadAll(conn)
+	if err != nil || string(reply) != "PING" {
+		t.Fatalf("io.ReadAll() = %q, %v", reply, err)
+	}
+	for _, line := range []string{"session 1 client->server 4 bytes", "session 1 server->client 4 bytes"} {
+		if !strings.Contains(logs.String(), line) {
+			t.Fatalf("the log is missing %q:\n%s", line, logs)
+		}
+	}
+}
+
+// TestProxyHookError tests that a failing hook ends the session and is logged
+func TestProxyHookError(t *testing.T) {
+	logs := &syncBuffer{}
+	p := &Proxy{
+		Addr:     `\\.\pipe\TestProxyHookError`,
+		Target:   `\\.\pipe\TestProxyHookErrorTarget`,
+		Hooks:    []Hook{func(c *Chunk) error { return errors.New("rejected") }},
+		ErrorLog: log.New(logs, "", 0),
+	}
+	startProxy(t, p, func(conn *npipe.PipeConn) {
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	})
+
+	conn, err := npipe.DialTimeout(p.Addr, time.Second)
+	if err != nil {
+		t.Fatalf("DialTimeout(): %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("anything"))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected io.EOF but received %v", err)
+	}
+	// The session is logged after the connections were closed
+	for deadline := time.Now().Add(time.Second); !strings.Contains(logs.String(), "rejected"); {
+		if time.Now().After(deadline) {
+			t.Fatalf("the error was not logged: %q", logs)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,139 @@
+//go:build windows || linux
+
+package dcerpc
+
+import (
+	// Standard
+	"fmt"
+	"net"
+	"sync"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// Client calls the operations of one interface over a bound connection. Calls are serialized because ncacn_np
+// doesn't multiplex them.
+type Client struct {
+	conn         net.Conn
+	assocGroupID uint32
+
+	mu        sync.Mutex
+	callID    uint32
+	contextID uint16
+	maxXmit   int
+	maxRecv   int
+}
+
+// Dial connects to the pipe at address and binds to iface
+func Dial(address string, iface SyntaxID) (*Client, error) {
+	conn, err := npipe.Dial(address)
+	if err != nil {
+		return nil, fmt.Errorf("dcerpc.Dial(): %s", err)
+	}
+	c, err := NewClient(conn, iface)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClient binds to iface with the NDR transfer syntax over a connected pipe. The client owns conn afterwards.
+func NewClient(conn net.Conn, iface SyntaxID) (*Client, error) {
+	c := &Client{conn: conn, callID: 1, maxRecv: DefaultMaxFrag}
+	bind := &Packet{
+		Flags:  FlagFirstFrag | FlagLastFrag,
+		CallID: c.callID,
+		Body: &Bind{
+			MaxXmitFrag: DefaultMaxFrag,
+			MaxRecvFrag: DefaultMaxFrag,
+			Contexts:    []Context{{ID: c.contextID, AbstractSyntax: iface, TransferSyntaxes: []SyntaxID{NDR}}},
+		},
+	}
+	if err := writePacket(conn, bind); err != nil {
+		return nil, fmt.Errorf("dcerpc.NewClient(): there was an error sending the bind: %s", err)
+	}
+	p, err := readPacket(conn, c.maxRecv)
+	if err != nil {
+		return nil, fmt.Errorf("dcerpc.NewClient(): there was an error receiving the answer to the bind: %s", err)
+	}
+	switch body := p.Body.(type) {
+	case *BindAck:
+		if len(body.Results) != 1 {
+			return nil, fmt.Errorf("dcerpc.NewClient(): expected 1 result but received %d", len(body.Results))
+		}
+		if r := body.Results[0]; r.Result != ResultAcceptance {
+			return nil, fmt.Errorf("dcerpc.NewClient(): the server rejected %s with result %d and reason %d", iface, r.Result, r.Reason)
+		}
+		// The server's receive size limits what the client transmits and the other way around
+		c.maxXmit = int(body.MaxRecvFrag)
+		if c.maxXmit > DefaultMaxFrag || c.maxXmit < minMaxFrag {
+			c.maxXmit = DefaultMaxFrag
+		}
+		c.assocGroupID = body.AssocGroupID
+		return c, nil
+	case *BindNak:
+		return nil, fmt.Errorf("dcerpc.NewClient(): the server rejected the bind with reason %d", body.Reason)
+	default:
+		return nil, fmt.Errorf("dcerpc.NewClient(): expected a bind_ack but received a %s", p.Body.Type())
+	}
+}
+
+// Call sends the request stub data for opnum and returns the response stub data. Requests and responses larger than
+// the negotiated fragment size are fragmented and reassembled. A fault is returned as a *FaultError.
+func (c *Client) Call(opnum uint16, stub []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.callID++
+	id := c.callID
+	pieces := fragments(stub, c.maxXmit, requestHeaderSize)
+	remaining := len(stub)
+	for i, piece := range pieces {
+		p := &Packet{
+			Flags:  fragmentFlags(i, len(pieces)),
+			CallID: id,
+			Body:   &Request{AllocHint: uint32(remaining), ContextID: c.contextID, Opnum: opnum, Stub: piece},
+		}
+		if err := writePacket(c.conn, p); err != nil {
+			return nil, fmt.Errorf("dcerpc.Client.Call(): there was an error sending call %d: %s", id, err)
+		}
+		remaining -= len(piece)
+	}
+
+	var out []byte
+	for first := true; ; first = false {
+		p, err := readPacket(c.conn, c.maxRecv)
+		if err != nil {
+			return nil, fmt.Errorf("dcerpc.Client.Call(): there was an error receiving the answer to call %d: %s", id, err)
+		}
+		if p.CallID != id {
+			return nil, fmt.Errorf("dcerpc.Client.Call(): received call ID %d while waiting for call %d", p.CallID, id)
+		}
+		if first && p.Flags&FlagFirstFrag == 0 {
+			return nil, fmt.Errorf("dcerpc.Client.Call(): the answer to call %d doesn't start with a first fragment", id)
+		}
+		switch body := p.Body.(type) {
+		case *Response:
+			out = append(out, body.Stub...)
+		case *Fault:
+			return nil, &FaultError{Status: body.Status, DidNotExecute: p.Flags&FlagDidNotExecute != 0}
+		default:
+			return nil, fmt.Errorf("dcerpc.Client.Call(): expected a response to call %d but received a %s", id, p.Body.Type())
+		}
+		if p.Flags&FlagLastFrag != 0 {
+			return out, nil
+		}
+	}
+}
+
+// AssocGroupID returns the association group the server assigned in the bind_ack
+func (c *Client) AssocGroupID() uint32 {
+	return c.assocGroupID
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,147 @@
+package dcerpc
+
+import (
+	// Standard
+	"bytes"
+	"strings"
+	"testing"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// echo is the test interface: opnum 0 echoes the request, opnum 1 fails with access denied
+var echo = SyntaxID{UUID: MustParseUUID("6bffd098-a112-3610-9833-46c3f87e345a"), Major: 1}
+
+// serve starts a stub server on a message mode pipe and returns its address
+func serve(t *testing.T, name string, s *Server) string {
+	t.Setenv("NPIPE_SOCKET_DIR", t.TempDir())
+	address := `\\.\pipe\` + name
+	ln, err := npipe.NewPipeListener(address, npipe.PipeAccessDuplex, npipe.PipeTypeMessage|npipe.PipeReadModeMessage, npipe.PipeUnlimitedInstances, 512, 512, 0, nil)
+	if err != nil {
+		t.Fatalf("NewPipeListener(%q): %v", address, err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go s.Serve(ln)
+	return address
+}
+
+// echoServer returns a server with the echo interface
+func echoServer(maxFrag uint16) *Server {
+	return &Server{
+		MaxFrag:       maxFrag,
+		SecondaryAddr: `\PIPE\echo`,
+		Handlers: map[SyntaxID]Handler{echo: func(opnum uint16, stub []byte) ([]byte, error) {
+			switch opnum {
+			case 0:
+				return stub, nil
+			case 1:
+				return nil, &FaultError{Status: StatusAccessDenied}
+			default:
+				return nil, &FaultError{Status: StatusOpRangeError, DidNotExecute: true}
+			}
+		}},
+	}
+}
+
+// TestClientCall binds, calls, and receives faults from the stub server
+func TestClientCall(t *testing.T) {
+	address := serve(t, "TestClientCall", echoServer(0))
+	client, err := Dial(address, echo)
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	defer client.Close()
+	if client.AssocGroupID() == 0 {
+		t.Fatal("the server didn't assign an association group")
+	}
+
+	for _, stub := range [][]byte{nil, []byte("hello")} {
+		out, err := client.Call(0, stub)
+		if err != nil || !bytes.Equal(out, stub) {
+			t.Fatalf("Call(0, %q) = %q, %v", stub, out, err)
+		}
+	}
+	_, err = client.Call(1, nil)
+	if fault, ok := err.(*FaultError); !ok || fault.Status != StatusAccessDenied || fault.DidNotExecute {
+		t.Fatalf("expected an access denied fault but received %v", err)
+	}
+	_, err = client.Call(99, nil)
+	if fault, ok := err.(*FaultError); !ok || fault.Status != StatusOpRangeError || !fault.DidNotExecute {
+		t.Fatalf("expected an opnum out of range fault but received %v", err)
+	}
+	// The association survives faults
+	if out, err := client.Call(0, []byte("again")); err != nil || string(out) != "again" {
+		t.Fatalf("Call() after a fault = %q, %v", out, err)
+	}
+}
+
+// TestClientFragmentation sends and receives stub data spanning many fragments of the smallest allowed size
+func TestClientFragmentation(t *testing.T) {
+	address := serve(t, "TestClientFragmentation", echoServer(minMaxFrag))
+	client, err := Dial(address, echo)
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	defer client.Close()
+	if client.maxXmit != minMaxFrag {
+		t.Fatalf("expected to negotiate %d byte fragments but negotiated %d", minMaxFrag, client.maxXmit)
+	}
+
+	stub := bytes.Repeat([]byte("0123456789"), 1000)
+	out, err := client.Call(0, stub)
+	if err != nil || !bytes.Equal(out, stub) {
+		t.Fatalf("Call() returned %d bytes, %v", len(out), err)
+	}
+}
+
+// TestBindRejected tests that binding to an interface the server doesn't have fails
+func TestBindRejected(t *testing.T) {
+	address := serve(t, "TestBindRejected", echoServer(0))
+	_, err := Dial(address, SRVSVC)
+	if err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Fatalf("expected the bind to be rejected but received %v", err)
+	}
+}
+
+// TestCallIDMismatch tests that a response to another call is detected
+func TestCallIDMismatch(t *testing.T) {
+	t.Setenv("NPIPE_SOCKET_DIR", t.TempDir())
+	address := `\\.\pipe\TestCallIDMismatch`
+	ln, err := npipe.NewPipeListener(address, npipe.PipeAccessDuplex, npipe.PipeTypeMessage|npipe.PipeReadModeMessage, npipe.PipeUnlimitedInstances, 512, 512, 0, nil)
+	if err != nil {
+		t.Fatalf("NewPipeListener(): %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Bind normally, then answer the call with the wrong call ID
+		p, err := readPacket(conn, DefaultMaxFrag)
+		if err != nil {
+			return
+		}
+		writePacket(conn, &Packet{Flags: FlagFirstFrag | FlagLastFrag, CallID: p.CallID, Body: &BindAck{
+			MaxXmitFrag: DefaultMaxFrag,
+			MaxRecvFrag: DefaultMaxFrag,
+			Results:     []Result{{TransferSyntax: NDR}},
+		}})
+		if p, err = readPacket(conn, DefaultMaxFrag); err != nil {
+			return
+		}
+		writePacket(conn, &Packet{Flags: FlagFirstFrag | FlagLastFrag, CallID: p.CallID + 1, Body: &Response{}})
+		readPacket(conn, DefaultMaxFrag)
+	}()
+
+	client, err := Dial(address, echo)
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	defer client.Close()
+	if _, err = client.Call(0, nil); err == nil || !strings.Contains(err.Error(), "received call ID 3 while waiting for call 2") {
+		t.Fatalf("expected a call ID mismatch but received %v", err)
+	}
+}
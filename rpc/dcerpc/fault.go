@@ -0,0 +1,49 @@
+package dcerpc
+
+import (
+	// Standard
+	"fmt"
+)
+
+// Status codes carried by fault PDUs
+const (
+	// StatusAccessDenied is the Win32 ERROR_ACCESS_DENIED
+	StatusAccessDenied uint32 = 0x00000005
+	// StatusBadStubData is the Win32 RPC_X_BAD_STUB_DATA returned when the stub data can't be decoded
+	StatusBadStubData uint32 = 0x000006f7
+	// StatusOpRangeError is nca_s_op_rng_error, the opnum is out of range
+	StatusOpRangeError uint32 = 0x1c010002
+	// StatusUnknownInterface is nca_s_unk_if, the presentation context isn't bound
+	StatusUnknownInterface uint32 = 0x1c010003
+	// StatusProtocolError is nca_s_proto_error, the PDU violated the protocol
+	StatusProtocolError uint32 = 0x1c01000b
+	// StatusUnspecified is nca_s_fault_unspec, the call failed for an unspecified reason
+	StatusUnspecified uint32 = 0x1c000012
+)
+
+// statusNames are the names of the well-known status codes
+var statusNames = map[uint32]string{
+	StatusAccessDenied:     "access denied",
+	StatusBadStubData:      "bad stub data",
+	StatusOpRangeError:     "nca_s_op_rng_error",
+	StatusUnknownInterface: "nca_s_unk_if",
+	StatusProtocolError:    "nca_s_proto_error",
+	StatusUnspecified:      "nca_s_fault_unspec",
+}
+
+// FaultError is returned by Client.Call when the server answered with a fault. Handlers return it to send a specific
+// status.
+type FaultError struct {
+	// Status is the NCA or Win32 status code
+	Status uint32
+	// DidNotExecute is true if the server reported that the call did not execute
+	DidNotExecute bool
+}
+
+// Error returns the status code and its name when it is well-known
+func (e *FaultError) Error() string {
+	if name, ok := statusNames[e.Status]; ok {
+		return fmt.Sprintf("dcerpc: fault 0x%08x (%s)", e.Status, name)
+	}
+	return fmt.Sprintf("dcerpc: fault 0x%08x", e.Status)
+}
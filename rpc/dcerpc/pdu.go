@@ -0,0 +1,646 @@
+// Package dcerpc implements the connection-oriented DCE/RPC protocol (MS-RPCE) over named pipes, the ncacn_np
+// protocol sequence used by endpoints such as \\.\pipe\srvsvc.
+//
+// Dial binds to an interface over a new pipe connection, NewClient over an existing one, and Call sends a request
+// and returns the reassembled response:
+//
+//	client, err := dcerpc.Dial(`\\.\pipe\srvsvc`, dcerpc.SRVSVC)
+//	defer client.Close()
+//	stub, err := client.Call(15, request) // NetrShareEnum
+//
+// The stub data of requests and responses is opaque to this package. Server is a minimal endpoint that dispatches
+// requests to handlers, meant for tests and for mocking services. Authentication is not supported.
+package dcerpc
+
+import (
+	// Standard
+	"encoding/binary"
+	"fmt"
+)
+
+// PacketType is the PTYPE of a PDU
+type PacketType uint8
+
+const (
+	// TypeRequest is a request from the client
+	TypeRequest PacketType = 0
+	// TypeResponse is a successful response
+	TypeResponse PacketType = 2
+	// TypeFault is a failed response
+	TypeFault PacketType = 3
+	// TypeBind opens an association
+	TypeBind PacketType = 11
+	// TypeBindAck accepts an association
+	TypeBindAck PacketType = 12
+	// TypeBindNak rejects an association
+	TypeBindNak PacketType = 13
+)
+
+// String returns the name of the packet type
+func (t PacketType) String() string {
+	switch t {
+	case TypeRequest:
+		return "request"
+	case TypeResponse:
+		return "response"
+	case TypeFault:
+		return "fault"
+	case TypeBind:
+		return "bind"
+	case TypeBindAck:
+		return "bind_ack"
+	case TypeBindNak:
+		return "bind_nak"
+	default:
+		return fmt.Sprintf("ptype(%d)", uint8(t))
+	}
+}
+
+// Flags are the pfc_flags of a PDU
+type Flags uint8
+
+const (
+	// FlagFirstFrag marks the first fragment of a call
+	FlagFirstFrag Flags = 0x01
+	// FlagLastFrag marks the last fragment of a call
+	FlagLastFrag Flags = 0x02
+	// FlagPendingCancel is set when a cancel was pending at the sender
+	FlagPendingCancel Flags = 0x04
+	// FlagConcMpx marks support for concurrent multiplexing in bind PDUs
+	FlagConcMpx Flags = 0x10
+	// FlagDidNotExecute is set on faults for calls that did not execute
+	FlagDidNotExecute Flags = 0x20
+	// FlagObjectUUID is set on requests carrying an object UUID
+	FlagObjectUUID Flags = 0x80
+)
+
+const (
+	// headerSize is the size of the common header
+	headerSize = 16
+	// requestHeaderSize and responseHeaderSize are the sizes of the headers before the stub data
+	requestHeaderSize  = headerSize + 8
+	responseHeaderSize = headerSize + 8
+	// DefaultMaxFrag is the fragment size Windows negotiates
+	DefaultMaxFrag = 4280
+	// minMaxFrag is the smallest fragment size an implementation must accept
+	minMaxFrag = 1432
+)
+
+// dataRep is the packed data representation this package sends: little endian integers, ASCII characters, and IEEE
+// floating point
+var dataRep = [4]byte{0x10, 0, 0, 0}
+
+// Body is the type specific part of a PDU: *Bind, *BindAck, *BindNak, *Request, *Response, or *Fault
+type Body interface {
+	// Type returns the packet type of the body
+	Type() PacketType
+	// marshal appends the body to b, which holds the PDU so far
+	marshal(b []byte) []byte
+	// unmarshal decodes the body from d
+	unmarshal(d *decoder, flags Flags) error
+}
+
+// Packet is a DCE/RPC connection-oriented PDU without authentication
+type Packet struct {
+	// Flags are the pfc_flags
+	Flags Flags
+	// CallID ties the fragments of requests and responses together
+	CallID uint32
+	// Body is the type specific part
+	Body Body
+}
+
+// MarshalBinary encodes the PDU
+func (p *Packet) MarshalBinary() ([]byte, error) {
+	b := make([]byte, headerSize, DefaultMaxFrag)
+	b[0] = 5
+	b[2] = byte(p.Body.Type())
+	b[3] = byte(p.Flags)
+	copy(b[4:8], dataRep[:])
+	binary.LittleEndian.PutUint32(b[12:], p.CallID)
+	b = p.Body.marshal(b)
+	if len(b) > 0xffff {
+		return nil, fmt.Errorf("dcerpc.Packet.MarshalBinary(): the %s PDU is %d bytes long, the limit is 65535", p.Body.Type(), len(b))
+	}
+	binary.LittleEndian.PutUint16(b[8:], uint16(len(b)))
+	return b, nil
+}
+
+// UnmarshalBinary decodes a single PDU that fills b
+func (p *Packet) UnmarshalBinary(b []byte) error {
+	if len(b) < headerSize {
+		return fmt.Errorf("dcerpc.Packet.UnmarshalBinary(): the PDU is %d bytes long, shorter than its header", len(b))
+	}
+	if b[0] != 5 || b[1] != 0 {
+		return fmt.Errorf("dcerpc.Packet.UnmarshalBinary(): unsupported protocol version %d.%d", b[0], b[1])
+	}
+	if b[4]&0xf0 != 0x10 {
+		return fmt.Errorf("dcerpc.Packet.UnmarshalBinary(): unsupported big endian data representation")
+	}
+	if size := int(binary.LittleEndian.Uint16(b[8:])); size != len(b) {
+		return fmt.Errorf("dcerpc.Packet.UnmarshalBinary(): the fragment length is %d but the PDU is %d bytes long", size, len(b))
+	}
+	if auth := binary.LittleEndian.Uint16(b[10:]); auth != 0 {
+		return fmt.Errorf("dcerpc.Packet.UnmarshalBinary(): authenticated PDUs are not supported")
+	}
+	p.Flags = Flags(b[3])
+	p.CallID = binary.LittleEndian.Uint32(b[12:])
+	switch t := PacketType(b[2]); t {
+	case TypeRequest:
+		p.Body = &Request{}
+	case TypeResponse:
+		p.Body = &Response{}
+	case TypeFault:
+		p.Body = &Fault{}
+	case TypeBind:
+		p.Body = &Bind{}
+	case TypeBindAck:
+		p.Body = &BindAck{}
+	case TypeBindNak:
+		p.Body = &BindNak{}
+	default:
+		return fmt.Errorf("dcerpc.Packet.UnmarshalBinary(): unsupported %s PDU", t)
+	}
+	d := &decoder{b: b, off: headerSize}
+	if err := p.Body.unmarshal(d, p.Flags); err != nil {
+		return fmt.Errorf("dcerpc.Packet.UnmarshalBinary(): invalid %s PDU: %s", p.Body.Type(), err)
+	}
+	return nil
+}
+
+// decoder reads little endian fields from a PDU
+type decoder struct {
+	b   []byte
+	off int
+}
+
+// next returns the next n bytes
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.b)-d.off < n {
+		return nil, fmt.Errorf("truncated at offset %d", d.off)
+	}
+	b := d.b[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+func (d *decoder) u8() (uint8, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *decoder) u16() (uint16, error) {
+	b, err := d.next(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(b), nil
+}
+
+func (d *decoder) u32() (uint32, error) {
+	b, err := d.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+func (d *decoder) syntax() (SyntaxID, error) {
+	b, err := d.next(20)
+	if err != nil {
+		return SyntaxID{}, err
+	}
+	return SyntaxID{
+		UUID:  decodeUUID(b),
+		Major: binary.LittleEndian.Uint16(b[16:]),
+		Minor: binary.LittleEndian.Uint16(b[18:]),
+	}, nil
+}
+
+// align skips the padding up to the next multiple of n from the start of the PDU
+func (d *decoder) align(n int) error {
+	_, err := d.next((n - d.off%n) % n)
+	return err
+}
+
+// rest returns the remaining bytes as a copy
+func (d *decoder) rest() []byte {
+	b := append([]byte(nil), d.b[d.off:]...)
+	d.off = len(d.b)
+	return b
+}
+
+// appendSyntax appends an NDR encoded syntax identifier
+func appendSyntax(b []byte, s SyntaxID) []byte {
+	b = appendUUID(b, s.UUID)
+	b = binary.LittleEndian.AppendUint16(b, s.Major)
+	return binary.LittleEndian.AppendUint16(b, s.Minor)
+}
+
+// Context is a presentation context proposed in a bind
+type Context struct {
+	// ID is used by requests to select the context
+	ID uint16
+	// AbstractSyntax is the interface
+	AbstractSyntax SyntaxID
+	// TransferSyntaxes are the proposed encodings of the stub data
+	TransferSyntaxes []SyntaxID
+}
+
+// Bind proposes presentation contexts to open an association
+type Bind struct {
+	MaxXmitFrag  uint16
+	MaxRecvFrag  uint16
+	AssocGroupID uint32
+	Contexts     []Context
+}
+
+// Type returns TypeBind
+func (*Bind) Type() PacketType { return TypeBind }
+
+func (p *Bind) marshal(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, p.MaxXmitFrag)
+	b = binary.LittleEndian.AppendUint16(b, p.MaxRecvFrag)
+	b = binary.LittleEndian.AppendUint32(b, p.AssocGroupID)
+	b = append(b, byte(len(p.Contexts)), 0, 0, 0)
+	for _, c := range p.Contexts {
+		b = binary.LittleEndian.AppendUint16(b, c.ID)
+		b = append(b, byte(len(c.TransferSyntaxes)), 0)
+		b = appendSyntax(b, c.AbstractSyntax)
+		for _, s := range c.TransferSyntaxes {
+			b = appendSyntax(b, s)
+		}
+	}
+	return b
+}
+
+func (p *Bind) unmarshal(d *decoder, _ Flags) (err error) {
+	if p.MaxXmitFrag, err = d.u16(); err != nil {
+		return err
+	}
+	if p.MaxRecvFrag, err = d.u16(); err != nil {
+		return err
+	}
+	if p.AssocGroupID, err = d.u32(); err != nil {
+		return err
+	}
+	n, err := d.u8()
+	if err != nil {
+		return err
+	}
+	if _, err = d.next(3); err != nil {
+		return err
+	}
+	p.Contexts = make([]Context, n)
+	for i := range p.Contexts {
+		c := &p.Contexts[i]
+		if c.ID, err = d.u16(); err != nil {
+			return err
+		}
+		syntaxes, err := d.u8()
+		if err != nil {
+			return err
+		}
+		if _, err = d.next(1); err != nil {
+			return err
+		}
+		if c.AbstractSyntax, err = d.syntax(); err != nil {
+			return err
+		}
+		c.TransferSyntaxes = make([]SyntaxID, syntaxes)
+		for j := range c.TransferSyntaxes {
+			if c.TransferSyntaxes[j], err = d.syntax(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+const (
+	// ResultAcceptance accepts a presentation context
+	ResultAcceptance uint16 = 0
+	// ResultUserRejection rejects a presentation context on behalf of the application
+	ResultUserRejection uint16 = 1
+	// ResultProviderRejection rejects a presentation context on behalf of the RPC runtime
+	ResultProviderRejection uint16 = 2
+)
+
+const (
+	// ReasonNotSpecified is a rejection without a reason
+	ReasonNotSpecified uint16 = 0
+	// ReasonAbstractSyntaxNotSupported rejects an unknown interface
+	ReasonAbstractSyntaxNotSupported uint16 = 1
+	// ReasonTransferSyntaxesNotSupported rejects contexts without a supported transfer syntax
+	ReasonTransferSyntaxesNotSupported uint16 = 2
+	// ReasonLocalLimitExceeded rejects contexts beyond the server's limit
+	ReasonLocalLimitExceeded uint16 = 3
+)
+
+// Result is the outcome of a proposed presentation context
+type Result struct {
+	// Result is ResultAcceptance or a rejection
+	Result uint16
+	// Reason explains a rejection
+	Reason uint16
+	// TransferSyntax is the accepted transfer syntax
+	TransferSyntax SyntaxID
+}
+
+// BindAck answers a bind with the result of every proposed context
+type BindAck struct {
+	MaxXmitFrag  uint16
+	MaxRecvFrag  uint16
+	AssocGroupID uint32
+	// SecondaryAddr is the local pipe name of the server, e.g. \PIPE\srvsvc
+	SecondaryAddr string
+	Results       []Result
+}
+
+// Type returns TypeBindAck
+func (*BindAck) Type() PacketType { return TypeBindAck }
+
+func (p *BindAck) marshal(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, p.MaxXmitFrag)
+	b = binary.LittleEndian.AppendUint16(b, p.MaxRecvFrag)
+	b = binary.LittleEndian.AppendUint32(b, p.AssocGroupID)
+	if p.SecondaryAddr == "" {
+		b = binary.LittleEndian.AppendUint16(b, 0)
+	} else {
+		// The length includes the terminating NUL
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(p.SecondaryAddr)+1))
+		b = append(b, p.SecondaryAddr...)
+		b = append(b, 0)
+	}
+	b = append(b, make([]byte, (4-len(b)%4)%4)...)
+	b = append(b, byte(len(p.Results)), 0, 0, 0)
+	for _, r := range p.Results {
+		b = binary.LittleEndian.AppendUint16(b, r.Result)
+		b = binary.LittleEndian.AppendUint16(b, r.Reason)
+		b = appendSyntax(b, r.TransferSyntax)
+	}
+	return b
+}
+
+func (p *BindAck) unmarshal(d *decoder, _ Flags) (err error) {
+	if p.MaxXmitFrag, err = d.u16(); err != nil {
+		return err
+	}
+	if p.MaxRecvFrag, err = d.u16(); err != nil {
+		return err
+	}
+	if p.AssocGroupID, err = d.u32(); err != nil {
+		return err
+	}
+	size, err := d.u16()
+	if err != nil {
+		return err
+	}
+	addr, err := d.next(int(size))
+	if err != nil {
+		return err
+	}
+	if len(addr) > 0 && addr[len(addr)-1] == 0 {
+		addr = addr[:len(addr)-1]
+	}
+	p.SecondaryAddr = string(addr)
+	if err = d.align(4); err != nil {
+		return err
+	}
+	n, err := d.u8()
+	if err != nil {
+		return err
+	}
+	if _, err = d.next(3); err != nil {
+		return err
+	}
+	p.Results = make([]Result, n)
+	for i := range p.Results {
+		r := &p.Results[i]
+		if r.Result, err = d.u16(); err != nil {
+			return err
+		}
+		if r.Reason, err = d.u16(); err != nil {
+			return err
+		}
+		if r.TransferSyntax, err = d.syntax(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	// NakReasonNotSpecified rejects a bind without a reason
+	NakReasonNotSpecified uint16 = 0
+	// NakReasonTemporaryCongestion rejects a bind because the server is busy
+	NakReasonTemporaryCongestion uint16 = 1
+	// NakReasonLocalLimitExceeded rejects a bind beyond the server's limit
+	NakReasonLocalLimitExceeded uint16 = 2
+	// NakReasonProtocolVersionNotSupported rejects a bind with an unsupported protocol version
+	NakReasonProtocolVersionNotSupported uint16 = 4
+)
+
+// BindNak rejects a bind
+type BindNak struct {
+	// Reason is the provider_reject_reason
+	Reason uint16
+	// Versions are the supported protocol versions as major, minor pairs
+	Versions [][2]uint8
+}
+
+// Type returns TypeBindNak
+func (*BindNak) Type() PacketType { return TypeBindNak }
+
+func (p *BindNak) marshal(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, p.Reason)
+	b = append(b, byte(len(p.Versions)))
+	for _, v := range p.Versions {
+		b = append(b, v[0], v[1])
+	}
+	return b
+}
+
+func (p *BindNak) unmarshal(d *decoder, _ Flags) (err error) {
+	if p.Reason, err = d.u16(); err != nil {
+		return err
+	}
+	// Some servers don't send the versions
+	n, err := d.u8()
+	if err != nil {
+		return nil
+	}
+	p.Versions = make([][2]uint8, 0, n)
+	for i := 0; i < int(n); i++ {
+		v, err := d.next(2)
+		if err != nil {
+			return err
+		}
+		p.Versions = append(p.Versions, [2]uint8{v[0], v[1]})
+	}
+	return nil
+}
+
+// Request is a fragment of a call
+type Request struct {
+	// AllocHint is the size of the stub data from this fragment to the end of the call
+	AllocHint uint32
+	// ContextID selects the presentation context
+	ContextID uint16
+	// Opnum is the operation in the interface
+	Opnum uint16
+	// Object is sent when not nil and sets FlagObjectUUID
+	Object *UUID
+	// Stub is the stub data in this fragment
+	Stub []byte
+}
+
+// Type returns TypeRequest
+func (*Request) Type() PacketType { return TypeRequest }
+
+func (p *Request) marshal(b []byte) []byte {
+	if p.Object != nil {
+		b[3] |= byte(FlagObjectUUID)
+	}
+	b = binary.LittleEndian.AppendUint32(b, p.AllocHint)
+	b = binary.LittleEndian.AppendUint16(b, p.ContextID)
+	b = binary.LittleEndian.AppendUint16(b, p.Opnum)
+	if p.Object != nil {
+		b = appendUUID(b, *p.Object)
+	}
+	return append(b, p.Stub...)
+}
+
+func (p *Request) unmarshal(d *decoder, flags Flags) (err error) {
+	if p.AllocHint, err = d.u32(); err != nil {
+		return err
+	}
+	if p.ContextID, err = d.u16(); err != nil {
+		return err
+	}
+	if p.Opnum, err = d.u16(); err != nil {
+		return err
+	}
+	if flags&FlagObjectUUID != 0 {
+		b, err := d.next(16)
+		if err != nil {
+			return err
+		}
+		u := decodeUUID(b)
+		p.Object = &u
+	}
+	p.Stub = d.rest()
+	return nil
+}
+
+// Response is a fragment of the result of a call
+type Response struct {
+	// AllocHint is the size of the stub data from this fragment to the end of the call
+	AllocHint uint32
+	// ContextID is the presentation context of the request
+	ContextID uint16
+	// CancelCount is the number of cancels the server received
+	CancelCount uint8
+	// Stub is the stub data in this fragment
+	Stub []byte
+}
+
+// Type returns TypeResponse
+func (*Response) Type() PacketType { return TypeResponse }
+
+func (p *Response) marshal(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint32(b, p.AllocHint)
+	b = binary.LittleEndian.AppendUint16(b, p.ContextID)
+	b = append(b, p.CancelCount, 0)
+	return append(b, p.Stub...)
+}
+
+func (p *Response) unmarshal(d *decoder, _ Flags) (err error) {
+	if p.AllocHint, err = d.u32(); err != nil {
+		return err
+	}
+	if p.ContextID, err = d.u16(); err != nil {
+		return err
+	}
+	if p.CancelCount, err = d.u8(); err != nil {
+		return err
+	}
+	if _, err = d.next(1); err != nil {
+		return err
+	}
+	p.Stub = d.rest()
+	return nil
+}
+
+// Fault reports a failed call
+type Fault struct {
+	AllocHint   uint32
+	ContextID   uint16
+	CancelCount uint8
+	// Status is the NCA or Win32 status code
+	Status uint32
+	// Stub is optional extended error data
+	Stub []byte
+}
+
+// Type returns TypeFault
+func (*Fault) Type() PacketType { return TypeFault }
+
+func (p *Fault) marshal(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint32(b, p.AllocHint)
+	b = binary.LittleEndian.AppendUint16(b, p.ContextID)
+	b = append(b, p.CancelCount, 0)
+	b = binary.LittleEndian.AppendUint32(b, p.Status)
+	b = append(b, 0, 0, 0, 0)
+	return append(b, p.Stub...)
+}
+
+func (p *Fault) unmarshal(d *decoder, _ Flags) (err error) {
+	if p.AllocHint, err = d.u32(); err != nil {
+		return err
+	}
+	if p.ContextID, err = d.u16(); err != nil {
+		return err
+	}
+	if p.CancelCount, err = d.u8(); err != nil {
+		return err
+	}
+	if _, err = d.next(1); err != nil {
+		return err
+	}
+	if p.Status, err = d.u32(); err != nil {
+		return err
+	}
+	if _, err = d.next(4); err != nil {
+		return err
+	}
+	p.Stub = d.rest()
+	return nil
+}
+
+// fragments splits stub into the stub data of fragments no larger than maxFrag with a header of headerSize bytes.
+// There is always at least one fragment.
+func fragments(stub []byte, maxFrag, headerSize int) [][]byte {
+	size := maxFrag - headerSize
+	pieces := make([][]byte, 0, len(stub)/size+1)
+	for len(stub) > size {
+		pieces = append(pieces, stub[:size])
+		stub = stub[size:]
+	}
+	return append(pieces, stub)
+}
+
+// fragmentFlags returns the flags of fragment i out of n
+func fragmentFlags(i, n int) Flags {
+	var flags Flags
+	if i == 0 {
+		flags |= FlagFirstFrag
+	}
+	if i == n-1 {
+		flags |= FlagLastFrag
+	}
+	return flags
+}
@@ -0,0 +1,184 @@
+package dcerpc
+
+import (
+	// Standard
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// golden decodes a hex dump, ignoring white space
+func golden(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatalf("invalid golden bytes: %v", err)
+	}
+	return b
+}
+
+// TestGoldenPDUs tests that PDUs encode to the bytes Windows clients and servers exchange on \pipe\srvsvc and decode
+// back to the same values
+func TestGoldenPDUs(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet Packet
+		bytes  string
+	}{
+		{
+			name: "bind",
+			packet: Packet{Flags: FlagFirstFrag | FlagLastFrag, CallID: 1, Body: &Bind{
+				MaxXmitFrag: 4280,
+				MaxRecvFrag: 4280,
+				Contexts:    []Context{{ID: 0, AbstractSyntax: SRVSVC, TransferSyntaxes: []SyntaxID{NDR}}},
+			}},
+			bytes: `05000b03 10000000 48000000 01000000 b810b810 00000000 01000000 00000100
+				c84f324b 7016d301 12785a47 bf6ee188 03000000 045d888a eb1cc911 9fe80800
+				2b104860 02000000`,
+		},
+		{
+			name: "bind_ack",
+			packet: Packet{Flags: FlagFirstFrag | FlagLastFrag, CallID: 1, Body: &BindAck{
+				MaxXmitFrag:   4280,
+				MaxRecvFrag:   4280,
+				AssocGroupID:  0x53f0,
+				SecondaryAddr: `\PIPE\srvsvc`,
+				Results:       []Result{{Result: ResultAcceptance, TransferSyntax: NDR}},
+			}},
+			bytes: `05000c03 10000000 44000000 01000000 b810b810 f0530000 0d005c50 4950455c
+				73727673 76630000 01000000 00000000 045d888a eb1cc911 9fe80800 2b104860
+				02000000`,
+		},
+		{
+			name: "bind_nak",
+			packet: Packet{Flags: FlagFirstFrag | FlagLastFrag, CallID: 1, Body: &BindNak{
+				Reason:   NakReasonProtocolVersionNotSupported,
+				Versions: [][2]uint8{{5, 0}},
+			}},
+			bytes: `05000d03 10000000 15000000 01000000 04000105 00`,
+		},
+		{
+			name: "request",
+			packet: Packet{Flags: FlagFirstFrag | FlagLastFrag, CallID: 2, Body: &Request{
+				AllocHint: 4,
+				Opnum:     15,
+				Stub:      []byte{1, 2, 3, 4},
+			}},
+			bytes: `05000003 10000000 1c000000 02000000 04000000 00000f00 01020304`,
+		},
+		{
+			name: "response",
+			packet: Packet{Flags: FlagFirstFrag | FlagLastFrag, CallID: 2, Body: &Response{
+				AllocHint: 4,
+				Stub:      []byte{0, 0, 0, 0},
+			}},
+			bytes: `05000203 10000000 1c000000 02000000 04000000 00000000 00000000`,
+		},
+		{
+			name: "fault",
+			packet: Packet{Flags: FlagFirstFrag | FlagLastFrag | FlagDidNotExecute, CallID: 2, Body: &Fault{
+				AllocHint: 32,
+				Status:    StatusOpRangeError,
+			}},
+			bytes: `05000323 10000000 20000000 02000000 20000000 00000000 0200011c 00000000`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := golden(t, test.bytes)
+			got, err := test.packet.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary(): %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("MarshalBinary():\n%x\nexpected:\n%x", got, want)
+			}
+			var p Packet
+			if err = p.UnmarshalBinary(want); err != nil {
+				t.Fatalf("UnmarshalBinary(): %v", err)
+			}
+			if !reflect.DeepEqual(p, test.packet) {
+				t.Fatalf("UnmarshalBinary() = %+v, expected %+v", p.Body, test.packet.Body)
+			}
+		})
+	}
+}
+
+// TestRequestObject tests that an object UUID sets the flag and round trips
+func TestRequestObject(t *testing.T) {
+	object := MustParseUUID("00112233-4455-6677-8899-aabbccddeeff")
+	b, err := (&Packet{Flags: FlagFirstFrag | FlagLastFrag, Body: &Request{Object: &object}}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary(): %v", err)
+	}
+	if Flags(b[3])&FlagObjectUUID == 0 {
+		t.Fatal("FlagObjectUUID is not set")
+	}
+	// The first three fields are little endian
+	if !bytes.Equal(b[24:32], []byte{0x33, 0x22, 0x11, 0x00, 0x55, 0x44, 0x77, 0x66}) {
+		t.Fatalf("unexpected UUID encoding %x", b[24:40])
+	}
+	var p Packet
+	if err = p.UnmarshalBinary(b); err != nil {
+		t.Fatalf("UnmarshalBinary(): %v", err)
+	}
+	if req := p.Body.(*Request); req.Object == nil || *req.Object != object || len(req.Stub) != 0 {
+		t.Fatalf("unexpected request %+v", req)
+	}
+}
+
+// TestUnmarshalInvalid tests that malformed PDUs are rejected instead of panicking
+func TestUnmarshalInvalid(t *testing.T) {
+	bind := golden(t, `05000b03 10000000 48000000 01000000 b810b810 00000000 01000000 00000100
+		c84f324b 7016d301 12785a47 bf6ee188 03000000 045d888a eb1cc911 9fe80800
+		2b104860 02000000`)
+	tests := map[string]func(b []byte) []byte{
+		"short header":   func(b []byte) []byte { return b[:10] },
+		"version":        func(b []byte) []byte { b[0] = 4; return b },
+		"big endian":     func(b []byte) []byte { b[4] = 0; return b },
+		"frag length":    func(b []byte) []byte { b[8]++; return b },
+		"authenticated":  func(b []byte) []byte { b[10] = 8; return b },
+		"unknown type":   func(b []byte) []byte { b[2] = 99; return b },
+		"truncated body": func(b []byte) []byte { b[8] = 0x40; return b[:0x40] },
+	}
+	for name, corrupt := range tests {
+		b := corrupt(append([]byte(nil), bind...))
+		var p Packet
+		if err := p.UnmarshalBinary(b); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// TestFragments tests how stub data is split across fragments
+func TestFragments(t *testing.T) {
+	stub := make([]byte, 2500)
+	pieces := fragments(stub, 1024, requestHeaderSize)
+	if len(pieces) != 3 || len(pieces[0]) != 1000 || len(pieces[1]) != 1000 || len(pieces[2]) != 500 {
+		t.Fatalf("unexpected fragments of %d pieces", len(pieces))
+	}
+	if flags := []Flags{fragmentFlags(0, 3), fragmentFlags(1, 3), fragmentFlags(2, 3)}; flags[0] != FlagFirstFrag || flags[1] != 0 || flags[2] != FlagLastFrag {
+		t.Fatalf("unexpected flags %v", flags)
+	}
+	if pieces = fragments(nil, 1024, requestHeaderSize); len(pieces) != 1 || len(pieces[0]) != 0 {
+		t.Fatal("empty stub data needs a single fragment")
+	}
+	if fragmentFlags(0, 1) != FlagFirstFrag|FlagLastFrag {
+		t.Fatal("a single fragment is the first and the last")
+	}
+}
+
+// TestUUID tests parsing and formatting UUIDs
+func TestUUID(t *testing.T) {
+	s := "4b324fc8-1670-01d3-1278-5a47bf6ee188"
+	u, err := ParseUUID(s)
+	if err != nil || u.String() != s {
+		t.Fatalf("ParseUUID(%q) = %s, %v", s, u, err)
+	}
+	for _, bad := range []string{"", "4b324fc8167001d312785a47bf6ee188", "4b324fc8-1670-01d3-1278-5a47bf6ee18g"} {
+		if _, err = ParseUUID(bad); err == nil {
+			t.Errorf("ParseUUID(%q) should fail", bad)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+//go:build windows || linux
+
+package dcerpc
+
+import (
+	// Standard
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Handler executes an operation of an interface and returns the response stub data. Returning a *FaultError sends
+// its status, any other error sends StatusUnspecified. Handlers should return StatusOpRangeError for unknown opnums.
+type Handler func(opnum uint16, stub []byte) ([]byte, error)
+
+// Server is a minimal DCE/RPC endpoint that binds clients to the interfaces it has handlers for and dispatches their
+// requests. It is meant to stand in for Windows services in tests.
+type Server struct {
+	// Handlers maps interfaces to the handlers of their operations
+	Handlers map[SyntaxID]Handler
+	// SecondaryAddr is returned in bind_ack, for example \PIPE\srvsvc
+	SecondaryAddr string
+	// MaxFrag is the largest fragment the server sends or receives, DefaultMaxFrag if zero
+	MaxFrag uint16
+
+	mu         sync.Mutex
+	assocGroup uint32
+}
+
+// Serve serves the connections accepted from ln until Accept fails
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// serverConn is the state of an association
+type serverConn struct {
+	s        *Server
+	conn     net.Conn
+	bound    bool
+	contexts map[uint16]Handler
+	maxXmit  int
+	maxRecv  int
+
+	// The request being reassembled
+	callID  uint32
+	request *Request
+	stub    []byte
+}
+
+// ServeConn answers the PDUs on conn until the client closes it or violates the protocol, and closes conn
+func (s *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	maxFrag := int(s.MaxFrag)
+	if maxFrag == 0 {
+		maxFrag = DefaultMaxFrag
+	}
+	c := &serverConn{s: s, conn: conn, contexts: make(map[uint16]Handler), maxXmit: maxFrag, maxRecv: maxFrag}
+	for {
+		p, err := readPacket(conn, c.maxRecv)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("dcerpc.Server.ServeConn(): %s", err)
+		}
+		switch body := p.Body.(type) {
+		case *Bind:
+			err = c.bind(p.CallID, body)
+		case *Request:
+			err = c.requestFragment(p, body)
+		default:
+			err = c.fault(p.CallID, 0, StatusProtocolError, true)
+			if err == nil {
+				err = fmt.Errorf("unexpected %s PDU", p.Body.Type())
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("dcerpc.Server.ServeConn(): %s", err)
+		}
+	}
+}
+
+// bind answers a bind with the result for every proposed context
+func (c *serverConn) bind(callID uint32, bind *Bind) error {
+	if c.bound || len(bind.Contexts) == 0 {
+		return writePacket(c.conn, &Packet{
+			Flags:  FlagFirstFrag | FlagLastFrag,
+			CallID: callID,
+			Body:   &BindNak{Reason: NakReasonNotSpecified, Versions: [][2]uint8{{5, 0}}},
+		})
+	}
+	c.bound = true
+	if int(bind.MaxRecvFrag) < c.maxXmit && bind.MaxRecvFrag >= minMaxFrag {
+		c.maxXmit = int(bind.MaxRecvFrag)
+	}
+
+	assocGroup := bind.AssocGroupID
+	if assocGroup == 0 {
+		c.s.mu.Lock()
+		c.s.assocGroup++
+		assocGroup = c.s.assocGroup
+		c.s.mu.Unlock()
+	}
+	ack := &BindAck{
+		MaxXmitFrag:   uint16(c.maxXmit),
+		MaxRecvFrag:   uint16(c.maxRecv),
+		AssocGroupID:  assocGroup,
+		SecondaryAddr: c.s.SecondaryAddr,
+	}
+	for _, ctx := range bind.Contexts {
+		handler, ok := c.s.Handlers[ctx.AbstractSyntax]
+		if !ok {
+			ack.Results = append(ack.Results, Result{Result: ResultProviderRejection, Reason: ReasonAbstractSyntaxNotSupported})
+			continue
+		}
+		result := Result{Result: ResultProviderRejection, Reason: ReasonTransferSyntaxesNotSupported}
+		for _, syntax := range ctx.TransferSyntaxes {
+			if syntax == NDR {
+				result = Result{Result: ResultAcceptance, TransferSyntax: NDR}
+				c.contexts[ctx.ID] = handler
+				break
+			}
+		}
+		ack.Results = append(ack.Results, result)
+	}
+	return writePacket(c.conn, &Packet{Flags: FlagFirstFrag | FlagLastFrag, CallID: callID, Body: ack})
+}
+
+// requestFragment reassembles a request and executes it once the last fragment arrived
+func (c *serverConn) requestFragment(p *Packet, req *Request) error {
+	if !c.bound {
+		return c.fault(p.CallID, req.ContextID, StatusProtocolError, true)
+	}
+	if p.Flags&FlagFirstFrag != 0 {
+		c.callID = p.CallID
+		c.request = req
+		c.stub = append([]byte(nil), req.Stub...)
+	} else if c.request == nil || p.CallID != c.callID {
+		c.request = nil
+		return c.fault(p.CallID, req.ContextID, StatusProtocolError, true)
+	} else {
+		c.stub = append(c.stub, req.Stub...)
+	}
+	if p.Flags&FlagLastFrag == 0 {
+		return nil
+	}
+
+	req, stub := c.request, c.stub
+	c.request, c.stub = nil, nil
+	handler, ok := c.contexts[req.ContextID]
+	if !ok {
+		return c.fault(p.CallID, req.ContextID, StatusUnknownInterface, true)
+	}
+	out, err := handler(req.Opnum, stub)
+	if err != nil {
+		if fault, ok := err.(*FaultError); ok {
+			return c.fault(p.CallID, req.ContextID, fault.Status, fault.DidNotExecute)
+		}
+		return c.fault(p.CallID, req.ContextID, StatusUnspecified, false)
+	}
+
+	pieces := fragments(out, c.maxXmit, responseHeaderSize)
+	remaining := len(out)
+	for i, piece := range pieces {
+		resp := &Packet{
+			Flags:  fragmentFlags(i, len(pieces)),
+			CallID: p.CallID,
+			Body:   &Response{AllocHint: uint32(remaining), ContextID: req.ContextID, Stub: piece},
+		}
+		if err = writePacket(c.conn, resp); err != nil {
+			return err
+		}
+		remaining -= len(piece)
+	}
+	return nil
+}
+
+// fault answers a call with a fault PDU
+func (c *serverConn) fault(callID uint32, contextID uint16, status uint32, didNotExecute bool) error {
+	flags := FlagFirstFrag | FlagLastFrag
+	if didNotExecute {
+		flags |= FlagDidNotExecute
+	}
+	return writePacket(c.conn, &Packet{
+		Flags:  flags,
+		CallID: callID,
+		Body:   &Fault{AllocHint: 32, ContextID: contextID, Status: status},
+	})
+}
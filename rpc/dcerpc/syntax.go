@@ -0,0 +1,79 @@
+package dcerpc
+
+import (
+	// Standard
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// UUID is an interface or object identifier in its canonical big endian byte order
+type UUID [16]byte
+
+// ParseUUID parses a UUID in the form 4b324fc8-1670-01d3-1278-5a47bf6ee188
+func ParseUUID(s string) (UUID, error) {
+	var u UUID
+	parts := strings.Split(s, "-")
+	if len(s) != 36 || len(parts) != 5 || len(parts[0]) != 8 || len(parts[1]) != 4 || len(parts[2]) != 4 || len(parts[3]) != 4 {
+		return u, fmt.Errorf("dcerpc.ParseUUID(): invalid UUID \"%s\"", s)
+	}
+	if _, err := hex.Decode(u[:], []byte(strings.Join(parts, ""))); err != nil {
+		return u, fmt.Errorf("dcerpc.ParseUUID(): invalid UUID \"%s\": %s", s, err)
+	}
+	return u, nil
+}
+
+// MustParseUUID is like ParseUUID but panics if s is invalid. It simplifies declaring well-known interfaces.
+func MustParseUUID(s string) UUID {
+	u, err := ParseUUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+// String returns the UUID in its canonical form
+func (u UUID) String() string {
+	h := hex.EncodeToString(u[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// appendUUID appends the NDR encoding of u; the first three fields are little endian
+func appendUUID(b []byte, u UUID) []byte {
+	b = binary.LittleEndian.AppendUint32(b, binary.BigEndian.Uint32(u[0:]))
+	b = binary.LittleEndian.AppendUint16(b, binary.BigEndian.Uint16(u[4:]))
+	b = binary.LittleEndian.AppendUint16(b, binary.BigEndian.Uint16(u[6:]))
+	return append(b, u[8:]...)
+}
+
+// decodeUUID decodes the NDR encoding of a UUID from the first 16 bytes of b
+func decodeUUID(b []byte) UUID {
+	var u UUID
+	binary.BigEndian.PutUint32(u[0:], binary.LittleEndian.Uint32(b[0:]))
+	binary.BigEndian.PutUint16(u[4:], binary.LittleEndian.Uint16(b[4:]))
+	binary.BigEndian.PutUint16(u[6:], binary.LittleEndian.Uint16(b[6:]))
+	copy(u[8:], b[8:16])
+	return u
+}
+
+// SyntaxID identifies a version of an interface or a transfer syntax
+type SyntaxID struct {
+	UUID  UUID
+	Major uint16
+	Minor uint16
+}
+
+// String returns the syntax as UUID vMajor.Minor
+func (s SyntaxID) String() string {
+	return fmt.Sprintf("%s v%d.%d", s.UUID, s.Major, s.Minor)
+}
+
+var (
+	// NDR is the NDR 2.0 transfer syntax, the only one this package negotiates
+	NDR = SyntaxID{UUID: MustParseUUID("8a885d04-1ceb-11c9-9fe8-08002b104860"), Major: 2}
+	// SRVSVC is the Server Service Remote Protocol interface reached through \\<host>\pipe\srvsvc
+	SRVSVC = SyntaxID{UUID: MustParseUUID("4b324fc8-1670-01d3-1278-5a47bf6ee188"), Major: 3}
+	// SAMR is the Security Account Manager Remote Protocol interface reached through \\<host>\pipe\samr
+	SAMR = SyntaxID{UUID: MustParseUUID("12345778-1234-abcd-ef00-0123456789ac"), Major: 1}
+)
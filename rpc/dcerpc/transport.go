@@ -0,0 +1,66 @@
+//go:build windows || linux
+
+package dcerpc
+
+import (
+	// Standard
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// readPacket reads the next PDU from r. It works in byte and message mode: in message mode the PDU is read from a
+// single message in parts, and the reads return npipe.ErrMoreData until the message was consumed.
+func readPacket(r io.Reader, maxFrag int) (*Packet, error) {
+	b := make([]byte, headerSize)
+	if err := readFull(r, b); err != nil {
+		return nil, err
+	}
+	size := int(binary.LittleEndian.Uint16(b[8:]))
+	if size < headerSize || size > maxFrag {
+		return nil, fmt.Errorf("the fragment length %d is outside of %d to %d", size, headerSize, maxFrag)
+	}
+	b = append(b, make([]byte, size-headerSize)...)
+	if err := readFull(r, b[headerSize:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	p := &Packet{}
+	if err := p.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// readFull is io.ReadFull for pipes that may be in message mode
+func readFull(r io.Reader, b []byte) error {
+	for n := 0; n < len(b); {
+		m, err := r.Read(b[n:])
+		n += m
+		if err == npipe.ErrMoreData {
+			continue
+		}
+		if err == io.EOF && n > 0 && n < len(b) {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil && n < len(b) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePacket writes p with a single call to Write so it is sent as one message
+func writePacket(w io.Writer, p *Packet) error {
+	b, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
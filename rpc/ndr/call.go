@@ -0,0 +1,29 @@
+//go:build windows || linux
+
+package ndr
+
+import (
+	// Standard
+	"fmt"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe/rpc/dcerpc"
+)
+
+// Call marshals the [in] parameters from in, executes the operation opnum on the interface c is bound to, and
+// unmarshals the [out] parameters and the return value into the struct out points to. Faults are returned as the
+// *dcerpc.FaultError from c.
+func Call(c *dcerpc.Client, opnum uint16, in, out interface{}) error {
+	stub, err := Marshal(in)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Call(opnum, stub)
+	if err != nil {
+		return err
+	}
+	if err = Unmarshal(resp, out); err != nil {
+		return fmt.Errorf("ndr.Call(): opnum %d: %s", opnum, err)
+	}
+	return nil
+}
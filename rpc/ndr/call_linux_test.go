@@ -0,0 +1,79 @@
+package ndr
+
+import (
+	// Standard
+	"reflect"
+	"testing"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+	"github.com/Ne0nd0g/npipe/rpc/dcerpc"
+)
+
+// TestCall enumerates shares from a stub srvsvc server over a pipe
+func TestCall(t *testing.T) {
+	t.Setenv("NPIPE_SOCKET_DIR", t.TempDir())
+	address := `\\.\pipe\srvsvc`
+	ln, err := npipe.NewPipeListener(address, npipe.PipeAccessDuplex, npipe.PipeTypeMessage|npipe.PipeReadModeMessage, npipe.PipeUnlimitedInstances, 512, 512, 0, nil)
+	if err != nil {
+		t.Fatalf("NewPipeListener(): %v", err)
+	}
+	defer ln.Close()
+
+	shares := []shareInfo1{
+		{Netname: "ADMIN$", Type: 0x80000000, Remark: "Remote Admin"},
+		{Netname: "IPC$", Type: 0x80000003, Remark: "Remote IPC"},
+	}
+	server := &dcerpc.Server{Handlers: map[dcerpc.SyntaxID]dcerpc.Handler{dcerpc.SRVSVC: func(opnum uint16, stub []byte) ([]byte, error) {
+		if opnum != 15 {
+			return nil, &dcerpc.FaultError{Status: dcerpc.StatusOpRangeError, DidNotExecute: true}
+		}
+		var in netrShareEnumIn
+		if err := Unmarshal(stub, &in); err != nil {
+			return nil, &dcerpc.FaultError{Status: dcerpc.StatusBadStubData, DidNotExecute: true}
+		}
+		if in.ServerName == nil || *in.ServerName != `\\DC` || in.InfoStruct.Level != 1 {
+			return nil, &dcerpc.FaultError{Status: dcerpc.StatusAccessDenied}
+		}
+		return Marshal(&netrShareEnumOut{
+			InfoStruct: shareEnumStruct{Level: 1, ShareInfo: shareEnumUnion{Level: 1, Level1: &shareInfo1Container{
+				EntriesRead: uint32(len(shares)),
+				Buffer:      shares,
+			}}},
+			TotalEntries: uint32(len(shares)),
+			ResumeHandle: in.ResumeHandle,
+		})
+	}}}
+	go server.Serve(ln)
+
+	client, err := dcerpc.Dial(address, dcerpc.SRVSVC)
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	defer client.Close()
+
+	name, resume := `\\DC`, uint32(0)
+	in := &netrShareEnumIn{
+		ServerName:            &name,
+		InfoStruct:            shareEnumStruct{Level: 1, ShareInfo: shareEnumUnion{Level: 1, Level1: &shareInfo1Container{}}},
+		PreferedMaximumLength: 0xffffffff,
+		ResumeHandle:          &resume,
+	}
+	var out netrShareEnumOut
+	if err = Call(client, 15, in, &out); err != nil {
+		t.Fatalf("Call(): %v", err)
+	}
+	if out.TotalEntries != 2 || out.InfoStruct.ShareInfo.Level1 == nil || !reflect.DeepEqual(out.InfoStruct.ShareInfo.Level1.Buffer, shares) {
+		t.Fatalf("unexpected shares %+v", out.InfoStruct.ShareInfo.Level1)
+	}
+
+	// Faults are returned unchanged
+	name = `\\OTHER`
+	err = Call(client, 15, in, &out)
+	if fault, ok := err.(*dcerpc.FaultError); !ok || fault.Status != dcerpc.StatusAccessDenied {
+		t.Fatalf("expected an access denied fault but received %v", err)
+	}
+	if err = Call(client, 15, struct{ A int }{}, &out); err == nil {
+		t.Fatal("Call() sent parameters that can't be marshalled")
+	}
+}
@@ -0,0 +1,414 @@
+package ndr
+
+import (
+	// Standard
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"unicode/utf16"
+)
+
+// Unmarshal decodes stub data into the fields of the struct v points to, which are the [out] parameters of an
+// operation followed by its return value
+func Unmarshal(b []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("ndr.Unmarshal(): expected a pointer to a struct of parameters but received %T", v)
+	}
+	d := &decoder{b: b}
+	if err := d.parameters(rv.Elem()); err != nil {
+		return fmt.Errorf("ndr.Unmarshal(): %s", err)
+	}
+	return nil
+}
+
+// decoder reads the stub data
+type decoder struct {
+	b   []byte
+	off int
+	// full maps the referent IDs of full pointers to their targets
+	full map[uint32]reflect.Value
+}
+
+func (d *decoder) align(n int) error {
+	_, err := d.next((n - d.off%n) % n)
+	return err
+}
+
+// next returns the next n bytes
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.b)-d.off < n {
+		return nil, fmt.Errorf("the stub data is truncated at offset %d", d.off)
+	}
+	b := d.b[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+func (d *decoder) u8() (uint8, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *decoder) u16() (uint16, error) {
+	if err := d.align(2); err != nil {
+		return 0, err
+	}
+	b, err := d.next(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(b), nil
+}
+
+func (d *decoder) u32() (uint32, error) {
+	if err := d.align(4); err != nil {
+		return 0, err
+	}
+	b, err := d.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+func (d *decoder) u64() (uint64, error) {
+	if err := d.align(8); err != nil {
+		return 0, err
+	}
+	b, err := d.next(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// count reads an array count and checks that the elements can fit in the remaining stub data
+func (d *decoder) count(elemSize int) (int, error) {
+	n, err := d.u32()
+	if err != nil {
+		return 0, err
+	}
+	if uint64(n)*uint64(elemSize) > uint64(len(d.b)-d.off) {
+		return 0, fmt.Errorf("the count %d at offset %d exceeds the stub data", n, d.off-4)
+	}
+	return int(n), nil
+}
+
+// parameters decodes the fields of a struct as top-level parameters
+func (d *decoder) parameters(rv reflect.Value) error {
+	fs, err := fields(rv.Type())
+	if err != nil {
+		return err
+	}
+	for _, f := range fs {
+		fv := rv.Field(f.index)
+		if !isPointer(fv.Type(), f.tag) {
+			err = d.referent(fv, f.tag)
+		} else if f.tag.pointer == notPointer || f.tag.pointer == refPointer {
+			// Top-level reference pointers have no representation, only their referent
+			err = d.referent(allocate(fv), f.tag.referent())
+		} else {
+			var def deferred
+			err = d.pointer(fv, f.tag, &def)
+			if err == nil {
+				err = def.flush()
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", f.name, err)
+		}
+	}
+	return nil
+}
+
+// referent decodes a complete construct followed by the referents of the pointers embedded in it
+func (d *decoder) referent(v reflect.Value, t fieldTag) error {
+	var def deferred
+	if err := d.value(v, t, &def, -1); err != nil {
+		return err
+	}
+	return def.flush()
+}
+
+// allocate points a pointer value to a new zero value and returns the value to decode the referent into; slices
+// and strings are their own referents
+func allocate(v reflect.Value) reflect.Value {
+	if v.Kind() == reflect.Ptr {
+		v.Set(reflect.New(v.Type().Elem()))
+		return v.Elem()
+	}
+	return v
+}
+
+// pointer decodes an embedded pointer and defers its referent
+func (d *decoder) pointer(v reflect.Value, t fieldTag, def *deferred) error {
+	id, err := d.u32()
+	if err != nil {
+		return err
+	}
+	if id == 0 {
+		if t.pointer == refPointer {
+			return fmt.Errorf("the reference pointer at offset %d is null", d.off-4)
+		}
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if t.pointer == fullPointer && v.Kind() == reflect.Ptr {
+		if target, ok := d.full[id]; ok {
+			v.Set(target)
+			return nil
+		}
+		if d.full == nil {
+			d.full = make(map[uint32]reflect.Value)
+		}
+		target := allocate(v)
+		d.full[id] = v
+		rt := t.referent()
+		*def = append(*def, func() error { return d.referent(target, rt) })
+		return nil
+	}
+	rt := t.referent()
+	if v.Kind() == reflect.Ptr {
+		target := allocate(v)
+		*def = append(*def, func() error { return d.referent(target, rt) })
+		return nil
+	}
+	// A non-null slice must not stay nil even if it turns out to be empty
+	if v.Kind() == reflect.Slice {
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+	*def = append(*def, func() error { return d.referent(v, rt) })
+	return nil
+}
+
+// value decodes v inline. The referents of embedded pointers are appended to def. hoisted is the maximum count of
+// the conformant array of a conformant struct, -1 if v isn't one.
+func (d *decoder) value(v reflect.Value, t fieldTag, def *deferred, hoisted int64) error {
+	if isPointer(v.Type(), t) {
+		return d.pointer(v, t, def)
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := d.u8()
+		v.SetBool(b != 0)
+		return err
+	case reflect.Int8:
+		b, err := d.u8()
+		v.SetInt(int64(int8(b)))
+		return err
+	case reflect.Uint8:
+		b, err := d.u8()
+		v.SetUint(uint64(b))
+		return err
+	case reflect.Int16:
+		n, err := d.u16()
+		v.SetInt(int64(int16(n)))
+		return err
+	case reflect.Uint16:
+		n, err := d.u16()
+		v.SetUint(uint64(n))
+		return err
+	case reflect.Int32:
+		n, err := d.u32()
+		v.SetInt(int64(int32(n)))
+		return err
+	case reflect.Uint32:
+		n, err := d.u32()
+		v.SetUint(uint64(n))
+		return err
+	case reflect.Int64:
+		n, err := d.u64()
+		v.SetInt(int64(n))
+		return err
+	case reflect.Uint64:
+		n, err := d.u64()
+		v.SetUint(n)
+		return err
+	case reflect.Float32:
+		n, err := d.u32()
+		v.SetFloat(float64(math.Float32frombits(n)))
+		return err
+	case reflect.Float64:
+		n, err := d.u64()
+		v.SetFloat(math.Float64frombits(n))
+		return err
+	case reflect.String:
+		return d.str(v, t, hoisted)
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := d.value(v.Index(i), t.element(), def, -1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Slice:
+		return d.slice(v, t, def, hoisted)
+	case reflect.Struct:
+		return d.structure(v, def, hoisted)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+}
+
+// variance reads the offset and actual count of a varying array
+func (d *decoder) variance(elemSize int) (int, error) {
+	offset, err := d.u32()
+	if err != nil {
+		return 0, err
+	}
+	if offset != 0 {
+		return 0, fmt.Errorf("varying arrays with a non-zero offset (%d) are not supported", offset)
+	}
+	return d.count(elemSize)
+}
+
+// str decodes a conformant varying string and drops its terminating NUL
+func (d *decoder) str(v reflect.Value, t fieldTag, hoisted int64) error {
+	size := 2
+	if t.ascii {
+		size = 1
+	}
+	if hoisted < 0 {
+		if _, err := d.u32(); err != nil {
+			return err
+		}
+	}
+	n, err := d.variance(size)
+	if err != nil {
+		return err
+	}
+	b, err := d.next(n * size)
+	if err != nil {
+		return err
+	}
+	if t.ascii {
+		if n > 0 && b[n-1] == 0 {
+			b = b[:n-1]
+		}
+		v.SetString(string(b))
+		return nil
+	}
+	chars := make([]uint16, n)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	if n > 0 && chars[n-1] == 0 {
+		chars = chars[:n-1]
+	}
+	v.SetString(string(utf16.Decode(chars)))
+	return nil
+}
+
+// slice decodes a conformant, varying, or conformant varying array
+func (d *decoder) slice(v reflect.Value, t fieldTag, def *deferred, hoisted int64) error {
+	conformant := t.conformant || !t.varying
+	max := int(hoisted)
+	if conformant && hoisted < 0 {
+		n, err := d.u32()
+		if err != nil {
+			return err
+		}
+		max = int(n)
+	}
+	n := max
+	if t.varying {
+		var err error
+		if n, err = d.variance(1); err != nil {
+			return err
+		}
+		if conformant && n > max {
+			return fmt.Errorf("the actual count %d exceeds the maximum count %d", n, max)
+		}
+	} else if uint64(n) > uint64(len(d.b)-d.off) {
+		return fmt.Errorf("the count %d exceeds the stub data", n)
+	}
+	capacity := n
+	if conformant && t.varying && max > n && max-n <= maxVaryingCapacity {
+		capacity = max
+	}
+	s := reflect.MakeSlice(v.Type(), n, capacity)
+	for i := 0; i < n; i++ {
+		if err := d.value(s.Index(i), t.element(), def, -1); err != nil {
+			return err
+		}
+	}
+	v.Set(s)
+	return nil
+}
+
+// structure decodes a struct or a union
+func (d *decoder) structure(v reflect.Value, def *deferred, hoisted int64) error {
+	typ := v.Type()
+	fs, err := fields(typ)
+	if err != nil {
+		return err
+	}
+	a, err := alignment(typ, fieldTag{})
+	if err != nil {
+		return err
+	}
+	if isUnion(fs) {
+		return d.union(v, fs, a, def)
+	}
+
+	if hoisted < 0 {
+		path, _, err := conformantField(typ)
+		if err != nil {
+			return err
+		}
+		if path != nil {
+			n, err := d.u32()
+			if err != nil {
+				return err
+			}
+			hoisted = int64(n)
+		}
+	}
+	if err = d.align(a); err != nil {
+		return err
+	}
+	for i, f := range fs {
+		fv := v.Field(f.index)
+		h := int64(-1)
+		if i == len(fs)-1 && !isPointer(fv.Type(), f.tag) {
+			h = hoisted
+		}
+		if err = d.value(fv, f.tag, def, h); err != nil {
+			return fmt.Errorf("%s: %s", f.name, err)
+		}
+	}
+	return nil
+}
+
+// union decodes the discriminant and the selected arm of a non-encapsulated union
+func (d *decoder) union(v reflect.Value, fs []structField, a int, def *deferred) error {
+	if err := d.align(a); err != nil {
+		return err
+	}
+	sw := v.Field(fs[0].index)
+	if err := d.value(sw, fieldTag{}, def, -1); err != nil {
+		return err
+	}
+	var discriminant int64
+	switch sw.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		discriminant = sw.Int()
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		discriminant = int64(sw.Uint())
+	default:
+		return fmt.Errorf("%s: the discriminant must be an integer", fs[0].name)
+	}
+	arm, err := unionArm(v.Type(), fs, discriminant)
+	if err != nil {
+		return err
+	}
+	if err = d.value(v.Field(arm.index), arm.tag, def, -1); err != nil {
+		return fmt.Errorf("%s: %s", arm.name, err)
+	}
+	return nil
+}
@@ -0,0 +1,596 @@
+// Package ndr encodes and decodes the stub data of DCE/RPC calls with the NDR 2.0 transfer syntax, driven by struct
+// tags.
+//
+// Marshal encodes the fields of a struct as the [in] parameters of an operation and Unmarshal decodes the [out]
+// parameters and the return value the same way, so the IDL of an operation maps to two structs:
+//
+//	// NET_API_STATUS NetrShareEnum(
+//	//     [in, string, unique] SRVSVC_HANDLE ServerName,
+//	//     [in, out] LPSHARE_ENUM_STRUCT InfoStruct,
+//	//     [in] DWORD PreferedMaximumLength,
+//	//     [out] DWORD* TotalEntries,
+//	//     [in, out, unique] DWORD* ResumeHandle);
+//	type netrShareEnumIn struct {
+//		ServerName            *string `ndr:"unique"`
+//		InfoStruct            ShareEnumStruct
+//		PreferedMaximumLength uint32
+//		ResumeHandle          *uint32 `ndr:"unique"`
+//	}
+//
+// Call pairs the encoding with a dcerpc.Client from dcerpc.Dial.
+//
+// # Mapping
+//
+// Integers and floats map to their NDR counterparts, bool to boolean, and Go arrays to fixed arrays; int and uint
+// are rejected because their size varies. Every value is aligned to its size relative to the start of the stub data
+// and structs are aligned to their largest member.
+//
+// A string is a conformant varying [string] array of UTF-16 characters with a terminating NUL, or of 8-bit
+// characters with the "ascii" tag. A slice is a conformant array by default; the "varying" tag makes it a varying
+// array and "conformant,varying" a conformant varying array whose maximum count is the capacity of the slice, as in
+// [size_is(MaximumLength/2), length_is(Length/2)]. A struct ending in a conformant array or a string is a conformant
+// struct and its maximum count is written in front of it.
+//
+// Go pointers are pointers. Embedded in a struct, array, or referent they are unique pointers unless tagged "ref" or
+// "full", and their referents are written after the construct that contains them. As parameters they are reference
+// pointers unless tagged "unique" or "full", like in IDL. The pointer tags also turn slices and strings into
+// pointers to them, e.g. `ndr:"unique"` on a string is [string, unique] wchar_t*, and a nil slice is a null pointer.
+// Full pointers to the same value share a referent ID and the referent is written once.
+//
+// A struct whose first field is tagged "switch" is a non-encapsulated union: the switch field is the discriminant
+// and the field tagged "case=N" matching it, or the one tagged "default", is the arm. The other arms are ignored.
+// Fields tagged "-" are skipped.
+package ndr
+
+import (
+	// Standard
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// firstReferentID is the referent ID Windows assigns to the first non-null pointer; the next ones increment by 4
+const firstReferentID = 0x00020000
+
+// maxVaryingCapacity limits the capacity a decoded conformant varying slice gets beyond its elements on the wire
+const maxVaryingCapacity = 1 << 16
+
+// pointerKind is the kind of an NDR pointer
+type pointerKind int
+
+const (
+	notPointer pointerKind = iota
+	refPointer
+	uniquePointer
+	fullPointer
+)
+
+// fieldTag holds the parsed ndr struct tag
+type fieldTag struct {
+	pointer    pointerKind
+	conformant bool
+	varying    bool
+	ascii      bool
+	isSwitch   bool
+	isDefault  bool
+	isCase     bool
+	caseValue  int64
+	skip       bool
+}
+
+// parseTag parses the value of an ndr struct tag
+func parseTag(tag string) (fieldTag, error) {
+	var t fieldTag
+	if tag == "-" {
+		t.skip = true
+		return t, nil
+	}
+	for _, opt := range strings.Split(tag, ",") {
+		switch {
+		case opt == "":
+		case opt == "ref":
+			t.pointer = refPointer
+		case opt == "unique":
+			t.pointer = uniquePointer
+		case opt == "full":
+			t.pointer = fullPointer
+		case opt == "conformant":
+			t.conformant = true
+		case opt == "varying":
+			t.varying = true
+		case opt == "ascii":
+			t.ascii = true
+		case opt == "switch":
+			t.isSwitch = true
+		case opt == "default":
+			t.isDefault = true
+		case strings.HasPrefix(opt, "case="):
+			v, err := strconv.ParseInt(strings.TrimPrefix(opt, "case="), 0, 64)
+			if err != nil {
+				return t, fmt.Errorf("invalid case \"%s\"", opt)
+			}
+			t.isCase = true
+			t.caseValue = v
+		default:
+			return t, fmt.Errorf("unknown option \"%s\"", opt)
+		}
+	}
+	return t, nil
+}
+
+// element returns the tag that applies to the elements of an array or the referent of a pointer
+func (t fieldTag) element() fieldTag {
+	return fieldTag{ascii: t.ascii}
+}
+
+// referent returns the tag that applies to the referent of a pointer tagged t
+func (t fieldTag) referent() fieldTag {
+	t.pointer = notPointer
+	return t
+}
+
+// structField is a field of a struct with its parsed tag
+type structField struct {
+	index int
+	name  string
+	tag   fieldTag
+}
+
+// fields returns the encoded fields of a struct type
+func fields(typ reflect.Type) ([]structField, error) {
+	var out []structField
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		tag, err := parseTag(f.Tag.Get("ndr"))
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %s", typ, f.Name, err)
+		}
+		if tag.skip {
+			continue
+		}
+		if !f.IsExported() {
+			return nil, fmt.Errorf("%s.%s: unexported fields must be tagged \"-\"", typ, f.Name)
+		}
+		out = append(out, structField{index: i, name: f.Name, tag: tag})
+	}
+	return out, nil
+}
+
+// isUnion returns true if the fields are those of a union
+func isUnion(fs []structField) bool {
+	return len(fs) > 0 && fs[0].tag.isSwitch
+}
+
+// unionArm returns the arm of a union selected by the discriminant
+func unionArm(typ reflect.Type, fs []structField, discriminant int64) (structField, error) {
+	var def *structField
+	for i, f := range fs[1:] {
+		if f.tag.isCase && f.tag.caseValue == discriminant {
+			return f, nil
+		}
+		if f.tag.isDefault {
+			def = &fs[1+i]
+		}
+	}
+	if def != nil {
+		return *def, nil
+	}
+	return structField{}, fmt.Errorf("%s has no arm for discriminant %d", typ, discriminant)
+}
+
+// isPointer returns true if values of typ tagged t are NDR pointers
+func isPointer(typ reflect.Type, t fieldTag) bool {
+	return t.pointer != notPointer || typ.Kind() == reflect.Ptr
+}
+
+// alignment returns the NDR alignment of values of typ tagged t
+func alignment(typ reflect.Type, t fieldTag) (int, error) {
+	if isPointer(typ, t) {
+		return 4, nil
+	}
+	switch typ.Kind() {
+	case reflect.Bool, reflect.Int8, reflect.Uint8:
+		return 1, nil
+	case reflect.Int16, reflect.Uint16:
+		return 2, nil
+	case reflect.Int32, reflect.Uint32, reflect.Float32, reflect.String:
+		return 4, nil
+	case reflect.Int64, reflect.Uint64, reflect.Float64:
+		return 8, nil
+	case reflect.Array:
+		return alignment(typ.Elem(), t.element())
+	case reflect.Slice:
+		a, err := alignment(typ.Elem(), t.element())
+		if a < 4 {
+			a = 4
+		}
+		return a, err
+	case reflect.Struct:
+		fs, err := fields(typ)
+		if err != nil {
+			return 0, err
+		}
+		max := 1
+		for _, f := range fs {
+			a, err := alignment(typ.Field(f.index).Type, f.tag)
+			if err != nil {
+				return 0, err
+			}
+			if a > max {
+				max = a
+			}
+		}
+		return max, nil
+	default:
+		return 0, fmt.Errorf("unsupported type %s", typ)
+	}
+}
+
+// conformantField returns the path of field indexes to the conformant array that makes a struct conformant, nil if
+// the struct isn't conformant
+func conformantField(typ reflect.Type) ([]int, fieldTag, error) {
+	fs, err := fields(typ)
+	if err != nil || len(fs) == 0 || isUnion(fs) {
+		return nil, fieldTag{}, err
+	}
+	last := fs[len(fs)-1]
+	ft := typ.Field(last.index).Type
+	if isPointer(ft, last.tag) {
+		return nil, fieldTag{}, nil
+	}
+	switch ft.Kind() {
+	case reflect.String:
+		return []int{last.index}, last.tag, nil
+	case reflect.Slice:
+		if last.tag.conformant || !last.tag.varying {
+			return []int{last.index}, last.tag, nil
+		}
+	case reflect.Struct:
+		path, tag, err := conformantField(ft)
+		if path != nil {
+			return append([]int{last.index}, path...), tag, err
+		}
+		return nil, fieldTag{}, err
+	}
+	return nil, fieldTag{}, nil
+}
+
+// Marshal encodes the fields of the struct v points to as the parameters of an operation
+func Marshal(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("ndr.Marshal(): expected a struct of parameters but received %T", v)
+	}
+	e := &encoder{nextID: firstReferentID}
+	if err := e.parameters(rv); err != nil {
+		return nil, fmt.Errorf("ndr.Marshal(): %s", err)
+	}
+	return e.buf, nil
+}
+
+// encoder builds the stub data
+type encoder struct {
+	buf    []byte
+	nextID uint32
+	// full maps the targets of full pointers to their referent IDs
+	full map[uintptr]uint32
+}
+
+// deferred are the referents of embedded pointers waiting for their construct to be complete
+type deferred []func() error
+
+// flush encodes the deferred referents in order
+func (d deferred) flush() error {
+	for _, f := range d {
+		if err := f(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) align(n int) {
+	for len(e.buf)%n != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *encoder) u16(v uint16) {
+	e.align(2)
+	e.buf = binary.LittleEndian.AppendUint16(e.buf, v)
+}
+
+func (e *encoder) u32(v uint32) {
+	e.align(4)
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) u64(v uint64) {
+	e.align(8)
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, v)
+}
+
+// referentID returns the next referent ID
+func (e *encoder) referentID() uint32 {
+	id := e.nextID
+	e.nextID += 4
+	return id
+}
+
+// parameters encodes the fields of a struct as top-level parameters
+func (e *encoder) parameters(rv reflect.Value) error {
+	fs, err := fields(rv.Type())
+	if err != nil {
+		return err
+	}
+	for _, f := range fs {
+		fv := rv.Field(f.index)
+		if !isPointer(fv.Type(), f.tag) {
+			if err = e.referent(fv, f.tag); err != nil {
+				return fmt.Errorf("%s: %s", f.name, err)
+			}
+			continue
+		}
+		// Top-level pointers are reference pointers unless tagged otherwise, and their referent follows immediately
+		tag := f.tag
+		if tag.pointer == notPointer {
+			tag.pointer = refPointer
+		}
+		var d deferred
+		if tag.pointer == refPointer {
+			if isNil(fv) {
+				return fmt.Errorf("%s: the reference pointer is nil", f.name)
+			}
+			err = e.referent(pointee(fv), tag.referent())
+		} else {
+			err = e.pointer(fv, tag, &d)
+			if err == nil {
+				err = d.flush()
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", f.name, err)
+		}
+	}
+	return nil
+}
+
+// referent encodes a complete construct followed by the referents of the pointers embedded in it
+func (e *encoder) referent(v reflect.Value, t fieldTag) error {
+	var d deferred
+	if err := e.value(v, t, &d, false); err != nil {
+		return err
+	}
+	return d.flush()
+}
+
+// isNil returns true if a pointer value is null
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Slice:
+		return v.IsNil()
+	default:
+		return false
+	}
+}
+
+// pointee returns the value a pointer value points to; slices and strings are their own referents
+func pointee(v reflect.Value) reflect.Value {
+	if v.Kind() == reflect.Ptr {
+		return v.Elem()
+	}
+	return v
+}
+
+// pointer encodes an embedded pointer and defers its referent
+func (e *encoder) pointer(v reflect.Value, t fieldTag, d *deferred) error {
+	kind := t.pointer
+	if kind == notPointer {
+		kind = uniquePointer
+	}
+	if isNil(v) {
+		if kind == refPointer {
+			return fmt.Errorf("the reference pointer is nil")
+		}
+		e.u32(0)
+		return nil
+	}
+	if kind == fullPointer && v.Kind() == reflect.Ptr {
+		if e.full == nil {
+			e.full = make(map[uintptr]uint32)
+		}
+		if id, ok := e.full[v.Pointer()]; ok {
+			e.u32(id)
+			return nil
+		}
+		id := e.referentID()
+		e.full[v.Pointer()] = id
+		e.u32(id)
+	} else {
+		e.u32(e.referentID())
+	}
+	target, rt := pointee(v), t.referent()
+	*d = append(*d, func() error { return e.referent(target, rt) })
+	return nil
+}
+
+// value encodes v inline. The referents of embedded pointers are appended to d. If hoisted is true v is the
+// conformant array of a conformant struct whose maximum count was already written.
+func (e *encoder) value(v reflect.Value, t fieldTag, d *deferred, hoisted bool) error {
+	if isPointer(v.Type(), t) {
+		return e.pointer(v, t, d)
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 1)
+		} else {
+			e.buf = append(e.buf, 0)
+		}
+	case reflect.Int8:
+		e.buf = append(e.buf, byte(v.Int()))
+	case reflect.Uint8:
+		e.buf = append(e.buf, byte(v.Uint()))
+	case reflect.Int16:
+		e.u16(uint16(v.Int()))
+	case reflect.Uint16:
+		e.u16(uint16(v.Uint()))
+	case reflect.Int32:
+		e.u32(uint32(v.Int()))
+	case reflect.Uint32:
+		e.u32(uint32(v.Uint()))
+	case reflect.Int64:
+		e.u64(uint64(v.Int()))
+	case reflect.Uint64:
+		e.u64(v.Uint())
+	case reflect.Float32:
+		e.u32(math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.u64(math.Float64bits(v.Float()))
+	case reflect.String:
+		e.str(v.String(), t, hoisted)
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := e.value(v.Index(i), t.element(), d, false); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		return e.slice(v, t, d, hoisted)
+	case reflect.Struct:
+		return e.structure(v, d, hoisted)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// str encodes a conformant varying string with a terminating NUL
+func (e *encoder) str(s string, t fieldTag, hoisted bool) {
+	if t.ascii {
+		count := uint32(len(s) + 1)
+		if !hoisted {
+			e.u32(count)
+		}
+		e.u32(0)
+		e.u32(count)
+		e.buf = append(e.buf, s...)
+		e.buf = append(e.buf, 0)
+		return
+	}
+	chars := utf16.Encode([]rune(s))
+	count := uint32(len(chars) + 1)
+	if !hoisted {
+		e.u32(count)
+	}
+	e.u32(0)
+	e.u32(count)
+	for _, c := range chars {
+		e.buf = binary.LittleEndian.AppendUint16(e.buf, c)
+	}
+	e.buf = append(e.buf, 0, 0)
+}
+
+// maxCount returns the maximum count of a conformant array or string
+func maxCount(v reflect.Value, t fieldTag) uint32 {
+	if v.Kind() == reflect.String {
+		if t.ascii {
+			return uint32(v.Len() + 1)
+		}
+		return uint32(len(utf16.Encode([]rune(v.String()))) + 1)
+	}
+	if t.varying {
+		return uint32(v.Cap())
+	}
+	return uint32(v.Len())
+}
+
+// slice encodes a conformant, varying, or conformant varying array
+func (e *encoder) slice(v reflect.Value, t fieldTag, d *deferred, hoisted bool) error {
+	conformant := t.conformant || !t.varying
+	if conformant && !hoisted {
+		e.u32(maxCount(v, t))
+	}
+	if t.varying {
+		e.u32(0)
+		e.u32(uint32(v.Len()))
+	}
+	for i := 0; i < v.Len(); i++ {
+		if err := e.value(v.Index(i), t.element(), d, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// structure encodes a struct or a union
+func (e *encoder) structure(v reflect.Value, d *deferred, hoisted bool) error {
+	typ := v.Type()
+	fs, err := fields(typ)
+	if err != nil {
+		return err
+	}
+	a, err := alignment(typ, fieldTag{})
+	if err != nil {
+		return err
+	}
+	if isUnion(fs) {
+		return e.union(v, fs, a, d)
+	}
+
+	// The maximum count of a conformant struct precedes it
+	if !hoisted {
+		path, tag, err := conformantField(typ)
+		if err != nil {
+			return err
+		}
+		if path != nil {
+			e.u32(maxCount(v.FieldByIndex(path), tag))
+		}
+	}
+	e.align(a)
+	for i, f := range fs {
+		last := i == len(fs)-1
+		fv := v.Field(f.index)
+		// The last field of a conformant struct doesn't repeat the maximum count
+		isConformant := last && !isPointer(fv.Type(), f.tag) &&
+			(fv.Kind() == reflect.String || fv.Kind() == reflect.Slice && (f.tag.conformant || !f.tag.varying) || fv.Kind() == reflect.Struct)
+		if err = e.value(fv, f.tag, d, isConformant); err != nil {
+			return fmt.Errorf("%s: %s", f.name, err)
+		}
+	}
+	return nil
+}
+
+// union encodes the discriminant and the selected arm of a non-encapsulated union
+func (e *encoder) union(v reflect.Value, fs []structField, a int, d *deferred) error {
+	e.align(a)
+	sw := v.Field(fs[0].index)
+	var discriminant int64
+	switch sw.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		discriminant = sw.Int()
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		discriminant = int64(sw.Uint())
+	default:
+		return fmt.Errorf("%s: the discriminant must be an integer", fs[0].name)
+	}
+	if err := e.value(sw, fieldTag{}, d, false); err != nil {
+		return err
+	}
+	arm, err := unionArm(v.Type(), fs, discriminant)
+	if err != nil {
+		return err
+	}
+	if err = e.value(v.Field(arm.index), arm.tag, d, false); err != nil {
+		return fmt.Errorf("%s: %s", arm.name, err)
+	}
+	return nil
+}
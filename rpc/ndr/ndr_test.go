@@ -0,0 +1,407 @@
+package ndr
+
+import (
+	// Standard
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// golden decodes a hex dump, ignoring white space
+func golden(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatalf("invalid golden bytes: %v", err)
+	}
+	return b
+}
+
+// utf16Hex returns the hex of a NUL terminated UTF-16 string
+func utf16Hex(s string) string {
+	var b []byte
+	for _, c := range s + "\x00" {
+		b = append(b, byte(c), byte(c>>8))
+	}
+	return hex.EncodeToString(b)
+}
+
+// roundTrip marshals in, compares the stub data with want if it isn't empty, and unmarshals it into out
+func roundTrip(t *testing.T, in, out interface{}, want string) {
+	t.Helper()
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal(): %v", err)
+	}
+	if want != "" {
+		if w := golden(t, want); !bytes.Equal(b, w) {
+			t.Fatalf("Marshal():\n%x\nexpected:\n%x", b, w)
+		}
+	}
+	if err = Unmarshal(b, out); err != nil {
+		t.Fatalf("Unmarshal(%x): %v", b, err)
+	}
+	if got := reflect.ValueOf(out).Elem().Interface(); !reflect.DeepEqual(got, reflect.ValueOf(in).Elem().Interface()) {
+		t.Fatalf("Unmarshal() = %+v, expected %+v", got, in)
+	}
+}
+
+// The srvsvc types of NetrShareEnum at level 1
+type shareInfo1 struct {
+	Netname string `ndr:"unique"`
+	Type    uint32
+	Remark  string `ndr:"unique"`
+}
+
+type shareInfo1Container struct {
+	EntriesRead uint32
+	Buffer      []shareInfo1 `ndr:"unique"`
+}
+
+type shareEnumUnion struct {
+	Level  uint32               `ndr:"switch"`
+	Level1 *shareInfo1Container `ndr:"case=1"`
+}
+
+type shareEnumStruct struct {
+	Level     uint32
+	ShareInfo shareEnumUnion
+}
+
+type netrShareEnumIn struct {
+	ServerName            *string `ndr:"unique"`
+	InfoStruct            shareEnumStruct
+	PreferedMaximumLength uint32
+	ResumeHandle          *uint32 `ndr:"unique"`
+}
+
+type netrShareEnumOut struct {
+	InfoStruct   shareEnumStruct
+	TotalEntries uint32
+	ResumeHandle *uint32 `ndr:"unique"`
+	Return       uint32
+}
+
+// The samr types of SamrConnect and SamrLookupDomainInSamServer
+type samrConnectIn struct {
+	ServerName    *uint16 `ndr:"unique"`
+	DesiredAccess uint32
+}
+
+type rpcUnicodeString struct {
+	Length        uint16
+	MaximumLength uint16
+	Buffer        []uint16 `ndr:"unique,conformant,varying"`
+}
+
+type samrLookupDomainIn struct {
+	ServerHandle [20]byte
+	Name         rpcUnicodeString
+}
+
+type rpcSID struct {
+	Revision            uint8
+	SubAuthorityCount   uint8
+	IdentifierAuthority [6]byte
+	SubAuthority        []uint32
+}
+
+type samrLookupDomainOut struct {
+	DomainID *rpcSID `ndr:"unique"`
+	Return   uint32
+}
+
+// TestGolden tests stub data in the layout Windows produces for srvsvc and samr calls, with the referent IDs
+// numbered from 0x00020000
+func TestGolden(t *testing.T) {
+	server := `\\DC`
+	zero := uint32(0)
+	handle := [20]byte{0: 0x01, 19: 0xff}
+	builtin := make([]uint16, 7, 8)
+	for i, c := range "BUILTIN" {
+		builtin[i] = uint16(c)
+	}
+	backslash := uint16('\\')
+
+	tests := []struct {
+		name  string
+		in    interface{}
+		out   interface{}
+		bytes string
+	}{
+		{
+			name: "NetrShareEnum request",
+			in: &netrShareEnumIn{
+				ServerName:            &server,
+				InfoStruct:            shareEnumStruct{Level: 1, ShareInfo: shareEnumUnion{Level: 1, Level1: &shareInfo1Container{}}},
+				PreferedMaximumLength: 0xffffffff,
+				ResumeHandle:          &zero,
+			},
+			out: &netrShareEnumIn{},
+			bytes: `00000200 05000000 00000000 05000000 ` + utf16Hex(server) + ` 0000
+				01000000 01000000 04000200 00000000 00000000 ffffffff 08000200 00000000`,
+		},
+		{
+			name: "NetrShareEnum response",
+			in: &netrShareEnumOut{
+				InfoStruct: shareEnumStruct{Level: 1, ShareInfo: shareEnumUnion{Level: 1, Level1: &shareInfo1Container{
+					EntriesRead: 1,
+					Buffer:      []shareInfo1{{Netname: "IPC$", Type: 0x80000003, Remark: "Remote IPC"}},
+				}}},
+				TotalEntries: 1,
+				ResumeHandle: &zero,
+			},
+			out: &netrShareEnumOut{},
+			bytes: `01000000 01000000 00000200 01000000 04000200 01000000 08000200 03000080 0c000200
+				05000000 00000000 05000000 ` + utf16Hex("IPC$") + ` 0000
+				0b000000 00000000 0b000000 ` + utf16Hex("Remote IPC") + ` 0000
+				01000000 10000200 00000000 00000000`,
+		},
+		{
+			name:  "SamrConnect request",
+			in:    &samrConnectIn{ServerName: &backslash, DesiredAccess: 0x31},
+			out:   &samrConnectIn{},
+			bytes: `00000200 5c000000 31000000`,
+		},
+		{
+			name:  "SamrLookupDomainInSamServer request",
+			in:    &samrLookupDomainIn{ServerHandle: handle, Name: rpcUnicodeString{Length: 14, MaximumLength: 16, Buffer: builtin}},
+			out:   &samrLookupDomainIn{},
+			bytes: `01000000 00000000 00000000 00000000 000000ff 0e001000 00000200 08000000 00000000 07000000 420055004900 4c00540049004e00`,
+		},
+		{
+			name: "SamrLookupDomainInSamServer response",
+			in: &samrLookupDomainOut{DomainID: &rpcSID{
+				Revision:            1,
+				SubAuthorityCount:   1,
+				IdentifierAuthority: [6]byte{5: 5},
+				SubAuthority:        []uint32{32},
+			}},
+			out:   &samrLookupDomainOut{},
+			bytes: `00000200 01000000 0101 000000000005 20000000 00000000`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			roundTrip(t, test.in, test.out, test.bytes)
+		})
+	}
+
+	// The capacity of conformant varying slices survives the round trip
+	var req samrLookupDomainIn
+	b, _ := Marshal(&samrLookupDomainIn{Name: rpcUnicodeString{Buffer: builtin}})
+	if err := Unmarshal(b, &req); err != nil || cap(req.Name.Buffer) != 8 {
+		t.Fatalf("expected a capacity of 8 but received %d, %v", cap(req.Name.Buffer), err)
+	}
+}
+
+// TestPrimitives tests the encoding and alignment of the primitive types
+func TestPrimitives(t *testing.T) {
+	type primitives struct {
+		A uint8
+		B uint16
+		C bool
+		D int32
+		E int8
+		F uint64
+		G int16
+		H float32
+		I float64
+		J [3]uint8
+		K int64
+		L uint32 `ndr:"-"`
+	}
+	in := &primitives{A: 1, B: 0x0203, C: true, D: -1, E: -2, F: 0x0405060708090a0b, G: -3, H: 1, I: -2, J: [3]uint8{7, 8, 9}, K: 5}
+	roundTrip(t, in, &primitives{}, `01 00 0302 01 000000 ffffffff fe 000000 0b0a090807060504 fdff 0000 0000803f
+		00000000000000c0 070809 0000000000 0500000000000000`)
+}
+
+// TestArrays tests fixed, conformant, varying, and conformant varying arrays
+func TestArrays(t *testing.T) {
+	type arrays struct {
+		Fixed      [2]uint16
+		Conformant []uint16
+		Varying    []uint16 `ndr:"varying"`
+		Both       []uint16 `ndr:"conformant,varying"`
+		Ascii      string   `ndr:"ascii"`
+		Empty      []uint32
+	}
+	in := &arrays{
+		Fixed:      [2]uint16{1, 2},
+		Conformant: []uint16{3},
+		Varying:    []uint16{4, 5},
+		Both:       append(make([]uint16, 0, 4), 6),
+		Ascii:      "hi",
+		Empty:      []uint32{},
+	}
+	roundTrip(t, in, &arrays{}, `01000200 01000000 0300 0000 00000000 02000000 04000500 04000000 00000000 01000000 0600 0000
+		03000000 00000000 03000000 686900 00 00000000`)
+
+	var out arrays
+	b, _ := Marshal(in)
+	if err := Unmarshal(b, &out); err != nil || cap(out.Both) != 4 {
+		t.Fatalf("expected a capacity of 4 but received %d, %v", cap(out.Both), err)
+	}
+}
+
+// TestPointers tests the referent IDs and the order in which referents are written
+func TestPointers(t *testing.T) {
+	type inner struct {
+		X *uint32
+		Y uint32
+	}
+	type outer struct {
+		P *inner
+		Q *uint32
+		R []uint8 `ndr:"unique"`
+		S *uint32 `ndr:"ref"`
+	}
+	type params struct {
+		Ref    *uint16
+		Unique *uint16 `ndr:"unique"`
+		Null   *uint16 `ndr:"unique"`
+		O      outer
+	}
+	x, q, s := uint32(0x11), uint32(0x22), uint32(0x33)
+	ref, unique := uint16(0x44), uint16(0x55)
+	in := &params{Ref: &ref, Unique: &unique, O: outer{P: &inner{X: &x, Y: 0x66}, Q: &q, S: &s}}
+	// The referents of P, Q, and S follow outer, and the referent of X follows the referent of P
+	roundTrip(t, in, &params{}, `4400 0000 00000200 5500 0000 00000000
+		04000200 08000200 00000000 0c000200
+		10000200 66000000 11000000 22000000 33000000`)
+}
+
+// TestFullPointers tests that full pointers to the same value are written once and decoded to the same pointer
+func TestFullPointers(t *testing.T) {
+	type node struct {
+		Value uint32
+		Next  *node `ndr:"full"`
+	}
+	type params struct {
+		A *node `ndr:"full"`
+		B *node `ndr:"full"`
+	}
+	// A cycle of two nodes
+	first := &node{Value: 1}
+	first.Next = &node{Value: 2, Next: first}
+	b, err := Marshal(&params{A: first, B: first.Next})
+	if err != nil {
+		t.Fatalf("Marshal(): %v", err)
+	}
+	want := golden(t, `00000200 01000000 04000200 02000000 00000200 04000200`)
+	if !bytes.Equal(b, want) {
+		t.Fatalf("Marshal():\n%x\nexpected:\n%x", b, want)
+	}
+	var out params
+	if err = Unmarshal(b, &out); err != nil {
+		t.Fatalf("Unmarshal(): %v", err)
+	}
+	if out.A == nil || out.A.Value != 1 || out.A.Next != out.B || out.B.Value != 2 || out.B.Next != out.A {
+		t.Fatalf("the cycle wasn't restored: %+v", out)
+	}
+}
+
+// TestUnions tests selecting union arms by the discriminant and the default arm
+func TestUnions(t *testing.T) {
+	type union struct {
+		Tag     uint16  `ndr:"switch"`
+		Short   uint16  `ndr:"case=1"`
+		Long    uint64  `ndr:"case=2"`
+		Pointer *uint32 `ndr:"default"`
+	}
+	type params struct {
+		U union
+	}
+	v := uint32(7)
+	// The discriminant and the arm are aligned to the largest arm
+	roundTrip(t, &params{U: union{Tag: 1, Short: 9}}, &params{}, `0100 0900`)
+	roundTrip(t, &params{U: union{Tag: 2, Long: 9}}, &params{}, `0200 000000000000 0900000000000000`)
+	roundTrip(t, &params{U: union{Tag: 0x10, Pointer: &v}}, &params{}, `1000 0000 00000200 07000000`)
+
+	type strict struct {
+		Tag   uint32 `ndr:"switch"`
+		Value uint32 `ndr:"case=0x1"`
+	}
+	if _, err := Marshal(&struct{ U strict }{strict{Tag: 2}}); err == nil || !strings.Contains(err.Error(), "no arm for discriminant 2") {
+		t.Fatalf("expected a missing arm error but received %v", err)
+	}
+	if err := Unmarshal(golden(t, `02000000 00000000`), &struct{ U strict }{}); err == nil {
+		t.Fatal("Unmarshal() accepted a discriminant without an arm")
+	}
+}
+
+// TestErrors tests that invalid types, values, and stub data are rejected
+func TestErrors(t *testing.T) {
+	marshal := map[string]interface{}{
+		"not a struct": 42,
+		"int":          &struct{ A int }{},
+		"nil ref":      &struct{ A *uint32 }{},
+		"nil embedded ref": &struct {
+			A struct {
+				B *uint32 `ndr:"ref"`
+			}
+		}{},
+		"unknown option": &struct {
+			A uint32 `ndr:"sparse"`
+		}{},
+		"bad case": &struct {
+			A uint32 `ndr:"case=x"`
+		}{},
+		"unexported": &struct{ a uint32 }{},
+		"map":        &struct{ A map[string]uint32 }{},
+		"float switch": &struct {
+			U struct {
+				A float32 `ndr:"switch"`
+			}
+		}{},
+	}
+	for name, v := range marshal {
+		if _, err := Marshal(v); err == nil {
+			t.Errorf("Marshal(%s) should fail", name)
+		}
+	}
+
+	type params struct {
+		S string
+		B []uint8
+	}
+	b, err := Marshal(&params{S: "abc", B: []uint8{1, 2, 3}})
+	if err != nil {
+		t.Fatalf("Marshal(): %v", err)
+	}
+	for i := 0; i < len(b); i++ {
+		if err = Unmarshal(b[:i], &params{}); err == nil {
+			t.Fatalf("Unmarshal() accepted %d of %d bytes", i, len(b))
+		}
+	}
+	unmarshal := map[string][]byte{
+		"offset":       golden(t, `04000000 01000000 03000000 61006200 6300 0000`),
+		"huge count":   golden(t, `ffffffff 00000000 ffffffff`),
+		"huge array":   golden(t, `01000000 00000000 01000000 0000 0000 ffffff7f`),
+		"actual > max": golden(t, `01000000 00000000 01000000 0000 0000 02000000 00000000 03000000 010203`),
+	}
+	for name, b := range unmarshal {
+		if err = Unmarshal(b, &struct {
+			S string
+			B []uint8 `ndr:"conformant,varying"`
+		}{}); err == nil {
+			t.Errorf("Unmarshal(%s) should fail", name)
+		}
+	}
+	if err = Unmarshal(golden(t, `00000000`), &struct {
+		A *uint32 `ndr:"ref"`
+	}{}); err != nil {
+		t.Errorf("a top-level reference pointer has no representation: %v", err)
+	}
+	if err = Unmarshal(golden(t, `00000000`), &struct {
+		A struct {
+			B *uint32 `ndr:"ref"`
+		}
+	}{}); err == nil {
+		t.Error("Unmarshal() accepted a null reference pointer")
+	}
+	if err = Unmarshal(nil, struct{}{}); err == nil {
+		t.Error("Unmarshal() accepted a value that isn't a pointer")
+	}
+}
@@ -0,0 +1,61 @@
+package npipe
+
+import (
+	// Standard
+	"net"
+	"time"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe/internal/winapi"
+)
+
+// The functions in this file back internal/simpipe. They are only registered by the tests and by builds with the
+// npipesim tag, so the simulated kernel is not linked into the programs that import this package.
+
+// simListener adapts a winListener running on the simulated kernel to net.Listener
+type simListener struct {
+	*winListener
+}
+
+// Accept implements the net.Listener Accept method
+func (l simListener) Accept() (net.Conn, error) {
+	c, err := l.accept()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// simListenPipe creates the first instance of a byte mode pipe in sim like NewPipeListenerQuick
+func simListenPipe(sim *winapi.Sim, address string) (net.Listener, error) {
+	if err := ValidatePipeAddress(address); err != nil {
+		return nil, err
+	}
+	mode := uint32(PipeAccessDuplex | FileFlagOverlapped | FileFlagFirstPipeInstance)
+	handle, err := sim.CreateNamedPipe(address, mode, PipeTypeByte, PipeUnlimitedInstances, 512, 512, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return simListener{&winListener{api: sim, addr: PipeAddr(address), handle: handle, config: newPipeConfig(mode, PipeTypeByte, PipeUnlimitedInstances, 512, 512, 0, nil)}}, nil
+}
+
+// simDialPipe connects to a pipe in sim, trying again while another client takes the available instance. Like
+// DialTimeout it waits before trying again, starting at a millisecond and backing off to the 100 milliseconds
+// DialTimeout waits.
+func simDialPipe(sim *winapi.Sim, address string) (net.Conn, error) {
+	retry := time.Millisecond
+	for {
+		c, err := winDial(sim, address, winapi.NMPWAIT_WAIT_FOREVER)
+		if err == winapi.ERROR_PIPE_BUSY {
+			time.Sleep(retry)
+			if retry < 100*time.Millisecond {
+				retry *= 2
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+}
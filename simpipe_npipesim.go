@@ -0,0 +1,13 @@
+//go:build npipesim
+
+package npipe
+
+import (
+	// Internal
+	"github.com/Ne0nd0g/npipe/internal/simpipe"
+)
+
+func init() {
+	simpipe.Listen = simListenPipe
+	simpipe.Dial = simDialPipe
+}
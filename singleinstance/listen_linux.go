@@ -0,0 +1,64 @@
+//go:build linux
+
+package singleinstance
+
+import (
+	// Standard
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+
+	// X Package
+	"golang.org/x/sys/unix"
+)
+
+// lockPath returns the path of the lock file that decides which process is the primary instance
+func lockPath(name string) string {
+	return filepath.Join(npipe.SocketDir(), "singleinstance", name+".lock")
+}
+
+// listen takes an exclusive lock on the application's lock file and then creates the primary instance's pipe.
+// The kernel releases the lock when the owning process exits, and npipe.Listen replaces the socket a crashed owner
+// left behind, so a stale owner never prevents a new primary instance from starting.
+func listen(name string) (*npipe.PipeListener, func() error, error) {
+	path := lockPath(name)
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, nil, fmt.Errorf("singleinstance.listen(): there was an error creating the lock directory: %s", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("singleinstance.listen(): there was an error opening the lock file: %s", err)
+	}
+
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err == unix.EWOULDBLOCK {
+		f.Close()
+		return nil, nil, errOwned
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("singleinstance.listen(): there was an error locking %s: %s", path, err)
+	}
+
+	// Record the owner to help diagnose a hung primary instance
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+
+	ln, err := npipe.Listen(pipeAddress(name))
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("singleinstance.listen(): %s", err)
+	}
+
+	release := func() error {
+		// The lock file is not removed; another process may already be waiting to lock it
+		f.Truncate(0)
+		return f.Close()
+	}
+	return ln, release, nil
+}
@@ -0,0 +1,91 @@
+//go:build windows
+
+package singleinstance
+
+import (
+	// Standard
+	"fmt"
+	"runtime"
+
+	// X Package
+	"golang.org/x/sys/windows"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// mutexName returns the name of the mutex that decides which process is the primary instance
+func mutexName(name string) string {
+	return `Global\` + name + `.singleinstance`
+}
+
+// listen acquires the application's named mutex and then creates the primary instance's pipe with
+// FILE_FLAG_FIRST_PIPE_INSTANCE. Ownership is decided by acquiring the mutex rather than by whether it already existed
+// because a secondary instance that opened the mutex keeps it alive after the primary instance exits. An abandoned
+// mutex, whose owner exited without releasing it, is acquired as well, so there is no stale state to clean up.
+// Ownership of a mutex belongs to a thread, so the mutex is acquired and released by a goroutine locked to its thread.
+func listen(name string) (*npipe.PipeListener, func() error, error) {
+	lpName, err := windows.UTF16PtrFromString(mutexName(name))
+	if err != nil {
+		return nil, nil, fmt.Errorf("singleinstance.listen(): %s", err)
+	}
+
+	acquired := make(chan error, 1)
+	done := make(chan struct{})
+	released := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		mutex, err := acquireMutex(lpName)
+		acquired <- err
+		if err != nil {
+			return
+		}
+		<-done
+		err = windows.ReleaseMutex(mutex)
+		if err != nil {
+			err = fmt.Errorf("there was an error calling the WINAPI ReleaseMutex function: %s", err)
+		}
+		windows.CloseHandle(mutex)
+		released <- err
+	}()
+	err = <-acquired
+	if err != nil {
+		return nil, nil, err
+	}
+	release := func() error {
+		close(done)
+		return <-released
+	}
+
+	ln, err := npipe.NewPipeListenerQuick(pipeAddress(name), true)
+	if err != nil {
+		release()
+		return nil, nil, fmt.Errorf("singleinstance.listen(): %s", err)
+	}
+	return ln, release, nil
+}
+
+// acquireMutex opens or creates the named mutex and acquires it without waiting. errOwned is returned if another
+// process holds it, or if it can't be opened because it belongs to a primary instance running as another user.
+func acquireMutex(lpName *uint16) (windows.Handle, error) {
+	mutex, err := windows.CreateMutex(nil, false, lpName)
+	if err == windows.ERROR_ACCESS_DENIED {
+		return 0, errOwned
+	}
+	if err != nil && err != windows.ERROR_ALREADY_EXISTS {
+		return 0, fmt.Errorf("singleinstance.listen(): there was an error calling the WINAPI CreateMutex function: %s", err)
+	}
+
+	event, err := windows.WaitForSingleObject(mutex, 0)
+	switch {
+	case err != nil:
+		windows.CloseHandle(mutex)
+		return 0, fmt.Errorf("singleinstance.listen(): there was an error calling the WINAPI WaitForSingleObject function: %s", err)
+	case event == windows.WAIT_OBJECT_0, event == windows.WAIT_ABANDONED:
+		return mutex, nil
+	default:
+		windows.CloseHandle(mutex)
+		return 0, errOwned
+	}
+}
@@ -0,0 +1,247 @@
+//go:build windows || linux
+
+// Package singleinstance ensures only one copy of an application runs at a time.
+//
+// The first process to call Acquire becomes the primary instance and serves a named pipe. Processes launched later
+// detect the pipe, forward their command line arguments and working directory to the primary instance, and receive
+// ErrAlreadyRunning so they can exit:
+//
+//	inst, err := singleinstance.Acquire("myapp")
+//	if err == singleinstance.ErrAlreadyRunning {
+//		os.Exit(0)
+//	}
+//	if err != nil {
+//		// handle error
+//	}
+//	defer inst.Close()
+//	for msg := range inst.Messages() {
+//		// open msg.Args relative to msg.Dir
+//	}
+//
+// On Windows ownership is decided by a named mutex and the pipe is created with FILE_FLAG_FIRST_PIPE_INSTANCE. On Linux
+// the pipe is served by the npipe socket backend and ownership is decided by an exclusive lock on a lock file in
+// npipe.SocketDir(). In both cases the kernel releases ownership when the owning process exits.
+package singleinstance
+
+import (
+	// Standard
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// ErrAlreadyRunning is returned by Acquire after the arguments were forwarded to the primary instance
+var ErrAlreadyRunning = errors.New("singleinstance: another instance is already running")
+
+// ErrStaleOwner is returned by Acquire when another process owns the instance but did not accept the forwarded
+// arguments in time, for example because it is hung
+var ErrStaleOwner = errors.New("singleinstance: the primary instance is not responding")
+
+// errOwned is returned by listen when another process is the primary instance
+var errOwned = errors.New("singleinstance: owned by another process")
+
+// forwardTimeout is how long a secondary instance waits for the primary instance to acknowledge its arguments
+var forwardTimeout = 5 * time.Second
+
+// Message is the command line a secondary instance forwards to the primary instance
+type Message struct {
+	// Args are the secondary instance's command line arguments without the program name
+	Args []string `json:"args"`
+	// Dir is the secondary instance's working directory
+	Dir string `json:"dir"`
+}
+
+// ack is the primary instance's reply to a forwarded Message
+type ack struct {
+	PID int `json:"pid"`
+}
+
+// Instance is the primary instance of an application
+type Instance struct {
+	name     string
+	ln       *npipe.PipeListener
+	release  func() error
+	messages chan Message
+	done     chan struct{}
+	wg       sync.WaitGroup
+	once     sync.Once
+}
+
+// Acquire makes the calling process the primary instance of the application identified by name. If another process
+// already is the primary instance, the caller's arguments and working directory are forwarded to it and
+// ErrAlreadyRunning is returned. The name may only contain ASCII letters, digits, '.', '-', and '_'.
+func Acquire(name string) (*Instance, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("singleinstance.Acquire(): there was an error getting the working directory: %s", err)
+	}
+	return acquireWith(name, Message{Args: os.Args[1:], Dir: dir})
+}
+
+// acquireWith implements Acquire, forwarding msg when the caller is not the primary instance
+func acquireWith(name string, msg Message) (*Instance, error) {
+	err := validateName(name)
+	if err != nil {
+		return nil, fmt.Errorf("singleinstance.Acquire(): %s", err)
+	}
+
+	ln, release, err := listen(name)
+	if err == errOwned {
+		err = Forward(name, msg)
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrAlreadyRunning
+	}
+	if err != nil {
+		return nil, fmt.Errorf("singleinstance.Acquire(): %s", err)
+	}
+
+	inst := &Instance{
+		name:     name,
+		ln:       ln,
+		release:  release,
+		messages: make(chan Message),
+		done:     make(chan struct{}),
+	}
+	inst.wg.Add(1)
+	go inst.serve()
+	return inst, nil
+}
+
+// Forward sends msg to the primary instance of the application identified by name and waits for it to be
+// acknowledged. ErrStaleOwner is returned if the primary instance does not respond within the timeout.
+func Forward(name string, msg Message) error {
+	err := validateName(name)
+	if err != nil {
+		return fmt.Errorf("singleinstance.Forward(): %s", err)
+	}
+
+	conn, err := npipe.DialTimeout(pipeAddress(name), forwardTimeout)
+	if err != nil {
+		if pe, ok := err.(npipe.PipeError); ok && pe.Timeout() {
+			return ErrStaleOwner
+		}
+		return fmt.Errorf("singleinstance.Forward(): %s", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(forwardTimeout))
+	err = json.NewEncoder(conn).Encode(msg)
+	if err == nil {
+		var a ack
+		err = json.NewDecoder(bufio.NewReader(conn)).Decode(&a)
+	}
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return ErrStaleOwner
+		}
+		return fmt.Errorf("singleinstance.Forward(): there was an error forwarding the arguments: %s", err)
+	}
+	return nil
+}
+
+// Messages returns the channel on which arguments forwarded by secondary instances are delivered. The channel is
+// closed by Close. A secondary instance is only acknowledged once its Message was received from the channel.
+func (i *Instance) Messages() <-chan Message {
+	return i.messages
+}
+
+// Close stops serving secondary instances and gives up ownership so another process can become the primary instance
+func (i *Instance) Close() error {
+	var err error
+	i.once.Do(func() {
+		close(i.done)
+		err = i.ln.Close()
+		i.wg.Wait()
+		close(i.messages)
+		if rerr := i.release(); rerr != nil && err == nil {
+			err = rerr
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("singleinstance.Instance.Close(): %s", err)
+	}
+	return nil
+}
+
+// serve accepts connections from secondary instances until the listener is closed
+func (i *Instance) serve() {
+	defer i.wg.Done()
+	for {
+		conn, err := i.ln.Accept()
+		if err != nil {
+			if err == npipe.ErrClosed {
+				return
+			}
+			select {
+			case <-i.done:
+				return
+			default:
+				continue
+			}
+		}
+		// Each secondary instance is served on its own so one that never sends its arguments doesn't delay the others
+		i.wg.Add(1)
+		go i.handle(conn)
+	}
+}
+
+// handle reads a single Message from a secondary instance, delivers it, and acknowledges it
+func (i *Instance) handle(conn net.Conn) {
+	defer i.wg.Done()
+	defer conn.Close()
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-i.done:
+			// Close doesn't wait for the deadline of a secondary instance that is still sending its arguments
+			conn.SetDeadline(time.Now())
+		case <-finished:
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(forwardTimeout))
+	var msg Message
+	err := json.NewDecoder(bufio.NewReader(conn)).Decode(&msg)
+	if err != nil {
+		return
+	}
+	select {
+	case i.messages <- msg:
+	case <-i.done:
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(forwardTimeout))
+	json.NewEncoder(conn).Encode(ack{PID: os.Getpid()})
+}
+
+// pipeAddress returns the address of the pipe served by the primary instance
+func pipeAddress(name string) string {
+	return `\\.\pipe\` + name + `.singleinstance`
+}
+
+// validateName ensures the application name can be used in pipe and file names
+func validateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("the application name is empty")
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '-', c == '_':
+		default:
+			return fmt.Errorf("the application name \"%s\" contains the invalid character %q", name, c)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package singleinstance
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Ne0nd0g/npipe"
+	"golang.org/x/sys/unix"
+)
+
+// useSocketDir points the npipe socket backend at a temporary directory for the duration of the test
+func useSocketDir(t *testing.T) {
+	t.Setenv("NPIPE_SOCKET_DIR", t.TempDir())
+}
+
+// TestForwardToPrimary tests that a second launch forwards its arguments to the primary instance
+func TestForwardToPrimary(t *testing.T) {
+	useSocketDir(t)
+	primary, err := acquireWith("TestForwardToPrimary", Message{})
+	if err != nil {
+		t.Fatalf("acquireWith(): %v", err)
+	}
+	defer primary.Close()
+
+	msg := Message{Args: []string{"--open", "file.txt"}, Dir: "/home/user"}
+	result := make(chan error)
+	go func() {
+		inst, err := acquireWith("TestForwardToPrimary", msg)
+		if inst != nil {
+			inst.Close()
+		}
+		result <- err
+	}()
+
+	select {
+	case got := <-primary.Messages():
+		if !reflect.DeepEqual(got, msg) {
+			t.Fatalf("Unexpected message (expected: %+v, got: %+v)", msg, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the forwarded message")
+	}
+	if err := <-result; err != ErrAlreadyRunning {
+		t.Fatalf("Expected ErrAlreadyRunning, got: %v", err)
+	}
+}
+
+// TestSilentClient tests that a client that never sends its arguments doesn't delay other secondary instances or Close
+func TestSilentClient(t *testing.T) {
+	useSocketDir(t)
+	primary, err := acquireWith("TestSilentClient", Message{})
+	if err != nil {
+		t.Fatalf("acquireWith(): %v", err)
+	}
+	silent, err := npipe.Dial(pipeAddress("TestSilentClient"))
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	defer silent.Close()
+
+	msg := Message{Args: []string{"second"}, Dir: "/"}
+	result := make(chan error, 1)
+	go func() {
+		_, err := acquireWith("TestSilentClient", msg)
+		result <- err
+	}()
+	select {
+	case got := <-primary.Messages():
+		if !reflect.DeepEqual(got, msg) {
+			t.Fatalf("Unexpected message (expected: %+v, got: %+v)", msg, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the forwarded message behind a silent client")
+	}
+	if err := <-result; err != ErrAlreadyRunning {
+		t.Fatalf("Expected ErrAlreadyRunning, got: %v", err)
+	}
+
+	start := time.Now()
+	if err := primary.Close(); err != nil {
+		t.Fatalf("Close(): %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Close() waited %s for the silent client", d)
+	}
+}
+
+// TestAcquireAfterClose tests that ownership is given up by Close
+func TestAcquireAfterClose(t *testing.T) {
+	useSocketDir(t)
+	first, err := acquireWith("TestAcquireAfterClose", Message{})
+	if err != nil {
+		t.Fatalf("acquireWith(): %v", err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close(): %v", err)
+	}
+	if _, ok := <-first.Messages(); ok {
+		t.Fatal("Messages() was not closed by Close()")
+	}
+
+	second, err := acquireWith("TestAcquireAfterClose", Message{})
+	if err != nil {
+		t.Fatalf("acquireWith() after Close(): %v", err)
+	}
+	second.Close()
+}
+
+// TestStaleOwner tests that a process holding the lock without serving the pipe is reported as stale
+func TestStaleOwner(t *testing.T) {
+	useSocketDir(t)
+	forwardTimeout = 200 * time.Millisecond
+	defer func() { forwardTimeout = 5 * time.Second }()
+
+	path := lockPath("TestStaleOwner")
+	os.MkdirAll(filepath.Dir(path), 0700)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile(): %v", err)
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		t.Fatalf("Flock(): %v", err)
+	}
+
+	inst, err := acquireWith("TestStaleOwner", Message{})
+	if inst != nil {
+		inst.Close()
+	}
+	if err != ErrStaleOwner {
+		t.Fatalf("Expected ErrStaleOwner, got: %v", err)
+	}
+}
+
+// TestCrashedOwner tests that the socket and lock file left behind by a crashed owner do not block a new primary
+func TestCrashedOwner(t *testing.T) {
+	useSocketDir(t)
+	// Simulate the leftovers of a crashed primary instance: an unlocked lock file and a socket nobody listens on
+	path := lockPath("TestCrashedOwner")
+	os.MkdirAll(filepath.Dir(path), 0700)
+	os.WriteFile(path, []byte("12345\n"), 0600)
+	socket := filepath.Join(npipe.SocketDir(), "TestCrashedOwner.singleinstance")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		t.Fatalf("ListenUnix(): %v", err)
+	}
+	ln.SetUnlinkOnClose(false)
+	ln.Close()
+
+	inst, err := acquireWith("TestCrashedOwner", Message{})
+	if err != nil {
+		t.Fatalf("acquireWith(): %v", err)
+	}
+	inst.Close()
+}
+
+// TestInvalidName tests that names that can't be used in pipe and file names are rejected
+func TestInvalidName(t *testing.T) {
+	useSocketDir(t)
+	for _, name := range []string{"", "../escape", `back\slash`, "space name"} {
+		if inst, err := acquireWith(name, Message{}); err == nil {
+			inst.Close()
+			t.Errorf("acquireWith(%q) did not return an error", name)
+		}
+	}
+}
@@ -0,0 +1,579 @@
+//go:build windows || linux
+
+package smb2
+
+import (
+	// Standard
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPort is the TCP port of SMB over Direct TCP
+const DefaultPort = 445
+
+// maxIOSize limits reads, writes, and transactions to one credit each
+const maxIOSize = 64 * 1024
+
+// creditRequest is the number of credits every request asks for, enough for concurrent reads and writes on several
+// pipes
+const creditRequest = 32
+
+// closeTimeout bounds how long Close waits for the server to acknowledge closing a pipe or a session
+const closeTimeout = 5 * time.Second
+
+// Dialer holds the credentials and options used to reach pipes on remote computers. The zero value connects
+// anonymously, which most Windows servers only allow for a few pipes.
+type Dialer struct {
+	// User, Password, and Domain are the NTLM credentials
+	User     string
+	Password string
+	Domain   string
+	// Workstation is the name of this computer sent to the server, empty by default
+	Workstation string
+	// Port is the TCP port of the server, DefaultPort if zero
+	Port int
+	// Timeout limits connecting and authenticating, and how long Dial waits for a busy pipe. Zero means no limit.
+	Timeout time.Duration
+	// RequireSigning refuses sessions whose messages aren't signed, even if the server doesn't require signing
+	RequireSigning bool
+}
+
+// parseAddress splits a remote pipe address \\<host>\pipe\<name> into the host and the pipe name
+func parseAddress(address string) (host, name string, err error) {
+	p := strings.Split(address, `\`)
+	if len(p) < 5 || p[0] != "" || p[1] != "" || p[2] == "" || !strings.EqualFold(p[3], "pipe") || p[4] == "" {
+		return "", "", fmt.Errorf("invalid pipe address \"%s\", expected \\\\<host>\\pipe\\<name>", address)
+	}
+	return p[2], strings.Join(p[4:], `\`), nil
+}
+
+// Dial connects to the pipe at address, which must be of the form \\<host>\pipe\<name>, on a new session that is
+// logged off when the connection is closed. If every instance of the pipe is busy, Dial waits for one until the
+// Timeout expires.
+func (d *Dialer) Dial(address string) (*Conn, error) {
+	host, name, err := parseAddress(address)
+	if err != nil {
+		return nil, fmt.Errorf("smb2.Dialer.Dial(): %s", err)
+	}
+	s, err := d.Session(host)
+	if err != nil {
+		return nil, fmt.Errorf("smb2.Dialer.Dial(): %s", err)
+	}
+	var deadline time.Time
+	if d.Timeout > 0 {
+		deadline = time.Now().Add(d.Timeout)
+	}
+	for {
+		conn, err := s.Open(name)
+		if err == nil {
+			conn.ownsSession = true
+			return conn, nil
+		}
+		busy := errors.Is(err, StatusPipeNotAvailable) || errors.Is(err, StatusPipeBusy)
+		if !busy || !deadline.IsZero() && time.Now().Add(100*time.Millisecond).After(deadline) {
+			s.Close()
+			return nil, fmt.Errorf("smb2.Dialer.Dial(): %s", err)
+		}
+		<-time.After(100 * time.Millisecond)
+	}
+}
+
+// Session connects to host, negotiates the dialect, authenticates, and connects to the IPC$ share
+func (d *Dialer) Session(host string) (*Session, error) {
+	port := d.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), d.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("smb2.Dialer.Session(): %s", err)
+	}
+	if d.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.Timeout))
+	}
+
+	s := newSession(conn, host)
+	if err = s.negotiate(d.RequireSigning); err == nil {
+		if err = s.sessionSetup(d); err == nil {
+			if err = s.treeConnect(); err == nil {
+				err = s.validateNegotiate()
+			}
+		}
+	}
+	if err != nil {
+		s.fail(err)
+		return nil, fmt.Errorf("smb2.Dialer.Session(): %s", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return s, nil
+}
+
+// Session is an authenticated SMB2 session connected to the IPC$ share of a server. Its pipes share one TCP
+// connection and are safe for concurrent use.
+type Session struct {
+	conn net.Conn
+	host string
+
+	dialect   uint16
+	maxIO     int
+	signing   bool
+	sessionID uint64
+	treeID    uint32
+	// offered and answered are the NEGOTIATE request and response, which validateNegotiate has the server confirm
+	offered  *negotiateRequest
+	answered *negotiateResponse
+
+	// wmu serializes writing messages
+	wmu sync.Mutex
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	nextID      uint64
+	credits     int
+	pending     map[uint64]*call
+	signer      *signer
+	established bool
+	err         error
+	done        chan struct{}
+}
+
+// call is a request waiting for its response
+type call struct {
+	msgID uint64
+	// asyncID is set by the interim response of a request the server completes asynchronously
+	asyncID uint64
+	// signed is set for requests that are signed even if the session isn't, whose responses must be signed too
+	signed bool
+	resp   chan []byte
+}
+
+func newSession(conn net.Conn, host string) *Session {
+	s := &Session{
+		conn:    conn,
+		host:    host,
+		credits: 1,
+		pending: make(map[uint64]*call),
+		done:    make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.readLoop()
+	return s
+}
+
+// fail ends the session with err, failing every pending and future request
+func (s *Session) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+		close(s.done)
+		s.cond.Broadcast()
+	}
+	s.mu.Unlock()
+	s.conn.Close()
+}
+
+// readLoop dispatches the responses to the requests waiting for them
+func (s *Session) readLoop() {
+	for {
+		msg, err := readMessage(s.conn)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		h, err := parseHeader(msg)
+		if err == nil && h.Flags&flagResponse == 0 {
+			err = fmt.Errorf("received a request from the server")
+		}
+		if err != nil {
+			s.fail(err)
+			return
+		}
+
+		s.mu.Lock()
+		s.credits += int(h.Credits)
+		s.cond.Broadcast()
+		c := s.pending[h.MessageID]
+		if c != nil && h.Status == StatusPending && h.Flags&flagAsync != 0 {
+			// The final response follows once the operation completes
+			c.asyncID = h.AsyncID
+			c = nil
+		} else if c != nil {
+			delete(s.pending, h.MessageID)
+		}
+		signer, established, signing := s.signer, s.established, s.signing
+		s.mu.Unlock()
+		if c == nil {
+			// Interim responses, oplock breaks, and responses to abandoned requests
+			continue
+		}
+
+		if h.Flags&flagSigned != 0 && signer != nil {
+			err = signer.verify(msg)
+		} else if h.Flags&flagSigned == 0 && (signing && established || c.signed) {
+			err = fmt.Errorf("the response to message %d isn't signed", h.MessageID)
+		}
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		c.resp <- msg
+	}
+}
+
+// send sends a request and returns the call to wait on for its response
+func (s *Session) send(command uint16, treeID uint32, body message) (*call, error) {
+	return s.sendSigned(command, treeID, body, false)
+}
+
+// sendSigned sends a request like send; if signed is true, the request is signed with the session key even if the
+// session isn't signed, and its response must be signed as well
+func (s *Session) sendSigned(command uint16, treeID uint32, body message, signed bool) (*call, error) {
+	s.mu.Lock()
+	for s.err == nil && s.credits == 0 {
+		s.cond.Wait()
+	}
+	if s.err != nil {
+		err := s.err
+		s.mu.Unlock()
+		return nil, err
+	}
+	s.credits--
+	c := &call{msgID: s.nextID, signed: signed, resp: make(chan []byte, 1)}
+	s.nextID++
+	s.pending[c.msgID] = c
+	signer := s.signer
+	if !s.established || !s.signing && !signed {
+		signer = nil
+	}
+	s.mu.Unlock()
+
+	h := &header{Command: command, Credits: creditRequest, MessageID: c.msgID, TreeID: treeID, SessionID: s.sessionID}
+	if s.dialect >= Dialect210 {
+		h.CreditCharge = 1
+	}
+	if err := s.write(h, body, signer); err != nil {
+		s.mu.Lock()
+		delete(s.pending, c.msgID)
+		s.mu.Unlock()
+		s.fail(err)
+		return nil, err
+	}
+	return c, nil
+}
+
+// write encodes, signs, and sends a message
+func (s *Session) write(h *header, body message, signer *signer) error {
+	msg := body.marshal(appendHeader(make([]byte, 0, 128), h))
+	if signer != nil {
+		signer.sign(msg)
+	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return writeMessage(s.conn, msg)
+}
+
+// wait waits for the response to c. If deadline or cancel is closed first, the request is cancelled and wait returns
+// the final response, which may be a successful one if the request completed before it could be cancelled; if abort
+// is closed first, the request is abandoned and wait returns net.ErrClosed.
+func (s *Session) wait(c *call, treeID uint32, deadline, cancel, abort <-chan struct{}) ([]byte, error) {
+	select {
+	case msg := <-c.resp:
+		return msg, nil
+	case <-s.done:
+		return nil, s.err
+	case <-abort:
+		return nil, net.ErrClosed
+	case <-deadline:
+	case <-cancel:
+	}
+
+	s.mu.Lock()
+	h := &header{Command: cmdCancel, MessageID: c.msgID, TreeID: treeID, SessionID: s.sessionID}
+	if c.asyncID != 0 {
+		h.Flags = flagAsync
+		h.AsyncID = c.asyncID
+	}
+	signer := s.signer
+	if !s.established || !s.signing {
+		signer = nil
+	}
+	s.mu.Unlock()
+	if err := s.write(h, &emptyMessage{}, signer); err != nil {
+		s.fail(err)
+		return nil, err
+	}
+	select {
+	case msg := <-c.resp:
+		return msg, nil
+	case <-s.done:
+		return nil, s.err
+	case <-abort:
+		return nil, net.ErrClosed
+	}
+}
+
+// roundTrip sends a request, waits for its response, and decodes it into out. Responses with a status other than
+// success or one of the accepted ones are returned as a StatusError. The header of the response is returned.
+func (s *Session) roundTrip(command uint16, treeID uint32, in, out message, accept ...StatusError) (*header, error) {
+	c, err := s.send(command, treeID, in)
+	if err != nil {
+		return nil, err
+	}
+	// Requests that tear down state are abandoned if the server doesn't answer
+	var abort chan struct{}
+	if command == cmdClose || command == cmdTreeDisconnect || command == cmdLogoff {
+		abort = make(chan struct{})
+		timer := time.AfterFunc(closeTimeout, func() { close(abort) })
+		defer timer.Stop()
+	}
+	msg, err := s.wait(c, treeID, nil, nil, abort)
+	if err != nil {
+		return nil, err
+	}
+	return decodeResponse(msg, out, accept...)
+}
+
+// decodeResponse checks the status of a response and decodes its body into out
+func decodeResponse(msg []byte, out message, accept ...StatusError) (*header, error) {
+	h, err := parseHeader(msg)
+	if err != nil {
+		return nil, err
+	}
+	ok := h.Status == StatusSuccess
+	for _, status := range accept {
+		ok = ok || h.Status == status
+	}
+	if !ok {
+		return h, h.Status
+	}
+	if err = out.unmarshal(msg); err != nil {
+		return h, fmt.Errorf("invalid response to command %d: %s", h.Command, err)
+	}
+	return h, nil
+}
+
+// negotiate agrees on the dialect and the security mode
+func (s *Session) negotiate(requireSigning bool) error {
+	req := &negotiateRequest{SecurityMode: signingEnabled, Dialects: dialects}
+	if requireSigning {
+		req.SecurityMode |= signingRequired
+	}
+	if _, err := rand.Read(req.ClientGUID[:]); err != nil {
+		return err
+	}
+	var resp negotiateResponse
+	if _, err := s.roundTrip(cmdNegotiate, 0, req, &resp); err != nil {
+		return fmt.Errorf("NEGOTIATE failed: %s", err)
+	}
+	s.offered, s.answered = req, &resp
+	supported := false
+	for _, d := range dialects {
+		supported = supported || resp.Dialect == d
+	}
+	if !supported {
+		return fmt.Errorf("the server selected the unsupported dialect 0x%04x", resp.Dialect)
+	}
+	s.dialect = resp.Dialect
+	s.signing = requireSigning || resp.SecurityMode&signingRequired != 0
+	s.maxIO = maxIOSize
+	for _, size := range []uint32{resp.MaxReadSize, resp.MaxWriteSize, resp.MaxTransactSize} {
+		if int(size) < s.maxIO {
+			s.maxIO = int(size)
+		}
+	}
+	if s.maxIO < 1024 {
+		return fmt.Errorf("the server's maximum read, write, or transaction size of %d bytes is too small", s.maxIO)
+	}
+	return nil
+}
+
+// sessionSetup authenticates with NTLM wrapped in SPNEGO
+func (s *Session) sessionSetup(d *Dialer) error {
+	ntlm := &ntlmClient{user: d.User, password: d.Password, domain: d.Domain, workstation: d.Workstation}
+	securityMode := uint8(signingEnabled)
+	if s.signing {
+		securityMode |= uint8(signingRequired)
+	}
+
+	var resp sessionSetupResponse
+	req := &sessionSetupRequest{SecurityMode: securityMode, SecurityBuffer: negTokenInit(ntlm.negotiateMessage())}
+	h, err := s.roundTrip(cmdSessionSetup, 0, req, &resp, StatusMoreProcessingRequired)
+	if err != nil {
+		return fmt.Errorf("SESSION_SETUP failed: %s", err)
+	}
+	if h.Status != StatusMoreProcessingRequired {
+		return fmt.Errorf("the server completed SESSION_SETUP without authenticating")
+	}
+	s.sessionID = h.SessionID
+	challenge, err := mechToken(resp.SecurityBuffer)
+	if err != nil {
+		return fmt.Errorf("invalid SESSION_SETUP response: %s", err)
+	}
+	auth, err := ntlm.authenticate(challenge)
+	if err != nil {
+		return fmt.Errorf("NTLM authentication failed: %s", err)
+	}
+	// The final response is signed with the new session's key
+	if ntlm.sessionKey != nil {
+		s.mu.Lock()
+		s.signer = newSigner(s.dialect, ntlm.sessionKey)
+		s.mu.Unlock()
+	}
+
+	req = &sessionSetupRequest{SecurityMode: securityMode, SecurityBuffer: negTokenResp(-1, nil, auth)}
+	if _, err = s.roundTrip(cmdSessionSetup, 0, req, &resp); err != nil {
+		return fmt.Errorf("SESSION_SETUP failed: %s", err)
+	}
+	if resp.SessionFlags&sessionEncrypt != 0 {
+		return fmt.Errorf("the server requires encryption, which is not supported")
+	}
+	if len(resp.SecurityBuffer) > 0 {
+		if token, err := parseSPNEGO(resp.SecurityBuffer); err == nil && token.state == negReject {
+			return fmt.Errorf("the server rejected the authentication")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if resp.SessionFlags&(sessionGuest|sessionNull) != 0 || ntlm.sessionKey == nil {
+		// Guest and anonymous sessions have no key to sign with
+		if s.signing {
+			return fmt.Errorf("signing is required but the server authenticated a guest or anonymous session")
+		}
+		s.signer = nil
+	}
+	s.established = true
+	return nil
+}
+
+// mechToken returns the NTLM message of a security buffer, which is usually wrapped in SPNEGO
+func mechToken(buf []byte) ([]byte, error) {
+	if bytes.HasPrefix(buf, ntlmSignature) {
+		return buf, nil
+	}
+	token, err := parseSPNEGO(buf)
+	if err != nil {
+		return nil, err
+	}
+	if token.state == negReject {
+		return nil, fmt.Errorf("the server rejected NTLM")
+	}
+	if len(token.token) == 0 {
+		return nil, fmt.Errorf("the SPNEGO token doesn't hold an NTLM message")
+	}
+	return token.token, nil
+}
+
+// treeConnect connects to the IPC$ share
+func (s *Session) treeConnect() error {
+	var resp treeConnectResponse
+	h, err := s.roundTrip(cmdTreeConnect, 0, &treeConnectRequest{Path: `\\` + s.host + `\IPC$`}, &resp)
+	if err != nil {
+		return fmt.Errorf("TREE_CONNECT to IPC$ failed: %s", err)
+	}
+	if resp.ShareType != shareTypePipe {
+		return fmt.Errorf("IPC$ is not a pipe share but of type %d", resp.ShareType)
+	}
+	s.treeID = h.TreeID
+	return nil
+}
+
+// validateNegotiate has the server confirm the NEGOTIATE exchange of an SMB 3 session with
+// FSCTL_VALIDATE_NEGOTIATE_INFO, which detects a man in the middle that downgraded the dialect or cleared the server's
+// signing requirement. The request and its response are signed with the session key even if the session isn't
+// signed, so guest and anonymous sessions, which have no key, can't be validated.
+func (s *Session) validateNegotiate() error {
+	s.mu.Lock()
+	signer := s.signer
+	s.mu.Unlock()
+	if s.dialect < Dialect300 || signer == nil {
+		return nil
+	}
+
+	// VALIDATE_NEGOTIATE_INFO: capabilities, client GUID, security mode, dialect count, and the dialects
+	in := binary.LittleEndian.AppendUint32(nil, s.offered.Capabilities)
+	in = append(in, s.offered.ClientGUID[:]...)
+	in = binary.LittleEndian.AppendUint16(in, s.offered.SecurityMode)
+	in = binary.LittleEndian.AppendUint16(in, uint16(len(s.offered.Dialects)))
+	for _, d := range s.offered.Dialects {
+		in = binary.LittleEndian.AppendUint16(in, d)
+	}
+	req := &ioctlRequest{CtlCode: fsctlValidateNegotiateInfo, FileID: allFiles, Input: in, MaxOutput: 24, Flags: ioctlIsFsctl}
+	c, err := s.sendSigned(cmdIoctl, s.treeID, req, true)
+	if err != nil {
+		return fmt.Errorf("VALIDATE_NEGOTIATE_INFO failed: %s", err)
+	}
+	msg, err := s.wait(c, s.treeID, nil, nil, nil)
+	var resp ioctlResponse
+	if err == nil {
+		_, err = decodeResponse(msg, &resp)
+	}
+	if err != nil {
+		return fmt.Errorf("VALIDATE_NEGOTIATE_INFO failed: %s", err)
+	}
+
+	// The server's side: capabilities, server GUID, security mode, and the selected dialect
+	out := resp.Output
+	if len(out) < 24 || binary.LittleEndian.Uint32(out) != s.answered.Capabilities ||
+		!bytes.Equal(out[4:20], s.answered.ServerGUID[:]) ||
+		binary.LittleEndian.Uint16(out[20:]) != s.answered.SecurityMode || binary.LittleEndian.Uint16(out[22:]) != s.dialect {
+		return fmt.Errorf("the VALIDATE_NEGOTIATE_INFO response doesn't match the NEGOTIATE response, which was tampered with")
+	}
+	return nil
+}
+
+// Open opens the pipe with the given name, e.g. "srvsvc"
+func (s *Session) Open(name string) (*Conn, error) {
+	name = strings.TrimLeft(name, `\`)
+	req := &createRequest{
+		ImpersonationLevel: impersonationImpersonation,
+		DesiredAccess:      pipeAccess,
+		ShareAccess:        shareReadWrite,
+		CreateDisposition:  fileOpen,
+		CreateOptions:      fileNonDirectoryFile,
+		Name:               name,
+	}
+	var resp createResponse
+	if _, err := s.roundTrip(cmdCreate, s.treeID, req, &resp); err != nil {
+		return nil, fmt.Errorf("smb2.Session.Open(): opening pipe \"%s\" failed: %w", name, err)
+	}
+	return newConn(s, `\\`+s.host+`\pipe\`+name, resp.FileID), nil
+}
+
+// Dialect returns the negotiated dialect
+func (s *Session) Dialect() uint16 {
+	return s.dialect
+}
+
+// Signed returns true if the messages of the session are signed
+func (s *Session) Signed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.signing && s.signer != nil
+}
+
+// Close disconnects from IPC$, logs off, and closes the TCP connection. Pipes opened on the session stop working.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	err := s.err
+	s.mu.Unlock()
+	if err != nil {
+		return nil
+	}
+	if _, err = s.roundTrip(cmdTreeDisconnect, s.treeID, &emptyMessage{}, &emptyMessage{}); err == nil {
+		_, err = s.roundTrip(cmdLogoff, 0, &emptyMessage{}, &emptyMessage{})
+	}
+	s.fail(net.ErrClosed)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("smb2.Session.Close(): %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,648 @@
+package smb2
+
+import (
+	// Standard
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// stubServer is a minimal SMB2 server that authenticates with NTLM, serves IPC$, and bridges every opened pipe to the
+// local pipe of the same name
+type stubServer struct {
+	t *testing.T
+	// dialect is the dialect the server selects
+	dialect uint16
+	// requireSigning makes the server require signed messages
+	requireSigning bool
+	// users maps user names to passwords
+	users map[string]string
+	// anonymous allows anonymous sessions
+	anonymous bool
+	// maxIO is the maximum read, write, and transaction size, 64 KiB if zero
+	maxIO uint32
+}
+
+// start listens on a random local port and returns the dialer to reach the server with the given credentials
+func (s *stubServer) start(user, password string) *Dialer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.t.Fatalf("net.Listen(): %v", err)
+	}
+	s.t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return &Dialer{User: user, Password: password, Port: ln.Addr().(*net.TCPAddr).Port, Timeout: 5 * time.Second}
+}
+
+// stubConn is the state of one client connection
+type stubConn struct {
+	s    *stubServer
+	conn net.Conn
+	wmu  sync.Mutex
+
+	ntlm   *ntlmServer
+	signer *signer
+	// negotiate is the client's NEGOTIATE request, which VALIDATE_NEGOTIATE_INFO is checked against
+	negotiate negotiateRequest
+
+	mu        sync.Mutex
+	files     map[fileID]*npipe.PipeConn
+	nextFile  uint64
+	nextAsync uint64
+	// pending maps the message IDs of asynchronous requests to their pipe, whose read is cancelled by CANCEL
+	pending map[uint64]*npipe.PipeConn
+}
+
+func (s *stubServer) serve(conn net.Conn) {
+	c := &stubConn{
+		s:       s,
+		conn:    conn,
+		files:   make(map[fileID]*npipe.PipeConn),
+		pending: make(map[uint64]*npipe.PipeConn),
+		ntlm: &ntlmServer{
+			computer:  "STUB",
+			domain:    "WORKGROUP",
+			anonymous: s.anonymous,
+			password: func(user, domain string) (string, bool) {
+				password, ok := s.users[user]
+				return password, ok
+			},
+		},
+	}
+	defer func() {
+		conn.Close()
+		c.mu.Lock()
+		for _, f := range c.files {
+			f.Close()
+		}
+		c.mu.Unlock()
+	}()
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		h, err := parseHeader(msg)
+		if err != nil {
+			s.t.Errorf("stub server: %v", err)
+			return
+		}
+		if h.Flags&flagSigned != 0 && c.signer != nil {
+			if err = c.signer.verify(msg); err != nil {
+				s.t.Errorf("stub server: invalid signature on command %d: %v", h.Command, err)
+				return
+			}
+		} else if s.requireSigning && c.signer != nil && h.Command != cmdSessionSetup {
+			s.t.Errorf("stub server: command %d isn't signed", h.Command)
+			return
+		}
+		if !c.handle(h, msg) {
+			return
+		}
+	}
+}
+
+// respond sends a response to the request h
+func (c *stubConn) respond(h *header, status StatusError, body message) {
+	r := &header{
+		Status:    status,
+		Command:   h.Command,
+		Credits:   1,
+		Flags:     flagResponse | h.Flags&flagAsync,
+		MessageID: h.MessageID,
+		AsyncID:   h.AsyncID,
+		TreeID:    h.TreeID,
+		SessionID: h.SessionID,
+	}
+	if h.Flags&flagAsync != 0 && status != StatusPending {
+		// The interim response granted the credits
+		r.Credits = 0
+	}
+	if body == nil {
+		body = &errorResponse{}
+	}
+	msg := body.marshal(appendHeader(nil, r))
+	if c.signer != nil && h.Command != cmdNegotiate {
+		c.signer.sign(msg)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	writeMessage(c.conn, msg)
+}
+
+// handle handles a request and returns false if the connection must be closed
+func (c *stubConn) handle(h *header, msg []byte) bool {
+	switch h.Command {
+	case cmdNegotiate:
+		req := &c.negotiate
+		if err := req.unmarshal(msg); err != nil {
+			c.s.t.Errorf("stub server: %v", err)
+			return false
+		}
+		size := c.s.maxIO
+		if size == 0 {
+			size = maxIOSize
+		}
+		resp := &negotiateResponse{
+			SecurityMode:    signingEnabled,
+			Dialect:         c.s.dialect,
+			MaxTransactSize: size,
+			MaxReadSize:     size,
+			MaxWriteSize:    size,
+			SystemTime:      fileTime(time.Now()),
+			SecurityBuffer:  negTokenInit(nil),
+		}
+		if c.s.requireSigning {
+			resp.SecurityMode |= signingRequired
+		}
+		c.respond(h, StatusSuccess, resp)
+
+	case cmdSessionSetup:
+		var req sessionSetupRequest
+		if err := req.unmarshal(msg); err != nil {
+			c.s.t.Errorf("stub server: %v", err)
+			return false
+		}
+		token, err := mechToken(req.SecurityBuffer)
+		if err != nil {
+			c.s.t.Errorf("stub server: %v", err)
+			return false
+		}
+		h.SessionID = 1
+		if c.ntlm.challenge == nil {
+			challenge, err := c.ntlm.challengeMessage(token)
+			if err != nil {
+				c.s.t.Errorf("stub server: %v", err)
+				return false
+			}
+			resp := &sessionSetupResponse{SecurityBuffer: negTokenResp(negAcceptIncomplete, oidNTLMSSP, challenge)}
+			c.respond(h, StatusMoreProcessingRequired, resp)
+			return true
+		}
+		identity, err := c.ntlm.verify(token)
+		if err != nil {
+			c.respond(h, StatusLogonFailure, nil)
+			return false
+		}
+		resp := &sessionSetupResponse{SecurityBuffer: negTokenResp(negAcceptCompleted, nil, nil)}
+		if identity.anonymous {
+			resp.SessionFlags = sessionNull
+		} else {
+			c.signer = newSigner(c.s.dialect, identity.sessionKey)
+		}
+		c.respond(h, StatusSuccess, resp)
+
+	case cmdTreeConnect:
+		var req treeConnectRequest
+		if err := req.unmarshal(msg); err != nil || !strings.HasSuffix(strings.ToUpper(req.Path), `\IPC$`) {
+			c.respond(h, StatusBadNetworkName, nil)
+			return true
+		}
+		h.TreeID = 1
+		c.respond(h, StatusSuccess, &treeConnectResponse{ShareType: shareTypePipe, MaximalAccess: pipeAccess})
+
+	case cmdCreate:
+		var req createRequest
+		if err := req.unmarshal(msg); err != nil {
+			c.respond(h, StatusInvalidParameter, nil)
+			return true
+		}
+		pipe, err := npipe.DialTimeout(`\\.\pipe\`+req.Name, 100*time.Millisecond)
+		if err != nil {
+			c.respond(h, StatusObjectNameNotFound, nil)
+			return true
+		}
+		c.mu.Lock()
+		c.nextFile++
+		var fid fileID
+		fid[0] = byte(c.nextFile)
+		c.files[fid] = pipe
+		c.mu.Unlock()
+		c.respond(h, StatusSuccess, &createResponse{CreateAction: fileOpened, FileID: fid})
+
+	case cmdRead:
+		var req readRequest
+		if err := req.unmarshal(msg); err != nil {
+			c.respond(h, StatusInvalidParameter, nil)
+			return true
+		}
+		c.read(h, req.FileID, false, nil, int(req.Length))
+
+	case cmdIoctl:
+		var req ioctlRequest
+		if err := req.unmarshal(msg); err != nil {
+			c.respond(h, StatusInvalidDeviceRequest, nil)
+			return true
+		}
+		switch req.CtlCode {
+		case fsctlPipeTransceive:
+			c.read(h, req.FileID, true, req.Input, int(req.MaxOutput))
+		case fsctlValidateNegotiateInfo:
+			return c.validateNegotiate(h, &req)
+		default:
+			c.respond(h, StatusInvalidDeviceRequest, nil)
+		}
+
+	case cmdWrite:
+		var req writeRequest
+		if err := req.unmarshal(msg); err != nil {
+			c.respond(h, StatusInvalidParameter, nil)
+			return true
+		}
+		c.mu.Lock()
+		pipe := c.files[req.FileID]
+		c.mu.Unlock()
+		if pipe == nil {
+			c.respond(h, StatusFileClosed, nil)
+			return true
+		}
+		n, err := pipe.Write(req.Data)
+		if err != nil {
+			c.respond(h, StatusPipeBroken, nil)
+			return true
+		}
+		c.respond(h, StatusSuccess, &writeResponse{Count: uint32(n)})
+
+	case cmdCancel:
+		c.mu.Lock()
+		pipe := c.pending[h.MessageID]
+		c.mu.Unlock()
+		if pipe != nil {
+			pipe.SetReadDeadline(time.Now())
+		}
+
+	case cmdClose:
+		var req closeRequest
+		if err := req.unmarshal(msg); err != nil {
+			c.respond(h, StatusInvalidParameter, nil)
+			return true
+		}
+		c.mu.Lock()
+		pipe := c.files[req.FileID]
+		delete(c.files, req.FileID)
+		c.mu.Unlock()
+		if pipe == nil {
+			c.respond(h, StatusFileClosed, nil)
+			return true
+		}
+		pipe.Close()
+		c.respond(h, StatusSuccess, &closeResponse{})
+
+	case cmdTreeDisconnect, cmdLogoff:
+		c.respond(h, StatusSuccess, &emptyMessage{})
+
+	default:
+		c.respond(h, StatusNotSupported, nil)
+	}
+	return true
+}
+
+// validateNegotiate answers VALIDATE_NEGOTIATE_INFO, which must be signed, or ends the connection if it doesn't match
+// the negotiation
+func (c *stubConn) validateNegotiate(h *header, req *ioctlRequest) bool {
+	want := binary.LittleEndian.AppendUint32(nil, c.negotiate.Capabilities)
+	want = append(want, c.negotiate.ClientGUID[:]...)
+	want = binary.LittleEndian.AppendUint16(want, c.negotiate.SecurityMode)
+	want = binary.LittleEndian.AppendUint16(want, uint16(len(c.negotiate.Dialects)))
+	for _, d := range c.negotiate.Dialects {
+		want = binary.LittleEndian.AppendUint16(want, d)
+	}
+	if h.Flags&flagSigned == 0 || !bytes.Equal(req.Input, want) {
+		return false
+	}
+	security := signingEnabled
+	if c.s.requireSigning {
+		security |= signingRequired
+	}
+	out := binary.LittleEndian.AppendUint32(nil, 0)
+	out = append(out, make([]byte, 16)...)
+	out = binary.LittleEndian.AppendUint16(out, security)
+	out = binary.LittleEndian.AppendUint16(out, c.s.dialect)
+	c.respond(h, StatusSuccess, &ioctlResponse{CtlCode: req.CtlCode, FileID: req.FileID, Output: out})
+	return true
+}
+
+// read answers READ and transceive requests asynchronously: it sends an interim response, writes the input if any,
+// and reads up to length bytes from the pipe until CANCEL sets its read deadline
+func (c *stubConn) read(h *header, fid fileID, transceive bool, input []byte, length int) {
+	c.mu.Lock()
+	pipe := c.files[fid]
+	if pipe != nil {
+		c.nextAsync++
+		c.pending[h.MessageID] = pipe
+	}
+	asyncID := c.nextAsync
+	c.mu.Unlock()
+	if pipe == nil {
+		c.respond(h, StatusFileClosed, nil)
+		return
+	}
+	pipe.SetReadDeadline(time.Time{})
+	final := *h
+	final.Flags |= flagAsync
+	final.AsyncID = asyncID
+	c.respond(&final, StatusPending, nil)
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.pending, h.MessageID)
+			c.mu.Unlock()
+		}()
+		if len(input) > 0 {
+			if _, err := pipe.Write(input); err != nil {
+				c.respond(&final, StatusPipeBroken, nil)
+				return
+			}
+		}
+		data := make([]byte, length)
+		n, err := pipe.Read(data)
+		status := StatusSuccess
+		var netErr net.Error
+		switch {
+		case errors.Is(err, npipe.ErrMoreData):
+			status = StatusBufferOverflow
+		case errors.As(err, &netErr) && netErr.Timeout():
+			c.respond(&final, StatusCancelled, nil)
+			return
+		case err != nil:
+			c.respond(&final, StatusPipeBroken, nil)
+			return
+		}
+		if transceive {
+			c.respond(&final, status, &ioctlResponse{CtlCode: fsctlPipeTransceive, FileID: fid, Output: data[:n]})
+		} else {
+			c.respond(&final, status, &readResponse{Data: data[:n]})
+		}
+	}()
+}
+
+// listen creates a local pipe that serves every connection with handler and returns its name
+func listen(t *testing.T, name string, message bool, handler func(net.Conn)) string {
+	t.Setenv("NPIPE_SOCKET_DIR", t.TempDir())
+	mode := uint32(npipe.PipeTypeByte | npipe.PipeReadModeByte)
+	if message {
+		mode = npipe.PipeTypeMessage | npipe.PipeReadModeMessage
+	}
+	ln, err := npipe.NewPipeListener(`\\.\pipe\`+name, npipe.PipeAccessDuplex, mode, npipe.PipeUnlimitedInstances, 512, 512, 0, nil)
+	if err != nil {
+		t.Fatalf("NewPipeListener(): %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+	return name
+}
+
+// address returns the remote address of a pipe on the stub server
+func address(name string) string {
+	return `\\127.0.0.1\pipe\` + name
+}
+
+// TestDialMessageMode echoes messages through a pipe opened over SMB2, including a message read in parts
+func TestDialMessageMode(t *testing.T) {
+	name := listen(t, "TestDialMessageMode", true, echoMessages)
+	stub := &stubServer{t: t, dialect: Dialect210, users: map[string]string{"alice": "secret"}}
+	conn, err := stub.start("alice", "secret").Dial(address(name))
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != address(name) {
+		t.Errorf("RemoteAddr() = %s, expected %s", conn.RemoteAddr(), address(name))
+	}
+
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+	buf := make([]byte, 64)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read() = %q, %v", buf[:n], err)
+	}
+
+	msg := bytes.Repeat([]byte("0123456789"), 10)
+	if _, err = conn.Write(msg); err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+	var got []byte
+	for {
+		n, err := conn.Read(buf[:30])
+		got = append(got, buf[:n]...)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, npipe.ErrMoreData) {
+			t.Fatalf("Read(): %v", err)
+		}
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("read %q in parts, expected %q", got, msg)
+	}
+}
+
+// TestDialByteMode streams more data than fits in one SMB2 read or write through a byte mode pipe
+func TestDialByteMode(t *testing.T) {
+	name := listen(t, "TestDialByteMode", false, func(conn net.Conn) { io.Copy(conn, conn) })
+	stub := &stubServer{t: t, dialect: Dialect300, maxIO: 4096, users: map[string]string{"alice": "secret"}}
+	conn, err := stub.start("alice", "secret").Dial(address(name))
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	defer conn.Close()
+
+	data := bytes.Repeat([]byte("npipe over smb2 "), 4096)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(data)
+		errc <- err
+	}()
+	got := make([]byte, len(data))
+	if _, err = io.ReadFull(conn, got); err != nil {
+		t.Fatalf("ReadFull(): %v", err)
+	}
+	if err = <-errc; err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("the echoed data differs")
+	}
+}
+
+// TestSigning authenticates and exchanges signed messages with each signing algorithm
+func TestSigning(t *testing.T) {
+	name := listen(t, "TestSigning", true, echoMessages)
+	for _, dialect := range []uint16{Dialect202, Dialect210, Dialect300, Dialect302} {
+		t.Run(strconv.FormatUint(uint64(dialect), 16), func(t *testing.T) {
+			stub := &stubServer{t: t, dialect: dialect, requireSigning: true, users: map[string]string{"bob": "hunter2"}}
+			d := stub.start("bob", "hunter2")
+			d.Domain = "WORKGROUP"
+			s, err := d.Session("127.0.0.1")
+			if err != nil {
+				t.Fatalf("Session(): %v", err)
+			}
+			defer s.Close()
+			if s.Dialect() != dialect || !s.Signed() {
+				t.Fatalf("Dialect() = 0x%04x, Signed() = %t", s.Dialect(), s.Signed())
+			}
+			conn, err := s.Open(name)
+			if err != nil {
+				t.Fatalf("Open(): %v", err)
+			}
+			defer conn.Close()
+			buf := make([]byte, 16)
+			if _, err = conn.Write([]byte("signed")); err != nil {
+				t.Fatalf("Write(): %v", err)
+			}
+			if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "signed" {
+				t.Fatalf("Read() = %q, %v", buf[:n], err)
+			}
+		})
+	}
+}
+
+// TestAuthentication tests wrong credentials, anonymous sessions, and refusing unsigned sessions
+func TestAuthentication(t *testing.T) {
+	stub := &stubServer{t: t, dialect: Dialect210, users: map[string]string{"alice": "secret"}}
+	_, err := stub.start("alice", "wrong").Session("127.0.0.1")
+	if err == nil || !strings.Contains(err.Error(), StatusLogonFailure.Error()) {
+		t.Fatalf("expected a logon failure but received %v", err)
+	}
+
+	_, err = stub.start("", "").Session("127.0.0.1")
+	if err == nil || !strings.Contains(err.Error(), StatusLogonFailure.Error()) {
+		t.Fatalf("expected a logon failure for an anonymous session but received %v", err)
+	}
+
+	stub = &stubServer{t: t, dialect: Dialect210, anonymous: true}
+	d := stub.start("", "")
+	s, err := d.Session("127.0.0.1")
+	if err != nil {
+		t.Fatalf("anonymous Session(): %v", err)
+	}
+	if s.Signed() {
+		t.Error("the anonymous session is signed")
+	}
+	s.Close()
+
+	d.RequireSigning = true
+	if _, err = d.Session("127.0.0.1"); err == nil {
+		t.Fatal("an anonymous session was established although signing is required")
+	}
+}
+
+// TestReadDeadline cancels a pending read when its deadline passes and reads the next message afterwards
+func TestReadDeadline(t *testing.T) {
+	release := make(chan struct{})
+	name := listen(t, "TestReadDeadline", true, func(conn net.Conn) {
+		<-release
+		conn.Write([]byte("late"))
+		io.Copy(io.Discard, conn)
+	})
+	stub := &stubServer{t: t, dialect: Dialect302, users: map[string]string{"alice": "secret"}}
+	conn, err := stub.start("alice", "secret").Dial(address(name))
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	buf := make([]byte, 16)
+	_, err = conn.Read(buf)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected a timeout but received %v", err)
+	}
+	if _, err = conn.Read(buf); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected a timeout from a read after the deadline but received %v", err)
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	close(release)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "late" {
+		t.Fatalf("Read() = %q, %v", buf[:n], err)
+	}
+
+	conn.Close()
+	if _, err = conn.Read(buf); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected net.ErrClosed after Close but received %v", err)
+	}
+}
+
+// TestTransact sends requests with FSCTL_PIPE_TRANSCEIVE, including a reply larger than the buffer
+func TestTransact(t *testing.T) {
+	name := listen(t, "TestTransact", true, echoMessages)
+	stub := &stubServer{t: t, dialect: Dialect300, users: map[string]string{"alice": "secret"}}
+	conn, err := stub.start("alice", "secret").Dial(address(name))
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 8)
+	if n, err := conn.Transact(context.Background(), []byte("ping"), buf); err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("Transact() = %q, %v", buf[:n], err)
+	}
+	n, err := conn.Transact(context.Background(), []byte("a longer request"), buf)
+	if !errors.Is(err, npipe.ErrMoreData) || string(buf[:n]) != "a longer" {
+		t.Fatalf("expected ErrMoreData but received %q, %v", buf[:n], err)
+	}
+	if n, err = conn.Read(buf); err != nil || string(buf[:n]) != " request" {
+		t.Fatalf("Read() of the rest = %q, %v", buf[:n], err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = conn.Transact(ctx, nil, buf); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled but received %v", err)
+	}
+}
+
+// TestDialErrors tests invalid addresses and pipes that don't exist
+func TestDialErrors(t *testing.T) {
+	t.Setenv("NPIPE_SOCKET_DIR", t.TempDir())
+	stub := &stubServer{t: t, dialect: Dialect210, users: map[string]string{"alice": "secret"}}
+	d := stub.start("alice", "secret")
+	for _, address := range []string{`\\.\pipe`, `\\host\share\name`, `host\pipe\name`, `\\host\pipe\`} {
+		if _, err := d.Dial(address); err == nil {
+			t.Errorf("Dial(%q) succeeded", address)
+		}
+	}
+
+	s, err := d.Session("127.0.0.1")
+	if err != nil {
+		t.Fatalf("Session(): %v", err)
+	}
+	defer s.Close()
+	if _, err = s.Open("missing"); !errors.Is(err, StatusObjectNameNotFound) {
+		t.Fatalf("expected STATUS_OBJECT_NAME_NOT_FOUND but received %v", err)
+	}
+}
@@ -0,0 +1,279 @@
+//go:build windows || linux
+
+package smb2
+
+import (
+	// Standard
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// Conn is a pipe opened over SMB2. It implements net.Conn; reads of message mode pipes that return part of a
+// message return npipe.ErrMoreData. Writes larger than 64 KiB are split, which splits them into several messages on
+// message mode pipes.
+type Conn struct {
+	s    *Session
+	addr npipe.PipeAddr
+	fid  fileID
+	// ownsSession is true if closing the connection closes the session, for connections returned by Dialer.Dial
+	ownsSession bool
+
+	readDeadline  deadline
+	writeDeadline deadline
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+func newConn(s *Session, address string, fid fileID) *Conn {
+	return &Conn{s: s, addr: npipe.PipeAddr(address), fid: fid, closed: make(chan struct{})}
+}
+
+// deadline is a deadline that can be changed while a request is waiting on it, like the deadlines of net.Pipe.
+// The zero value has no deadline.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // cancel is closed once the deadline passed
+}
+
+// set changes the deadline; the zero time removes it
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.cancel == nil {
+		d.cancel = make(chan struct{})
+	}
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer fired, wait for it to close the channel
+		<-d.cancel
+	}
+	d.timer = nil
+
+	expired := isClosed(d.cancel)
+	if t.IsZero() {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !expired {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed once the deadline passed
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cancel == nil {
+		d.cancel = make(chan struct{})
+	}
+	return d.cancel
+}
+
+// isClosed reports whether c is closed
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// check returns the error of an operation started after Close or after its deadline passed
+func (c *Conn) check(d *deadline) error {
+	if isClosed(c.closed) {
+		return net.ErrClosed
+	}
+	if isClosed(d.wait()) {
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// pipeError converts the status of a failed pipe operation. A cancelled request timed out unless the connection was
+// closed, and a pipe closed by the server ends the stream.
+func (c *Conn) pipeError(err error) error {
+	switch {
+	case errors.Is(err, StatusCancelled):
+		if isClosed(c.closed) {
+			return net.ErrClosed
+		}
+		return os.ErrDeadlineExceeded
+	case errors.Is(err, StatusPipeBroken), errors.Is(err, StatusPipeDisconnected), errors.Is(err, StatusPipeClosing),
+		errors.Is(err, StatusEndOfFile), errors.Is(err, StatusPipeEmpty):
+		return io.EOF
+	}
+	return err
+}
+
+// do sends a request on the pipe and waits for its response, cancelling the request once the deadline or the
+// context's done channel is closed
+func (c *Conn) do(command uint16, in, out message, d *deadline, done <-chan struct{}) (*header, error) {
+	call, err := c.s.send(command, c.s.treeID, in)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := c.s.wait(call, c.s.treeID, d.wait(), done, c.closed)
+	if err != nil {
+		return nil, err
+	}
+	return decodeResponse(msg, out, StatusBufferOverflow)
+}
+
+// Read implements the net.Conn Read method
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.check(&c.readDeadline); err != nil {
+		return 0, err
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	length := len(b)
+	if length > c.s.maxIO {
+		length = c.s.maxIO
+	}
+	var resp readResponse
+	h, err := c.do(cmdRead, &readRequest{Length: uint32(length), FileID: c.fid}, &resp, &c.readDeadline, nil)
+	if err != nil {
+		return 0, c.pipeError(err)
+	}
+	n := copy(b, resp.Data)
+	if h.Status == StatusBufferOverflow {
+		return n, npipe.ErrMoreData
+	}
+	return n, nil
+}
+
+// Write implements the net.Conn Write method
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.check(&c.writeDeadline); err != nil {
+		return 0, err
+	}
+	written := 0
+	for {
+		chunk := b[written:]
+		if len(chunk) > c.s.maxIO {
+			chunk = chunk[:c.s.maxIO]
+		}
+		var resp writeResponse
+		if _, err := c.do(cmdWrite, &writeRequest{FileID: c.fid, Data: chunk}, &resp, &c.writeDeadline, nil); err != nil {
+			return written, c.pipeError(err)
+		}
+		if int(resp.Count) > len(chunk) {
+			return written, fmt.Errorf("smb2.Conn.Write(): the server wrote %d of %d bytes", resp.Count, len(chunk))
+		}
+		written += int(resp.Count)
+		if written == len(b) {
+			return written, nil
+		}
+		if resp.Count == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+}
+
+// Transact writes req as one message and reads the reply into resp in a single round trip (FSCTL_PIPE_TRANSCEIVE),
+// which requires a message mode pipe. If the reply is larger than resp, the rest of it is left in the pipe and
+// npipe.ErrMoreData is returned. The read deadline and ctx both bound the transaction.
+func (c *Conn) Transact(ctx context.Context, req, resp []byte) (int, error) {
+	if err := c.check(&c.readDeadline); err != nil {
+		return 0, err
+	}
+	if len(req) > c.s.maxIO {
+		return 0, fmt.Errorf("smb2.Conn.Transact(): the %d byte request exceeds the limit of %d bytes", len(req), c.s.maxIO)
+	}
+	max := len(resp)
+	if max > c.s.maxIO {
+		max = c.s.maxIO
+	}
+	in := &ioctlRequest{CtlCode: fsctlPipeTransceive, FileID: c.fid, Input: req, MaxOutput: uint32(max), Flags: ioctlIsFsctl}
+	var out ioctlResponse
+	h, err := c.do(cmdIoctl, in, &out, &c.readDeadline, ctx.Done())
+	if err != nil {
+		if errors.Is(err, StatusCancelled) && ctx.Err() != nil && !isClosed(c.readDeadline.wait()) {
+			return 0, ctx.Err()
+		}
+		return 0, c.pipeError(err)
+	}
+	n := copy(resp, out.Output)
+	if h.Status == StatusBufferOverflow {
+		return n, npipe.ErrMoreData
+	}
+	return n, nil
+}
+
+// Close closes the pipe, and the session if the connection came from Dialer.Dial. Pending reads and writes return
+// net.ErrClosed.
+func (c *Conn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		_, err = c.s.roundTrip(cmdClose, c.s.treeID, &closeRequest{FileID: c.fid}, &closeResponse{})
+		if errors.Is(err, StatusFileClosed) || errors.Is(err, StatusPipeBroken) || errors.Is(err, StatusPipeDisconnected) {
+			err = nil
+		}
+		if c.ownsSession {
+			if serr := c.s.Close(); err == nil {
+				err = serr
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("smb2.Conn.Close(): %s", err)
+		}
+	})
+	return err
+}
+
+// Session returns the session the pipe was opened on
+func (c *Conn) Session() *Session {
+	return c.s
+}
+
+// LocalAddr returns the address of the pipe
+func (c *Conn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// RemoteAddr returns the address of the pipe
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline implements the net.Conn SetDeadline method
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline implements the net.Conn SetReadDeadline method
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements the net.Conn SetWriteDeadline method
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
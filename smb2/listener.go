@@ -0,0 +1,395 @@
+//go:build windows || linux
+
+package smb2
+
+import (
+	// Standard
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// pipeBufferSize is how many bytes each direction of a pipe opened on a Server buffers before writes block
+const pipeBufferSize = 64 * 1024
+
+// listenBacklog is how many opened pipes wait for Accept before clients receive STATUS_PIPE_NOT_AVAILABLE
+const listenBacklog = 16
+
+var (
+	// errWouldBlock is returned by non-blocking queue operations that would have to wait
+	errWouldBlock = errors.New("the operation would block")
+	// errInterrupted is returned by queue operations whose cancel channel was closed
+	errInterrupted = errors.New("the operation was interrupted")
+	// errReaderClosed is returned by queue operations after the reading end closed
+	errReaderClosed = errors.New("the reading end of the pipe is closed")
+	// errWriterClosed is returned by writes after the writing end closed
+	errWriterClosed = errors.New("the writing end of the pipe is closed")
+)
+
+// pipeQueue is one direction of a pipe opened on a Server, holding whole messages in message mode and chunks of the
+// stream in byte mode
+type pipeQueue struct {
+	mu      sync.Mutex
+	message bool
+	data    [][]byte
+	size    int
+	// rclosed is set once the reader closed its end, wclosed once the writer did
+	rclosed bool
+	wclosed bool
+	// changed is closed and replaced whenever data is added or removed or an end is closed
+	changed chan struct{}
+}
+
+func newPipeQueue(message bool) *pipeQueue {
+	return &pipeQueue{message: message, changed: make(chan struct{})}
+}
+
+// notify wakes the operations waiting for a change. The caller must hold mu.
+func (q *pipeQueue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// read reads the next message, or the buffered bytes in byte mode, into b. In message mode a message larger than b
+// is read in parts and all but the last return npipe.ErrMoreData. If block is false and nothing is buffered read
+// returns errWouldBlock, otherwise it waits until data arrives, the writer closes its end (io.EOF), or cancel is
+// closed (errInterrupted).
+func (q *pipeQueue) read(b []byte, block bool, cancel <-chan struct{}) (int, error) {
+	if len(b) == 0 && !q.message {
+		return 0, nil
+	}
+	q.mu.Lock()
+	for len(q.data) == 0 {
+		if q.rclosed {
+			q.mu.Unlock()
+			return 0, errReaderClosed
+		}
+		if q.wclosed {
+			q.mu.Unlock()
+			return 0, io.EOF
+		}
+		if !block {
+			q.mu.Unlock()
+			return 0, errWouldBlock
+		}
+		changed := q.changed
+		q.mu.Unlock()
+		select {
+		case <-changed:
+		case <-cancel:
+			return 0, errInterrupted
+		}
+		q.mu.Lock()
+	}
+	defer q.mu.Unlock()
+	if q.rclosed {
+		return 0, errReaderClosed
+	}
+
+	var n int
+	var err error
+	if q.message {
+		msg := q.data[0]
+		if n = copy(b, msg); n < len(msg) {
+			q.data[0] = msg[n:]
+			err = npipe.ErrMoreData
+		} else {
+			q.data = q.data[1:]
+		}
+	} else {
+		for len(q.data) > 0 && n < len(b) {
+			c := copy(b[n:], q.data[0])
+			if n += c; c < len(q.data[0]) {
+				q.data[0] = q.data[0][c:]
+			} else {
+				q.data = q.data[1:]
+			}
+		}
+	}
+	q.size -= n
+	q.notify()
+	return n, err
+}
+
+// write adds b as one message, or to the stream in byte mode. It waits while the buffer is full unless block is
+// false, in which case it returns errWouldBlock. A write larger than the buffer is accepted once the buffer is empty.
+func (q *pipeQueue) write(b []byte, block bool, cancel <-chan struct{}) (int, error) {
+	q.mu.Lock()
+	for {
+		if q.wclosed {
+			q.mu.Unlock()
+			return 0, errWriterClosed
+		}
+		if q.rclosed {
+			q.mu.Unlock()
+			return 0, errReaderClosed
+		}
+		if q.size == 0 || q.size+len(b) <= pipeBufferSize {
+			break
+		}
+		if !block {
+			q.mu.Unlock()
+			return 0, errWouldBlock
+		}
+		changed := q.changed
+		q.mu.Unlock()
+		select {
+		case <-changed:
+		case <-cancel:
+			return 0, errInterrupted
+		}
+		q.mu.Lock()
+	}
+	defer q.mu.Unlock()
+	if len(b) > 0 || q.message {
+		q.data = append(q.data, append([]byte(nil), b...))
+		q.size += len(b)
+		q.notify()
+	}
+	return len(b), nil
+}
+
+// buffered returns the number of bytes waiting to be read
+func (q *pipeQueue) buffered() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// closeRead closes the reading end, discarding the buffered data
+func (q *pipeQueue) closeRead() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.rclosed {
+		q.rclosed = true
+		q.data, q.size = nil, 0
+		q.notify()
+	}
+}
+
+// closeWrite closes the writing end; the reader receives io.EOF once it read the buffered data
+func (q *pipeQueue) closeWrite() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.wclosed {
+		q.wclosed = true
+		q.notify()
+	}
+}
+
+// Identity describes the client that opened a pipe on a Server
+type Identity struct {
+	// User and Domain are the names the client authenticated with, empty for anonymous clients
+	User   string
+	Domain string
+	// Anonymous is true if the client authenticated without credentials
+	Anonymous bool
+	// Addr is the address of the client's TCP connection
+	Addr net.Addr
+}
+
+// Listener accepts the clients that open a pipe on a Server. It can be used wherever an npipe.PipeListener is.
+type Listener struct {
+	srv     *Server
+	key     string
+	addr    npipe.PipeAddr
+	message bool
+
+	backlog   chan *ServerConn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Accept implements the Accept method in the net.Listener interface; it waits for the next client to open the pipe
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.AcceptPipe()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// AcceptPipe waits for the next client to open the pipe and returns the new connection. It returns npipe.ErrClosed
+// once the listener was closed.
+func (l *Listener) AcceptPipe() (*ServerConn, error) {
+	select {
+	case c := <-l.backlog:
+		return c, nil
+	case <-l.closed:
+		return nil, npipe.ErrClosed
+	}
+}
+
+// Close stops accepting clients and frees the pipe name. Pipes opened but not yet accepted are closed, accepted
+// connections are not.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		l.srv.mu.Lock()
+		if l.srv.pipes[l.key] == l {
+			delete(l.srv.pipes, l.key)
+		}
+		close(l.closed)
+		l.srv.mu.Unlock()
+		for {
+			select {
+			case c := <-l.backlog:
+				c.Close()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// Addr returns the listener's network address, a PipeAddr of the form \\.\pipe\<name>
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// offer queues a pipe opened by a client for Accept and returns false if the backlog is full or the listener closed.
+// The caller must hold the server's mu so the pipe can't be queued after Close emptied the backlog.
+func (l *Listener) offer(c *ServerConn) bool {
+	select {
+	case <-l.closed:
+		return false
+	default:
+	}
+	select {
+	case l.backlog <- c:
+		return true
+	default:
+		return false
+	}
+}
+
+// ServerConn is the server end of a pipe that a client opened on a Server. It behaves like an npipe.PipeConn:
+// reads of message mode pipes that return part of a message return npipe.ErrMoreData and every Write is one message.
+type ServerConn struct {
+	addr     npipe.PipeAddr
+	identity Identity
+	// in holds the data the client wrote, out the data the client reads
+	in  *pipeQueue
+	out *pipeQueue
+
+	readDeadline  deadline
+	writeDeadline deadline
+	closeOnce     sync.Once
+}
+
+func newServerConn(addr npipe.PipeAddr, message bool, identity Identity) *ServerConn {
+	return &ServerConn{addr: addr, identity: identity, in: newPipeQueue(message), out: newPipeQueue(message)}
+}
+
+// localError converts the errors of queue operations on the server end
+func (c *ServerConn) localError(err error) error {
+	switch err {
+	case errInterrupted:
+		return os.ErrDeadlineExceeded
+	case errWriterClosed:
+		return net.ErrClosed
+	case errReaderClosed:
+		if c.isClosed() {
+			return net.ErrClosed
+		}
+		// The client closed the pipe
+		return io.ErrClosedPipe
+	}
+	return err
+}
+
+// isClosed reports whether Close was called
+func (c *ServerConn) isClosed() bool {
+	c.in.mu.Lock()
+	defer c.in.mu.Unlock()
+	return c.in.rclosed
+}
+
+// Read implements the net.Conn Read method. It returns io.EOF once the client closed the pipe and its data was read.
+func (c *ServerConn) Read(b []byte) (int, error) {
+	cancel := c.readDeadline.wait()
+	if isClosed(cancel) && !c.isClosed() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	n, err := c.in.read(b, true, cancel)
+	if err != nil && err != npipe.ErrMoreData {
+		return n, c.localError(err)
+	}
+	return n, err
+}
+
+// Write implements the net.Conn Write method. It returns io.ErrClosedPipe once the client closed the pipe.
+func (c *ServerConn) Write(b []byte) (int, error) {
+	cancel := c.writeDeadline.wait()
+	if isClosed(cancel) && !c.isClosed() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	n, err := c.out.write(b, true, cancel)
+	if err != nil {
+		return n, c.localError(err)
+	}
+	return n, nil
+}
+
+// CloseWrite signals the end of the data; the client reads the buffered data and then receives an error
+func (c *ServerConn) CloseWrite() error {
+	c.out.closeWrite()
+	return nil
+}
+
+// Close closes the server end. The client can still read the data written before, then its reads fail.
+func (c *ServerConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		c.in.closeRead()
+		c.out.closeWrite()
+		err = nil
+	})
+	return err
+}
+
+// closeRemote closes the client end after the client closed the pipe or its session ended
+func (c *ServerConn) closeRemote() {
+	c.in.closeWrite()
+	c.out.closeRead()
+}
+
+// Identity returns the client that opened the pipe
+func (c *ServerConn) Identity() Identity {
+	return c.identity
+}
+
+// LocalAddr returns the address of the pipe
+func (c *ServerConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// RemoteAddr returns the address of the pipe like npipe.PipeConn does; Identity holds the client's TCP address
+func (c *ServerConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline implements the net.Conn SetDeadline method
+func (c *ServerConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline implements the net.Conn SetReadDeadline method
+func (c *ServerConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements the net.Conn SetWriteDeadline method
+func (c *ServerConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
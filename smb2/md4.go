@@ -0,0 +1,58 @@
+package smb2
+
+import (
+	// Standard
+	"encoding/binary"
+	"math/bits"
+)
+
+// md4 returns the MD4 digest of b (RFC 1320). NTLM hashes passwords with it and the standard library doesn't have it.
+func md4(b []byte) [16]byte {
+	a0, b0, c0, d0 := uint32(0x67452301), uint32(0xefcdab89), uint32(0x98badcfe), uint32(0x10325476)
+
+	// Pad to 56 mod 64 bytes and append the length in bits
+	msg := append(append([]byte(nil), b...), 0x80)
+	for len(msg)%64 != 56 {
+		msg = append(msg, 0)
+	}
+	msg = binary.LittleEndian.AppendUint64(msg, uint64(len(b))*8)
+
+	var x [16]uint32
+	for chunk := msg; len(chunk) > 0; chunk = chunk[64:] {
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(chunk[4*i:])
+		}
+		a, b, c, d := a0, b0, c0, d0
+
+		// Round 1
+		for _, i := range []int{0, 4, 8, 12} {
+			a = bits.RotateLeft32(a+(b&c|^b&d)+x[i], 3)
+			d = bits.RotateLeft32(d+(a&b|^a&c)+x[i+1], 7)
+			c = bits.RotateLeft32(c+(d&a|^d&b)+x[i+2], 11)
+			b = bits.RotateLeft32(b+(c&d|^c&a)+x[i+3], 19)
+		}
+		// Round 2
+		for _, i := range []int{0, 1, 2, 3} {
+			a = bits.RotateLeft32(a+(b&c|b&d|c&d)+x[i]+0x5a827999, 3)
+			d = bits.RotateLeft32(d+(a&b|a&c|b&c)+x[i+4]+0x5a827999, 5)
+			c = bits.RotateLeft32(c+(d&a|d&b|a&b)+x[i+8]+0x5a827999, 9)
+			b = bits.RotateLeft32(b+(c&d|c&a|d&a)+x[i+12]+0x5a827999, 13)
+		}
+		// Round 3
+		for _, i := range []int{0, 2, 1, 3} {
+			a = bits.RotateLeft32(a+(b^c^d)+x[i]+0x6ed9eba1, 3)
+			d = bits.RotateLeft32(d+(a^b^c)+x[i+8]+0x6ed9eba1, 9)
+			c = bits.RotateLeft32(c+(d^a^b)+x[i+4]+0x6ed9eba1, 11)
+			b = bits.RotateLeft32(b+(c^d^a)+x[i+12]+0x6ed9eba1, 15)
+		}
+
+		a0, b0, c0, d0 = a0+a, b0+b, c0+c, d0+d
+	}
+
+	var digest [16]byte
+	binary.LittleEndian.PutUint32(digest[0:], a0)
+	binary.LittleEndian.PutUint32(digest[4:], b0)
+	binary.LittleEndian.PutUint32(digest[8:], c0)
+	binary.LittleEndian.PutUint32(digest[12:], d0)
+	return digest
+}
@@ -0,0 +1,611 @@
+package smb2
+
+import (
+	// Standard
+	"encoding/binary"
+	"fmt"
+	"unicode/utf16"
+)
+
+// message is the body of an SMB2 request or response. Offsets inside bodies are relative to the start of the header,
+// so marshal appends to a buffer that already holds the header and unmarshal receives the whole message.
+type message interface {
+	marshal(b []byte) []byte
+	unmarshal(msg []byte) error
+}
+
+// fileID identifies an open file, made of the persistent and the volatile part
+type fileID [16]byte
+
+// body returns the body of msg after checking its structure size
+func body(msg []byte, structureSize uint16) ([]byte, error) {
+	b := msg[headerSize:]
+	if len(b) < int(structureSize)&^1 {
+		return nil, fmt.Errorf("the %d byte body is shorter than its structure", len(b))
+	}
+	if size := binary.LittleEndian.Uint16(b); size != structureSize {
+		return nil, fmt.Errorf("expected a structure size of %d but received %d", structureSize, size)
+	}
+	return b, nil
+}
+
+// buffer returns the variable length field at offset from the start of the header
+func buffer(msg []byte, offset, length uint32) ([]byte, error) {
+	if length == 0 {
+		return nil, nil
+	}
+	if offset < headerSize || uint64(offset)+uint64(length) > uint64(len(msg)) {
+		return nil, fmt.Errorf("the %d byte buffer at offset %d is outside of the %d byte message", length, offset, len(msg))
+	}
+	return msg[offset : offset+length], nil
+}
+
+// pad8 pads b to a multiple of 8 bytes, the alignment of variable length fields
+func pad8(b []byte) []byte {
+	for len(b)%8 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// encodeUTF16 encodes s as UTF-16LE without a terminating NUL
+func encodeUTF16(s string) []byte {
+	chars := utf16.Encode([]rune(s))
+	b := make([]byte, 0, 2*len(chars))
+	for _, c := range chars {
+		b = binary.LittleEndian.AppendUint16(b, c)
+	}
+	return b
+}
+
+// decodeUTF16 decodes UTF-16LE, ignoring a trailing odd byte
+func decodeUTF16(b []byte) string {
+	chars := make([]uint16, len(b)/2)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(chars))
+}
+
+// errorResponse is the body of responses that fail, and of interim STATUS_PENDING responses
+type errorResponse struct {
+	Data []byte
+}
+
+func (m *errorResponse) marshal(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, 9)
+	b = append(b, 0, 0)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(m.Data)))
+	if len(m.Data) == 0 {
+		return append(b, 0)
+	}
+	return append(b, m.Data...)
+}
+
+func (m *errorResponse) unmarshal(msg []byte) error {
+	b, err := body(msg, 9)
+	if err != nil {
+		return err
+	}
+	m.Data, err = buffer(msg, headerSize+8, binary.LittleEndian.Uint32(b[4:]))
+	return err
+}
+
+// emptyMessage is the body of LOGOFF, TREE_DISCONNECT, CANCEL, and ECHO requests and responses
+type emptyMessage struct{}
+
+func (m *emptyMessage) marshal(b []byte) []byte {
+	return append(b, 4, 0, 0, 0)
+}
+
+func (m *emptyMessage) unmarshal(msg []byte) error {
+	_, err := body(msg, 4)
+	return err
+}
+
+type negotiateRequest struct {
+	SecurityMode uint16
+	Capabilities uint32
+	ClientGUID   [16]byte
+	Dialects     []uint16
+}
+
+func (m *negotiateRequest) marshal(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, 36)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(m.Dialects)))
+	b = binary.LittleEndian.AppendUint16(b, m.SecurityMode)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, m.Capabilities)
+	b = append(b, m.ClientGUID[:]...)
+	b = binary.LittleEndian.AppendUint64(b, 0)
+	for _, d := range m.Dialects {
+		b = binary.LittleEndian.AppendUint16(b, d)
+	}
+	return b
+}
+
+func (m *negotiateRequest) unmarshal(msg []byte) error {
+	b, err := body(msg, 36)
+	if err != nil {
+		return err
+	}
+	count := int(binary.LittleEndian.Uint16(b[2:]))
+	m.SecurityMode = binary.LittleEndian.Uint16(b[4:])
+	m.Capabilities = binary.LittleEndian.Uint32(b[8:])
+	copy(m.ClientGUID[:], b[12:28])
+	if len(b) < 36+2*count {
+		return fmt.Errorf("the message is too short for %d dialects", count)
+	}
+	m.Dialects = make([]uint16, count)
+	for i := range m.Dialects {
+		m.Dialects[i] = binary.LittleEndian.Uint16(b[36+2*i:])
+	}
+	return nil
+}
+
+type negotiateResponse struct {
+	SecurityMode    uint16
+	Dialect         uint16
+	ServerGUID      [16]byte
+	Capabilities    uint32
+	MaxTransactSize uint32
+	MaxReadSize     uint32
+	MaxWriteSize    uint32
+	SystemTime      uint64
+	ServerStartTime uint64
+	SecurityBuffer  []byte
+}
+
+func (m *negotiateResponse) marshal(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, 65)
+	b = binary.LittleEndian.AppendUint16(b, m.SecurityMode)
+	b = binary.LittleEndian.AppendUint16(b, m.Dialect)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = append(b, m.ServerGUID[:]...)
+	b = binary.LittleEndian.AppendUint32(b, m.Capabilities)
+	b = binary.LittleEndian.AppendUint32(b, m.MaxTransactSize)
+	b = binary.LittleEndian.AppendUint32(b, m.MaxReadSize)
+	b = binary.LittleEndian.AppendUint32(b, m.MaxWriteSize)
+	b = binary.LittleEndian.AppendUint64(b, m.SystemTime)
+	b = binary.LittleEndian.AppendUint64(b, m.ServerStartTime)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(b)+8))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(m.SecurityBuffer)))
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	if len(m.SecurityBuffer) == 0 {
+		return append(b, 0)
+	}
+	return append(b, m.SecurityBuffer...)
+}
+
+func (m *negotiateResponse) unmarshal(msg []byte) error {
+	b, err := body(msg, 65)
+	if err != nil {
+		return err
+	}
+	m.SecurityMode = binary.LittleEndian.Uint16(b[2:])
+	m.Dialect = binary.LittleEndian.Uint16(b[4:])
+	copy(m.ServerGUID[:], b[8:24])
+	m.Capabilities = binary.LittleEndian.Uint32(b[24:])
+	m.MaxTransactSize = binary.LittleEndian.Uint32(b[28:])
+	m.MaxReadSize = binary.LittleEndian.Uint32(b[32:])
+	m.MaxWriteSize = binary.LittleEndian.Uint32(b[36:])
+	m.SystemTime = binary.LittleEndian.Uint64(b[40:])
+	m.ServerStartTime = binary.LittleEndian.Uint64(b[48:])
+	m.SecurityBuffer, err = buffer(msg, uint32(binary.LittleEndian.Uint16(b[56:])), uint32(binary.LittleEndian.Uint16(b[58:])))
+	return err
+}
+
+type sessionSetupRequest struct {
+	Flags             uint8
+	SecurityMode      uint8
+	Capabilities      uint32
+	PreviousSessionID uint64
+	SecurityBuffer    []byte
+}
+
+func (m *sessionSetupRequest) marshal(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, 25)
+	b = append(b, m.Flags, m.SecurityMode)
+	b = binary.LittleEndian.AppendUint32(b, m.Capabilities)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(b)+12))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(m.SecurityBuffer)))
+	b = binary.LittleEndian.AppendUint64(b, m.PreviousSessionID)
+	return append(b, m.SecurityBuffer...)
+}
+
+func (m *sessionSetupRequest) unmarshal(msg []byte) error {
+	b, err := body(msg, 25)
+	if err != nil {
+		return err
+	}
+	m.Flags = b[2]
+	m.SecurityMode = b[3]
+	m.Capabilities = binary.LittleEndian.Uint32(b[4:])
+	m.PreviousSessionID = binary.LittleEndian.Uint64(b[16:])
+	m.SecurityBuffer, err = buffer(msg, uint32(binary.LittleEndian.Uint16(b[12:])), uint32(binary.LittleEndian.Uint16(b[14:])))
+	return err
+}
+
+type sessionSetupResponse struct {
+	SessionFlags   uint16
+	SecurityBuffer []byte
+}
+
+func (m *sessionSetupResponse) marshal(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, 9)
+	b = binary.LittleEndian.AppendUint16(b, m.SessionFlags)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(b)+4))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(m.SecurityBuffer)))
+	if len(m.SecurityBuffer) == 0 {
+		return append(b, 0)
+	}
+	return append(b, m.SecurityBuffer...)
+}
+
+func (m *sessionSetupResponse) unmarshal(msg []byte) error {
+	b, err := body(msg, 9)
+	if err != nil {
+		return err
+	}
+	m.SessionFlags = binary.LittleEndian.Uint16(b[2:])
+	m.SecurityBuffer, err = buffer(msg, uint32(binary.LittleEndian.Uint16(b[4:])), uint32(binary.LittleEndian.Uint16(b[6:])))
+	return err
+}
+
+type treeConnectRequest struct {
+	Path string
+}
+
+func (m *treeConnectRequest) marshal(b []byte) []byte {
+	path := encodeUTF16(m.Path)
+	b = binary.LittleEndian.AppendUint16(b, 9)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(b)+4))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(path)))
+	return append(b, path...)
+}
+
+func (m *treeConnectRequest) unmarshal(msg []byte) error {
+	b, err := body(msg, 9)
+	if err != nil {
+		return err
+	}
+	path, err := buffer(msg, uint32(binary.LittleEndian.Uint16(b[4:])), uint32(binary.LittleEndian.Uint16(b[6:])))
+	m.Path = decodeUTF16(path)
+	return err
+}
+
+type treeConnectResponse struct {
+	ShareType     uint8
+	ShareFlags    uint32
+	Capabilities  uint32
+	MaximalAccess uint32
+}
+
+func (m *treeConnectResponse) marshal(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, 16)
+	b = append(b, m.ShareType, 0)
+	b = binary.LittleEndian.AppendUint32(b, m.ShareFlags)
+	b = binary.LittleEndian.AppendUint32(b, m.Capabilities)
+	return binary.LittleEndian.AppendUint32(b, m.MaximalAccess)
+}
+
+func (m *treeConnectResponse) unmarshal(msg []byte) error {
+	b, err := body(msg, 16)
+	if err != nil {
+		return err
+	}
+	m.ShareType = b[2]
+	m.ShareFlags = binary.LittleEndian.Uint32(b[4:])
+	m.Capabilities = binary.LittleEndian.Uint32(b[8:])
+	m.MaximalAccess = binary.LittleEndian.Uint32(b[12:])
+	return nil
+}
+
+// Values of CREATE requests for opening pipes
+const (
+	impersonationImpersonation uint32 = 2
+	// pipeAccess is FILE_READ_DATA, FILE_WRITE_DATA, FILE_APPEND_DATA, FILE_READ_EA, FILE_WRITE_EA,
+	// FILE_READ_ATTRIBUTES, FILE_WRITE_ATTRIBUTES, READ_CONTROL, and SYNCHRONIZE
+	pipeAccess           uint32 = 0x0012019f
+	shareReadWrite       uint32 = 0x00000003
+	fileOpen             uint32 = 0x00000001
+	fileNonDirectoryFile uint32 = 0x00000040
+	fileOpened           uint32 = 0x00000001
+)
+
+type createRequest struct {
+	ImpersonationLevel uint32
+	DesiredAccess      uint32
+	FileAttributes     uint32
+	ShareAccess        uint32
+	CreateDisposition  uint32
+	CreateOptions      uint32
+	Name               string
+}
+
+func (m *createRequest) marshal(b []byte) []byte {
+	name := encodeUTF16(m.Name)
+	b = binary.LittleEndian.AppendUint16(b, 57)
+	b = append(b, 0, 0)
+	b = binary.LittleEndian.AppendUint32(b, m.ImpersonationLevel)
+	b = binary.LittleEndian.AppendUint64(b, 0)
+	b = binary.LittleEndian.AppendUint64(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, m.DesiredAccess)
+	b = binary.LittleEndian.AppendUint32(b, m.FileAttributes)
+	b = binary.LittleEndian.AppendUint32(b, m.ShareAccess)
+	b = binary.LittleEndian.AppendUint32(b, m.CreateDisposition)
+	b = binary.LittleEndian.AppendUint32(b, m.CreateOptions)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(b)+12))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(name)))
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	if len(name) == 0 {
+		return append(b, 0)
+	}
+	return append(b, name...)
+}
+
+func (m *createRequest) unmarshal(msg []byte) error {
+	b, err := body(msg, 57)
+	if err != nil {
+		return err
+	}
+	m.ImpersonationLevel = binary.LittleEndian.Uint32(b[4:])
+	m.DesiredAccess = binary.LittleEndian.Uint32(b[24:])
+	m.FileAttributes = binary.LittleEndian.Uint32(b[28:])
+	m.ShareAccess = binary.LittleEndian.Uint32(b[32:])
+	m.CreateDisposition = binary.LittleEndian.Uint32(b[36:])
+	m.CreateOptions = binary.LittleEndian.Uint32(b[40:])
+	name, err := buffer(msg, uint32(binary.LittleEndian.Uint16(b[44:])), uint32(binary.LittleEndian.Uint16(b[46:])))
+	m.Name = decodeUTF16(name)
+	return err
+}
+
+type createResponse struct {
+	CreateAction   uint32
+	FileAttributes uint32
+	FileID         fileID
+}
+
+func (m *createResponse) marshal(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, 89)
+	b = append(b, 0, 0)
+	b = binary.LittleEndian.AppendUint32(b, m.CreateAction)
+	// Creation, last access, last write, and change times, allocation size, and end of file
+	b = append(b, make([]byte, 48)...)
+	b = binary.LittleEndian.AppendUint32(b, m.FileAttributes)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = append(b, m.FileID[:]...)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	return append(b, 0)
+}
+
+func (m *createResponse) unmarshal(msg []byte) error {
+	b, err := body(msg, 89)
+	if err != nil {
+		return err
+	}
+	m.CreateAction = binary.LittleEndian.Uint32(b[4:])
+	m.FileAttributes = binary.LittleEndian.Uint32(b[56:])
+	copy(m.FileID[:], b[64:80])
+	return nil
+}
+
+type closeRequest struct {
+	FileID fileID
+}
+
+func (m *closeRequest) marshal(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, 24)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	return append(b, m.FileID[:]...)
+}
+
+func (m *closeRequest) unmarshal(msg []byte) error {
+	b, err := body(msg, 24)
+	if err != nil {
+		return err
+	}
+	copy(m.FileID[:], b[8:24])
+	return nil
+}
+
+type closeResponse struct{}
+
+func (m *closeResponse) marshal(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, 60)
+	return append(b, make([]byte, 58)...)
+}
+
+func (m *closeResponse) unmarshal(msg []byte) error {
+	_, err := body(msg, 60)
+	return err
+}
+
+type readRequest struct {
+	Length       uint32
+	Offset       uint64
+	FileID       fileID
+	MinimumCount uint32
+}
+
+func (m *readRequest) marshal(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, 49)
+	b = append(b, 0x50, 0)
+	b = binary.LittleEndian.AppendUint32(b, m.Length)
+	b = binary.LittleEndian.AppendUint64(b, m.Offset)
+	b = append(b, m.FileID[:]...)
+	b = binary.LittleEndian.AppendUint32(b, m.MinimumCount)
+	// Channel, remaining bytes, read channel info offset and length, and the mandatory buffer byte
+	return append(b, make([]byte, 13)...)
+}
+
+func (m *readRequest) unmarshal(msg []byte) error {
+	b, err := body(msg, 49)
+	if err != nil {
+		return err
+	}
+	m.Length = binary.LittleEndian.Uint32(b[4:])
+	m.Offset = binary.LittleEndian.Uint64(b[8:])
+	copy(m.FileID[:], b[16:32])
+	m.MinimumCount = binary.LittleEndian.Uint32(b[32:])
+	return nil
+}
+
+type readResponse struct {
+	Data          []byte
+	DataRemaining uint32
+}
+
+func (m *readResponse) marshal(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, 17)
+	b = append(b, byte(len(b)+14), 0)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(m.Data)))
+	b = binary.LittleEndian.AppendUint32(b, m.DataRemaining)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	if len(m.Data) == 0 {
+		return append(b, 0)
+	}
+	return append(b, m.Data...)
+}
+
+func (m *readResponse) unmarshal(msg []byte) error {
+	b, err := body(msg, 17)
+	if err != nil {
+		return err
+	}
+	m.DataRemaining = binary.LittleEndian.Uint32(b[8:])
+	m.Data, err = buffer(msg, uint32(b[2]), binary.LittleEndian.Uint32(b[4:]))
+	return err
+}
+
+type writeRequest struct {
+	Offset uint64
+	FileID fileID
+	Data   []byte
+}
+
+func (m *writeRequest) marshal(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, 49)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(b)+46))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(m.Data)))
+	b = binary.LittleEndian.AppendUint64(b, m.Offset)
+	b = append(b, m.FileID[:]...)
+	// Channel, remaining bytes, write channel info offset and length, and flags
+	b = append(b, make([]byte, 16)...)
+	if len(m.Data) == 0 {
+		return append(b, 0)
+	}
+	return append(b, m.Data...)
+}
+
+func (m *writeRequest) unmarshal(msg []byte) error {
+	b, err := body(msg, 49)
+	if err != nil {
+		return err
+	}
+	m.Offset = binary.LittleEndian.Uint64(b[8:])
+	copy(m.FileID[:], b[16:32])
+	m.Data, err = buffer(msg, uint32(binary.LittleEndian.Uint16(b[2:])), binary.LittleEndian.Uint32(b[4:]))
+	return err
+}
+
+type writeResponse struct {
+	Count uint32
+}
+
+func (m *writeResponse) marshal(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, 17)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, m.Count)
+	return append(b, make([]byte, 9)...)
+}
+
+func (m *writeResponse) unmarshal(msg []byte) error {
+	b, err := body(msg, 17)
+	if err != nil {
+		return err
+	}
+	m.Count = binary.LittleEndian.Uint32(b[4:])
+	return nil
+}
+
+type ioctlRequest struct {
+	CtlCode   uint32
+	FileID    fileID
+	Input     []byte
+	MaxOutput uint32
+	Flags     uint32
+}
+
+func (m *ioctlRequest) marshal(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, 57)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, m.CtlCode)
+	b = append(b, m.FileID[:]...)
+	offset := uint32(len(b) + 32)
+	if len(m.Input) == 0 {
+		offset = 0
+	}
+	b = binary.LittleEndian.AppendUint32(b, offset)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(m.Input)))
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, m.MaxOutput)
+	b = binary.LittleEndian.AppendUint32(b, m.Flags)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	if len(m.Input) == 0 {
+		return append(b, 0)
+	}
+	return append(b, m.Input...)
+}
+
+func (m *ioctlRequest) unmarshal(msg []byte) error {
+	b, err := body(msg, 57)
+	if err != nil {
+		return err
+	}
+	m.CtlCode = binary.LittleEndian.Uint32(b[4:])
+	copy(m.FileID[:], b[8:24])
+	m.MaxOutput = binary.LittleEndian.Uint32(b[44:])
+	m.Flags = binary.LittleEndian.Uint32(b[48:])
+	m.Input, err = buffer(msg, binary.LittleEndian.Uint32(b[24:]), binary.LittleEndian.Uint32(b[28:]))
+	return err
+}
+
+type ioctlResponse struct {
+	CtlCode uint32
+	FileID  fileID
+	Output  []byte
+}
+
+func (m *ioctlResponse) marshal(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, 49)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, m.CtlCode)
+	b = append(b, m.FileID[:]...)
+	offset := uint32(len(b) + 24)
+	b = binary.LittleEndian.AppendUint32(b, offset)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, offset)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(m.Output)))
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	return append(b, m.Output...)
+}
+
+func (m *ioctlResponse) unmarshal(msg []byte) error {
+	b, err := body(msg, 49)
+	if err != nil {
+		return err
+	}
+	m.CtlCode = binary.LittleEndian.Uint32(b[4:])
+	copy(m.FileID[:], b[8:24])
+	m.Output, err = buffer(msg, binary.LittleEndian.Uint32(b[32:]), binary.LittleEndian.Uint32(b[36:]))
+	return err
+}
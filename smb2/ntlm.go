@@ -0,0 +1,424 @@
+package smb2
+
+import (
+	// Standard
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// NTLM negotiate flags
+const (
+	ntlmUnicode                 uint32 = 0x00000001
+	ntlmRequestTarget           uint32 = 0x00000004
+	ntlmSign                    uint32 = 0x00000010
+	ntlmNTLM                    uint32 = 0x00000200
+	ntlmAnonymous               uint32 = 0x00000800
+	ntlmAlwaysSign              uint32 = 0x00008000
+	ntlmTargetTypeServer        uint32 = 0x00020000
+	ntlmExtendedSessionSecurity uint32 = 0x00080000
+	ntlmTargetInfo              uint32 = 0x00800000
+	ntlmVersion                 uint32 = 0x02000000
+	ntlm128                     uint32 = 0x20000000
+	ntlmKeyExchange             uint32 = 0x40000000
+	ntlm56                      uint32 = 0x80000000
+
+	ntlmClientFlags = ntlmUnicode | ntlmRequestTarget | ntlmSign | ntlmNTLM | ntlmAlwaysSign |
+		ntlmExtendedSessionSecurity | ntlmTargetInfo | ntlmVersion | ntlm128 | ntlmKeyExchange | ntlm56
+)
+
+// NTLM message types
+const (
+	ntlmNegotiateMessage    uint32 = 1
+	ntlmChallengeMessage    uint32 = 2
+	ntlmAuthenticateMessage uint32 = 3
+)
+
+// AV pair IDs of the target info
+const (
+	avEOL             uint16 = 0x0000
+	avNbComputerName  uint16 = 0x0001
+	avNbDomainName    uint16 = 0x0002
+	avDNSComputerName uint16 = 0x0003
+	avDNSDomainName   uint16 = 0x0004
+	avFlags           uint16 = 0x0006
+	avTimestamp       uint16 = 0x0007
+)
+
+// avFlagMIC tells the server the AUTHENTICATE message carries a MIC
+const avFlagMIC uint32 = 0x00000002
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlmVersionInfo is the version structure sent in NTLM messages: Windows 10, NTLM revision 15
+var ntlmVersionInfo = []byte{10, 0, 0x61, 0x4a, 0, 0, 0, 15}
+
+// appendFields appends the field descriptors of fields and returns the payload to append after the fixed part, which
+// is fixed bytes long
+func appendFields(b []byte, fixed int, fields ...[]byte) ([]byte, []byte) {
+	var payload []byte
+	for _, f := range fields {
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(f)))
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(f)))
+		b = binary.LittleEndian.AppendUint32(b, uint32(fixed+len(payload)))
+		payload = append(payload, f...)
+	}
+	return b, payload
+}
+
+// readField returns the payload field described at offset in msg
+func readField(msg []byte, offset int) ([]byte, error) {
+	if len(msg) < offset+8 {
+		return nil, fmt.Errorf("the %d byte NTLM message is truncated", len(msg))
+	}
+	length := int(binary.LittleEndian.Uint16(msg[offset:]))
+	start := int(binary.LittleEndian.Uint32(msg[offset+4:]))
+	if length == 0 {
+		return nil, nil
+	}
+	if start > len(msg) || length > len(msg)-start {
+		return nil, fmt.Errorf("the NTLM field at offset %d is outside of the message", offset)
+	}
+	return msg[start : start+length], nil
+}
+
+// checkNTLMMessage checks the signature and the type of an NTLM message
+func checkNTLMMessage(msg []byte, typ uint32, size int) error {
+	if len(msg) < size || !bytes.Equal(msg[:8], ntlmSignature) {
+		return fmt.Errorf("invalid NTLM message")
+	}
+	if t := binary.LittleEndian.Uint32(msg[8:]); t != typ {
+		return fmt.Errorf("expected NTLM message type %d but received %d", typ, t)
+	}
+	return nil
+}
+
+// ntlmChallenge is a decoded CHALLENGE_MESSAGE
+type ntlmChallenge struct {
+	flags      uint32
+	challenge  [8]byte
+	targetInfo []byte
+}
+
+func parseNTLMChallenge(msg []byte) (*ntlmChallenge, error) {
+	if err := checkNTLMMessage(msg, ntlmChallengeMessage, 48); err != nil {
+		return nil, err
+	}
+	c := &ntlmChallenge{flags: binary.LittleEndian.Uint32(msg[20:])}
+	copy(c.challenge[:], msg[24:32])
+	var err error
+	c.targetInfo, err = readField(msg, 40)
+	return c, err
+}
+
+// ntowfv2 returns the NTLMv2 response key of a user
+func ntowfv2(user, password, domain string) []byte {
+	hash := md4(encodeUTF16(password))
+	mac := hmac.New(md5.New, hash[:])
+	mac.Write(encodeUTF16(strings.ToUpper(user) + domain))
+	return mac.Sum(nil)
+}
+
+// hmacMD5 returns HMAC-MD5 of the concatenated data
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// avPairs returns the value of every AV pair of a target info, or an error if it isn't well formed
+func avPairs(info []byte) (map[uint16][]byte, error) {
+	pairs := make(map[uint16][]byte)
+	for len(info) >= 4 {
+		id := binary.LittleEndian.Uint16(info)
+		length := int(binary.LittleEndian.Uint16(info[2:]))
+		if id == avEOL {
+			return pairs, nil
+		}
+		if len(info) < 4+length {
+			break
+		}
+		pairs[id] = info[4 : 4+length]
+		info = info[4+length:]
+	}
+	return nil, fmt.Errorf("the target info is not terminated")
+}
+
+// appendAVPair appends an AV pair to a target info
+func appendAVPair(b []byte, id uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, id)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+// ntlmClient authenticates with NTLMv2
+type ntlmClient struct {
+	user        string
+	password    string
+	domain      string
+	workstation string
+
+	negotiate  []byte
+	sessionKey []byte
+}
+
+// negotiateMessage returns the NEGOTIATE_MESSAGE that starts the authentication
+func (c *ntlmClient) negotiateMessage() []byte {
+	b := append([]byte(nil), ntlmSignature...)
+	b = binary.LittleEndian.AppendUint32(b, ntlmNegotiateMessage)
+	b = binary.LittleEndian.AppendUint32(b, ntlmClientFlags)
+	// Empty domain and workstation fields
+	b = append(b, make([]byte, 16)...)
+	c.negotiate = append(b, ntlmVersionInfo...)
+	return c.negotiate
+}
+
+// authenticate answers the server's challenge with an AUTHENTICATE_MESSAGE and sets the session key. An empty user
+// authenticates anonymously, which has no session key.
+func (c *ntlmClient) authenticate(challengeMsg []byte) ([]byte, error) {
+	challenge, err := parseNTLMChallenge(challengeMsg)
+	if err != nil {
+		return nil, err
+	}
+	flags := ntlmClientFlags & challenge.flags
+	if flags&ntlmUnicode == 0 {
+		return nil, fmt.Errorf("the server doesn't support Unicode")
+	}
+
+	var lm, nt, encryptedKey []byte
+	var mic bool
+	if c.user == "" && c.password == "" {
+		flags |= ntlmAnonymous
+		flags &^= ntlmKeyExchange
+		lm = []byte{0}
+		c.sessionKey = nil
+	} else {
+		pairs, err := avPairs(challenge.targetInfo)
+		if err != nil {
+			return nil, err
+		}
+		var clientChallenge [8]byte
+		if _, err = rand.Read(clientChallenge[:]); err != nil {
+			return nil, err
+		}
+
+		// Use the server's time if it sent one, which also requires a MIC
+		timestamp := pairs[avTimestamp]
+		info := challenge.targetInfo
+		if len(timestamp) == 8 {
+			mic = true
+			info = appendTargetInfoFlags(info, avFlagMIC)
+		} else {
+			timestamp = binary.LittleEndian.AppendUint64(nil, fileTime(time.Now()))
+		}
+
+		key := ntowfv2(c.user, c.password, c.domain)
+		nt, c.sessionKey = ntlmv2Response(key, challenge.challenge, clientChallenge, timestamp, info)
+		if mic {
+			lm = make([]byte, 24)
+		} else {
+			lm = append(hmacMD5(key, challenge.challenge[:], clientChallenge[:]), clientChallenge[:]...)
+		}
+		if flags&ntlmKeyExchange != 0 {
+			exported := make([]byte, 16)
+			if _, err = rand.Read(exported); err != nil {
+				return nil, err
+			}
+			encryptedKey = rc4Crypt(c.sessionKey, exported)
+			c.sessionKey = exported
+		}
+	}
+
+	const fixed = 88
+	b := append([]byte(nil), ntlmSignature...)
+	b = binary.LittleEndian.AppendUint32(b, ntlmAuthenticateMessage)
+	b, payload := appendFields(b, fixed, lm, nt, encodeUTF16(c.domain), encodeUTF16(c.user), encodeUTF16(c.workstation), encryptedKey)
+	b = binary.LittleEndian.AppendUint32(b, flags)
+	b = append(b, ntlmVersionInfo...)
+	b = append(b, make([]byte, 16)...)
+	b = append(b, payload...)
+	if mic {
+		copy(b[72:88], hmacMD5(c.sessionKey, c.negotiate, challengeMsg, b))
+	}
+	return b, nil
+}
+
+// ntlmv2Response returns the NTLMv2 response to a server challenge and the session base key, which NTLMv2 uses as the
+// key exchange key
+func ntlmv2Response(key []byte, serverChallenge, clientChallenge [8]byte, timestamp, info []byte) ([]byte, []byte) {
+	temp := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge[:]...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, info...)
+	temp = append(temp, 0, 0, 0, 0)
+	proof := hmacMD5(key, serverChallenge[:], temp)
+	return append(proof, temp...), hmacMD5(key, proof)
+}
+
+// appendTargetInfoFlags returns a copy of a target info with flags added to its MsvAvFlags pair
+func appendTargetInfoFlags(info []byte, flags uint32) []byte {
+	var out []byte
+	for len(info) >= 4 {
+		id := binary.LittleEndian.Uint16(info)
+		length := int(binary.LittleEndian.Uint16(info[2:]))
+		if id == avEOL || len(info) < 4+length {
+			break
+		}
+		value := info[4 : 4+length]
+		if id == avFlags && length == 4 {
+			flags |= binary.LittleEndian.Uint32(value)
+		} else {
+			out = appendAVPair(out, id, value)
+		}
+		info = info[4+length:]
+	}
+	out = appendAVPair(out, avFlags, binary.LittleEndian.AppendUint32(nil, flags))
+	return appendAVPair(out, avEOL, nil)
+}
+
+// rc4Crypt encrypts or decrypts data with RC4, which NTLM uses to exchange the session key
+func rc4Crypt(key, data []byte) []byte {
+	cipher, err := rc4.NewCipher(key)
+	if err != nil {
+		// The keys are always 16 bytes long
+		panic(err)
+	}
+	out := make([]byte, len(data))
+	cipher.XORKeyStream(out, data)
+	return out
+}
+
+// fileTime converts t to a Windows FILETIME, the number of 100 ns intervals since 1601
+func fileTime(t time.Time) uint64 {
+	return uint64(t.UnixNano()/100) + 116444736000000000
+}
+
+// ntlmServer verifies the NTLMv2 authentication of a client
+type ntlmServer struct {
+	// computer and domain are the NetBIOS names of the server and its domain
+	computer string
+	domain   string
+	// password returns the password of a user and whether the user exists
+	password func(user, domain string) (string, bool)
+	// anonymous allows clients to authenticate without credentials
+	anonymous bool
+
+	negotiate []byte
+	challenge []byte
+	nonce     [8]byte
+}
+
+// ntlmIdentity is the result of a successful authentication
+type ntlmIdentity struct {
+	user       string
+	domain     string
+	anonymous  bool
+	sessionKey []byte
+}
+
+// challengeMessage answers the client's NEGOTIATE_MESSAGE with a CHALLENGE_MESSAGE
+func (s *ntlmServer) challengeMessage(negotiate []byte) ([]byte, error) {
+	if err := checkNTLMMessage(negotiate, ntlmNegotiateMessage, 16); err != nil {
+		return nil, err
+	}
+	s.negotiate = append([]byte(nil), negotiate...)
+	if _, err := rand.Read(s.nonce[:]); err != nil {
+		return nil, err
+	}
+	flags := binary.LittleEndian.Uint32(negotiate[12:])&ntlmClientFlags | ntlmUnicode | ntlmNTLM | ntlmTargetInfo | ntlmTargetTypeServer
+
+	var info []byte
+	info = appendAVPair(info, avNbDomainName, encodeUTF16(s.domain))
+	info = appendAVPair(info, avNbComputerName, encodeUTF16(s.computer))
+	info = appendAVPair(info, avDNSDomainName, encodeUTF16(strings.ToLower(s.domain)))
+	info = appendAVPair(info, avDNSComputerName, encodeUTF16(strings.ToLower(s.computer)))
+	info = appendAVPair(info, avTimestamp, binary.LittleEndian.AppendUint64(nil, fileTime(time.Now())))
+	info = appendAVPair(info, avEOL, nil)
+
+	const fixed = 56
+	b := append([]byte(nil), ntlmSignature...)
+	b = binary.LittleEndian.AppendUint32(b, ntlmChallengeMessage)
+	target := encodeUTF16(s.computer)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(target)))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(target)))
+	b = binary.LittleEndian.AppendUint32(b, fixed)
+	b = binary.LittleEndian.AppendUint32(b, flags)
+	b = append(b, s.nonce[:]...)
+	b = append(b, make([]byte, 8)...)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(info)))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(info)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(fixed+len(target)))
+	b = append(b, ntlmVersionInfo...)
+	b = append(b, target...)
+	b = append(b, info...)
+	s.challenge = b
+	return b, nil
+}
+
+// verify checks the client's AUTHENTICATE_MESSAGE
+func (s *ntlmServer) verify(msg []byte) (*ntlmIdentity, error) {
+	if err := checkNTLMMessage(msg, ntlmAuthenticateMessage, 64); err != nil {
+		return nil, err
+	}
+	var fields [6][]byte
+	for i := range fields {
+		f, err := readField(msg, 12+8*i)
+		if err != nil {
+			return nil, err
+		}
+		fields[i] = f
+	}
+	lm, nt, domain, user, encryptedKey := fields[0], fields[1], decodeUTF16(fields[2]), decodeUTF16(fields[3]), fields[5]
+	flags := binary.LittleEndian.Uint32(msg[60:])
+
+	if user == "" && len(nt) == 0 && len(lm) <= 1 {
+		if !s.anonymous {
+			return nil, StatusLogonFailure
+		}
+		return &ntlmIdentity{anonymous: true}, nil
+	}
+	if len(nt) < 16+28 {
+		// NTLMv1 and LMv2 only responses are not accepted
+		return nil, StatusLogonFailure
+	}
+	password, ok := s.password(user, domain)
+	if !ok {
+		return nil, StatusLogonFailure
+	}
+	key := ntowfv2(user, password, domain)
+	proof := hmacMD5(key, s.nonce[:], nt[16:])
+	if !hmac.Equal(proof, nt[:16]) {
+		return nil, StatusLogonFailure
+	}
+
+	sessionKey := hmacMD5(key, proof)
+	if flags&ntlmKeyExchange != 0 && len(encryptedKey) == 16 {
+		sessionKey = rc4Crypt(sessionKey, encryptedKey)
+	}
+
+	// Check the MIC if the client says there is one
+	pairs, err := avPairs(nt[16+28:])
+	if err != nil {
+		return nil, StatusLogonFailure
+	}
+	if f := pairs[avFlags]; len(f) == 4 && binary.LittleEndian.Uint32(f)&avFlagMIC != 0 {
+		if len(msg) < 88 {
+			return nil, StatusLogonFailure
+		}
+		zeroed := append([]byte(nil), msg...)
+		copy(zeroed[72:88], make([]byte, 16))
+		if !hmac.Equal(hmacMD5(sessionKey, s.negotiate, s.challenge, zeroed), msg[72:88]) {
+			return nil, StatusLogonFailure
+		}
+	}
+	return &ntlmIdentity{user: user, domain: domain, sessionKey: sessionKey}, nil
+}
@@ -0,0 +1,847 @@
+//go:build windows || linux
+
+package smb2
+
+import (
+	// Standard
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// maxCredits bounds the credits a client of the Server may hold
+const maxCredits = 128
+
+// dialectWildcard is the dialect of the NEGOTIATE response to an SMB1 negotiation offering "SMB 2.???"; the client
+// then negotiates again with SMB2
+const dialectWildcard uint16 = 0x02ff
+
+// allFiles is the file ID of related compound requests that refers to the file of the previous request
+var allFiles = fileID{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// Server is an SMB2 server that serves nothing but the pipes of the IPC$ share. Each pipe name registered with Listen
+// has a Listener whose Accept returns the pipes remote clients open, so handlers written for an npipe.PipeListener
+// serve SMB clients unchanged:
+//
+//	srv := &smb2.Server{Password: func(user, domain string) (string, bool) { return "secret", user == "alice" }}
+//	ln, err := srv.Listen("echo", npipe.PipeTypeMessage|npipe.PipeReadModeMessage)
+//	tcp, err := net.Listen("tcp", ":445")
+//	go srv.Serve(tcp)
+//
+// Clients authenticate with NTLMv2 and may use the dialects 2.0.2 to 3.0.2; each TCP connection holds one session.
+type Server struct {
+	// Computer and Domain are the NetBIOS names the server announces, NPIPE and WORKGROUP if empty
+	Computer string
+	Domain   string
+	// Password returns the password of a user and whether the user exists. If nil, only anonymous clients are accepted.
+	Password func(user, domain string) (string, bool)
+	// AllowAnonymous accepts clients that authenticate without credentials
+	AllowAnonymous bool
+	// RequireSigning requires authenticated clients to sign their messages
+	RequireSigning bool
+	// MaxDialect is the highest dialect the server negotiates, Dialect302 if zero
+	MaxDialect uint16
+
+	mu          sync.Mutex
+	pipes       map[string]*Listener
+	listeners   map[net.Listener]struct{}
+	conns       map[*serverConn]struct{}
+	guid        [16]byte
+	nextSession uint64
+	closed      bool
+}
+
+// init allocates the server's state on first use. The caller must hold mu.
+func (srv *Server) init() {
+	if srv.pipes == nil {
+		srv.pipes = make(map[string]*Listener)
+		srv.listeners = make(map[net.Listener]struct{})
+		srv.conns = make(map[*serverConn]struct{})
+		rand.Read(srv.guid[:])
+	}
+}
+
+// Listen registers the pipe name, e.g. "srvsvc" or \\.\pipe\srvsvc, and returns the Listener accepting the clients
+// that open it. pipeMode takes the flags of npipe.NewPipeListener; with npipe.PipeTypeMessage the pipe preserves
+// message boundaries.
+func (srv *Server) Listen(name string, pipeMode uint32) (*Listener, error) {
+	if len(name) > 9 && strings.EqualFold(name[:9], `\\.\pipe\`) {
+		name = name[9:]
+	}
+	if name == "" {
+		return nil, fmt.Errorf("smb2.Server.Listen(): the pipe name is empty")
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.init()
+	if srv.closed {
+		return nil, fmt.Errorf("smb2.Server.Listen(): %s", net.ErrClosed)
+	}
+	key := strings.ToLower(name)
+	if _, ok := srv.pipes[key]; ok {
+		return nil, fmt.Errorf("smb2.Server.Listen(): the pipe \"%s\" is already listening", name)
+	}
+	l := &Listener{
+		srv:     srv,
+		key:     key,
+		addr:    npipe.PipeAddr(`\\.\pipe\` + name),
+		message: pipeMode&npipe.PipeTypeMessage != 0,
+		backlog: make(chan *ServerConn, listenBacklog),
+		closed:  make(chan struct{}),
+	}
+	srv.pipes[key] = l
+	return l, nil
+}
+
+// listener returns the Listener of a pipe name or nil
+func (srv *Server) listener(name string) *Listener {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.pipes[strings.ToLower(name)]
+}
+
+// Serve serves the connections accepted from ln until Accept fails or the server is closed
+func (srv *Server) Serve(ln net.Listener) error {
+	srv.mu.Lock()
+	srv.init()
+	if srv.closed {
+		srv.mu.Unlock()
+		ln.Close()
+		return net.ErrClosed
+	}
+	srv.listeners[ln] = struct{}{}
+	srv.mu.Unlock()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.listeners, ln)
+		srv.mu.Unlock()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.ServeConn(conn)
+	}
+}
+
+// Close stops the listeners passed to Serve, closes the client connections, and closes every pipe Listener
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	srv.init()
+	srv.closed = true
+	var closers []io.Closer
+	for ln := range srv.listeners {
+		closers = append(closers, ln)
+	}
+	for c := range srv.conns {
+		closers = append(closers, c.conn)
+	}
+	for _, l := range srv.pipes {
+		closers = append(closers, l)
+	}
+	srv.mu.Unlock()
+	for _, c := range closers {
+		c.Close()
+	}
+	return nil
+}
+
+// serverConn is the state of a client connection and its session
+type serverConn struct {
+	srv  *Server
+	conn net.Conn
+	// wmu serializes writing responses
+	wmu sync.Mutex
+
+	// The negotiated state, only used by the goroutine reading the requests
+	negotiated         bool
+	dialect            uint16
+	clientGUID         [16]byte
+	clientSecurityMode uint16
+	clientCapabilities uint32
+	clientDialects     []uint16
+	ntlm               *ntlmServer
+
+	mu        sync.Mutex
+	signing   bool
+	sessionID uint64
+	identity  *Identity
+	signer    *signer
+	treeID    uint32
+	files     map[fileID]*ServerConn
+	lastFile  fileID
+	nextFile  uint64
+	nextAsync uint64
+	// pending maps the message IDs of asynchronous requests to the channels that cancel them
+	pending map[uint64]chan struct{}
+	credits int
+}
+
+// ServeConn answers the requests on conn until the client disconnects or violates the protocol, and closes conn
+func (srv *Server) ServeConn(conn net.Conn) error {
+	c := &serverConn{
+		srv:     srv,
+		conn:    conn,
+		files:   make(map[fileID]*ServerConn),
+		pending: make(map[uint64]chan struct{}),
+		credits: 1,
+	}
+	srv.mu.Lock()
+	srv.init()
+	closed := srv.closed
+	srv.conns[c] = struct{}{}
+	srv.mu.Unlock()
+	defer func() {
+		conn.Close()
+		c.closeFiles()
+		srv.mu.Lock()
+		delete(srv.conns, c)
+		srv.mu.Unlock()
+	}()
+	if closed {
+		return nil
+	}
+
+	for {
+		msg, err := readMessage(conn)
+		if err == io.EOF || errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err == nil {
+			err = c.dispatch(msg)
+		}
+		if err != nil {
+			return fmt.Errorf("smb2.Server.ServeConn(): %s", err)
+		}
+	}
+}
+
+// dispatch handles the requests of a message, which holds several of them if they are compounded
+func (c *serverConn) dispatch(msg []byte) error {
+	if len(msg) >= 4 && bytes.Equal(msg[:4], []byte{0xff, 'S', 'M', 'B'}) {
+		return c.negotiateSMB1(msg)
+	}
+	for len(msg) > 0 {
+		h, err := parseHeader(msg)
+		if err != nil {
+			return err
+		}
+		if h.Flags&flagResponse != 0 {
+			return fmt.Errorf("received a response from the client")
+		}
+		part := msg
+		msg = nil
+		if h.NextCommand != 0 {
+			if h.NextCommand < headerSize || int(h.NextCommand) > len(part) {
+				return fmt.Errorf("invalid compound offset %d", h.NextCommand)
+			}
+			part, msg = part[:h.NextCommand], part[h.NextCommand:]
+		}
+		if err = c.handle(h, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// respond sends the response to req. A non-zero asyncID makes the response asynchronous: the interim
+// STATUS_PENDING response grants the credits and the final response none.
+func (c *serverConn) respond(req *header, status StatusError, body message, asyncID uint64) {
+	h := &header{
+		Status:    status,
+		Command:   req.Command,
+		Flags:     flagResponse,
+		MessageID: req.MessageID,
+		TreeID:    req.TreeID,
+		SessionID: req.SessionID,
+	}
+	if asyncID != 0 {
+		h.Flags |= flagAsync
+		h.AsyncID = asyncID
+	}
+
+	c.mu.Lock()
+	if asyncID == 0 || status == StatusPending {
+		want := int(req.Credits)
+		if want < 1 {
+			want = 1
+		}
+		if room := maxCredits - c.credits; want > room {
+			want = room
+		}
+		if want < 0 {
+			want = 0
+		}
+		c.credits += want
+		h.Credits = uint16(want)
+	}
+	// Responses to signed requests are signed, and the response completing an SMB 3 session setup always is
+	signer := c.signer
+	sign := c.signing || req.Flags&flagSigned != 0 ||
+		req.Command == cmdSessionSetup && status == StatusSuccess && c.dialect >= Dialect300
+	c.mu.Unlock()
+
+	if body == nil {
+		body = &errorResponse{}
+	}
+	msg := body.marshal(appendHeader(make([]byte, 0, 128), h))
+	if signer != nil && sign && req.Command != cmdNegotiate {
+		signer.sign(msg)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	writeMessage(c.conn, msg)
+}
+
+// async answers req with an interim response and runs op in a goroutine that sends the final response. op returns
+// once it completes or cancel is closed by a CANCEL request.
+func (c *serverConn) async(req *header, op func(cancel <-chan struct{}) (StatusError, message)) {
+	cancel := make(chan struct{})
+	c.mu.Lock()
+	c.nextAsync++
+	asyncID := c.nextAsync
+	c.pending[req.MessageID] = cancel
+	c.mu.Unlock()
+
+	c.respond(req, StatusPending, nil, asyncID)
+	go func() {
+		status, body := op(cancel)
+		c.mu.Lock()
+		delete(c.pending, req.MessageID)
+		c.mu.Unlock()
+		c.respond(req, status, body, asyncID)
+	}()
+}
+
+// handle handles one request and returns an error if the connection must be closed
+func (c *serverConn) handle(h *header, msg []byte) error {
+	charge := int(h.CreditCharge)
+	if charge == 0 {
+		charge = 1
+	}
+	c.mu.Lock()
+	if h.Command != cmdCancel {
+		c.credits -= charge
+	}
+	if h.Flags&flagRelated != 0 {
+		h.SessionID, h.TreeID = c.sessionID, c.treeID
+	}
+	signer, signing := c.signer, c.signing
+	c.mu.Unlock()
+
+	if !c.negotiated && h.Command != cmdNegotiate {
+		return fmt.Errorf("received command %d before NEGOTIATE", h.Command)
+	}
+	if signer != nil && h.Command != cmdNegotiate {
+		if h.Flags&flagSigned != 0 && signer.verify(msg) != nil || h.Flags&flagSigned == 0 && signing && h.Command != cmdSessionSetup {
+			if h.Command != cmdCancel {
+				c.respond(h, StatusAccessDenied, nil, 0)
+			}
+			return nil
+		}
+	}
+
+	switch h.Command {
+	case cmdNegotiate:
+		return c.negotiate(h, msg)
+	case cmdSessionSetup:
+		c.sessionSetup(h, msg)
+	case cmdLogoff:
+		if c.check(h, false) {
+			c.respond(h, StatusSuccess, &emptyMessage{}, 0)
+			c.closeFiles()
+			c.mu.Lock()
+			c.sessionID, c.identity, c.signer, c.treeID = 0, nil, nil, 0
+			c.mu.Unlock()
+		}
+	case cmdTreeConnect:
+		c.treeConnect(h, msg)
+	case cmdTreeDisconnect:
+		if c.check(h, true) {
+			c.closeFiles()
+			c.mu.Lock()
+			c.treeID = 0
+			c.mu.Unlock()
+			c.respond(h, StatusSuccess, &emptyMessage{}, 0)
+		}
+	case cmdCreate:
+		c.create(h, msg)
+	case cmdClose:
+		var req closeRequest
+		if c.check(h, true) && c.decode(h, msg, &req) {
+			c.mu.Lock()
+			if req.FileID == allFiles {
+				req.FileID = c.lastFile
+			}
+			f := c.files[req.FileID]
+			delete(c.files, req.FileID)
+			c.mu.Unlock()
+			if f == nil {
+				c.respond(h, StatusFileClosed, nil, 0)
+				return nil
+			}
+			f.closeRemote()
+			c.respond(h, StatusSuccess, &closeResponse{}, 0)
+		}
+	case cmdFlush:
+		if c.check(h, true) {
+			c.respond(h, StatusSuccess, &emptyMessage{}, 0)
+		}
+	case cmdRead:
+		c.read(h, msg)
+	case cmdWrite:
+		c.write(h, msg)
+	case cmdIoctl:
+		return c.ioctl(h, msg)
+	case cmdCancel:
+		c.mu.Lock()
+		cancel := c.pending[h.MessageID]
+		delete(c.pending, h.MessageID)
+		c.mu.Unlock()
+		if cancel != nil {
+			close(cancel)
+		}
+	case cmdEcho:
+		c.respond(h, StatusSuccess, &emptyMessage{}, 0)
+	default:
+		c.respond(h, StatusNotSupported, nil, 0)
+	}
+	return nil
+}
+
+// check answers req with an error and returns false unless it belongs to the session and, if tree is true, to the
+// IPC$ tree connect
+func (c *serverConn) check(req *header, tree bool) bool {
+	c.mu.Lock()
+	status := StatusSuccess
+	if c.identity == nil || req.SessionID != c.sessionID {
+		status = StatusUserSessionDeleted
+	} else if tree && (c.treeID == 0 || req.TreeID != c.treeID) {
+		status = StatusNetworkNameDeleted
+	}
+	c.mu.Unlock()
+	if status != StatusSuccess {
+		c.respond(req, status, nil, 0)
+		return false
+	}
+	return true
+}
+
+// decode decodes the body of a request and answers it with STATUS_INVALID_PARAMETER if it is malformed
+func (c *serverConn) decode(req *header, msg []byte, body message) bool {
+	if err := body.unmarshal(msg); err != nil {
+		c.respond(req, StatusInvalidParameter, nil, 0)
+		return false
+	}
+	return true
+}
+
+// file returns the open pipe with the given ID or answers req with STATUS_FILE_CLOSED
+func (c *serverConn) file(req *header, fid fileID) *ServerConn {
+	c.mu.Lock()
+	if fid == allFiles {
+		fid = c.lastFile
+	}
+	f := c.files[fid]
+	c.mu.Unlock()
+	if f == nil {
+		c.respond(req, StatusFileClosed, nil, 0)
+	}
+	return f
+}
+
+// closeFiles closes every pipe the client opened, after a logoff, a tree disconnect, or the end of the connection
+func (c *serverConn) closeFiles() {
+	c.mu.Lock()
+	files := c.files
+	c.files = make(map[fileID]*ServerConn)
+	c.mu.Unlock()
+	for _, f := range files {
+		f.closeRemote()
+	}
+}
+
+// negotiateSMB1 answers the SMB1 NEGOTIATE that Windows and Samba clients start with. A client offering "SMB 2.???"
+// receives the wildcard dialect and negotiates again with SMB2, one offering only "SMB 2.002" gets SMB 2.0.2.
+func (c *serverConn) negotiateSMB1(msg []byte) error {
+	if c.negotiated || len(msg) < 35 || msg[4] != 0x72 {
+		return fmt.Errorf("received an SMB1 request that isn't a NEGOTIATE")
+	}
+	var wildcard, smb202 bool
+	for _, d := range bytes.Split(msg[35:], []byte{0}) {
+		wildcard = wildcard || string(d) == "\x02SMB 2.???"
+		smb202 = smb202 || string(d) == "\x02SMB 2.002"
+	}
+	resp := &negotiateResponse{Dialect: dialectWildcard}
+	switch {
+	case wildcard:
+	case smb202:
+		c.negotiated, c.dialect = true, Dialect202
+		resp.Dialect = Dialect202
+		c.mu.Lock()
+		c.signing = c.srv.RequireSigning
+		c.mu.Unlock()
+	default:
+		return fmt.Errorf("the client doesn't support SMB2")
+	}
+	c.mu.Lock()
+	c.credits--
+	c.mu.Unlock()
+	c.respond(&header{Command: cmdNegotiate, Credits: 1}, StatusSuccess, c.negotiateResponse(resp), 0)
+	return nil
+}
+
+// negotiate selects the highest dialect both ends support
+func (c *serverConn) negotiate(h *header, msg []byte) error {
+	if c.negotiated {
+		return fmt.Errorf("received a second NEGOTIATE")
+	}
+	var req negotiateRequest
+	if err := req.unmarshal(msg); err != nil {
+		return err
+	}
+	max := c.srv.MaxDialect
+	if max == 0 {
+		max = Dialect302
+	}
+	var dialect uint16
+	for _, d := range req.Dialects {
+		for _, supported := range dialects {
+			if d == supported && d <= max && d > dialect {
+				dialect = d
+			}
+		}
+	}
+	if dialect == 0 {
+		c.respond(h, StatusNotSupported, nil, 0)
+		return fmt.Errorf("the client offered no supported dialect")
+	}
+	c.negotiated, c.dialect = true, dialect
+	c.clientGUID, c.clientSecurityMode, c.clientCapabilities = req.ClientGUID, req.SecurityMode, req.Capabilities
+	c.clientDialects = req.Dialects
+	c.mu.Lock()
+	c.signing = c.srv.RequireSigning || req.SecurityMode&signingRequired != 0
+	c.mu.Unlock()
+	c.respond(h, StatusSuccess, c.negotiateResponse(&negotiateResponse{Dialect: dialect}), 0)
+	return nil
+}
+
+// negotiateResponse fills in the fields of a NEGOTIATE response that don't depend on the request
+func (c *serverConn) negotiateResponse(resp *negotiateResponse) *negotiateResponse {
+	resp.SecurityMode = signingEnabled
+	if c.srv.RequireSigning {
+		resp.SecurityMode |= signingRequired
+	}
+	resp.ServerGUID = c.srv.guid
+	resp.MaxTransactSize, resp.MaxReadSize, resp.MaxWriteSize = maxIOSize, maxIOSize, maxIOSize
+	resp.SystemTime = fileTime(time.Now())
+	resp.SecurityBuffer = negTokenInit(nil)
+	return resp
+}
+
+// sessionSetup authenticates the client with NTLM wrapped in SPNEGO
+func (c *serverConn) sessionSetup(h *header, msg []byte) {
+	var req sessionSetupRequest
+	if !c.decode(h, msg, &req) {
+		return
+	}
+	c.mu.Lock()
+	status := StatusSuccess
+	switch {
+	case c.identity != nil:
+		// One session per connection
+		status = StatusRequestNotAccepted
+	case h.SessionID == 0:
+		c.srv.mu.Lock()
+		c.srv.nextSession++
+		c.sessionID = c.srv.nextSession
+		c.srv.mu.Unlock()
+		c.ntlm = &ntlmServer{computer: c.srv.Computer, domain: c.srv.Domain, password: c.srv.Password, anonymous: c.srv.AllowAnonymous}
+		if c.ntlm.computer == "" {
+			c.ntlm.computer = "NPIPE"
+		}
+		if c.ntlm.domain == "" {
+			c.ntlm.domain = "WORKGROUP"
+		}
+		if c.ntlm.password == nil {
+			c.ntlm.password = func(string, string) (string, bool) { return "", false }
+		}
+	case h.SessionID != c.sessionID || c.ntlm == nil:
+		status = StatusUserSessionDeleted
+	}
+	h.SessionID = c.sessionID
+	c.mu.Unlock()
+	if status != StatusSuccess {
+		c.respond(h, status, nil, 0)
+		return
+	}
+
+	token, err := mechToken(req.SecurityBuffer)
+	if err != nil {
+		c.respond(h, StatusInvalidParameter, nil, 0)
+		return
+	}
+	if c.ntlm.challenge == nil {
+		challenge, err := c.ntlm.challengeMessage(token)
+		if err != nil {
+			c.respond(h, StatusInvalidParameter, nil, 0)
+			return
+		}
+		resp := &sessionSetupResponse{SecurityBuffer: negTokenResp(negAcceptIncomplete, oidNTLMSSP, challenge)}
+		c.respond(h, StatusMoreProcessingRequired, resp, 0)
+		return
+	}
+
+	identity, err := c.ntlm.verify(token)
+	c.ntlm = nil
+	if err != nil {
+		c.respond(h, StatusLogonFailure, nil, 0)
+		c.mu.Lock()
+		c.sessionID = 0
+		c.mu.Unlock()
+		return
+	}
+	resp := &sessionSetupResponse{SecurityBuffer: negTokenResp(negAcceptCompleted, nil, nil)}
+	c.mu.Lock()
+	c.identity = &Identity{User: identity.user, Domain: identity.domain, Anonymous: identity.anonymous, Addr: c.conn.RemoteAddr()}
+	c.signing = c.signing || req.SecurityMode&uint8(signingRequired) != 0
+	if identity.anonymous {
+		// Anonymous sessions have no key to sign with
+		resp.SessionFlags = sessionNull
+	} else {
+		c.signer = newSigner(c.dialect, identity.sessionKey)
+	}
+	c.mu.Unlock()
+	c.respond(h, StatusSuccess, resp, 0)
+}
+
+// treeConnect connects the session to IPC$, the only share
+func (c *serverConn) treeConnect(h *header, msg []byte) {
+	var req treeConnectRequest
+	if !c.check(h, false) || !c.decode(h, msg, &req) {
+		return
+	}
+	share := req.Path[strings.LastIndex(req.Path, `\`)+1:]
+	if !strings.EqualFold(share, "IPC$") {
+		c.respond(h, StatusBadNetworkName, nil, 0)
+		return
+	}
+	c.mu.Lock()
+	c.treeID = 1
+	c.mu.Unlock()
+	h.TreeID = 1
+	c.respond(h, StatusSuccess, &treeConnectResponse{ShareType: shareTypePipe, MaximalAccess: pipeAccess}, 0)
+}
+
+// create opens a pipe and hands its server end to the pipe's Listener
+func (c *serverConn) create(h *header, msg []byte) {
+	var req createRequest
+	if !c.check(h, true) || !c.decode(h, msg, &req) {
+		return
+	}
+	name := strings.TrimLeft(req.Name, `\`)
+	c.mu.Lock()
+	identity := *c.identity
+	c.mu.Unlock()
+
+	srv := c.srv
+	srv.mu.Lock()
+	l := srv.pipes[strings.ToLower(name)]
+	var f *ServerConn
+	status := StatusObjectNameNotFound
+	if l != nil {
+		f = newServerConn(l.addr, l.message, identity)
+		status = StatusSuccess
+		if !l.offer(f) {
+			status = StatusPipeNotAvailable
+		}
+	}
+	srv.mu.Unlock()
+	if status != StatusSuccess {
+		c.respond(h, status, nil, 0)
+		return
+	}
+
+	c.mu.Lock()
+	c.nextFile++
+	var fid fileID
+	binary.LittleEndian.PutUint64(fid[:], c.nextFile)
+	binary.LittleEndian.PutUint64(fid[8:], c.nextFile)
+	c.files[fid] = f
+	c.lastFile = fid
+	c.mu.Unlock()
+	// FILE_ATTRIBUTE_NORMAL
+	c.respond(h, StatusSuccess, &createResponse{CreateAction: fileOpened, FileAttributes: 0x80, FileID: fid}, 0)
+}
+
+// queueStatus converts the result of a read from or a write to a pipe into the status the client receives
+func queueStatus(err error) StatusError {
+	switch err {
+	case nil:
+		return StatusSuccess
+	case npipe.ErrMoreData:
+		return StatusBufferOverflow
+	case errInterrupted:
+		return StatusCancelled
+	case io.EOF:
+		// The server end closed the pipe and the client read the remaining data
+		return StatusPipeBroken
+	case errReaderClosed:
+		// The client closed the pipe while reading, or the server end closed it while the client writes
+		return StatusPipeClosing
+	case errWriterClosed:
+		return StatusFileClosed
+	}
+	return StatusInvalidParameter
+}
+
+// read answers READ, asynchronously if the pipe is empty
+func (c *serverConn) read(h *header, msg []byte) {
+	var req readRequest
+	if !c.check(h, true) || !c.decode(h, msg, &req) {
+		return
+	}
+	f := c.file(h, req.FileID)
+	if f == nil {
+		return
+	}
+	length := req.Length
+	if length > maxIOSize {
+		length = maxIOSize
+	}
+	buf := make([]byte, length)
+	result := func(n int, err error) (StatusError, message) {
+		status := queueStatus(err)
+		if status == StatusSuccess || status == StatusBufferOverflow {
+			return status, &readResponse{Data: buf[:n]}
+		}
+		return status, nil
+	}
+	n, err := f.out.read(buf, false, nil)
+	if err != errWouldBlock {
+		status, body := result(n, err)
+		c.respond(h, status, body, 0)
+		return
+	}
+	c.async(h, func(cancel <-chan struct{}) (StatusError, message) {
+		return result(f.out.read(buf, true, cancel))
+	})
+}
+
+// write answers WRITE, asynchronously if the pipe's buffer is full
+func (c *serverConn) write(h *header, msg []byte) {
+	var req writeRequest
+	if !c.check(h, true) || !c.decode(h, msg, &req) {
+		return
+	}
+	f := c.file(h, req.FileID)
+	if f == nil {
+		return
+	}
+	result := func(n int, err error) (StatusError, message) {
+		if status := queueStatus(err); status != StatusSuccess {
+			return status, nil
+		}
+		return StatusSuccess, &writeResponse{Count: uint32(n)}
+	}
+	n, err := f.in.write(req.Data, false, nil)
+	if err != errWouldBlock {
+		status, body := result(n, err)
+		c.respond(h, status, body, 0)
+		return
+	}
+	c.async(h, func(cancel <-chan struct{}) (StatusError, message) {
+		return result(f.in.write(req.Data, true, cancel))
+	})
+}
+
+// ioctl answers the pipe transactions and waits, and the validation of the negotiation
+func (c *serverConn) ioctl(h *header, msg []byte) error {
+	var req ioctlRequest
+	if !c.check(h, true) || !c.decode(h, msg, &req) {
+		return nil
+	}
+	switch req.CtlCode {
+	case fsctlPipeTransceive:
+		f := c.file(h, req.FileID)
+		if f == nil {
+			return nil
+		}
+		if !f.in.message {
+			c.respond(h, StatusInvalidPipeState, nil, 0)
+			return nil
+		}
+		if f.out.buffered() > 0 {
+			// Transactions fail while the client has unread data
+			c.respond(h, StatusPipeBusy, nil, 0)
+			return nil
+		}
+		max := req.MaxOutput
+		if max > maxIOSize {
+			max = maxIOSize
+		}
+		c.async(h, func(cancel <-chan struct{}) (StatusError, message) {
+			if _, err := f.in.write(req.Input, true, cancel); err != nil {
+				return queueStatus(err), nil
+			}
+			buf := make([]byte, max)
+			n, err := f.out.read(buf, true, cancel)
+			status := queueStatus(err)
+			if status != StatusSuccess && status != StatusBufferOverflow {
+				return status, nil
+			}
+			return status, &ioctlResponse{CtlCode: req.CtlCode, FileID: req.FileID, Output: buf[:n]}
+		})
+
+	case fsctlPipeWait:
+		// FSCTL_PIPE_WAIT_BUFFER: timeout, name length, timeout specified, padding, and the name
+		if len(req.Input) < 14 || len(req.Input) < 14+int(binary.LittleEndian.Uint32(req.Input[8:])) {
+			c.respond(h, StatusInvalidParameter, nil, 0)
+			return nil
+		}
+		name := decodeUTF16(req.Input[14 : 14+binary.LittleEndian.Uint32(req.Input[8:])])
+		if c.srv.listener(strings.TrimLeft(name, `\`)) == nil {
+			c.respond(h, StatusObjectNameNotFound, nil, 0)
+			return nil
+		}
+		c.respond(h, StatusSuccess, &ioctlResponse{CtlCode: req.CtlCode, FileID: req.FileID}, 0)
+
+	case fsctlValidateNegotiateInfo:
+		// VALIDATE_NEGOTIATE_INFO: capabilities, client GUID, security mode, dialect count, and the dialects
+		in := req.Input
+		if len(in) < 24 || len(in) < 24+2*int(binary.LittleEndian.Uint16(in[22:])) {
+			return fmt.Errorf("invalid VALIDATE_NEGOTIATE_INFO request")
+		}
+		valid := binary.LittleEndian.Uint32(in) == c.clientCapabilities && bytes.Equal(in[4:20], c.clientGUID[:]) &&
+			binary.LittleEndian.Uint16(in[20:]) == c.clientSecurityMode &&
+			int(binary.LittleEndian.Uint16(in[22:])) == len(c.clientDialects)
+		for i := 0; valid && i < len(c.clientDialects); i++ {
+			valid = binary.LittleEndian.Uint16(in[24+2*i:]) == c.clientDialects[i]
+		}
+		if !valid {
+			return fmt.Errorf("VALIDATE_NEGOTIATE_INFO doesn't match the negotiation")
+		}
+		resp := c.negotiateResponse(&negotiateResponse{})
+		out := binary.LittleEndian.AppendUint32(nil, 0)
+		out = append(out, resp.ServerGUID[:]...)
+		out = binary.LittleEndian.AppendUint16(out, resp.SecurityMode)
+		out = binary.LittleEndian.AppendUint16(out, c.dialect)
+		c.respond(h, StatusSuccess, &ioctlResponse{CtlCode: req.CtlCode, FileID: req.FileID, Output: out}, 0)
+
+	default:
+		c.respond(h, StatusInvalidDeviceRequest, nil, 0)
+	}
+	return nil
+}
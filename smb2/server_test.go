@@ -0,0 +1,491 @@
+//go:build windows || linux
+
+package smb2
+
+import (
+	// Standard
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// echoMessages echoes every message read from conn
+func echoMessages(conn net.Conn) {
+	buf := make([]byte, 128*1024)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err = conn.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// users is the password callback of the test servers
+func users(user, domain string) (string, bool) {
+	return "secret", user == "alice"
+}
+
+// serve serves srv on a random local port until the test ends and returns a dialer for alice
+func serve(t *testing.T, srv *Server) *Dialer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): %v", err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	go srv.Serve(ln)
+	return &Dialer{User: "alice", Password: "secret", Port: ln.Addr().(*net.TCPAddr).Port, Timeout: 5 * time.Second}
+}
+
+// handle serves every connection accepted from ln with handler
+func handle(ln net.Listener, handler func(net.Conn)) {
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+}
+
+// TestServer echoes messages between the client and a handler written against net.Listener
+func TestServer(t *testing.T) {
+	srv := &Server{Password: users}
+	d := serve(t, srv)
+	ln, err := srv.Listen(`\\.\pipe\Echo`, npipe.PipeTypeMessage|npipe.PipeReadModeMessage)
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	if ln.Addr().String() != `\\.\pipe\Echo` {
+		t.Errorf("Addr() = %s", ln.Addr())
+	}
+	if _, err = srv.Listen("echo", 0); err == nil {
+		t.Error("a second Listen() on the same pipe succeeded")
+	}
+	identities := make(chan Identity, 1)
+	go func() {
+		conn, err := ln.AcceptPipe()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		identities <- conn.Identity()
+		echoMessages(conn)
+	}()
+
+	conn, err := d.Dial(`\\127.0.0.1\pipe\echo`)
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	defer conn.Close()
+	if id := <-identities; id.User != "alice" || id.Anonymous || id.Addr == nil {
+		t.Errorf("Identity() = %+v", id)
+	}
+
+	buf := make([]byte, 8)
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read() = %q, %v", buf[:n], err)
+	}
+	if _, err = conn.Write([]byte("a longer message")); err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+	n, err := conn.Read(buf)
+	if !errors.Is(err, npipe.ErrMoreData) || string(buf[:n]) != "a longer" {
+		t.Fatalf("expected ErrMoreData but received %q, %v", buf[:n], err)
+	}
+	if n, err = conn.Read(buf); err != nil || string(buf[:n]) != " message" {
+		t.Fatalf("Read() of the rest = %q, %v", buf[:n], err)
+	}
+	if n, err = conn.Transact(context.Background(), []byte("transact"), buf); err != nil || string(buf[:n]) != "transact" {
+		t.Fatalf("Transact() = %q, %v", buf[:n], err)
+	}
+}
+
+// TestServerSigning streams data through a byte mode pipe with signing required in every dialect
+func TestServerSigning(t *testing.T) {
+	for _, dialect := range []uint16{Dialect202, Dialect210, Dialect300, Dialect302} {
+		t.Run(strconv.FormatUint(uint64(dialect), 16), func(t *testing.T) {
+			srv := &Server{Password: users, RequireSigning: true, MaxDialect: dialect}
+			d := serve(t, srv)
+			ln, err := srv.Listen("stream", npipe.PipeTypeByte)
+			if err != nil {
+				t.Fatalf("Listen(): %v", err)
+			}
+			handle(ln, func(conn net.Conn) { io.Copy(conn, conn) })
+
+			s, err := d.Session("127.0.0.1")
+			if err != nil {
+				t.Fatalf("Session(): %v", err)
+			}
+			defer s.Close()
+			if s.Dialect() != dialect || !s.Signed() {
+				t.Fatalf("Dialect() = 0x%04x, Signed() = %t", s.Dialect(), s.Signed())
+			}
+			conn, err := s.Open("stream")
+			if err != nil {
+				t.Fatalf("Open(): %v", err)
+			}
+			defer conn.Close()
+
+			data := bytes.Repeat([]byte("signed stream "), 20000)
+			errc := make(chan error, 1)
+			go func() {
+				_, err := conn.Write(data)
+				errc <- err
+			}()
+			got := make([]byte, len(data))
+			if _, err = io.ReadFull(conn, got); err != nil {
+				t.Fatalf("ReadFull(): %v", err)
+			}
+			if err = <-errc; err != nil {
+				t.Fatalf("Write(): %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("the echoed data differs")
+			}
+		})
+	}
+}
+
+// TestServerClose tests closing either end of a pipe and closing the listener
+func TestServerClose(t *testing.T) {
+	srv := &Server{Password: users}
+	d := serve(t, srv)
+	ln, err := srv.Listen("close", npipe.PipeTypeMessage)
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	s, err := d.Session("127.0.0.1")
+	if err != nil {
+		t.Fatalf("Session(): %v", err)
+	}
+	defer s.Close()
+
+	// The server writes and closes, the client reads the data and then io.EOF
+	client, err := s.Open("close")
+	if err != nil {
+		t.Fatalf("Open(): %v", err)
+	}
+	server, err := ln.AcceptPipe()
+	if err != nil {
+		t.Fatalf("AcceptPipe(): %v", err)
+	}
+	server.Write([]byte("bye"))
+	server.Close()
+	buf := make([]byte, 8)
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != "bye" {
+		t.Fatalf("Read() = %q, %v", buf[:n], err)
+	}
+	if _, err = client.Read(buf); err != io.EOF {
+		t.Fatalf("expected io.EOF after the server closed but received %v", err)
+	}
+	if _, err = server.Read(buf); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected net.ErrClosed from the closed server end but received %v", err)
+	}
+	client.Close()
+
+	// The client closes, the server reads io.EOF and can't write
+	client, err = s.Open("close")
+	if err != nil {
+		t.Fatalf("Open(): %v", err)
+	}
+	if server, err = ln.AcceptPipe(); err != nil {
+		t.Fatalf("AcceptPipe(): %v", err)
+	}
+	client.Write([]byte("last"))
+	client.Close()
+	if n, err := server.Read(buf); err != nil || string(buf[:n]) != "last" {
+		t.Fatalf("Read() = %q, %v", buf[:n], err)
+	}
+	if _, err = server.Read(buf); err != io.EOF {
+		t.Fatalf("expected io.EOF after the client closed but received %v", err)
+	}
+	if _, err = server.Write([]byte("lost")); err != io.ErrClosedPipe {
+		t.Fatalf("expected io.ErrClosedPipe but received %v", err)
+	}
+	server.Close()
+
+	ln.Close()
+	if _, err = ln.Accept(); err != npipe.ErrClosed {
+		t.Fatalf("expected npipe.ErrClosed from Accept() but received %v", err)
+	}
+	if _, err = s.Open("close"); !errors.Is(err, StatusObjectNameNotFound) {
+		t.Fatalf("expected STATUS_OBJECT_NAME_NOT_FOUND after Close but received %v", err)
+	}
+}
+
+// TestServerDeadlines cancels a client read waiting on the server and times out a read on the server end
+func TestServerDeadlines(t *testing.T) {
+	srv := &Server{Password: users}
+	d := serve(t, srv)
+	ln, err := srv.Listen("slow", npipe.PipeTypeMessage)
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	client, err := d.Dial(`\\127.0.0.1\pipe\slow`)
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	defer client.Close()
+	server, err := ln.AcceptPipe()
+	if err != nil {
+		t.Fatalf("AcceptPipe(): %v", err)
+	}
+	defer server.Close()
+
+	var netErr net.Error
+	buf := make([]byte, 8)
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err = client.Read(buf); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected a timeout from the client but received %v", err)
+	}
+	server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err = server.Read(buf); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected a timeout from the server end but received %v", err)
+	}
+
+	// Neither cancelled read consumed a message
+	client.SetReadDeadline(time.Time{})
+	server.SetReadDeadline(time.Time{})
+	server.Write([]byte("ping"))
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("Read() = %q, %v", buf[:n], err)
+	}
+	client.Write([]byte("pong"))
+	if n, err := server.Read(buf); err != nil || string(buf[:n]) != "pong" {
+		t.Fatalf("Read() = %q, %v", buf[:n], err)
+	}
+}
+
+// TestServerErrors tests authentication failures, anonymous sessions, missing pipes, and a full backlog
+func TestServerErrors(t *testing.T) {
+	d := serve(t, &Server{Password: users})
+	wrong := *d
+	wrong.Password = "wrong"
+	if _, err := wrong.Session("127.0.0.1"); err == nil || !strings.Contains(err.Error(), StatusLogonFailure.Error()) {
+		t.Fatalf("expected a logon failure but received %v", err)
+	}
+	d.User, d.Password = "", ""
+	if _, err := d.Session("127.0.0.1"); err == nil {
+		t.Fatal("an anonymous session was accepted")
+	}
+
+	srv := &Server{AllowAnonymous: true}
+	d = serve(t, srv)
+	d.User, d.Password = "", ""
+	ln, err := srv.Listen("busy", npipe.PipeTypeMessage)
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	defer ln.Close()
+	s, err := d.Session("127.0.0.1")
+	if err != nil {
+		t.Fatalf("anonymous Session(): %v", err)
+	}
+	defer s.Close()
+
+	if _, err = s.Open("missing"); !errors.Is(err, StatusObjectNameNotFound) {
+		t.Fatalf("expected STATUS_OBJECT_NAME_NOT_FOUND but received %v", err)
+	}
+	for i := 0; i < listenBacklog; i++ {
+		if _, err = s.Open("busy"); err != nil {
+			t.Fatalf("Open() %d: %v", i, err)
+		}
+	}
+	if _, err = s.Open("busy"); !errors.Is(err, StatusPipeNotAvailable) {
+		t.Fatalf("expected STATUS_PIPE_NOT_AVAILABLE with a full backlog but received %v", err)
+	}
+	conn, err := ln.AcceptPipe()
+	if err != nil {
+		t.Fatalf("AcceptPipe(): %v", err)
+	}
+	if id := conn.Identity(); !id.Anonymous || id.User != "" {
+		t.Errorf("Identity() = %+v", id)
+	}
+	conn.Close()
+	if _, err = s.Open("busy"); err != nil {
+		t.Fatalf("Open() after Accept: %v", err)
+	}
+}
+
+// TestServerNegotiate answers an SMB1 NEGOTIATE offering SMB2 with the wildcard dialect, then validates the
+// negotiation of an SMB 3 session
+func TestServerNegotiate(t *testing.T) {
+	srv := &Server{Password: users}
+	client, server := net.Pipe()
+	defer client.Close()
+	go srv.ServeConn(server)
+
+	// SMB1 NEGOTIATE as sent by Windows: the header, a word count of 0, the byte count, and the dialects
+	offered := []byte("\x02NT LM 0.12\x00\x02SMB 2.002\x00\x02SMB 2.???\x00")
+	smb1 := append([]byte{0xff, 'S', 'M', 'B', 0x72}, make([]byte, 27)...)
+	smb1 = append(smb1, 0)
+	smb1 = binary.LittleEndian.AppendUint16(smb1, uint16(len(offered)))
+	smb1 = append(smb1, offered...)
+	if err := writeMessage(client, smb1); err != nil {
+		t.Fatalf("writeMessage(): %v", err)
+	}
+	var resp negotiateResponse
+	msg, err := readMessage(client)
+	if err == nil {
+		_, err = decodeResponse(msg, &resp)
+	}
+	if err != nil || resp.Dialect != dialectWildcard {
+		t.Fatalf("NEGOTIATE response to SMB1 = dialect 0x%04x, %v", resp.Dialect, err)
+	}
+
+	req := &negotiateRequest{SecurityMode: signingEnabled, Capabilities: 0x44, ClientGUID: [16]byte{7}, Dialects: dialects}
+	if err = writeMessage(client, req.marshal(appendHeader(nil, &header{Command: cmdNegotiate, MessageID: 1}))); err != nil {
+		t.Fatalf("writeMessage(): %v", err)
+	}
+	if msg, err = readMessage(client); err == nil {
+		_, err = decodeResponse(msg, &resp)
+	}
+	if err != nil || resp.Dialect != Dialect302 {
+		t.Fatalf("NEGOTIATE = dialect 0x%04x, %v", resp.Dialect, err)
+	}
+
+	// VALIDATE_NEGOTIATE_INFO is checked against the negotiation and answered with the server's side of it
+	validate := binary.LittleEndian.AppendUint32(nil, req.Capabilities)
+	validate = append(validate, req.ClientGUID[:]...)
+	validate = binary.LittleEndian.AppendUint16(validate, req.SecurityMode)
+	validate = binary.LittleEndian.AppendUint16(validate, uint16(len(req.Dialects)))
+	for _, d := range req.Dialects {
+		validate = binary.LittleEndian.AppendUint16(validate, d)
+	}
+	var out []byte
+	srv.mu.Lock()
+	var conns []*serverConn
+	for c := range srv.conns {
+		conns = append(conns, c)
+	}
+	srv.mu.Unlock()
+	for _, c := range conns {
+		// Skip the session setup by authenticating the connection directly
+		c.mu.Lock()
+		c.sessionID, c.treeID, c.identity = 1, 1, &Identity{}
+		c.mu.Unlock()
+	}
+	ioctl := &ioctlRequest{CtlCode: fsctlValidateNegotiateInfo, FileID: allFiles, Input: validate, MaxOutput: 24, Flags: ioctlIsFsctl}
+	if err = writeMessage(client, ioctl.marshal(appendHeader(nil, &header{Command: cmdIoctl, MessageID: 2, TreeID: 1, SessionID: 1}))); err != nil {
+		t.Fatalf("writeMessage(): %v", err)
+	}
+	var ioctlResp ioctlResponse
+	if msg, err = readMessage(client); err == nil {
+		_, err = decodeResponse(msg, &ioctlResp)
+	}
+	if out = ioctlResp.Output; err != nil || len(out) != 24 {
+		t.Fatalf("VALIDATE_NEGOTIATE_INFO = %x, %v", out, err)
+	}
+	if !bytes.Equal(out[4:20], resp.ServerGUID[:]) || binary.LittleEndian.Uint16(out[22:]) != Dialect302 {
+		t.Fatalf("VALIDATE_NEGOTIATE_INFO returned %x", out)
+	}
+
+	// A mismatch ends the connection
+	validate[0] ^= 1
+	ioctl.Input = validate
+	writeMessage(client, ioctl.marshal(appendHeader(nil, &header{Command: cmdIoctl, MessageID: 3, TreeID: 1, SessionID: 1})))
+	if _, err = readMessage(client); err == nil {
+		t.Fatal("the server answered a VALIDATE_NEGOTIATE_INFO that doesn't match the negotiation")
+	}
+}
+
+// tamper returns a dialer that reaches the server of d through a man in the middle that passes every message through
+// rewrite before relaying it
+func tamper(t *testing.T, d *Dialer, rewrite func(h *header, msg []byte)) *Dialer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	relay := func(dst, src net.Conn) {
+		defer dst.Close()
+		defer src.Close()
+		for {
+			msg, err := readMessage(src)
+			if err != nil {
+				return
+			}
+			if h, err := parseHeader(msg); err == nil {
+				rewrite(h, msg)
+			}
+			if err = writeMessage(dst, msg); err != nil {
+				return
+			}
+		}
+	}
+	handle(ln, func(client net.Conn) {
+		server, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(d.Port)))
+		if err != nil {
+			return
+		}
+		go relay(server, client)
+		relay(client, server)
+	})
+	tampered := *d
+	tampered.Port = ln.Addr().(*net.TCPAddr).Port
+	return &tampered
+}
+
+// TestValidateNegotiate tests that the client has the server validate the negotiation of SMB 3 sessions, which
+// detects a man in the middle that tampered with it
+func TestValidateNegotiate(t *testing.T) {
+	srv := &Server{Password: users}
+	d := serve(t, srv)
+	s, err := d.Session("127.0.0.1")
+	if err != nil {
+		t.Fatalf("Session(): %v", err)
+	}
+	if s.Dialect() != Dialect302 {
+		t.Errorf("Dialect() = 0x%04x", s.Dialect())
+	}
+	s.Close()
+
+	// Downgrading the dialect the server selected goes unnoticed until the server reports its side of the negotiation
+	downgraded := tamper(t, d, func(h *header, msg []byte) {
+		if h.Command == cmdNegotiate && h.Flags&flagResponse != 0 {
+			binary.LittleEndian.PutUint16(msg[headerSize+4:], Dialect300)
+		}
+	})
+	if s, err = downgraded.Session("127.0.0.1"); err == nil {
+		s.Close()
+		t.Fatal("a session whose NEGOTIATE response was downgraded to SMB 3.0 was established")
+	}
+	if !strings.Contains(err.Error(), "VALIDATE_NEGOTIATE_INFO") {
+		t.Errorf("Session() with a downgraded NEGOTIATE response = %v; want a failed validation", err)
+	}
+
+	// The server ends the connection when the dialects it saw differ from the ones the client offered
+	stripped := tamper(t, d, func(h *header, msg []byte) {
+		if h.Command == cmdNegotiate && h.Flags&flagResponse == 0 {
+			binary.LittleEndian.PutUint16(msg[headerSize+2:], uint16(len(dialects)-1))
+		}
+	})
+	if s, err = stripped.Session("127.0.0.1"); err == nil {
+		s.Close()
+		t.Fatal("a session whose NEGOTIATE request lost the highest dialect was established")
+	}
+	if !strings.Contains(err.Error(), "VALIDATE_NEGOTIATE_INFO failed") {
+		t.Errorf("Session() with a stripped NEGOTIATE request = %v; want the server to reject the validation", err)
+	}
+}
@@ -0,0 +1,130 @@
+package smb2
+
+import (
+	// Standard
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+)
+
+// signer signs and verifies the messages of a session
+type signer struct {
+	dialect uint16
+	key     []byte
+}
+
+// newSigner derives the signing key of a session from its session key. SMB 2 signs with HMAC-SHA256 of the session
+// key, SMB 3 with AES-CMAC of a key derived from it.
+func newSigner(dialect uint16, sessionKey []byte) *signer {
+	key := sessionKey
+	if len(key) > 16 {
+		key = key[:16]
+	}
+	if dialect >= Dialect300 {
+		key = kdf(key, []byte("SMB2AESCMAC\x00"), []byte("SmbSign\x00"))
+	}
+	return &signer{dialect: dialect, key: key}
+}
+
+// signature returns the signature of msg, computed with the signature field zeroed
+func (s *signer) signature(msg []byte) [16]byte {
+	var zero [16]byte
+	saved := append([]byte(nil), msg[48:64]...)
+	copy(msg[48:64], zero[:])
+	defer copy(msg[48:64], saved)
+
+	var sig [16]byte
+	if s.dialect >= Dialect300 {
+		sig = cmac(s.key, msg)
+	} else {
+		mac := hmac.New(sha256.New, s.key)
+		mac.Write(msg)
+		copy(sig[:], mac.Sum(nil))
+	}
+	return sig
+}
+
+// sign sets the signed flag and the signature of msg
+func (s *signer) sign(msg []byte) {
+	binary.LittleEndian.PutUint32(msg[16:], binary.LittleEndian.Uint32(msg[16:])|flagSigned)
+	sig := s.signature(msg)
+	copy(msg[48:64], sig[:])
+}
+
+// verify checks the signature of a signed message
+func (s *signer) verify(msg []byte) error {
+	sig := s.signature(msg)
+	if subtle.ConstantTimeCompare(sig[:], msg[48:64]) != 1 {
+		return fmt.Errorf("invalid signature %x", msg[48:64])
+	}
+	return nil
+}
+
+// kdf is the SP800-108 key derivation function in counter mode with HMAC-SHA256 that derives the 128-bit SMB 3 keys
+func kdf(key, label, context []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte{0, 0, 0, 1})
+	mac.Write(label)
+	mac.Write([]byte{0})
+	mac.Write(context)
+	mac.Write([]byte{0, 0, 0, 128})
+	return mac.Sum(nil)[:16]
+}
+
+// cmac returns the AES-CMAC of msg (RFC 4493)
+func cmac(key, msg []byte) [16]byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		// The keys are always 16 bytes long
+		panic(err)
+	}
+
+	// Derive the subkeys from the encrypted zero block
+	var l, k1, k2 [16]byte
+	block.Encrypt(l[:], l[:])
+	shift := func(dst, src *[16]byte) {
+		carry := src[0] >> 7
+		for i := 0; i < 15; i++ {
+			dst[i] = src[i]<<1 | src[i+1]>>7
+		}
+		dst[15] = src[15] << 1
+		if carry != 0 {
+			dst[15] ^= 0x87
+		}
+	}
+	shift(&k1, &l)
+	shift(&k2, &k1)
+
+	// Every block but the last is chained as is; the last is xored with k1 if complete, or padded and xored with k2
+	n := (len(msg) + 15) / 16
+	complete := n > 0 && len(msg)%16 == 0
+	if n == 0 {
+		n = 1
+	}
+	var x [16]byte
+	for i := 0; i < n-1; i++ {
+		xorBytes(x[:], x[:], msg[16*i:16*i+16])
+		block.Encrypt(x[:], x[:])
+	}
+	var last [16]byte
+	copy(last[:], msg[16*(n-1):])
+	if complete {
+		xorBytes(last[:], last[:], k1[:])
+	} else {
+		last[len(msg)-16*(n-1)] = 0x80
+		xorBytes(last[:], last[:], k2[:])
+	}
+	xorBytes(x[:], x[:], last[:])
+	block.Encrypt(x[:], x[:])
+	return x
+}
+
+// xorBytes sets dst[i] = a[i] ^ b[i] for the 16 bytes of a block
+func xorBytes(dst, a, b []byte) {
+	for i := 0; i < 16; i++ {
+		dst[i] = a[i] ^ b[i]
+	}
+}
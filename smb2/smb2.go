@@ -0,0 +1,284 @@
+// Package smb2 reaches named pipes on remote computers over SMB 2 and 3, the protocol the Windows redirector uses
+// for \\<computer>\pipe\<name> addresses, so pipes on Windows hosts can be used from any platform.
+//
+// A Dialer authenticates with NTLM, connects to the IPC$ share, and opens the pipe as a file whose reads and writes
+// become SMB2 READ and WRITE requests:
+//
+//	d := &smb2.Dialer{User: "alice", Password: "secret", Domain: "CORP"}
+//	conn, err := d.Dial(`\\fileserver\pipe\srvsvc`)
+//
+// Several pipes can share one authenticated session:
+//
+//	s, err := d.Session("fileserver")
+//	lsarpc, err := s.Open("lsarpc")
+//	samr, err := s.Open("samr")
+//
+// The dialects 2.0.2, 2.1, 3.0, and 3.0.2 are offered and messages are signed when either end requires it.
+// Authenticated SMB 3 sessions have the server validate the negotiation, so a man in the middle can't downgrade it
+// unnoticed.
+// Encryption and the 3.1.1 dialect are not supported; servers that require encryption refuse the session.
+//
+// Reads of message mode pipes that return part of a message return npipe.ErrMoreData like local pipes do.
+//
+// Server is the other end: it serves the IPC$ share to remote clients and hands each pipe they open to the Listener
+// registered for its name, so the same Accept loop serves local and SMB clients.
+package smb2
+
+import (
+	// Standard
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Dialects
+const (
+	Dialect202 uint16 = 0x0202
+	Dialect210 uint16 = 0x0210
+	Dialect300 uint16 = 0x0300
+	Dialect302 uint16 = 0x0302
+)
+
+// dialects are the dialects the client offers, the server picks the highest it supports
+var dialects = []uint16{Dialect202, Dialect210, Dialect300, Dialect302}
+
+// Commands
+const (
+	cmdNegotiate      uint16 = 0x0000
+	cmdSessionSetup   uint16 = 0x0001
+	cmdLogoff         uint16 = 0x0002
+	cmdTreeConnect    uint16 = 0x0003
+	cmdTreeDisconnect uint16 = 0x0004
+	cmdCreate         uint16 = 0x0005
+	cmdClose          uint16 = 0x0006
+	cmdFlush          uint16 = 0x0007
+	cmdRead           uint16 = 0x0008
+	cmdWrite          uint16 = 0x0009
+	cmdIoctl          uint16 = 0x000b
+	cmdCancel         uint16 = 0x000c
+	cmdEcho           uint16 = 0x000d
+)
+
+// Header flags
+const (
+	flagResponse uint32 = 0x00000001
+	flagAsync    uint32 = 0x00000002
+	flagRelated  uint32 = 0x00000004
+	flagSigned   uint32 = 0x00000008
+)
+
+// Security modes of NEGOTIATE and SESSION_SETUP
+const (
+	signingEnabled  uint16 = 0x0001
+	signingRequired uint16 = 0x0002
+)
+
+// Session flags of the SESSION_SETUP response
+const (
+	sessionGuest   uint16 = 0x0001
+	sessionNull    uint16 = 0x0002
+	sessionEncrypt uint16 = 0x0004
+)
+
+// Share types of the TREE_CONNECT response
+const (
+	shareTypeDisk  uint8 = 0x01
+	shareTypePipe  uint8 = 0x02
+	shareTypePrint uint8 = 0x03
+)
+
+// File system control codes
+const (
+	fsctlPipeTransceive uint32 = 0x0011c017
+	fsctlPipeWait       uint32 = 0x00110018
+	// fsctlValidateNegotiateInfo lets SMB 3 clients verify that the negotiation wasn't tampered with
+	fsctlValidateNegotiateInfo uint32 = 0x00140204
+	ioctlIsFsctl               uint32 = 0x00000001
+)
+
+// NT status codes the server returns as errors
+const (
+	StatusSuccess                StatusError = 0x00000000
+	StatusPending                StatusError = 0x00000103
+	StatusBufferOverflow         StatusError = 0x80000005
+	StatusNotImplemented         StatusError = 0xc0000002
+	StatusInvalidHandle          StatusError = 0xc0000008
+	StatusInvalidParameter       StatusError = 0xc000000d
+	StatusInvalidDeviceRequest   StatusError = 0xc0000010
+	StatusEndOfFile              StatusError = 0xc0000011
+	StatusMoreProcessingRequired StatusError = 0xc0000016
+	StatusAccessDenied           StatusError = 0xc0000022
+	StatusObjectNameNotFound     StatusError = 0xc0000034
+	StatusLogonFailure           StatusError = 0xc000006d
+	StatusInsufficientResources  StatusError = 0xc000009a
+	StatusPipeNotAvailable       StatusError = 0xc00000ac
+	StatusInvalidPipeState       StatusError = 0xc00000ad
+	StatusPipeBusy               StatusError = 0xc00000ae
+	StatusPipeDisconnected       StatusError = 0xc00000b0
+	StatusPipeClosing            StatusError = 0xc00000b1
+	StatusIOTimeout              StatusError = 0xc00000b5
+	StatusNotSupported           StatusError = 0xc00000bb
+	StatusNetworkNameDeleted     StatusError = 0xc00000c9
+	StatusBadNetworkName         StatusError = 0xc00000cc
+	StatusRequestNotAccepted     StatusError = 0xc00000d0
+	StatusPipeEmpty              StatusError = 0xc00000d9
+	StatusCancelled              StatusError = 0xc0000120
+	StatusFileClosed             StatusError = 0xc0000128
+	StatusPipeBroken             StatusError = 0xc000014b
+	StatusUserSessionDeleted     StatusError = 0xc0000203
+)
+
+// statusNames are the names of the status codes for error messages
+var statusNames = map[StatusError]string{
+	StatusSuccess:                "STATUS_SUCCESS",
+	StatusPending:                "STATUS_PENDING",
+	StatusBufferOverflow:         "STATUS_BUFFER_OVERFLOW",
+	StatusNotImplemented:         "STATUS_NOT_IMPLEMENTED",
+	StatusInvalidHandle:          "STATUS_INVALID_HANDLE",
+	StatusInvalidParameter:       "STATUS_INVALID_PARAMETER",
+	StatusInvalidDeviceRequest:   "STATUS_INVALID_DEVICE_REQUEST",
+	StatusEndOfFile:              "STATUS_END_OF_FILE",
+	StatusMoreProcessingRequired: "STATUS_MORE_PROCESSING_REQUIRED",
+	StatusAccessDenied:           "STATUS_ACCESS_DENIED",
+	StatusObjectNameNotFound:     "STATUS_OBJECT_NAME_NOT_FOUND",
+	StatusLogonFailure:           "STATUS_LOGON_FAILURE",
+	StatusInsufficientResources:  "STATUS_INSUFFICIENT_RESOURCES",
+	StatusPipeNotAvailable:       "STATUS_PIPE_NOT_AVAILABLE",
+	StatusInvalidPipeState:       "STATUS_INVALID_PIPE_STATE",
+	StatusPipeBusy:               "STATUS_PIPE_BUSY",
+	StatusPipeDisconnected:       "STATUS_PIPE_DISCONNECTED",
+	StatusPipeClosing:            "STATUS_PIPE_CLOSING",
+	StatusIOTimeout:              "STATUS_IO_TIMEOUT",
+	StatusNotSupported:           "STATUS_NOT_SUPPORTED",
+	StatusNetworkNameDeleted:     "STATUS_NETWORK_NAME_DELETED",
+	StatusBadNetworkName:         "STATUS_BAD_NETWORK_NAME",
+	StatusRequestNotAccepted:     "STATUS_REQUEST_NOT_ACCEPTED",
+	StatusPipeEmpty:              "STATUS_PIPE_EMPTY",
+	StatusCancelled:              "STATUS_CANCELLED",
+	StatusFileClosed:             "STATUS_FILE_CLOSED",
+	StatusPipeBroken:             "STATUS_PIPE_BROKEN",
+	StatusUserSessionDeleted:     "STATUS_USER_SESSION_DELETED",
+}
+
+// StatusError is an NT status code returned by the server
+type StatusError uint32
+
+// Error implements the error interface
+func (e StatusError) Error() string {
+	if name, ok := statusNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("NT status 0x%08x", uint32(e))
+}
+
+// headerSize is the size of the SMB2 header
+const headerSize = 64
+
+// protocolID starts every SMB2 message
+var protocolID = [4]byte{0xfe, 'S', 'M', 'B'}
+
+// header is the SMB2 packet header. AsyncID replaces the process and tree IDs of the synchronous header when
+// flagAsync is set.
+type header struct {
+	CreditCharge uint16
+	Status       StatusError
+	Command      uint16
+	Credits      uint16
+	Flags        uint32
+	NextCommand  uint32
+	MessageID    uint64
+	AsyncID      uint64
+	TreeID       uint32
+	SessionID    uint64
+	Signature    [16]byte
+}
+
+// appendHeader appends the encoded header to b
+func appendHeader(b []byte, h *header) []byte {
+	b = append(b, protocolID[:]...)
+	b = binary.LittleEndian.AppendUint16(b, headerSize)
+	b = binary.LittleEndian.AppendUint16(b, h.CreditCharge)
+	b = binary.LittleEndian.AppendUint32(b, uint32(h.Status))
+	b = binary.LittleEndian.AppendUint16(b, h.Command)
+	b = binary.LittleEndian.AppendUint16(b, h.Credits)
+	b = binary.LittleEndian.AppendUint32(b, h.Flags)
+	b = binary.LittleEndian.AppendUint32(b, h.NextCommand)
+	b = binary.LittleEndian.AppendUint64(b, h.MessageID)
+	if h.Flags&flagAsync != 0 {
+		b = binary.LittleEndian.AppendUint64(b, h.AsyncID)
+	} else {
+		b = binary.LittleEndian.AppendUint32(b, 0)
+		b = binary.LittleEndian.AppendUint32(b, h.TreeID)
+	}
+	b = binary.LittleEndian.AppendUint64(b, h.SessionID)
+	return append(b, h.Signature[:]...)
+}
+
+// parseHeader decodes the header at the start of msg
+func parseHeader(msg []byte) (*header, error) {
+	if len(msg) < headerSize {
+		return nil, fmt.Errorf("the %d byte message is shorter than an SMB2 header", len(msg))
+	}
+	if [4]byte{msg[0], msg[1], msg[2], msg[3]} != protocolID {
+		return nil, fmt.Errorf("the message doesn't start with the SMB2 protocol ID but with %x", msg[:4])
+	}
+	if size := binary.LittleEndian.Uint16(msg[4:]); size != headerSize {
+		return nil, fmt.Errorf("invalid header size %d", size)
+	}
+	h := &header{
+		CreditCharge: binary.LittleEndian.Uint16(msg[6:]),
+		Status:       StatusError(binary.LittleEndian.Uint32(msg[8:])),
+		Command:      binary.LittleEndian.Uint16(msg[12:]),
+		Credits:      binary.LittleEndian.Uint16(msg[14:]),
+		Flags:        binary.LittleEndian.Uint32(msg[16:]),
+		NextCommand:  binary.LittleEndian.Uint32(msg[20:]),
+		MessageID:    binary.LittleEndian.Uint64(msg[24:]),
+		SessionID:    binary.LittleEndian.Uint64(msg[40:]),
+	}
+	if h.Flags&flagAsync != 0 {
+		h.AsyncID = binary.LittleEndian.Uint64(msg[32:])
+	} else {
+		h.TreeID = binary.LittleEndian.Uint32(msg[36:])
+	}
+	copy(h.Signature[:], msg[48:64])
+	return h, nil
+}
+
+// maxMessageSize bounds the messages read from the transport. Reads and writes are limited to maxIOSize so the
+// largest legitimate message is a little over 64 KiB, but a server may answer NEGOTIATE with larger buffers.
+const maxMessageSize = 1 << 20
+
+// writeMessage writes msg with the 4 byte Direct TCP transport header
+func writeMessage(w io.Writer, msg []byte) error {
+	if len(msg) > 0xffffff {
+		return fmt.Errorf("the %d byte message is too large for the transport", len(msg))
+	}
+	frame := make([]byte, 4, 4+len(msg))
+	binary.BigEndian.PutUint32(frame, uint32(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
+
+// readMessage reads a message framed with the Direct TCP transport header
+func readMessage(r io.Reader) ([]byte, error) {
+	var frame [4]byte
+	if _, err := io.ReadFull(r, frame[:]); err != nil {
+		return nil, err
+	}
+	if frame[0] != 0 {
+		return nil, fmt.Errorf("invalid transport header %x", frame)
+	}
+	size := binary.BigEndian.Uint32(frame[:])
+	if size > maxMessageSize {
+		return nil, fmt.Errorf("the %d byte message exceeds the limit of %d bytes", size, maxMessageSize)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,139 @@
+package smb2
+
+import (
+	// Standard
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// unhex decodes a hex dump, ignoring white space
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatalf("invalid hex: %v", err)
+	}
+	return b
+}
+
+// TestMD4 tests MD4 with the vectors of RFC 1320
+func TestMD4(t *testing.T) {
+	tests := map[string]string{
+		"":    "31d6cfe0d16ae931b73c59d7e0c089c0",
+		"a":   "bde52cb31de33e46245e05fbdbd6fb24",
+		"abc": "a448017aaf21d8525fc10ae87aa6729d",
+		"12345678901234567890123456789012345678901234567890123456789012345678901234567890": "e33b4ddc9c38f2199c3e7b164fcc0536",
+	}
+	for in, want := range tests {
+		if got := md4([]byte(in)); hex.EncodeToString(got[:]) != want {
+			t.Errorf("md4(%q) = %x, expected %s", in, got, want)
+		}
+	}
+}
+
+// TestCMAC tests AES-CMAC with the vectors of RFC 4493
+func TestCMAC(t *testing.T) {
+	key := unhex(t, "2b7e151628aed2a6abf7158809cf4f3c")
+	msg := unhex(t, `6bc1bee22e409f96e93d7e117393172a ae2d8a571e03ac9c9eb76fac45af8e51
+		30c81c46a35ce411e5fbc1191a0a52ef f69f2445df4f9b17ad2b417be66c3710`)
+	tests := []struct {
+		length int
+		want   string
+	}{
+		{0, "bb1d6929e95937287fa37d129b756746"},
+		{16, "070a16b46b4d4144f79bdd9dd04a287c"},
+		{40, "dfa66747de9ae63030ca32611497c827"},
+		{64, "51f0bebf7e3b9d92fc49741779363cfe"},
+	}
+	for _, test := range tests {
+		if got := cmac(key, msg[:test.length]); hex.EncodeToString(got[:]) != test.want {
+			t.Errorf("cmac() of %d bytes = %x, expected %s", test.length, got, test.want)
+		}
+	}
+}
+
+// TestNTLMv2 tests the NTLMv2 computations with the example of MS-NLMP section 4.2.4
+func TestNTLMv2(t *testing.T) {
+	if hash := md4(encodeUTF16("Password")); hex.EncodeToString(hash[:]) != "a4f49c406510bdcab6824ee7c30fd852" {
+		t.Fatalf("unexpected NT hash %x", hash)
+	}
+	key := ntowfv2("User", "Password", "Domain")
+	if want := unhex(t, "0c868a403bfd7a93a3001ef22ef02e3f"); !bytes.Equal(key, want) {
+		t.Fatalf("ntowfv2() = %x, expected %x", key, want)
+	}
+
+	serverChallenge := [8]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	clientChallenge := [8]byte{0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa}
+	info := unhex(t, `02000c00 44006f00 6d006100 69006e00 01000c00 53006500 72007600 65007200 00000000`)
+	nt, sessionBaseKey := ntlmv2Response(key, serverChallenge, clientChallenge, make([]byte, 8), info)
+	if want := unhex(t, "68cd0ab851e51c96aabc927bebef6a1c"); !bytes.Equal(nt[:16], want) {
+		t.Errorf("NTProofStr = %x, expected %x", nt[:16], want)
+	}
+	if want := unhex(t, "8de40ccadbc14a82f15cb0ad0de95ca3"); !bytes.Equal(sessionBaseKey, want) {
+		t.Errorf("SessionBaseKey = %x, expected %x", sessionBaseKey, want)
+	}
+	lm := hmacMD5(key, serverChallenge[:], clientChallenge[:])
+	if want := unhex(t, "86c35097ac9cec102554764a57cccc19"); !bytes.Equal(lm, want) {
+		t.Errorf("LMv2 response = %x, expected %x", lm, want)
+	}
+}
+
+// TestMessages round trips every message through marshal and unmarshal
+func TestMessages(t *testing.T) {
+	fid := fileID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	tests := []struct {
+		in, out message
+	}{
+		{&negotiateRequest{SecurityMode: signingEnabled, Capabilities: 1, ClientGUID: [16]byte{1}, Dialects: dialects}, &negotiateRequest{}},
+		{&negotiateResponse{SecurityMode: 3, Dialect: Dialect302, MaxReadSize: 1 << 16, SecurityBuffer: []byte{0x60, 0}}, &negotiateResponse{}},
+		{&sessionSetupRequest{SecurityMode: 1, PreviousSessionID: 7, SecurityBuffer: []byte("token")}, &sessionSetupRequest{}},
+		{&sessionSetupResponse{SessionFlags: sessionGuest, SecurityBuffer: []byte("token")}, &sessionSetupResponse{}},
+		{&treeConnectRequest{Path: `\\host\IPC$`}, &treeConnectRequest{}},
+		{&treeConnectResponse{ShareType: shareTypePipe, MaximalAccess: pipeAccess}, &treeConnectResponse{}},
+		{&createRequest{ImpersonationLevel: 2, DesiredAccess: pipeAccess, ShareAccess: 3, CreateDisposition: fileOpen, Name: "srvsvc"}, &createRequest{}},
+		{&createResponse{CreateAction: fileOpened, FileAttributes: 0x80, FileID: fid}, &createResponse{}},
+		{&closeRequest{FileID: fid}, &closeRequest{}},
+		{&readRequest{Length: 1024, Offset: 8, FileID: fid, MinimumCount: 1}, &readRequest{}},
+		{&readResponse{Data: []byte("data"), DataRemaining: 3}, &readResponse{}},
+		{&writeRequest{Offset: 8, FileID: fid, Data: []byte("data")}, &writeRequest{}},
+		{&writeResponse{Count: 4}, &writeResponse{}},
+		{&ioctlRequest{CtlCode: fsctlPipeTransceive, FileID: fid, Input: []byte("in"), MaxOutput: 512, Flags: ioctlIsFsctl}, &ioctlRequest{}},
+		{&ioctlResponse{CtlCode: fsctlPipeTransceive, FileID: fid, Output: []byte("out")}, &ioctlResponse{}},
+	}
+	for _, test := range tests {
+		msg := test.in.marshal(appendHeader(nil, &header{Command: cmdRead}))
+		if err := test.out.unmarshal(msg); err != nil {
+			t.Errorf("%T.unmarshal(): %v", test.out, err)
+			continue
+		}
+		if !reflect.DeepEqual(test.in, test.out) {
+			t.Errorf("%T round trip = %+v, expected %+v", test.in, test.out, test.in)
+		}
+	}
+
+	h := &header{CreditCharge: 1, Status: StatusPending, Command: cmdIoctl, Credits: 32, Flags: flagResponse | flagAsync, MessageID: 9, AsyncID: 42, SessionID: 5}
+	got, err := parseHeader(appendHeader(nil, h))
+	if err != nil || !reflect.DeepEqual(got, h) {
+		t.Errorf("parseHeader() = %+v, %v, expected %+v", got, err, h)
+	}
+}
+
+// TestSPNEGO decodes the tokens the client and the server send
+func TestSPNEGO(t *testing.T) {
+	token, err := parseSPNEGO(negTokenInit([]byte("negotiate")))
+	if err != nil || len(token.mechs) != 1 || !bytes.Equal(token.mechs[0], oidNTLMSSP) || string(token.token) != "negotiate" {
+		t.Fatalf("parseSPNEGO() of NegTokenInit = %+v, %v", token, err)
+	}
+	token, err = parseSPNEGO(negTokenResp(negAcceptIncomplete, oidNTLMSSP, bytes.Repeat([]byte("c"), 300)))
+	if err != nil || token.state != negAcceptIncomplete || len(token.token) != 300 {
+		t.Fatalf("parseSPNEGO() of NegTokenResp = %+v, %v", token, err)
+	}
+	if token, err = parseSPNEGO(negTokenResp(-1, nil, nil)); err != nil || token.state != -1 || token.token != nil {
+		t.Fatalf("parseSPNEGO() of an empty NegTokenResp = %+v, %v", token, err)
+	}
+	if _, err = parseSPNEGO([]byte{0xa1, 0x05, 0x30}); err == nil {
+		t.Fatal("parseSPNEGO() accepted a truncated token")
+	}
+}
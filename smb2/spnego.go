@@ -0,0 +1,166 @@
+package smb2
+
+import (
+	// Standard
+	"bytes"
+	"fmt"
+)
+
+// SPNEGO (RFC 4178) wraps the NTLM messages in SESSION_SETUP. Only the few DER constructs it needs are encoded by
+// hand rather than through encoding/asn1, whose handling of the explicit context tags is cumbersome.
+
+var (
+	// oidSPNEGO is 1.3.6.1.5.5.2
+	oidSPNEGO = []byte{0x06, 0x06, 0x2b, 0x06, 0x01, 0x05, 0x05, 0x02}
+	// oidNTLMSSP is 1.3.6.1.4.1.311.2.2.10
+	oidNTLMSSP = []byte{0x06, 0x0a, 0x2b, 0x06, 0x01, 0x04, 0x01, 0x82, 0x37, 0x02, 0x02, 0x0a}
+)
+
+// negState values of NegTokenResp
+const (
+	negAcceptCompleted  = 0
+	negAcceptIncomplete = 1
+	negReject           = 2
+)
+
+// tlv encodes a DER element
+func tlv(tag byte, content ...[]byte) []byte {
+	n := 0
+	for _, c := range content {
+		n += len(c)
+	}
+	b := []byte{tag}
+	switch {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n < 0x100:
+		b = append(b, 0x81, byte(n))
+	default:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	}
+	for _, c := range content {
+		b = append(b, c...)
+	}
+	return b
+}
+
+// parseTLV splits the first DER element of b into its tag and content and returns the bytes that follow it
+func parseTLV(b []byte) (tag byte, content, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, fmt.Errorf("truncated SPNEGO token")
+	}
+	tag, n, b := b[0], int(b[1]), b[2:]
+	if n >= 0x80 {
+		size := n & 0x7f
+		if size == 0 || size > 3 || len(b) < size {
+			return 0, nil, nil, fmt.Errorf("invalid SPNEGO length")
+		}
+		n = 0
+		for _, c := range b[:size] {
+			n = n<<8 | int(c)
+		}
+		b = b[size:]
+	}
+	if len(b) < n {
+		return 0, nil, nil, fmt.Errorf("truncated SPNEGO token")
+	}
+	return tag, b[:n], b[n:], nil
+}
+
+// negTokenInit returns the initial token offering NTLM with the optimistic NTLM token. Servers send it without a
+// token in the NEGOTIATE response to announce the mechanisms they support.
+func negTokenInit(mechToken []byte) []byte {
+	fields := [][]byte{tlv(0xa0, tlv(0x30, oidNTLMSSP))}
+	if mechToken != nil {
+		fields = append(fields, tlv(0xa2, tlv(0x04, mechToken)))
+	}
+	return tlv(0x60, oidSPNEGO, tlv(0xa0, tlv(0x30, fields...)))
+}
+
+// negTokenResp returns a response token. state is omitted if negative, supportedMech and the token if nil.
+func negTokenResp(state int, supportedMech, token []byte) []byte {
+	var fields [][]byte
+	if state >= 0 {
+		fields = append(fields, tlv(0xa0, tlv(0x0a, []byte{byte(state)})))
+	}
+	if supportedMech != nil {
+		fields = append(fields, tlv(0xa1, supportedMech))
+	}
+	if token != nil {
+		fields = append(fields, tlv(0xa2, tlv(0x04, token)))
+	}
+	return tlv(0xa1, tlv(0x30, fields...))
+}
+
+// spnegoToken is the decoded content of an SPNEGO token
+type spnegoToken struct {
+	// mechs are the mechanisms of a NegTokenInit
+	mechs [][]byte
+	// state is the negState of a NegTokenResp, -1 if absent
+	state int
+	// token is the mechanism token
+	token []byte
+}
+
+// parseSPNEGO decodes a NegTokenInit or a NegTokenResp
+func parseSPNEGO(b []byte) (*spnegoToken, error) {
+	t := &spnegoToken{state: -1}
+	tag, content, _, err := parseTLV(b)
+	if err != nil {
+		return nil, err
+	}
+	if tag == 0x60 {
+		// The initial token is the SPNEGO OID followed by [0] NegTokenInit
+		if !bytes.HasPrefix(content, oidSPNEGO) {
+			return nil, fmt.Errorf("the token is not an SPNEGO token")
+		}
+		if tag, content, _, err = parseTLV(content[len(oidSPNEGO):]); err != nil {
+			return nil, err
+		}
+		if tag != 0xa0 {
+			return nil, fmt.Errorf("expected NegTokenInit but received tag 0x%02x", tag)
+		}
+	} else if tag != 0xa1 {
+		return nil, fmt.Errorf("unexpected SPNEGO tag 0x%02x", tag)
+	}
+
+	tag, seq, _, err := parseTLV(content)
+	if err != nil {
+		return nil, err
+	}
+	if tag != 0x30 {
+		return nil, fmt.Errorf("expected a sequence but received tag 0x%02x", tag)
+	}
+	for len(seq) > 0 {
+		var field []byte
+		if tag, field, seq, err = parseTLV(seq); err != nil {
+			return nil, err
+		}
+		_, value, _, err := parseTLV(field)
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case 0xa0:
+			if len(field) > 0 && field[0] == 0x0a {
+				// negState of NegTokenResp
+				if len(value) != 1 {
+					return nil, fmt.Errorf("invalid negState")
+				}
+				t.state = int(value[0])
+				continue
+			}
+			// mechTypes of NegTokenInit
+			for len(value) > 0 {
+				start := value
+				if _, _, value, err = parseTLV(value); err != nil {
+					return nil, err
+				}
+				t.mechs = append(t.mechs, start[:len(start)-len(value)])
+			}
+		case 0xa2:
+			t.token = value
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,196 @@
+package npipe
+
+import (
+	// Standard
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// ListenerStats is a snapshot of the counters of a PipeListener. The byte and timeout counters add up the I/O of every
+// connection the listener accepted, including connections that were already closed.
+type ListenerStats struct {
+	// Accepts is the number of connections returned by Accept
+	Accepts uint64 `json:"accepts"`
+	// Rejected is the number of instances that failed to connect for reasons other than ERROR_NO_DATA on Windows.
+	// Clients beyond the maximum number of instances are refused by the kernel before the listener sees them, so it
+	// is 0 on Linux.
+	Rejected uint64 `json:"rejected"`
+	// NoDataDrops is the number of clients Accept skipped because they disconnected before they were accepted, which
+	// Windows reports as ERROR_NO_DATA. The socket backend returns those clients from Accept, so it is 0 on Linux.
+	NoDataDrops uint64 `json:"no_data_drops"`
+	// ActiveConns is the number of accepted connections that were not closed or disconnected yet
+	ActiveConns int64 `json:"active_conns"`
+	// BytesIn is the number of bytes read from the accepted connections
+	BytesIn uint64 `json:"bytes_in"`
+	// BytesOut is the number of bytes written to the accepted connections
+	BytesOut uint64 `json:"bytes_out"`
+	// Timeouts is the number of reads and writes on the accepted connections that failed because their deadline passed
+	Timeouts uint64 `json:"timeouts"`
+}
+
+// ConnStats is a snapshot of the counters of a PipeConn. Data moved through SyscallConn is not counted.
+type ConnStats struct {
+	// BytesIn is the number of bytes read from the connection
+	BytesIn uint64 `json:"bytes_in"`
+	// BytesOut is the number of bytes written to the connection
+	BytesOut uint64 `json:"bytes_out"`
+	// Timeouts is the number of reads and writes that failed because their deadline passed
+	Timeouts uint64 `json:"timeouts"`
+	// DialRetries is the number of times Dial or DialTimeout waited for the pipe to become available before the
+	// connection was established; it is 0 for server side connections
+	DialRetries uint64 `json:"dial_retries"`
+}
+
+// listenerCounters are the counters behind PipeListener.Stats; the connections the listener accepted add their I/O
+type listenerCounters struct {
+	accepts  atomic.Uint64
+	rejected atomic.Uint64
+	noData   atomic.Uint64
+	active   atomic.Int64
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+	timeouts atomic.Uint64
+}
+
+// snapshot returns the current values of the counters
+func (s *listenerCounters) snapshot() ListenerStats {
+	return ListenerStats{
+		Accepts:     s.accepts.Load(),
+		Rejected:    s.rejected.Load(),
+		NoDataDrops: s.noData.Load(),
+		ActiveConns: s.active.Load(),
+		BytesIn:     s.bytesIn.Load(),
+		BytesOut:    s.bytesOut.Load(),
+		Timeouts:    s.timeouts.Load(),
+	}
+}
+
+// connCounters are the counters behind PipeConn.Stats; listener is the listener that accepted the connection, nil for
+// clients
+type connCounters struct {
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+	timeouts    atomic.Uint64
+	dialRetries atomic.Uint64
+	listener    *listenerCounters
+}
+
+// read counts the result of a read that returned n bytes and err
+func (s *connCounters) read(n int, err error) {
+	if n > 0 {
+		s.bytesIn.Add(uint64(n))
+		if s.listener != nil {
+			s.listener.bytesIn.Add(uint64(n))
+		}
+	}
+	s.timeout(err)
+}
+
+// wrote counts the result of a write that returned n bytes and err
+func (s *connCounters) wrote(n int, err error) {
+	if n > 0 {
+		s.bytesOut.Add(uint64(n))
+		if s.listener != nil {
+			s.listener.bytesOut.Add(uint64(n))
+		}
+	}
+	s.timeout(err)
+}
+
+// timeout counts err if it is the error of I/O that hit its deadline
+func (s *connCounters) timeout(err error) {
+	if err != nil && isTimeout(err) {
+		s.timeouts.Add(1)
+		if s.listener != nil {
+			s.listener.timeouts.Add(1)
+		}
+	}
+}
+
+// snapshot returns the current values of the counters
+func (s *connCounters) snapshot() ConnStats {
+	return ConnStats{
+		BytesIn:     s.bytesIn.Load(),
+		BytesOut:    s.bytesOut.Load(),
+		Timeouts:    s.timeouts.Load(),
+		DialRetries: s.dialRetries.Load(),
+	}
+}
+
+// StatsVar reports statistics as JSON every time String is called. It implements expvar.Var, so statistics can be
+// published without this package depending on expvar and net/http:
+//
+//	expvar.Publish("pipe", ln.StatsVar())
+type StatsVar func() interface{}
+
+// String returns the current statistics as JSON
+func (v StatsVar) String() string {
+	b, err := json.Marshal(v())
+	if err != nil {
+		return fmt.Sprintf("%q", err.Error())
+	}
+	return string(b)
+}
+
+// StatsVar returns the statistics of the listener as an expvar.Var
+func (l *PipeListener) StatsVar() StatsVar {
+	return func() interface{} { return l.Stats() }
+}
+
+// StatsVar returns the statistics of the connection as an expvar.Var
+func (c *PipeConn) StatsVar() StatsVar {
+	return func() interface{} { return c.Stats() }
+}
+
+// promMetric is a metric family of the Prometheus exposition written by WritePrometheus
+type promMetric struct {
+	name  string
+	kind  string
+	help  string
+	value func(s ListenerStats) string
+}
+
+// promMetrics are the metric families of a listener
+var promMetrics = []promMetric{
+	{"npipe_listener_accepts_total", "counter", "Connections returned by Accept.", func(s ListenerStats) string { return fmt.Sprint(s.Accepts) }},
+	{"npipe_listener_rejected_total", "counter", "Clients the listener turned away.", func(s ListenerStats) string { return fmt.Sprint(s.Rejected) }},
+	{"npipe_listener_no_data_drops_total", "counter", "Clients that disconnected before they were accepted.", func(s ListenerStats) string { return fmt.Sprint(s.NoDataDrops) }},
+	{"npipe_listener_active_connections", "gauge", "Accepted connections that are still open.", func(s ListenerStats) string { return fmt.Sprint(s.ActiveConns) }},
+	{"npipe_listener_read_bytes_total", "counter", "Bytes read from the accepted connections.", func(s ListenerStats) string { return fmt.Sprint(s.BytesIn) }},
+	{"npipe_listener_written_bytes_total", "counter", "Bytes written to the accepted connections.", func(s ListenerStats) string { return fmt.Sprint(s.BytesOut) }},
+	{"npipe_listener_timeouts_total", "counter", "Reads and writes on the accepted connections that hit their deadline.", func(s ListenerStats) string { return fmt.Sprint(s.Timeouts) }},
+}
+
+// promLabel escapes a label value for the Prometheus text exposition format
+var promLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WritePrometheus writes the statistics of the listeners to w in the Prometheus text exposition format, labelled with
+// their pipe address, so a metrics endpoint needs no client library:
+//
+//	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+//		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+//		npipe.WritePrometheus(w, ln)
+//	})
+//
+// Connections are not exported individually; their I/O is part of the statistics of the listener that accepted them.
+func WritePrometheus(w io.Writer, listeners ...*PipeListener) error {
+	stats := make([]ListenerStats, len(listeners))
+	for i, l := range listeners {
+		stats[i] = l.Stats()
+	}
+	var b strings.Builder
+	for _, m := range promMetrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for i, l := range listeners {
+			fmt.Fprintf(&b, "%s{pipe=\"%s\"} %s\n", m.name, promLabel.Replace(l.Addr().String()), m.value(stats[i]))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	if err != nil {
+		return fmt.Errorf("npipe.WritePrometheus(): %s", err)
+	}
+	return nil
+}
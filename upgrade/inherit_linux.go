@@ -0,0 +1,58 @@
+//go:build linux
+
+package upgrade
+
+import (
+	// Standard
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+
+	// X Package
+	"golang.org/x/sys/unix"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// inheritFiles passes the files to the new process as extra file descriptors and returns their descriptor numbers
+// in the new process
+func inheritFiles(cmd *exec.Cmd, files []*os.File) ([]string, error) {
+	ids := make([]string, len(files))
+	for i, f := range files {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+		// Descriptors 0 through 2 are stdin, stdout, and stderr
+		ids[i] = strconv.Itoa(3 + i)
+	}
+	return ids, nil
+}
+
+// listenerFile duplicates the listening socket for the new process. PipeListener.File is not used because it stops
+// the listener from removing the socket file when it is closed, which must not happen if the new process fails.
+func listenerFile(ln *npipe.PipeListener) (*os.File, error) {
+	rc, err := ln.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("upgrade.listenerFile(): %s", err)
+	}
+	var fd int
+	var dupErr error
+	err = rc.Control(func(s uintptr) {
+		fd, dupErr = unix.FcntlInt(s, unix.F_DUPFD_CLOEXEC, 0)
+	})
+	if err == nil {
+		err = dupErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("upgrade.listenerFile(): there was an error duplicating the socket of %s: %s", ln.Addr(), err)
+	}
+	return os.NewFile(uintptr(fd), ln.Addr().String()), nil
+}
+
+// handOff keeps the listener from removing the socket file the new process serves once it is closed, which
+// PipeListener.File does
+func handOff(ln *npipe.PipeListener) {
+	if f, err := ln.File(); err == nil {
+		f.Close()
+	}
+}
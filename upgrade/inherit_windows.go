@@ -0,0 +1,44 @@
+//go:build windows
+
+package upgrade
+
+import (
+	// Standard
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	// X Package
+	"golang.org/x/sys/windows"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+// inheritFiles marks the files' handles as inheritable and restricts the new process to inheriting exactly those
+// handles, which keep their values in the new process
+func inheritFiles(cmd *exec.Cmd, files []*os.File) ([]string, error) {
+	ids := make([]string, len(files))
+	var handles []syscall.Handle
+	for i, f := range files {
+		err := windows.SetHandleInformation(windows.Handle(f.Fd()), windows.HANDLE_FLAG_INHERIT, windows.HANDLE_FLAG_INHERIT)
+		if err != nil {
+			return nil, fmt.Errorf("upgrade.inheritFiles(): there was an error calling the WINAPI SetHandleInformation function: %s", err)
+		}
+		handles = append(handles, syscall.Handle(f.Fd()))
+		ids[i] = strconv.FormatUint(uint64(f.Fd()), 10)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{AdditionalInheritedHandles: handles}
+	return ids, nil
+}
+
+// listenerFile transfers the instance of the listener that waits for the next client to the new process. The listener
+// keeps working with new instances, so nothing needs to be undone if the new process fails.
+func listenerFile(ln *npipe.PipeListener) (*os.File, error) {
+	return ln.File()
+}
+
+// handOff does nothing on Windows, where the pipe exists as long as any process holds one of its instances
+func handOff(ln *npipe.PipeListener) {}
@@ -0,0 +1,285 @@
+//go:build windows || linux
+
+// Package upgrade restarts a pipe server without a window in which clients can't connect.
+//
+// The running process calls Upgrade to start the new binary and hand it its listeners. The new process picks them up
+// with Listen, which falls back to npipe.Listen when nothing was inherited, and calls Ready once it is serving. Upgrade
+// then closes the listeners in the old process, which finishes its in-flight connections and exits:
+//
+//	ln, err := upgrade.Listen(`\\.\pipe\myservice`)
+//	tracked := upgrade.Track(ln)
+//	go serve(tracked)
+//	upgrade.Ready()
+//
+//	// on SIGHUP or a service control request
+//	if _, err := upgrade.Upgrade(ctx, ln); err == nil {
+//		tracked.Drain(ctx)
+//		os.Exit(0)
+//	}
+//
+// Listeners are inherited as handles on Windows and as file descriptors on Linux.
+package upgrade
+
+import (
+	// Standard
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe"
+)
+
+const (
+	// envListeners holds the comma separated handles or file descriptors of the inherited listeners
+	envListeners = "NPIPE_UPGRADE_LISTENERS"
+	// envReady holds the handle or file descriptor the new process writes to once it is ready
+	envReady = "NPIPE_UPGRADE_READY"
+)
+
+// Upgrader starts the new process. The zero value restarts the running executable with the same arguments.
+type Upgrader struct {
+	// Path is the executable to start, os.Executable() if empty
+	Path string
+	// Args are the arguments without the program name, os.Args[1:] if nil
+	Args []string
+	// Env is appended to the environment of the current process
+	Env []string
+	// Stdout and Stderr default to the current process's
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Upgrade starts the running executable with the same arguments using the zero Upgrader
+func Upgrade(ctx context.Context, listeners ...*npipe.PipeListener) (*os.Process, error) {
+	var u Upgrader
+	return u.Upgrade(ctx, listeners...)
+}
+
+// Upgrade starts the new process, hands it the listeners, and waits until it calls Ready. The listeners are closed in
+// this process once the new process is ready; connections that were already accepted are not affected. If ctx is
+// done or the new process exits before it is ready, the new process is killed and the listeners keep working here.
+func (u *Upgrader) Upgrade(ctx context.Context, listeners ...*npipe.PipeListener) (*os.Process, error) {
+	path := u.Path
+	if path == "" {
+		var err error
+		path, err = os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("upgrade.Upgrader.Upgrade(): there was an error getting the executable path: %s", err)
+		}
+	}
+	args := u.Args
+	if args == nil {
+		args = os.Args[1:]
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("upgrade.Upgrader.Upgrade(): there was an error creating the readiness pipe: %s", err)
+	}
+	defer readyR.Close()
+
+	files := []*os.File{readyW}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, ln := range listeners {
+		f, err := listenerFile(ln)
+		if err != nil {
+			return nil, fmt.Errorf("upgrade.Upgrader.Upgrade(): %s", err)
+		}
+		files = append(files, f)
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = u.Stdout
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	cmd.Stderr = u.Stderr
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	ids, err := inheritFiles(cmd, files)
+	if err != nil {
+		return nil, fmt.Errorf("upgrade.Upgrader.Upgrade(): %s", err)
+	}
+	cmd.Env = append(os.Environ(), u.Env...)
+	cmd.Env = append(cmd.Env, envReady+"="+ids[0], envListeners+"="+strings.Join(ids[1:], ","))
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("upgrade.Upgrader.Upgrade(): there was an error starting %s: %s", path, err)
+	}
+	// The new process holds its own copies now; closing ours lets the readiness pipe report EOF if it exits
+	for _, f := range files {
+		f.Close()
+	}
+	files = nil
+
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := readyR.Read(b)
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("upgrade.Upgrader.Upgrade(): the new process did not become ready: %s", err)
+	}
+	// Reap the new process in the background; it outlives this one once the upgrade is complete
+	go cmd.Wait()
+
+	// The handoff is only committed now, so a failed upgrade leaves the listeners as they were
+	for _, ln := range listeners {
+		handOff(ln)
+		ln.Close()
+	}
+	return cmd.Process, nil
+}
+
+var (
+	inheritOnce sync.Once
+	inherited   map[string]*npipe.PipeListener
+	inheritErr  error
+)
+
+// Inherited returns the listeners handed to this process by Upgrade keyed by pipe address. The map is empty if the
+// process was not started by Upgrade.
+func Inherited() (map[string]*npipe.PipeListener, error) {
+	inheritOnce.Do(func() {
+		inherited = make(map[string]*npipe.PipeListener)
+		value := os.Getenv(envListeners)
+		os.Unsetenv(envListeners)
+		if value == "" {
+			return
+		}
+		for _, id := range strings.Split(value, ",") {
+			n, err := strconv.ParseUint(id, 10, 64)
+			if err != nil {
+				inheritErr = fmt.Errorf("upgrade.Inherited(): invalid inherited listener \"%s\": %s", id, err)
+				break
+			}
+			f := os.NewFile(uintptr(n), "listener")
+			ln, err := npipe.FileListener(f)
+			f.Close()
+			if err != nil {
+				inheritErr = fmt.Errorf("upgrade.Inherited(): %s", err)
+				break
+			}
+			inherited[ln.Addr().String()] = ln
+		}
+		if inheritErr != nil {
+			// The previous process keeps serving the pipes, so the listeners are closed without removing them
+			for address, ln := range inherited {
+				handOff(ln)
+				ln.Close()
+				delete(inherited, address)
+			}
+		}
+	})
+	return inherited, inheritErr
+}
+
+// Listen returns the listener for address handed over by the previous process, or creates it with npipe.Listen
+func Listen(address string) (*npipe.PipeListener, error) {
+	listeners, err := Inherited()
+	if err != nil {
+		return nil, err
+	}
+	if ln, ok := listeners[address]; ok {
+		delete(listeners, address)
+		return ln, nil
+	}
+	ln, err := npipe.Listen(address)
+	if err != nil {
+		return nil, fmt.Errorf("upgrade.Listen(): %s", err)
+	}
+	return ln, nil
+}
+
+// Ready tells the previous process that this process is serving the inherited listeners so it can close them.
+// Ready does nothing if the process was not started by Upgrade.
+func Ready() error {
+	value := os.Getenv(envReady)
+	os.Unsetenv(envReady)
+	if value == "" {
+		return nil
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("upgrade.Ready(): invalid readiness handle \"%s\": %s", value, err)
+	}
+	f := os.NewFile(uintptr(n), "ready")
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	if err != nil {
+		return fmt.Errorf("upgrade.Ready(): there was an error notifying the previous process: %s", err)
+	}
+	return nil
+}
+
+// TrackedListener is a net.Listener that counts the connections it accepted which have not been closed yet
+type TrackedListener struct {
+	net.Listener
+	wg sync.WaitGroup
+}
+
+// Track wraps ln so the old process can wait for its in-flight connections with Drain after an upgrade
+func Track(ln net.Listener) *TrackedListener {
+	return &TrackedListener{Listener: ln}
+}
+
+// Accept waits for and returns the next connection to the listener
+func (t *TrackedListener) Accept() (net.Conn, error) {
+	conn, err := t.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	t.wg.Add(1)
+	return &trackedConn{Conn: conn, done: t.wg.Done}, nil
+}
+
+// Drain waits until every accepted connection was closed or ctx is done
+func (t *TrackedListener) Drain(ctx context.Context) error {
+	drained := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("upgrade.TrackedListener.Drain(): %s", ctx.Err())
+	}
+}
+
+// trackedConn marks the connection as done the first time it is closed
+type trackedConn struct {
+	net.Conn
+	once sync.Once
+	done func()
+}
+
+// Close closes the connection
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.done)
+	return err
+}
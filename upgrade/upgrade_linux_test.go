@@ -0,0 +1,146 @@
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ne0nd0g/npipe"
+)
+
+const testAddress = `\\.\pipe\TestUpgrade`
+
+// TestHelperProcess is the new process started by TestUpgrade; it serves one client from the inherited listener
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("NPIPE_UPGRADE_HELPER") != "1" {
+		t.Skip("only runs as the upgraded process")
+	}
+	listeners, err := Inherited()
+	if err != nil || len(listeners) != 1 {
+		fmt.Fprintf(os.Stderr, "unexpected inherited listeners %v: %v\n", listeners, err)
+		os.Exit(1)
+	}
+	ln, err := Listen(testAddress)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Listen(): %v\n", err)
+		os.Exit(1)
+	}
+	if os.Getenv("NPIPE_UPGRADE_FAIL") == "1" {
+		os.Exit(1)
+	}
+	if err := Ready(); err != nil {
+		fmt.Fprintf(os.Stderr, "Ready(): %v\n", err)
+		os.Exit(1)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		os.Exit(1)
+	}
+	fmt.Fprintf(conn, "served by %d", os.Getpid())
+	conn.Close()
+	ln.Close()
+	os.Exit(0)
+}
+
+// TestUpgrade tests that the listener is served by the new process without removing the pipe
+func TestUpgrade(t *testing.T) {
+	t.Setenv("NPIPE_SOCKET_DIR", t.TempDir())
+	ln, err := npipe.Listen(testAddress)
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	tracked := Track(ln)
+
+	// A connection accepted before the upgrade must keep the old process draining
+	client, err := npipe.Dial(testAddress)
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	server, err := tracked.Accept()
+	if err != nil {
+		t.Fatalf("Accept(): %v", err)
+	}
+
+	u := Upgrader{
+		Args: []string{"-test.run=^TestHelperProcess$"},
+		Env:  []string{"NPIPE_UPGRADE_HELPER=1"},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	process, err := u.Upgrade(ctx, ln)
+	if err != nil {
+		t.Fatalf("Upgrade(): %v", err)
+	}
+
+	conn, err := npipe.DialTimeout(testAddress, time.Second)
+	if err != nil {
+		t.Fatalf("Dial() after the upgrade: %v", err)
+	}
+	reply, err := io.ReadAll(conn)
+	conn.Close()
+	if err != nil {
+		t.Fatalf("ReadAll(): %v", err)
+	}
+	if expected := fmt.Sprintf("served by %d", process.Pid); string(reply) != expected {
+		t.Fatalf("Unexpected reply (expected: %q, got: %q)", expected, reply)
+	}
+
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer drainCancel()
+	if err := tracked.Drain(drainCtx); err == nil {
+		t.Fatal("Drain() returned before the in-flight connection was closed")
+	}
+	server.Close()
+	client.Close()
+	if err := tracked.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain(): %v", err)
+	}
+}
+
+// TestUpgradeFailure tests that the old process keeps its listener when the new process never becomes ready
+func TestUpgradeFailure(t *testing.T) {
+	t.Setenv("NPIPE_SOCKET_DIR", t.TempDir())
+	ln, err := npipe.Listen(testAddress)
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	defer ln.Close()
+
+	u := Upgrader{
+		Args:   []string{"-test.run=^TestHelperProcess$"},
+		Env:    []string{"NPIPE_UPGRADE_HELPER=1", "NPIPE_UPGRADE_FAIL=1"},
+		Stderr: io.Discard,
+		Stdout: io.Discard,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := u.Upgrade(ctx, ln); err == nil || !strings.Contains(err.Error(), "did not become ready") {
+		t.Fatalf("Expected the upgrade to fail, got: %v", err)
+	}
+
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Write([]byte("old"))
+			conn.Close()
+		}
+	}()
+	conn, err := npipe.DialTimeout(testAddress, time.Second)
+	if err != nil {
+		t.Fatalf("Dial() after the failed upgrade: %v", err)
+	}
+	defer conn.Close()
+	reply, _ := io.ReadAll(conn)
+	if string(reply) != "old" {
+		t.Fatalf("Unexpected reply: %q", reply)
+	}
+
+	// The failed upgrade did not hand off the listener, so closing it still removes the pipe
+	ln.Close()
+	if entries, err := os.ReadDir(npipe.SocketDir()); err != nil || len(entries) != 0 {
+		t.Fatalf("Closing the listener after the failed upgrade left %v behind: %v", entries, err)
+	}
+}
@@ -0,0 +1,132 @@
+package npipe
+
+import (
+	// Standard
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// PipeEventType is the kind of change reported by WatchPipes
+type PipeEventType int
+
+const (
+	// PipeCreated is reported when a pipe matching the pattern starts to exist
+	PipeCreated PipeEventType = iota + 1
+	// PipeRemoved is reported when a pipe matching the pattern no longer exists
+	PipeRemoved
+)
+
+// String returns the name of the event type
+func (t PipeEventType) String() string {
+	switch t {
+	case PipeCreated:
+		return "created"
+	case PipeRemoved:
+		return "removed"
+	default:
+		return fmt.Sprintf("PipeEventType(%d)", int(t))
+	}
+}
+
+// PipeEvent is a change to the set of pipes reported by WatchPipes
+type PipeEvent struct {
+	Type PipeEventType
+	// Name is the name of the pipe without the \\<host>\pipe\ prefix
+	Name string
+}
+
+// watchBuffer is the capacity of the channel returned by WatchPipes
+const watchBuffer = 16
+
+// WatchPipes reports local pipes whose name matches pattern as they are created and removed. Pipes that already
+// exist when WatchPipes is called are reported as created first. The returned channel is closed when ctx is done or
+// when watching fails.
+//
+// The pattern uses the syntax of path.Match where backslashes in the pipe name are treated as path separators, so
+// `*` does not match across them. An empty pattern matches every pipe.
+func WatchPipes(ctx context.Context, pattern string) (<-chan PipeEvent, error) {
+	if pattern == "" {
+		pattern = "*"
+	}
+	if _, err := matchPipeName(pattern, ""); err != nil {
+		return nil, fmt.Errorf("npipe.WatchPipes(): invalid pattern \"%s\": %s", pattern, err)
+	}
+	events := make(chan PipeEvent, watchBuffer)
+	w := &pipeWatcher{pattern: pattern, known: make(map[string]bool), events: events}
+	err := w.start(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("npipe.WatchPipes(): %s", err)
+	}
+	return events, nil
+}
+
+// pipeWatcher tracks the set of known pipes so that every change is reported exactly once
+type pipeWatcher struct {
+	pattern string
+	known   map[string]bool
+	events  chan PipeEvent
+}
+
+// matchPipeName reports whether the pipe name matches the watch pattern
+func matchPipeName(pattern, name string) (bool, error) {
+	return path.Match(strings.ReplaceAll(pattern, `\`, "/"), strings.ReplaceAll(name, `\`, "/"))
+}
+
+// update records that the pipe was created or removed and returns the event to report, if any
+func (w *pipeWatcher) update(name string, exists bool) (PipeEvent, bool) {
+	if ok, _ := matchPipeName(w.pattern, name); !ok {
+		return PipeEvent{}, false
+	}
+	if w.known[name] == exists {
+		return PipeEvent{}, false
+	}
+	if exists {
+		w.known[name] = true
+		return PipeEvent{Type: PipeCreated, Name: name}, true
+	}
+	delete(w.known, name)
+	return PipeEvent{Type: PipeRemoved, Name: name}, true
+}
+
+// sync replaces the set of known pipes with the provided snapshot and returns the resulting events ordered by name
+func (w *pipeWatcher) sync(pipes []PipeInfo) []PipeEvent {
+	current := make(map[string]bool, len(pipes))
+	for _, p := range pipes {
+		current[p.Name] = true
+	}
+	var events []PipeEvent
+	for name := range w.known {
+		if !current[name] {
+			if e, ok := w.update(name, false); ok {
+				events = append(events, e)
+			}
+		}
+	}
+	for name := range current {
+		if e, ok := w.update(name, true); ok {
+			events = append(events, e)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Name == events[j].Name {
+			return events[i].Type < events[j].Type
+		}
+		return events[i].Name < events[j].Name
+	})
+	return events
+}
+
+// send delivers the events to the watcher's channel; false is returned if ctx was done first
+func (w *pipeWatcher) send(ctx context.Context, events ...PipeEvent) bool {
+	for _, e := range events {
+		select {
+		case w.events <- e:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
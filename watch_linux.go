@@ -0,0 +1,137 @@
+//go:build linux
+
+package npipe
+
+import (
+	// Standard
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	// X Package
+	"golang.org/x/sys/unix"
+)
+
+// inotifyEvent is a decoded inotify_event structure
+type inotifyEvent struct {
+	mask uint32
+	name string
+}
+
+// start adds an inotify watch on the socket directory, takes the initial snapshot with ListPipes, and reports the
+// directory's create and delete events until ctx is done.
+func (w *pipeWatcher) start(ctx context.Context) error {
+	dir := SocketDir()
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return fmt.Errorf("there was an error creating the socket directory: %s", err)
+	}
+
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("there was an error calling inotify_init1: %s", err)
+	}
+	_, err = unix.InotifyAddWatch(fd, dir, unix.IN_CREATE|unix.IN_DELETE|unix.IN_MOVED_FROM|unix.IN_MOVED_TO)
+	if err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("there was an error calling inotify_add_watch for %s: %s", dir, err)
+	}
+	// The file is non-blocking so reads go through the runtime poller and are interrupted by Close
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	// The snapshot is taken after the watch was added so no change can be missed
+	pipes, err := ListPipes(".")
+	if err != nil {
+		f.Close()
+		return err
+	}
+	initial := w.sync(pipes)
+
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	go func() {
+		defer close(w.events)
+		if !w.send(ctx, initial...) {
+			return
+		}
+		buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+			for _, e := range parseInotifyEvents(buf[:n]) {
+				var events []PipeEvent
+				if e.mask&unix.IN_Q_OVERFLOW != 0 {
+					// Events were dropped, fall back to comparing against a fresh snapshot
+					pipes, err := ListPipes(".")
+					if err != nil {
+						return
+					}
+					events = w.sync(pipes)
+				} else if event, ok := w.handle(dir, e); ok {
+					events = append(events, event)
+				}
+				if !w.send(ctx, events...) {
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// handle converts an inotify event for the socket directory into a PipeEvent
+func (w *pipeWatcher) handle(dir string, e inotifyEvent) (PipeEvent, bool) {
+	if e.name == "" || strings.HasPrefix(e.name, ".") {
+		// Metadata and other backend files
+		return PipeEvent{}, false
+	}
+	name, err := unescapePipeName(e.name)
+	if err != nil {
+		return PipeEvent{}, false
+	}
+	if e.mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+		info, err := os.Lstat(filepath.Join(dir, e.name))
+		if err != nil || info.Mode()&os.ModeSocket == 0 {
+			return PipeEvent{}, false
+		}
+		return w.update(name, true)
+	}
+	return w.update(name, false)
+}
+
+// parseInotifyEvents decodes the inotify_event structures read from an inotify file descriptor
+// https://man7.org/linux/man-pages/man7/inotify.7.html
+//
+//	struct inotify_event {
+//		int      wd;
+//		uint32_t mask;
+//		uint32_t cookie;
+//		uint32_t len;
+//		char     name[];
+//	};
+func parseInotifyEvents(buf []byte) []inotifyEvent {
+	var events []inotifyEvent
+	for len(buf) >= unix.SizeofInotifyEvent {
+		raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[0]))
+		nameLen := int(raw.Len)
+		if unix.SizeofInotifyEvent+nameLen > len(buf) {
+			break
+		}
+		name := buf[unix.SizeofInotifyEvent : unix.SizeofInotifyEvent+nameLen]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		events = append(events, inotifyEvent{mask: raw.Mask, name: string(name)})
+		buf = buf[unix.SizeofInotifyEvent+nameLen:]
+	}
+	return events
+}
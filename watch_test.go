@@ -0,0 +1,59 @@
+package npipe
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestMatchPipeName tests that backslashes in pipe names are treated as separators by the watch pattern
+func TestMatchPipeName(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"*", "srvsvc", true},
+		{"srv*", "srvsvc", true},
+		{"srv*", "lsass", false},
+		{"*", `mojo\1234`, false},
+		{`mojo\*`, `mojo\1234`, true},
+		{"svc-?", "svc-1", true},
+	}
+	for _, test := range tests {
+		match, err := matchPipeName(test.pattern, test.name)
+		if err != nil {
+			t.Fatalf("matchPipeName(%q, %q): %v", test.pattern, test.name, err)
+		}
+		if match != test.match {
+			t.Errorf("matchPipeName(%q, %q) = %t, expected %t", test.pattern, test.name, match, test.match)
+		}
+	}
+}
+
+// TestPipeWatcherSync tests that snapshots are converted into created and removed events exactly once
+func TestPipeWatcherSync(t *testing.T) {
+	w := &pipeWatcher{pattern: "svc*", known: make(map[string]bool)}
+
+	events := w.sync([]PipeInfo{{Name: "svc-b"}, {Name: "svc-a"}, {Name: "other"}})
+	expected := []PipeEvent{{PipeCreated, "svc-a"}, {PipeCreated, "svc-b"}}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("Unexpected events (expected: %v, got: %v)", expected, events)
+	}
+
+	if events = w.sync([]PipeInfo{{Name: "svc-a"}, {Name: "svc-b"}}); len(events) != 0 {
+		t.Fatalf("Expected no events for an unchanged snapshot, got: %v", events)
+	}
+
+	events = w.sync([]PipeInfo{{Name: "svc-b"}, {Name: "svc-c"}})
+	expected = []PipeEvent{{PipeRemoved, "svc-a"}, {PipeCreated, "svc-c"}}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("Unexpected events (expected: %v, got: %v)", expected, events)
+	}
+
+	if _, ok := w.update("svc-c", true); ok {
+		t.Fatal("update() reported an already known pipe as created")
+	}
+	if e, ok := w.update("svc-c", false); !ok || e.Type != PipeRemoved {
+		t.Fatalf("update() did not report the removal, got: %v", e)
+	}
+}
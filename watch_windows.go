@@ -0,0 +1,46 @@
+//go:build windows
+
+package npipe
+
+import (
+	// Standard
+	"context"
+	"time"
+)
+
+// watchPollInterval is how often the pipe directory is enumerated while watching
+const watchPollInterval = 250 * time.Millisecond
+
+// start takes the initial snapshot of the pipe directory and then polls it with ListPipes until ctx is done.
+// The named pipe file system does not support directory change notifications, so polling is the only option.
+func (w *pipeWatcher) start(ctx context.Context) error {
+	pipes, err := ListPipes(".")
+	if err != nil {
+		return err
+	}
+	initial := w.sync(pipes)
+
+	go func() {
+		defer close(w.events)
+		if !w.send(ctx, initial...) {
+			return
+		}
+		ticker := time.NewTicker(watchPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			pipes, err := ListPipes(".")
+			if err != nil {
+				return
+			}
+			if !w.send(ctx, w.sync(pipes)...) {
+				return
+			}
+		}
+	}()
+	return nil
+}
@@ -3,19 +3,165 @@
 package npipe
 
 import (
-	"fmt"
 	// Standard
 	"unsafe"
 
 	// X Package
 	"golang.org/x/sys/windows"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe/internal/winapi"
 )
 
 var (
 	modkernel32 = windows.NewLazyDLL("kernel32.dll")
+	modntdll    = windows.NewLazyDLL("ntdll.dll")
 )
 
+// sysAPI is the Win32 API used by PipeListener and PipeConn
+var sysAPI winapi.API = winAPI{}
+
+// winAPI implements winapi.API with the Windows kernel. Errors are returned unwrapped so the listener and connection
+// code can compare them against Win32 error codes.
+type winAPI struct{}
+
+// CreateNamedPipe creates an instance of a named pipe; sa must be nil or a *windows.SecurityAttributes
+func (winAPI) CreateNamedPipe(name string, openMode, pipeMode, maxInstances, outBufferSize, inBufferSize, defaultTimeout uint32, sa interface{}) (winapi.Handle, error) {
+	lpName, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return winapi.InvalidHandle, err
+	}
+	attrs, _ := sa.(*windows.SecurityAttributes)
+	handle, err := windows.CreateNamedPipe(lpName, openMode, pipeMode, maxInstances, outBufferSize, inBufferSize, defaultTimeout, attrs)
+	return winapi.Handle(handle), err
+}
+
+// ConnectNamedPipe enables a named pipe server process to wait for a client process to connect
+func (winAPI) ConnectNamedPipe(pipe winapi.Handle, overlapped *winapi.Overlapped) error {
+	return windows.ConnectNamedPipe(windows.Handle(pipe), toOverlapped(overlapped))
+}
+
+// DisconnectNamedPipe disconnects the server end of a named pipe instance from a client process
+func (winAPI) DisconnectNamedPipe(pipe winapi.Handle) error {
+	return disconnectNamedPipe(windows.Handle(pipe))
+}
+
+// WaitNamedPipe waits until an instance of the named pipe is available for connection
+func (winAPI) WaitNamedPipe(name string, timeout uint32) error {
+	lpName, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	return waitNamedPipe(lpName, timeout)
+}
+
+// CreateFile opens the client end of a named pipe
+func (winAPI) CreateFile(name string, access, mode, createMode, attrs uint32) (winapi.Handle, error) {
+	lpName, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return winapi.InvalidHandle, err
+	}
+	handle, err := windows.CreateFile(lpName, access, mode, nil, createMode, attrs, 0)
+	return winapi.Handle(handle), err
+}
+
+// ReadFile reads data from the pipe
+func (winAPI) ReadFile(handle winapi.Handle, buf []byte, done *uint32, overlapped *winapi.Overlapped) error {
+	return windows.ReadFile(windows.Handle(handle), buf, done, toOverlapped(overlapped))
+}
+
+// WriteFile writes data to the pipe
+func (winAPI) WriteFile(handle winapi.Handle, buf []byte, done *uint32, overlapped *winapi.Overlapped) error {
+	return windows.WriteFile(windows.Handle(handle), buf, done, toOverlapped(overlapped))
+}
+
+// CancelIoEx cancels the pending I/O operation identified by overlapped, or every operation including
+// FlushFileBuffers if it is nil
+func (winAPI) CancelIoEx(handle winapi.Handle, overlapped *winapi.Overlapped) error {
+	return windows.CancelIoEx(windows.Handle(handle), toOverlapped(overlapped))
+}
+
+// CreateEvent creates an event object
+func (winAPI) CreateEvent(manualReset, initialState bool) (winapi.Handle, error) {
+	var manual, initial uint32
+	if manualReset {
+		manual = 1
+	}
+	if initialState {
+		initial = 1
+	}
+	event, err := windows.CreateEvent(nil, manual, initial, nil)
+	return winapi.Handle(event), err
+}
+
+// GetOverlappedResult retrieves the result of an overlapped operation, waiting for it to complete if wait is true
+func (winAPI) GetOverlappedResult(handle winapi.Handle, overlapped *winapi.Overlapped, done *uint32, wait bool) error {
+	return windows.GetOverlappedResult(windows.Handle(handle), toOverlapped(overlapped), done, wait)
+}
+
+// CloseHandle closes the handle
+func (winAPI) CloseHandle(handle winapi.Handle) error {
+	return windows.CloseHandle(windows.Handle(handle))
+}
+
+// TransactNamedPipe writes in as one message and reads the reply into out
+func (winAPI) TransactNamedPipe(handle winapi.Handle, in, out []byte, done *uint32, overlapped *winapi.Overlapped) error {
+	return transactNamedPipe(windows.Handle(handle), in, out, done, toOverlapped(overlapped))
+}
+
+// SetNamedPipeHandleState sets the read mode of the handle
+func (winAPI) SetNamedPipeHandleState(handle winapi.Handle, mode uint32) error {
+	return windows.SetNamedPipeHandleState(windows.Handle(handle), &mode, nil, nil)
+}
+
+// GetNamedPipeInfo returns the type, buffer sizes, and instance limit of the pipe
+func (winAPI) GetNamedPipeInfo(handle winapi.Handle, flags, outBufferSize, inBufferSize, maxInstances *uint32) error {
+	return windows.GetNamedPipeInfo(windows.Handle(handle), flags, outBufferSize, inBufferSize, maxInstances)
+}
+
+// GetNamedPipeHandleState returns the read mode of the handle and the number of instances of the pipe
+func (winAPI) GetNamedPipeHandleState(handle winapi.Handle, state, curInstances *uint32) error {
+	return windows.GetNamedPipeHandleState(windows.Handle(handle), state, curInstances, nil, nil, nil, 0)
+}
+
+// FlushFileBuffers waits until the peer read all data written to the pipe
+func (winAPI) FlushFileBuffers(handle winapi.Handle) error {
+	return windows.FlushFileBuffers(windows.Handle(handle))
+}
+
+// PeekNamedPipe copies data from the pipe into buf without removing it
+func (winAPI) PeekNamedPipe(handle winapi.Handle, buf []byte, read, available, leftThisMessage *uint32) error {
+	return peekNamedPipe(windows.Handle(handle), buf, read, available, leftThisMessage)
+}
+
+// GetNamedPipeClientProcessId returns the process identifier of the client end of the pipe
+func (winAPI) GetNamedPipeClientProcessId(handle winapi.Handle, pid *uint32) error {
+	return getNamedPipeClientProcessId(windows.Handle(handle), pid)
+}
+
+// GetNamedPipeServerProcessId returns the process identifier of the server end of the pipe
+func (winAPI) GetNamedPipeServerProcessId(handle winapi.Handle, pid *uint32) error {
+	return getNamedPipeServerProcessId(windows.Handle(handle), pid)
+}
+
+// OpenProcess opens a handle to the process with the requested PROCESS_* access
+func (winAPI) OpenProcess(access uint32, pid uint32) (winapi.Handle, error) {
+	process, err := windows.OpenProcess(access, false, pid)
+	return winapi.Handle(process), err
+}
+
+// DuplicateHandle duplicates source, a handle of sourceProcess, into targetProcess
+func (winAPI) DuplicateHandle(sourceProcess, source, targetProcess winapi.Handle, target *winapi.Handle, access uint32, inherit bool, options uint32) error {
+	return windows.DuplicateHandle(windows.Handle(sourceProcess), windows.Handle(source), windows.Handle(targetProcess), (*windows.Handle)(target), access, inherit, options)
+}
+
+// toOverlapped converts the portable OVERLAPPED structure, which has the same memory layout, for the windows package
+func toOverlapped(overlapped *winapi.Overlapped) *windows.Overlapped {
+	return (*windows.Overlapped)(unsafe.Pointer(overlapped))
+}
+
 // disconnectNamedPipe disconnects the server end of a named pipe instance from a client process.
+// The Win32 error is returned unwrapped.
 // https://learn.microsoft.com/en-us/windows/win32/api/namedpipeapi/nf-namedpipeapi-disconnectnamedpipe
 // BOOL DisconnectNamedPipe(
 //
@@ -25,14 +171,86 @@ var (
 func disconnectNamedPipe(handle windows.Handle) error {
 	procDisconnectNamedPipe := modkernel32.NewProc("DisconnectNamedPipe")
 	ret, _, err := procDisconnectNamedPipe.Call(uintptr(handle))
-	if err != windows.Errno(0) {
-		return fmt.Errorf("npipe.disconnectNamedPipe(): there was an error calling the Windows API function DisconnectNamedPipe with return code %d: %s", ret, err)
+	if ret == 0 {
+		return err
+	}
+	return nil
+}
+
+// transactNamedPipe combines the functions that write a message to and read a message from the specified named pipe
+// into a single network operation. The Win32 error is returned unwrapped, e.g. ERROR_IO_PENDING or ERROR_MORE_DATA.
+// https://learn.microsoft.com/en-us/windows/win32/api/namedpipeapi/nf-namedpipeapi-transactnamedpipe
+// BOOL TransactNamedPipe(
+//
+//	[in]                HANDLE       hNamedPipe,
+//	[in]                LPVOID       lpInBuffer,
+//	[in]                DWORD        nInBufferSize,
+//	[out]               LPVOID       lpOutBuffer,
+//	[in]                DWORD        nOutBufferSize,
+//	[out]               LPDWORD      lpBytesRead,
+//	[in, out, optional] LPOVERLAPPED lpOverlapped
+//
+// );
+func transactNamedPipe(handle windows.Handle, in, out []byte, done *uint32, overlapped *windows.Overlapped) error {
+	procTransactNamedPipe := modkernel32.NewProc("TransactNamedPipe")
+	var lpInBuffer, lpOutBuffer uintptr
+	if len(in) > 0 {
+		lpInBuffer = uintptr(unsafe.Pointer(&in[0]))
+	}
+	if len(out) > 0 {
+		lpOutBuffer = uintptr(unsafe.Pointer(&out[0]))
+	}
+	ret, _, err := procTransactNamedPipe.Call(
+		uintptr(handle),
+		lpInBuffer,
+		uintptr(len(in)),
+		lpOutBuffer,
+		uintptr(len(out)),
+		uintptr(unsafe.Pointer(done)),
+		uintptr(unsafe.Pointer(overlapped)),
+	)
+	if ret == 0 {
+		return err
+	}
+	return nil
+}
+
+// peekNamedPipe copies data from a named pipe into a buffer without removing it from the pipe, and returns information
+// about the data in the pipe. It does not block. The Win32 error is returned unwrapped, e.g. ERROR_BROKEN_PIPE.
+// https://learn.microsoft.com/en-us/windows/win32/api/namedpipeapi/nf-namedpipeapi-peeknamedpipe
+// BOOL PeekNamedPipe(
+//
+//	[in]            HANDLE  hNamedPipe,
+//	[out, optional] LPVOID  lpBuffer,
+//	[in]            DWORD   nBufferSize,
+//	[out, optional] LPDWORD lpBytesRead,
+//	[out, optional] LPDWORD lpTotalBytesAvail,
+//	[out, optional] LPDWORD lpBytesLeftThisMessage
+//
+// );
+func peekNamedPipe(handle windows.Handle, buf []byte, read, available, leftThisMessage *uint32) error {
+	procPeekNamedPipe := modkernel32.NewProc("PeekNamedPipe")
+	var lpBuffer uintptr
+	if len(buf) > 0 {
+		lpBuffer = uintptr(unsafe.Pointer(&buf[0]))
+	}
+	ret, _, err := procPeekNamedPipe.Call(
+		uintptr(handle),
+		lpBuffer,
+		uintptr(len(buf)),
+		uintptr(unsafe.Pointer(read)),
+		uintptr(unsafe.Pointer(available)),
+		uintptr(unsafe.Pointer(leftThisMessage)),
+	)
+	if ret == 0 {
+		return err
 	}
 	return nil
 }
 
 // waitNamedPipe waits until either a time-out interval elapses or an instance of the specified named pipe is available
 // for connection (that is, the pipe's server process has a pending ConnectNamedPipe operation on the pipe).
+// The Win32 error is returned unwrapped, e.g. ERROR_SEM_TIMEOUT or ERROR_FILE_NOT_FOUND.
 // https://learn.microsoft.com/en-us/windows/win32/api/namedpipeapi/nf-namedpipeapi-waitnamedpipew
 // BOOL WaitNamedPipeW(
 //
@@ -42,9 +260,116 @@ func disconnectNamedPipe(handle windows.Handle) error {
 // );
 func waitNamedPipe(name *uint16, timeout uint32) error {
 	procWaitNamedPipeW := modkernel32.NewProc("WaitNamedPipeW")
-	ret, _, err := procWaitNamedPipeW.Call(uintptr(unsafe.Pointer(name)), uintptr(timeout), 0)
-	if err != windows.Errno(0) {
-		return fmt.Errorf("npipe.waitNamedPipe(): there was an error calling the Windows API function WaitNamedPipeW with return code %d: %s", ret, err)
+	ret, _, err := procWaitNamedPipeW.Call(uintptr(unsafe.Pointer(name)), uintptr(timeout))
+	if ret == 0 {
+		return err
+	}
+	return nil
+}
+
+// ntQueryDirectoryFile returns various kinds of information about files in the directory specified by a given file
+// handle. The number of bytes written to buf is returned; a windows.NTStatus is returned as the error when the
+// function does not succeed (e.g., STATUS_NO_MORE_FILES).
+// https://learn.microsoft.com/en-us/windows-hardware/drivers/ddi/ntifs/nf-ntifs-ntquerydirectoryfile
+// __kernel_entry NTSYSCALLAPI NTSTATUS NtQueryDirectoryFile(
+//
+//	[in]           HANDLE                 FileHandle,
+//	[in, optional] HANDLE                 Event,
+//	[in, optional] PIO_APC_ROUTINE        ApcRoutine,
+//	[in, optional] PVOID                  ApcContext,
+//	[out]          PIO_STATUS_BLOCK       IoStatusBlock,
+//	[out]          PVOID                  FileInformation,
+//	[in]           ULONG                  Length,
+//	[in]           FILE_INFORMATION_CLASS FileInformationClass,
+//	[in]           BOOLEAN                ReturnSingleEntry,
+//	[in, optional] PUNICODE_STRING        FileName,
+//	[in]           BOOLEAN                RestartScan
+//
+// );
+func ntQueryDirectoryFile(handle windows.Handle, buf []byte, restart bool) (int, error) {
+	procNtQueryDirectoryFile := modntdll.NewProc("NtQueryDirectoryFile")
+	var iosb windows.IO_STATUS_BLOCK
+	var restartScan uintptr
+	if restart {
+		restartScan = 1
+	}
+	ret, _, _ := procNtQueryDirectoryFile.Call(
+		uintptr(handle),
+		0,
+		0,
+		0,
+		uintptr(unsafe.Pointer(&iosb)),
+		uintptr(unsafe.Pointer(&buf[0])),
+		uintptr(len(buf)),
+		fileDirectoryInformationClass,
+		0,
+		0,
+		restartScan,
+	)
+	if ret != 0 {
+		return 0, windows.NTStatus(ret)
+	}
+	return int(iosb.Information), nil
+}
+
+// ntQueryInformationFile copies the information of class about the file specified by handle into info, which must
+// point to size bytes; a windows.NTStatus is returned as the error when the function does not succeed.
+// https://learn.microsoft.com/en-us/windows-hardware/drivers/ddi/ntifs/nf-ntifs-ntqueryinformationfile
+// __kernel_entry NTSYSCALLAPI NTSTATUS NtQueryInformationFile(
+//
+//	[in]  HANDLE                 FileHandle,
+//	[out] PIO_STATUS_BLOCK       IoStatusBlock,
+//	[out] PVOID                  FileInformation,
+//	[in]  ULONG                  Length,
+//	[in]  FILE_INFORMATION_CLASS FileInformationClass
+//
+// );
+func ntQueryInformationFile(handle windows.Handle, info unsafe.Pointer, size uint32, class uint32) error {
+	procNtQueryInformationFile := modntdll.NewProc("NtQueryInformationFile")
+	var iosb windows.IO_STATUS_BLOCK
+	ret, _, _ := procNtQueryInformationFile.Call(
+		uintptr(handle),
+		uintptr(unsafe.Pointer(&iosb)),
+		uintptr(info),
+		uintptr(size),
+		uintptr(class),
+	)
+	if ret != 0 {
+		return windows.NTStatus(ret)
+	}
+	return nil
+}
+
+// getNamedPipeClientProcessId retrieves the client process identifier for the specified named pipe.
+// https://learn.microsoft.com/en-us/windows/win32/api/winbase/nf-winbase-getnamedpipeclientprocessid
+// BOOL GetNamedPipeClientProcessId(
+//
+//	[in]  HANDLE Pipe,
+//	[out] PULONG ClientProcessId
+//
+// );
+func getNamedPipeClientProcessId(handle windows.Handle, pid *uint32) error {
+	procGetNamedPipeClientProcessId := modkernel32.NewProc("GetNamedPipeClientProcessId")
+	ret, _, err := procGetNamedPipeClientProcessId.Call(uintptr(handle), uintptr(unsafe.Pointer(pid)))
+	if ret == 0 {
+		return err
+	}
+	return nil
+}
+
+// getNamedPipeServerProcessId retrieves the server process identifier for the specified named pipe.
+// https://learn.microsoft.com/en-us/windows/win32/api/winbase/nf-winbase-getnamedpipeserverprocessid
+// BOOL GetNamedPipeServerProcessId(
+//
+//	[in]  HANDLE Pipe,
+//	[out] PULONG ServerProcessId
+//
+// );
+func getNamedPipeServerProcessId(handle windows.Handle, pid *uint32) error {
+	procGetNamedPipeServerProcessId := modkernel32.NewProc("GetNamedPipeServerProcessId")
+	ret, _, err := procGetNamedPipeServerProcessId.Call(uintptr(handle), uintptr(unsafe.Pointer(pid)))
+	if ret == 0 {
+		return err
 	}
 	return nil
 }
@@ -0,0 +1,586 @@
+package npipe
+
+import (
+	// Standard
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe/internal/winapi"
+)
+
+// winConn is the Windows named pipe connection behind PipeConn. It only talks to the kernel through winapi.API so the
+// same code runs against the simulated kernel in tests on every platform.
+type winConn struct {
+	api           winapi.API    // api is the Win32 API implementation the connection uses
+	handle        winapi.Handle // handle is a Windows handle to the named pipe
+	addr          PipeAddr      // addr is the named pipe network (pipe) and address
+	readDeadline  pipeDeadline  // readDeadline is the timeout deadline to read
+	writeDeadline pipeDeadline  // writeDeadline is the timeout deadline to write
+	server        bool          // server is true for connections returned by PipeListener.AcceptPipe
+	listener      *winListener  // listener is the listener that accepted this server side connection, nil for clients
+	ops           opCache       // ops holds the overlapped structures and events of completed operations for reuse
+	stats         connCounters  // stats counts the I/O of the connection
+
+	// rframe is the number of data bytes of a frame read by PipeConn.RecvHandles that are still unread; reads stop at
+	// the end of the frame and return ERROR_MORE_DATA until it was read
+	rframe atomic.Int64
+
+	// mu guards closed, disconnected, which is set once Disconnect handed the instance back to the listener, and
+	// closing, which is closed by either to interrupt the SyscallConn callbacks waiting for data. refs counts the
+	// running callbacks, which Close and Disconnect wait for before giving up the handle.
+	mu           sync.Mutex
+	closed       bool
+	disconnected bool
+	closing      chan struct{}
+	refs         sync.WaitGroup
+}
+
+const (
+	// readyPollMin and readyPollMax bound the interval at which SyscallConn's Read checks whether data arrived
+	readyPollMin = time.Millisecond
+	readyPollMax = 20 * time.Millisecond
+)
+
+// iodata is a structure used to track input/output data
+type iodata struct {
+	n   uint32
+	err error
+}
+
+// completeRequest looks at iodata to see if a request is pending. If so, it waits for it to either complete or to
+// abort due to hitting the specified deadline, which may be changed while the request is pending, or ctx being done,
+// in which case ctx.Err() is returned. If no request is pending, the content of iodata is returned. The deadline
+// cancels the request through its own timer, so only a ctx that can be done costs a goroutine.
+func (c *winConn) completeRequest(ctx context.Context, data iodata, deadline *pipeDeadline, op *ioOp) (size int, err error) {
+	if data.err == winapi.ERROR_IO_INCOMPLETE || data.err == winapi.ERROR_IO_PENDING {
+		expired := !deadline.add(op)
+		if expired {
+			op.cancel()
+		}
+		var stop chan struct{}
+		var interrupted chan bool
+		if done := ctx.Done(); done != nil {
+			stop = make(chan struct{})
+			interrupted = make(chan bool, 1)
+			go func() {
+				select {
+				case <-done:
+					op.cancel()
+					interrupted <- true
+				case <-stop:
+					interrupted <- false
+				}
+			}()
+		}
+		// Wait for the request even if it was cancelled so the buffer and overlapped structure are no longer in use;
+		// it may have completed before it could be cancelled
+		data.n, data.err = waitForCompletion(c.api, c.handle, &op.overlapped)
+		if deadline.remove(op) {
+			expired = true
+		}
+		cancelled := false
+		if stop != nil {
+			// The goroutine must be done with op before it is reused
+			close(stop)
+			cancelled = <-interrupted
+		}
+		if data.err == winapi.ERROR_OPERATION_ABORTED {
+			if cancelled {
+				data.err = ctx.Err()
+			} else if expired {
+				data.err = timeout(c.addr.String())
+			}
+		}
+	}
+	// Windows will produce ERROR_BROKEN_PIPE upon closing
+	// a handle on the other end of a connection. Go RPC
+	// expects an io.EOF error in this case.
+	if data.err == winapi.ERROR_BROKEN_PIPE {
+		data.err = io.EOF
+	}
+	return int(data.n), data.err
+}
+
+// Read implements the net.Conn Read method.
+func (c *winConn) Read(b []byte) (int, error) {
+	// Use ReadFile() rather than Read() because the latter
+	// contains a workaround that eats ERROR_BROKEN_PIPE.
+	op, err := c.ops.get(c.api, c.handle)
+	if err != nil {
+		return 0, fmt.Errorf("npipe.PipeConn.Read(): %s", err)
+	}
+	defer c.ops.put(c.api, op)
+	return c.read(b, op)
+}
+
+// read reads into b with op, which ReadFrom and WriteTo reuse across calls
+func (c *winConn) read(b []byte, op *ioOp) (int, error) {
+	if isClosed(c.readDeadline.wait()) {
+		err := timeout(c.addr.String())
+		c.stats.timeout(err)
+		return 0, err
+	}
+	frame := c.rframe.Load()
+	if frame > 0 && int64(len(b)) > frame {
+		b = b[:frame]
+	}
+	var n uint32
+	err := c.api.ReadFile(c.handle, b, &n, &op.overlapped)
+	size, err := c.completeRequest(context.Background(), iodata{n, err}, &c.readDeadline, op)
+	if frame > 0 && c.rframe.Add(-int64(size)) > 0 && err == nil {
+		err = winapi.ERROR_MORE_DATA
+	}
+	c.stats.read(size, err)
+	return size, err
+}
+
+// Write implements the net.Conn Write method.
+func (c *winConn) Write(b []byte) (int, error) {
+	op, err := c.ops.get(c.api, c.handle)
+	if err != nil {
+		return 0, fmt.Errorf("npipe.PipeConn.Write(): %s", err)
+	}
+	defer c.ops.put(c.api, op)
+	return c.write(b, op)
+}
+
+// write writes b with op, which ReadFrom and WriteBuffers reuse across calls
+func (c *winConn) write(b []byte, op *ioOp) (int, error) {
+	if isClosed(c.writeDeadline.wait()) {
+		err := timeout(c.addr.String())
+		c.stats.timeout(err)
+		return 0, err
+	}
+	var n uint32
+	err := c.api.WriteFile(c.handle, b, &n, &op.overlapped)
+	size, err := c.completeRequest(context.Background(), iodata{n, err}, &c.writeDeadline, op)
+	c.stats.wrote(size, err)
+	return size, err
+}
+
+// Transact writes req as one message and reads the reply into resp in a single operation like TransactNamedPipe. The
+// pipe must be a message pipe in message read mode with no unread data. A reply larger than resp returns ErrMoreData
+// and the rest of it is returned by Read. The transaction is bounded by the read deadline and by ctx; if ctx is done
+// first Transact returns ctx.Err().
+func (c *winConn) Transact(ctx context.Context, req, resp []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if isClosed(c.readDeadline.wait()) || isClosed(c.writeDeadline.wait()) {
+		err := timeout(c.addr.String())
+		c.stats.timeout(err)
+		return 0, err
+	}
+	op, err := c.ops.get(c.api, c.handle)
+	if err != nil {
+		return 0, fmt.Errorf("npipe.PipeConn.Transact(): %s", err)
+	}
+	defer c.ops.put(c.api, op)
+	var n uint32
+	err = c.api.TransactNamedPipe(c.handle, req, resp, &n, &op.overlapped)
+	size, err := c.completeRequest(ctx, iodata{n, err}, &c.readDeadline, op)
+	// The request was written if a reply arrived
+	written := 0
+	if err == nil || err == winapi.ERROR_MORE_DATA {
+		written = len(req)
+	}
+	c.stats.wrote(written, err)
+	c.stats.read(size, nil)
+	return size, err
+}
+
+// Stats returns the number of bytes read and written, the I/O that timed out, and the times Dial waited for the pipe
+func (c *winConn) Stats() ConnStats {
+	return c.stats.snapshot()
+}
+
+// SetReadMode switches the connection between byte and message read mode at runtime with SetNamedPipeHandleState;
+// mode is PipeReadModeByte or PipeReadModeMessage. Only message pipes can be read in message mode.
+func (c *winConn) SetReadMode(mode uint32) error {
+	if mode&^PipeReadModeMessage != 0 {
+		return fmt.Errorf("npipe.PipeConn.SetReadMode(): invalid read mode 0x%x", mode)
+	}
+	if err := c.api.SetNamedPipeHandleState(c.handle, mode); err != nil {
+		return fmt.Errorf("npipe.PipeConn.SetReadMode(): there was an error calling WINAPI SetNamedPipeHandleState: %s", err)
+	}
+	return nil
+}
+
+// Info returns the type, read mode, buffer sizes, and instance counts of the pipe from GetNamedPipeInfo and
+// GetNamedPipeHandleState
+func (c *winConn) Info() (HandleInfo, error) {
+	info, err := handleInfo(c.api, c.handle)
+	if err != nil {
+		return info, fmt.Errorf("npipe.PipeConn.Info(): %s", err)
+	}
+	return info, nil
+}
+
+// handleInfo describes the end of the pipe behind handle
+func handleInfo(api winapi.API, handle winapi.Handle) (HandleInfo, error) {
+	var flags, outBufferSize, inBufferSize, maxInstances uint32
+	err := api.GetNamedPipeInfo(handle, &flags, &outBufferSize, &inBufferSize, &maxInstances)
+	if err != nil {
+		return HandleInfo{}, fmt.Errorf("there was an error calling WINAPI GetNamedPipeInfo: %s", err)
+	}
+	var state, curInstances uint32
+	err = api.GetNamedPipeHandleState(handle, &state, &curInstances)
+	if err != nil {
+		return HandleInfo{}, fmt.Errorf("there was an error calling WINAPI GetNamedPipeHandleState: %s", err)
+	}
+
+	info := HandleInfo{
+		Server:           flags&winapi.PIPE_SERVER_END != 0,
+		Message:          flags&winapi.PIPE_TYPE_MESSAGE != 0,
+		ReadMessage:      state&winapi.PIPE_READMODE_MESSAGE != 0,
+		OutBufferSize:    int(outBufferSize),
+		InBufferSize:     int(inBufferSize),
+		CurrentInstances: int(curInstances),
+		MaxInstances:     int(maxInstances),
+	}
+	if maxInstances == winapi.PIPE_UNLIMITED_INSTANCES {
+		info.MaxInstances = -1
+	}
+	return info, nil
+}
+
+// Peek copies the data waiting to be read into b without consuming it and without waiting for data to arrive. In
+// message mode only the current message is copied, and ErrMoreData is returned if it does not fit in b. Peek returns
+// io.EOF once the peer closed its end and all of its data was read.
+func (c *winConn) Peek(b []byte) (int, error) {
+	var read, available, left uint32
+	err := c.api.PeekNamedPipe(c.handle, b, &read, &available, &left)
+	if err != nil {
+		return 0, c.peekError("Peek", err)
+	}
+	if left > 0 {
+		return int(read), winapi.ERROR_MORE_DATA
+	}
+	return int(read), nil
+}
+
+// Available returns the number of bytes that can be read without blocking and, in message mode, the number of bytes
+// left in the current message, which is the size of the next message unless it was partially read. The number of bytes
+// left in a frame PipeConn.RecvHandles returned ErrMoreData for is reported as the message. It returns io.EOF once the
+// peer closed its end and all of its data was read.
+func (c *winConn) Available() (total, message int, err error) {
+	var read, available, left uint32
+	err = c.api.PeekNamedPipe(c.handle, nil, &read, &available, &left)
+	if err != nil {
+		return 0, 0, c.peekError("Available", err)
+	}
+	if frame := c.rframe.Load(); frame > 0 {
+		return int(available), int(frame), nil
+	}
+	return int(available), int(left), nil
+}
+
+// peekError converts the errors of PeekNamedPipe like completeRequest does for reads
+func (c *winConn) peekError(method string, err error) error {
+	if err == winapi.ERROR_BROKEN_PIPE {
+		return io.EOF
+	}
+	return fmt.Errorf("npipe.PipeConn.%s(): there was an error calling WINAPI PeekNamedPipe: %s", method, err)
+}
+
+// Flush waits until the peer read all data written to the pipe, like FlushFileBuffers. It returns ctx.Err() if ctx is
+// done first and a timeout error once the write deadline passes; the abandoned flush ends when the peer catches up or
+// the connection is closed, which cancels it. It returns ErrClosed if the connection is closed while it waits.
+func (c *winConn) Flush(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	deadline := c.writeDeadline.wait()
+	if isClosed(deadline) {
+		return timeout(c.addr.String())
+	}
+	closing, err := c.acquire()
+	if err != nil {
+		return err
+	}
+	// FlushFileBuffers has no deadline, so it runs in a goroutine that ends when the peer read the data or closed its
+	// end, or when Close cancels it. The goroutine holds a reference, so the handle is not closed while it is in use.
+	done := make(chan error, 1)
+	go func() {
+		defer c.refs.Done()
+		result := make(chan error, 1)
+		go func() {
+			result <- c.api.FlushFileBuffers(c.handle)
+		}()
+		select {
+		case err := <-result:
+			done <- err
+		case <-closing:
+			c.api.CancelIoEx(c.handle, nil)
+			done <- <-result
+		}
+	}()
+	select {
+	case err := <-done:
+		if err == winapi.ERROR_OPERATION_ABORTED {
+			return ErrClosed
+		}
+		if err != nil {
+			return fmt.Errorf("npipe.PipeConn.Flush(): there was an error calling WINAPI FlushFileBuffers: %s", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-deadline:
+		return timeout(c.addr.String())
+	}
+}
+
+// CloseGracefully flushes the connection and closes it. The connection is closed even if the flush fails, in which
+// case the flush error is returned and the peer may not have read all data.
+func (c *winConn) CloseGracefully(ctx context.Context) error {
+	err := c.Flush(ctx)
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Disconnect disconnects the client like DisconnectNamedPipe and returns the pipe instance to the listener that
+// accepted the connection, so the next Accept reuses it instead of creating a new instance. Data the client has not
+// read is discarded and pending I/O fails. The connection must not be used afterwards; a later Close does nothing.
+// Only server side connections can be disconnected.
+func (c *winConn) Disconnect() error {
+	if c.listener == nil {
+		return fmt.Errorf("npipe.PipeConn.Disconnect(): only connections accepted by a PipeListener can be disconnected")
+	}
+	if !c.shutdown(true) {
+		return fmt.Errorf("npipe.PipeConn.Disconnect(): the connection was already closed or disconnected")
+	}
+	defer c.ops.close(c.api)
+	err := c.api.DisconnectNamedPipe(c.handle)
+	if err != nil {
+		// The instance is in an unknown state, so it is not worth reusing
+		c.api.CloseHandle(c.handle)
+		return fmt.Errorf("npipe.PipeConn.Disconnect(): there was an error calling WINAPI DisconnectNamedPipe: %s", err)
+	}
+	c.listener.release(c.handle)
+	return nil
+}
+
+// Close closes the connection. It does nothing once the connection was disconnected.
+func (c *winConn) Close() error {
+	if !c.shutdown(false) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.disconnected {
+			return nil
+		}
+		return ErrClosed
+	}
+	defer c.ops.close(c.api)
+	return c.api.CloseHandle(c.handle)
+}
+
+// shutdown marks the connection closed or disconnected, interrupts the SyscallConn callbacks waiting for data, and
+// waits for the running ones to return. It reports false if the connection was already closed or disconnected.
+func (c *winConn) shutdown(disconnect bool) bool {
+	c.mu.Lock()
+	if c.closed || c.disconnected {
+		c.mu.Unlock()
+		return false
+	}
+	if disconnect {
+		c.disconnected = true
+	} else {
+		c.closed = true
+	}
+	if c.closing != nil {
+		close(c.closing)
+	}
+	c.mu.Unlock()
+	if c.listener != nil {
+		c.listener.stats.active.Add(-1)
+	}
+	c.refs.Wait()
+	return true
+}
+
+// SyscallConn returns a raw connection to the pipe handle for issuing custom Win32 calls. Close and Disconnect wait
+// for the running callbacks to return and the handle can't be used once they were called.
+func (c *winConn) SyscallConn() (syscall.RawConn, error) {
+	return &winRawConn{c: c}, nil
+}
+
+// acquire registers a SyscallConn callback and returns the channel that is closed when the connection is closed
+func (c *winConn) acquire() (<-chan struct{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.disconnected {
+		return nil, ErrClosed
+	}
+	if c.closing == nil {
+		c.closing = make(chan struct{})
+	}
+	c.refs.Add(1)
+	return c.closing, nil
+}
+
+// winRawConn implements syscall.RawConn for the handle of a winConn
+type winRawConn struct {
+	c *winConn
+}
+
+// Control calls f with the pipe handle
+func (r *winRawConn) Control(f func(fd uintptr)) error {
+	if _, err := r.c.acquire(); err != nil {
+		return err
+	}
+	defer r.c.refs.Done()
+	f(uintptr(r.c.handle))
+	return nil
+}
+
+// Read calls f with the pipe handle until it returns true. Named pipes have no readiness notification, so between
+// calls Read polls until data is available or the peer closed the pipe; it fails once the read deadline passes or
+// the connection is closed.
+func (r *winRawConn) Read(f func(fd uintptr) bool) error {
+	closing, err := r.c.acquire()
+	if err != nil {
+		return err
+	}
+	defer r.c.refs.Done()
+
+	for !f(uintptr(r.c.handle)) {
+		wait := readyPollMin
+		for {
+			// Errors such as a broken pipe are left for f to observe
+			total, _, err := r.c.Available()
+			if err != nil || total > 0 {
+				break
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-r.c.readDeadline.wait():
+				timer.Stop()
+				return timeout(r.c.addr.String())
+			case <-closing:
+				timer.Stop()
+				return ErrClosed
+			}
+			if wait *= 2; wait > readyPollMax {
+				wait = readyPollMax
+			}
+		}
+	}
+	return nil
+}
+
+// Write calls f with the pipe handle once. Named pipes have no writability notification, so Write returns
+// ErrNotSupported if f asks to wait.
+func (r *winRawConn) Write(f func(fd uintptr) bool) error {
+	if _, err := r.c.acquire(); err != nil {
+		return err
+	}
+	defer r.c.refs.Done()
+	if !f(uintptr(r.c.handle)) {
+		return ErrNotSupported
+	}
+	return nil
+}
+
+// LocalAddr returns the local network address.
+func (c *winConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// RemoteAddr returns the remote network address.
+func (c *winConn) RemoteAddr() net.Addr {
+	// not sure what to do here, we don't have remote addr....
+	return c.addr
+}
+
+// SetDeadline implements the net.Conn SetDeadline method.
+// Note that timeouts are only supported on Windows Vista/Server 2008 and above
+func (c *winConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return fmt.Errorf("npipe.PipeConn.SetDeadline(): %s", err)
+	}
+	err = c.SetWriteDeadline(t)
+	if err != nil {
+		return fmt.Errorf("npipe.PipeConn.SetDeadline(): %s", err)
+	}
+	return nil
+}
+
+// SetReadDeadline implements the net.Conn SetReadDeadline method.
+// Note that timeouts are only supported on Windows Vista/Server 2008 and above
+func (c *winConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements the net.Conn SetWriteDeadline method.
+// Note that timeouts are only supported on Windows Vista/Server 2008 and above
+func (c *winConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// newOverlapped creates a structure used to track asynchronous
+// I/O requests that have been issued.
+func newOverlapped(api winapi.API) (*winapi.Overlapped, error) {
+	event, err := api.CreateEvent(true, true)
+	if err != nil {
+		return nil, fmt.Errorf("npipe.newOverlapped(): there was an error callling WINAPI CreateEvent: %s", err)
+	}
+	return &winapi.Overlapped{HEvent: event}, nil
+}
+
+// waitForCompletion waits for an asynchronous I/O request referred to by overlapped to complete.
+// This function returns the number of bytes transferred by the operation and the error the operation completed with,
+// such as ERROR_OPERATION_ABORTED when it was cancelled, so callers can compare it against Win32 error codes.
+// https://learn.microsoft.com/en-us/windows/win32/api/ioapiset/nf-ioapiset-getoverlappedresult
+func waitForCompletion(api winapi.API, handle winapi.Handle, overlapped *winapi.Overlapped) (transferred uint32, err error) {
+	err = api.GetOverlappedResult(handle, overlapped, &transferred, true)
+	return transferred, err
+}
+
+// winDial is a helper to initiate a connection to a named pipe that has been started by a server.
+// The timeout is only enforced if the pipe server has already created the pipe, otherwise
+// this function will return immediately. ERROR_FILE_NOT_FOUND and ERROR_PIPE_BUSY are returned unwrapped so callers
+// can retry.
+func winDial(api winapi.API, address string, timeout uint32) (*winConn, error) {
+	// If at least one instance of the pipe has been created, this function
+	// will wait timeout milliseconds for it to become available.
+	// It will return immediately regardless of timeout, if no instances
+	// of the named pipe have been created yet.
+	// If this returns with no error, there is a pipe available.
+	err := api.WaitNamedPipe(address, timeout)
+	if err != nil {
+		if err == winapi.ERROR_BAD_PATHNAME {
+			// badly formatted pipe name
+			return nil, badAddr(address)
+		}
+		return nil, err
+	}
+	handle, err := api.CreateFile(
+		address,
+		winapi.GENERIC_READ|winapi.GENERIC_WRITE,
+		winapi.FILE_SHARE_READ|winapi.FILE_SHARE_WRITE,
+		winapi.OPEN_EXISTING,
+		winapi.FILE_FLAG_OVERLAPPED,
+	)
+	if err != nil {
+		if err == winapi.ERROR_FILE_NOT_FOUND || err == winapi.ERROR_PIPE_BUSY {
+			// Another client took the instance or the server closed it since WaitNamedPipe returned
+			return nil, err
+		}
+		return nil, fmt.Errorf("npipe.dial(): there was an error calling WINAPI CreateFile: %s", err)
+	}
+	return &winConn{api: api, handle: handle, addr: PipeAddr(address)}, nil
+}
@@ -0,0 +1,1201 @@
+package npipe
+
+import (
+	// Standard
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe/conntest"
+	"github.com/Ne0nd0g/npipe/internal/bench"
+	"github.com/Ne0nd0g/npipe/internal/simpipe"
+	"github.com/Ne0nd0g/npipe/internal/winapi"
+)
+
+// The tests in this file run the Windows listener and connection code against the simulated kernel so its state
+// machine is exercised on every platform.
+
+func init() {
+	// The benchmarks use the simulated transport, which only builds with the npipesim tag register otherwise
+	simpipe.Listen = simListenPipe
+	simpipe.Dial = simDialPipe
+}
+
+// simListen creates the first instance of a pipe in the simulated kernel like NewPipeListener
+func simListen(t testing.TB, sim *winapi.Sim, address string, pipeMode uint32) *winListener {
+	t.Helper()
+	mode := uint32(PipeAccessDuplex | FileFlagOverlapped | FileFlagFirstPipeInstance)
+	handle, err := sim.CreateNamedPipe(address, mode, pipeMode, PipeUnlimitedInstances, 512, 512, 0, nil)
+	if err != nil {
+		t.Fatalf("CreateNamedPipe(%q): %v", address, err)
+	}
+	return &winListener{api: sim, addr: PipeAddr(address), handle: handle, config: newPipeConfig(mode, pipeMode, PipeUnlimitedInstances, 512, 512, 0, nil)}
+}
+
+// simPair connects a client using api, the simulated kernel or one of its processes, to the listener and returns both
+// ends
+func simPair(t testing.TB, api winapi.API, ln *winListener) (client, server *winConn) {
+	t.Helper()
+	accepted := make(chan *winConn, 1)
+	errs := make(chan error, 1)
+	go func() {
+		c, err := ln.accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		accepted <- c
+	}()
+	// Like Dial, retry until accept created the next instance
+	client, err := winDial(api, ln.addr.String(), 1000)
+	for deadline := time.Now().Add(time.Second); err == winapi.ERROR_FILE_NOT_FOUND && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		client, err = winDial(api, ln.addr.String(), 1000)
+	}
+	if err != nil {
+		t.Fatalf("winDial(%q): %v", ln.addr, err)
+	}
+	select {
+	case server = <-accepted:
+	case err = <-errs:
+		t.Fatalf("accept(): %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for accept()")
+	}
+	return client, server
+}
+
+// checkHandles fails the test if handles were leaked
+func checkHandles(t *testing.T, sim *winapi.Sim, want int) {
+	t.Helper()
+	if got := sim.OpenHandles(); got != want {
+		t.Fatalf("expected %d open handles but there are %d", want, got)
+	}
+}
+
+// TestSimCommonUseCase accepts two clients, one after the other, and exchanges data in both directions
+func TestSimCommonUseCase(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimCommonUseCase`, PipeTypeByte)
+
+	for i := 0; i < 2; i++ {
+		client, server := simPair(t, sim, ln)
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatalf("client.Write(): %v", err)
+		}
+		b := make([]byte, 16)
+		n, err := server.Read(b)
+		if err != nil || string(b[:n]) != "ping" {
+			t.Fatalf("server.Read() = %q, %v", b[:n], err)
+		}
+		if _, err = server.Write([]byte("pong")); err != nil {
+			t.Fatalf("server.Write(): %v", err)
+		}
+		n, err = client.Read(b)
+		if err != nil || string(b[:n]) != "pong" {
+			t.Fatalf("client.Read() = %q, %v", b[:n], err)
+		}
+		client.Close()
+		server.Close()
+	}
+
+	if err := ln.Close(); err != nil {
+		t.Fatalf("Close(): %v", err)
+	}
+	checkHandles(t, sim, 0)
+}
+
+// TestSimPipeConnected tests that a client which connected before AcceptPipe was called is returned
+// (ERROR_PIPE_CONNECTED)
+func TestSimPipeConnected(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimPipeConnected`, PipeTypeByte)
+	defer ln.Close()
+
+	client, err := winDial(sim, ln.addr.String(), 0)
+	if err != nil {
+		t.Fatalf("winDial(): %v", err)
+	}
+	defer client.Close()
+	server, err := ln.acceptPipe()
+	if err != nil {
+		t.Fatalf("acceptPipe(): %v", err)
+	}
+	defer server.Close()
+
+	if _, err = client.Write([]byte("hello")); err != nil {
+		t.Fatalf("client.Write(): %v", err)
+	}
+	b := make([]byte, 16)
+	n, err := server.Read(b)
+	if err != nil || string(b[:n]) != "hello" {
+		t.Fatalf("server.Read() = %q, %v", b[:n], err)
+	}
+}
+
+// TestSimAcceptNoData tests that Accept skips clients that connected and disconnected before they were accepted
+// (ERROR_NO_DATA) without leaking the instance
+func TestSimAcceptNoData(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimAcceptNoData`, PipeTypeByte)
+
+	gone, err := winDial(sim, ln.addr.String(), 0)
+	if err != nil {
+		t.Fatalf("winDial(): %v", err)
+	}
+	gone.Close()
+
+	if _, err = ln.acceptPipe(); err != winapi.ERROR_NO_DATA {
+		t.Fatalf("expected ERROR_NO_DATA from acceptPipe() but received %v", err)
+	}
+	client, server := simPair(t, sim, ln)
+	client.Close()
+	server.Close()
+	ln.Close()
+	checkHandles(t, sim, 0)
+}
+
+// TestSimCancelAccept tests that closing the listener aborts a pending accept (ERROR_OPERATION_ABORTED) and
+// releases its handles
+func TestSimCancelAccept(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimCancelAccept`, PipeTypeByte)
+
+	// Consume the first instance so the second accept waits on a new one
+	client, server := simPair(t, sim, ln)
+	defer client.Close()
+	defer server.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := ln.accept()
+		errs <- err
+	}()
+	for {
+		ln.mu.Lock()
+		waiting := ln.acceptHandle != 0
+		ln.mu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := ln.Close(); err != nil {
+		t.Fatalf("Close(): %v", err)
+	}
+	select {
+	case err := <-errs:
+		if err != ErrClosed {
+			t.Fatalf("expected ErrClosed but received %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the accept to be cancelled")
+	}
+	if ln.acceptHandle != 0 || ln.acceptOverlapped.HEvent != 0 {
+		t.Fatal("Close did not release the accept handles")
+	}
+	// Only the connected pair is left
+	checkHandles(t, sim, 2)
+}
+
+// TestSimFirstInstance tests that FILE_FLAG_FIRST_PIPE_INSTANCE fails while the pipe exists and succeeds again once
+// the listener was closed
+func TestSimFirstInstance(t *testing.T) {
+	sim := winapi.NewSim()
+	address := `\\.\pipe\TestSimFirstInstance`
+	ln := simListen(t, sim, address, PipeTypeByte)
+
+	_, err := sim.CreateNamedPipe(address, PipeAccessDuplex|FileFlagOverlapped|FileFlagFirstPipeInstance, PipeTypeByte, PipeUnlimitedInstances, 512, 512, 0, nil)
+	if err != winapi.ERROR_ACCESS_DENIED {
+		t.Fatalf("expected ERROR_ACCESS_DENIED but received %v", err)
+	}
+	ln.Close()
+	ln = simListen(t, sim, address, PipeTypeByte)
+	ln.Close()
+}
+
+// TestSimPipeBusy tests that clients can't connect while every instance is in use
+func TestSimPipeBusy(t *testing.T) {
+	sim := winapi.NewSim()
+	address := `\\.\pipe\TestSimPipeBusy`
+	handle, err := sim.CreateNamedPipe(address, PipeAccessDuplex|FileFlagOverlapped, PipeTypeByte, 1, 512, 512, 0, nil)
+	if err != nil {
+		t.Fatalf("CreateNamedPipe(): %v", err)
+	}
+	ln := &winListener{api: sim, addr: PipeAddr(address), handle: handle, config: newPipeConfig(PipeAccessDuplex|FileFlagOverlapped, PipeTypeByte, 1, 512, 512, 0, nil)}
+	defer ln.Close()
+
+	client, err := winDial(sim, address, 0)
+	if err != nil {
+		t.Fatalf("winDial(): %v", err)
+	}
+	defer client.Close()
+
+	_, err = winDial(sim, address, 10)
+	if err != winapi.ERROR_SEM_TIMEOUT {
+		t.Fatalf("expected ERROR_SEM_TIMEOUT from WaitNamedPipe but received %v", err)
+	}
+	_, err = sim.CreateFile(address, 0, 0, 0, 0)
+	if err != winapi.ERROR_PIPE_BUSY {
+		t.Fatalf("expected ERROR_PIPE_BUSY from CreateFile but received %v", err)
+	}
+	// The next instance can't be created either
+	_, err = ln.createInstance()
+	if err != winapi.ERROR_PIPE_BUSY {
+		t.Fatalf("expected ERROR_PIPE_BUSY from createInstance but received %v", err)
+	}
+}
+
+// TestSimDialNotFound tests the errors Dial retries on or reports
+func TestSimDialNotFound(t *testing.T) {
+	sim := winapi.NewSim()
+	_, err := winDial(sim, `\\.\pipe\TestSimDialNotFound`, 0)
+	if err != winapi.ERROR_FILE_NOT_FOUND {
+		t.Fatalf("expected ERROR_FILE_NOT_FOUND but received %v", err)
+	}
+	_, err = winDial(sim, `\\.\pipo\TestSimDialNotFound`, 0)
+	if _, ok := err.(PipeError); !ok {
+		t.Fatalf("expected a PipeError for a bad address but received %v", err)
+	}
+}
+
+// TestSimReadDeadline tests that a read past its deadline is cancelled and returns a timeout without losing data
+// written afterwards
+func TestSimReadDeadline(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimReadDeadline`, PipeTypeByte)
+	defer ln.Close()
+	client, server := simPair(t, sim, ln)
+	defer client.Close()
+	defer server.Close()
+
+	client.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	b := make([]byte, 16)
+	_, err := client.Read(b)
+	if pe, ok := err.(PipeError); !ok || !pe.Timeout() {
+		t.Fatalf("expected a timeout PipeError but received %v", err)
+	}
+
+	if _, err = server.Write([]byte("late")); err != nil {
+		t.Fatalf("server.Write(): %v", err)
+	}
+	client.SetReadDeadline(time.Time{})
+	n, err := client.Read(b)
+	if err != nil || string(b[:n]) != "late" {
+		t.Fatalf("client.Read() = %q, %v", b[:n], err)
+	}
+}
+
+// TestSimWriteDeadline tests that a write that exceeds the buffer quota pends until its deadline
+func TestSimWriteDeadline(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimWriteDeadline`, PipeTypeByte)
+	defer ln.Close()
+	client, server := simPair(t, sim, ln)
+	defer client.Close()
+	defer server.Close()
+
+	client.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := client.Write(make([]byte, 4096))
+	if pe, ok := err.(PipeError); !ok || !pe.Timeout() {
+		t.Fatalf("expected a timeout PipeError but received %v", err)
+	}
+
+	// A write that is read in time completes
+	client.SetWriteDeadline(time.Now().Add(time.Second))
+	data := bytes.Repeat([]byte("x"), 2048)
+	go io.ReadFull(server, make([]byte, len(data)))
+	n, err := client.Write(data)
+	if err != nil || n != len(data) {
+		t.Fatalf("client.Write() = %d, %v", n, err)
+	}
+}
+
+// TestSimBrokenPipe tests that the client reads the data left by a server that closed its end before io.EOF and
+// that writes fail with ERROR_NO_DATA
+func TestSimBrokenPipe(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimBrokenPipe`, PipeTypeByte)
+	defer ln.Close()
+	client, server := simPair(t, sim, ln)
+	defer client.Close()
+
+	if _, err := server.Write([]byte("bye")); err != nil {
+		t.Fatalf("server.Write(): %v", err)
+	}
+	server.Close()
+
+	data, err := io.ReadAll(client)
+	if err != nil || string(data) != "bye" {
+		t.Fatalf("io.ReadAll() = %q, %v", data, err)
+	}
+	if _, err = client.Write([]byte("x")); err != winapi.ERROR_NO_DATA {
+		t.Fatalf("expected ERROR_NO_DATA but received %v", err)
+	}
+}
+
+// TestSimMessageMode tests that a message larger than the read buffer returns ERROR_MORE_DATA and the rest of the
+// message on the next read
+func TestSimMessageMode(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimMessageMode`, PipeTypeMessage|PipeReadModeMessage)
+	defer ln.Close()
+	client, server := simPair(t, sim, ln)
+	defer client.Close()
+	defer server.Close()
+
+	for _, m := range []string{"first message", "second"} {
+		if _, err := client.Write([]byte(m)); err != nil {
+			t.Fatalf("client.Write(): %v", err)
+		}
+	}
+	b := make([]byte, 5)
+	n, err := server.Read(b)
+	if err != winapi.ERROR_MORE_DATA || string(b[:n]) != "first" {
+		t.Fatalf("server.Read() = %q, %v", b[:n], err)
+	}
+	b = make([]byte, 64)
+	n, err = server.Read(b)
+	if err != nil || string(b[:n]) != " message" {
+		t.Fatalf("server.Read() = %q, %v", b[:n], err)
+	}
+	n, err = server.Read(b)
+	if err != nil || string(b[:n]) != "second" {
+		t.Fatalf("server.Read() = %q, %v", b[:n], err)
+	}
+}
+
+// TestSimMessageListenerInstances tests that the instances Accept creates after the first one have the pipe mode and
+// buffer sizes the listener was created with
+func TestSimMessageListenerInstances(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimMessageListenerInstances`, PipeTypeMessage|PipeReadModeMessage)
+	defer ln.Close()
+
+	for i := 0; i < 2; i++ {
+		client, server := simPair(t, sim, ln)
+		info, err := server.Info()
+		if err != nil || !info.Message || !info.ReadMessage || info.OutBufferSize != 512 || info.InBufferSize != 512 {
+			t.Fatalf("server %d Info() = %+v, %v; want a message mode instance with 512 byte buffers", i, info, err)
+		}
+		if _, err = client.Write([]byte("message")); err != nil {
+			t.Fatalf("client %d Write(): %v", i, err)
+		}
+		b := make([]byte, 4)
+		n, err := server.Read(b)
+		if err != winapi.ERROR_MORE_DATA || string(b[:n]) != "mess" {
+			t.Fatalf("server %d Read() = %q, %v; want the start of the message and ERROR_MORE_DATA", i, b[:n], err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+// TestSimPeek tests that Peek and Available report buffered data without consuming it and io.EOF after the peer
+// closed its end
+func TestSimPeek(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimPeek`, PipeTypeMessage|PipeReadModeMessage)
+	defer ln.Close()
+	client, server := simPair(t, sim, ln)
+	defer server.Close()
+
+	b := make([]byte, 64)
+	if n, err := server.Peek(b); n != 0 || err != nil {
+		t.Fatalf("Peek() with nothing buffered = %d, %v", n, err)
+	}
+	client.Write([]byte("first message"))
+	client.Write([]byte("second"))
+	if total, message, err := server.Available(); total != 19 || message != 13 || err != nil {
+		t.Fatalf("Available() = %d, %d, %v; want 19, 13", total, message, err)
+	}
+	n, err := server.Peek(b[:5])
+	if err != winapi.ERROR_MORE_DATA || string(b[:n]) != "first" {
+		t.Fatalf("Peek() into a short buffer = %q, %v", b[:n], err)
+	}
+	n, err = server.Read(b[:6])
+	if err != winapi.ERROR_MORE_DATA || string(b[:n]) != "first " {
+		t.Fatalf("Read() = %q, %v", b[:n], err)
+	}
+	if total, message, err := server.Available(); total != 13 || message != 7 || err != nil {
+		t.Fatalf("Available() after a partial Read() = %d, %d, %v; want 13, 7", total, message, err)
+	}
+	n, err = server.Peek(b)
+	if err != nil || string(b[:n]) != "message" {
+		t.Fatalf("Peek() after a partial Read() = %q, %v", b[:n], err)
+	}
+
+	client.Close()
+	server.Read(b)
+	n, err = server.Peek(b)
+	if err != nil || string(b[:n]) != "second" {
+		t.Fatalf("Peek() after the peer closed = %q, %v", b[:n], err)
+	}
+	server.Read(b)
+	if _, err := server.Peek(b); err != io.EOF {
+		t.Errorf("Peek() after the data was read = %v; want %v", err, io.EOF)
+	}
+	if _, _, err := server.Available(); err != io.EOF {
+		t.Errorf("Available() after the data was read = %v; want %v", err, io.EOF)
+	}
+}
+
+// TestSimTransact tests TransactNamedPipe transactions, which need message read mode and no unread data and can be
+// cancelled by the context
+func TestSimTransact(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimTransact`, PipeTypeMessage|PipeReadModeMessage)
+	defer ln.Close()
+	client, server := simPair(t, sim, ln)
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		b := make([]byte, 64)
+		for {
+			n, err := server.Read(b)
+			if err != nil {
+				return
+			}
+			if string(b[:n]) != "ignore" {
+				server.Write(bytes.Repeat(b[:n], 2))
+			}
+		}
+	}()
+	ctx := context.Background()
+
+	b := make([]byte, 64)
+	if _, err := client.Transact(ctx, []byte("hello"), b); err != winapi.ERROR_BAD_PIPE {
+		t.Fatalf("Transact() in byte read mode = %v; want %v", err, winapi.ERROR_BAD_PIPE)
+	}
+	if err := client.SetReadMode(PipeReadModeMessage); err != nil {
+		t.Fatalf("SetReadMode(): %v", err)
+	}
+	n, err := client.Transact(ctx, []byte("hello"), b)
+	if err != nil || string(b[:n]) != "hellohello" {
+		t.Fatalf("Transact() = %q, %v", b[:n], err)
+	}
+	n, err = client.Transact(ctx, []byte("hello"), b[:4])
+	if err != winapi.ERROR_MORE_DATA || string(b[:n]) != "hell" {
+		t.Fatalf("Transact() into a short buffer = %q, %v", b[:n], err)
+	}
+	if _, err = client.Transact(ctx, []byte("hello"), b); err != winapi.ERROR_PIPE_BUSY {
+		t.Fatalf("Transact() with unread data = %v; want %v", err, winapi.ERROR_PIPE_BUSY)
+	}
+	client.Read(b)
+
+	cctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err = client.Transact(cctx, []byte("ignore"), b); err != context.DeadlineExceeded {
+		t.Fatalf("Transact() with an expiring context = %v; want %v", err, context.DeadlineExceeded)
+	}
+	client.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err = client.Transact(ctx, []byte("ignore"), b)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Transact() past the read deadline = %v; want a timeout", err)
+	}
+}
+
+// TestSimConformance runs the net.Conn conformance suite against the Windows connection code on the simulated kernel
+func TestSimConformance(t *testing.T) {
+	sim := winapi.NewSim()
+	var pairs int
+	conntest.TestConn(t, func() (net.Conn, net.Conn) {
+		pairs++
+		ln := simListen(t, sim, fmt.Sprintf(`\\.\pipe\TestSimConformance%d`, pairs), PipeTypeByte)
+		t.Cleanup(func() { ln.Close() })
+		client, server := simPair(t, sim, ln)
+		return client, server
+	})
+}
+
+func TestSimFlush(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimFlush`, PipeTypeByte)
+	defer ln.Close()
+	client, server := simPair(t, sim, ln)
+	defer client.Close()
+	ctx := context.Background()
+
+	if err := server.Flush(ctx); err != nil {
+		t.Fatalf("Flush() with no data written: %v", err)
+	}
+	server.Write([]byte("hello"))
+	cctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	err := server.Flush(cctx)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Flush() of unread data with an expiring context = %v; want %v", err, context.DeadlineExceeded)
+	}
+	server.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	err = server.Flush(ctx)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Flush() past the write deadline = %v; want a timeout", err)
+	}
+	server.SetWriteDeadline(time.Time{})
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- server.CloseGracefully(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	b := make([]byte, 16)
+	if n, err := client.Read(b); err != nil || string(b[:n]) != "hello" {
+		t.Fatalf("Read() = %q, %v", b[:n], err)
+	}
+	if err := <-closed; err != nil {
+		t.Fatalf("CloseGracefully(): %v", err)
+	}
+	if _, err := client.Read(b); err != io.EOF {
+		t.Fatalf("Read() after CloseGracefully() = %v; want %v", err, io.EOF)
+	}
+
+	// A flush fails when the peer closes without reading
+	client2, server2 := simPair(t, sim, ln)
+	defer server2.Close()
+	server2.Write([]byte("unread"))
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- server2.Flush(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	client2.Close()
+	if err := <-flushed; err == nil {
+		t.Fatal("Flush() succeeded after the peer closed without reading")
+	}
+}
+
+// TestSimFlushClose tests that Close cancels the flushes that are still waiting for the peer, including abandoned
+// ones, instead of closing the handle while they use it
+func TestSimFlushClose(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimFlushClose`, PipeTypeByte)
+	defer ln.Close()
+	client, server := simPair(t, sim, ln)
+	defer client.Close()
+	server.Write([]byte("unread"))
+
+	cctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	err := server.Flush(cctx)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Flush() with an expiring context = %v; want %v", err, context.DeadlineExceeded)
+	}
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- server.Flush(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- server.Close()
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("Close(): %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close() did not cancel the pending flushes")
+	}
+	if err := <-flushed; err != ErrClosed {
+		t.Fatalf("Flush() interrupted by Close() = %v; want %v", err, ErrClosed)
+	}
+	if err := server.Flush(context.Background()); err != ErrClosed {
+		t.Fatalf("Flush() after Close() = %v; want %v", err, ErrClosed)
+	}
+}
+
+// TestSimSendHandles tests that a broker pushes handles into a sandboxed worker, which can't open the broker's process,
+// and that a worker can't push handles into the broker
+func TestSimSendHandles(t *testing.T) {
+	for name, mode := range map[string]uint32{"byte": PipeTypeByte, "message": PipeTypeMessage | PipeReadModeMessage} {
+		t.Run(name, func(t *testing.T) {
+			sim := winapi.NewSim()
+			worker := sim.Process(100, true)
+			ln := simListen(t, sim, `\\.\pipe\TestSimSendHandles-`+name, mode)
+			client, server := simPair(t, worker, ln)
+
+			event, err := sim.CreateEvent(true, false)
+			if err != nil {
+				t.Fatalf("CreateEvent(): %v", err)
+			}
+			if n, err := server.sendHandles([]byte("take this"), []winapi.Handle{event}); n != 9 || err != nil {
+				t.Fatalf("sendHandles() = %d, %v", n, err)
+			}
+			buf := make([]byte, 16)
+			n, handles, err := client.recvHandles(buf)
+			if err != nil || string(buf[:n]) != "take this" || len(handles) != 1 {
+				t.Fatalf("recvHandles() = %q, %d handles, %v", buf[:n], len(handles), err)
+			}
+			if pid, ok := sim.HandleOwner(handles[0]); !ok || pid != 100 {
+				t.Errorf("the received handle belongs to process %d, %v; want the worker", pid, ok)
+			}
+			if pid, ok := sim.HandleOwner(event); !ok || pid != winapi.SimProcessID {
+				t.Errorf("the sent handle belongs to process %d, %v; want the broker to keep it", pid, ok)
+			}
+
+			if _, err = client.sendHandles([]byte("escape"), []winapi.Handle{handles[0]}); err == nil {
+				t.Error("a sandboxed worker pushed a handle into the broker")
+			}
+			if available, _, err := server.Available(); available != 0 || err != nil {
+				t.Errorf("Available() = %d, %v after a failed sendHandles(); want nothing written", available, err)
+			}
+
+			worker.CloseHandle(handles[0])
+			sim.CloseHandle(event)
+			client.Close()
+			server.Close()
+			ln.Close()
+			checkHandles(t, sim, 0)
+		})
+	}
+}
+
+func TestSimDisconnect(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimDisconnect`, PipeTypeByte)
+	client, server := simPair(t, sim, ln)
+	handle := server.handle
+
+	client.Write([]byte("unread"))
+	if err := server.Disconnect(); err != nil {
+		t.Fatalf("Disconnect(): %v", err)
+	}
+	if _, err := client.Read(make([]byte, 8)); err != winapi.ERROR_PIPE_NOT_CONNECTED {
+		t.Fatalf("Read() after Disconnect() = %v; want %v", err, winapi.ERROR_PIPE_NOT_CONNECTED)
+	}
+	if err := server.Disconnect(); err == nil {
+		t.Error("Disconnect() of a disconnected connection succeeded")
+	}
+	if err := server.Close(); err != nil {
+		t.Errorf("Close() after Disconnect() = %v", err)
+	}
+	if err := client.Disconnect(); err == nil {
+		t.Error("Disconnect() of a client succeeded")
+	}
+	client.Close()
+	if len(ln.idle) != 1 {
+		t.Fatalf("the listener has %d idle instances; want 1", len(ln.idle))
+	}
+
+	// The next client is served by the disconnected instance
+	client, server = simPair(t, sim, ln)
+	if server.handle != handle || len(ln.idle) != 0 {
+		t.Fatalf("accept() returned handle %v with %d idle instances; want the disconnected handle %v", server.handle, len(ln.idle), handle)
+	}
+	client.Write([]byte("hello"))
+	b := make([]byte, 8)
+	if n, err := server.Read(b); err != nil || string(b[:n]) != "hello" {
+		t.Fatalf("Read() on the reused instance = %q, %v", b[:n], err)
+	}
+
+	// Closing the listener closes the idle instances
+	client.Close()
+	server.Disconnect()
+	ln.Close()
+	checkHandles(t, sim, 0)
+}
+
+func TestSimInfo(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimInfo`, PipeTypeByte)
+	info, err := ln.Info()
+	if err != nil {
+		t.Fatalf("Info(): %v", err)
+	}
+	want := HandleInfo{Server: true, OutBufferSize: 512, InBufferSize: 512, CurrentInstances: 1, MaxInstances: -1}
+	if info != want {
+		t.Fatalf("listener Info() = %+v; want %+v", info, want)
+	}
+	client, server := simPair(t, sim, ln)
+	if info, err = server.Info(); err != nil || !info.Server || info.Message || info.CurrentInstances != 1 {
+		t.Fatalf("server Info() = %+v, %v", info, err)
+	}
+	if err = client.SetReadMode(PipeReadModeMessage); err == nil {
+		t.Fatal("SetReadMode(PipeReadModeMessage) on a byte pipe succeeded")
+	}
+
+	// The listener creates the instance that waits for the next client
+	if info, err = ln.Info(); err != nil || info.CurrentInstances != 2 || ln.handle == 0 {
+		t.Fatalf("listener Info() after accept() = %+v, %v", info, err)
+	}
+	client.Close()
+	server.Close()
+	ln.Close()
+	checkHandles(t, sim, 0)
+
+	ln = simListen(t, sim, `\\.\pipe\TestSimInfo-message`, PipeTypeMessage|PipeReadModeMessage)
+	defer ln.Close()
+	client, server = simPair(t, sim, ln)
+	defer client.Close()
+	defer server.Close()
+	if info, err = client.Info(); err != nil || info.Server || !info.Message || info.ReadMessage {
+		t.Fatalf("client Info() = %+v, %v", info, err)
+	}
+	if err = client.SetReadMode(PipeReadModeMessage); err != nil {
+		t.Fatalf("SetReadMode(PipeReadModeMessage): %v", err)
+	}
+	if info, err = client.Info(); err != nil || !info.ReadMessage {
+		t.Fatalf("client Info() in message read mode = %+v, %v", info, err)
+	}
+	if err = client.SetReadMode(0x1); err == nil {
+		t.Error("SetReadMode() with an invalid mode succeeded")
+	}
+}
+
+func TestSimSyscallConn(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimSyscallConn`, PipeTypeByte)
+	client, server := simPair(t, sim, ln)
+	defer client.Close()
+
+	rc, err := server.SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn(): %v", err)
+	}
+	var handle uintptr
+	if err = rc.Control(func(fd uintptr) { handle = fd }); err != nil || winapi.Handle(handle) != server.handle {
+		t.Fatalf("Control() = %v with handle %v; want %v", err, handle, server.handle)
+	}
+
+	// Read polls until the data the callback waits for arrives
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		client.Write([]byte("raw"))
+	}()
+	calls := 0
+	err = rc.Read(func(fd uintptr) bool {
+		calls++
+		var read, available, left uint32
+		sim.PeekNamedPipe(winapi.Handle(fd), nil, &read, &available, &left)
+		return available > 0
+	})
+	if err != nil || calls < 2 {
+		t.Fatalf("Read() = %v after %d calls", err, calls)
+	}
+	server.Read(make([]byte, 8))
+
+	server.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	err = rc.Read(func(fd uintptr) bool { return false })
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Read() past the read deadline = %v; want a timeout", err)
+	}
+	server.SetReadDeadline(time.Time{})
+	if err = rc.Write(func(fd uintptr) bool { return false }); err != ErrNotSupported {
+		t.Fatalf("Write() waiting for writability = %v; want %v", err, ErrNotSupported)
+	}
+
+	// Close interrupts a waiting Read and waits for it before closing the handle
+	reading := make(chan error, 1)
+	go func() {
+		reading <- rc.Read(func(fd uintptr) bool { return false })
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err = server.Close(); err != nil {
+		t.Fatalf("Close(): %v", err)
+	}
+	if err = <-reading; err != ErrClosed {
+		t.Fatalf("Read() interrupted by Close() = %v; want %v", err, ErrClosed)
+	}
+	if err = rc.Control(func(fd uintptr) {}); err != ErrClosed {
+		t.Fatalf("Control() after Close() = %v; want %v", err, ErrClosed)
+	}
+	if err = server.Close(); err != ErrClosed {
+		t.Fatalf("second Close() = %v; want %v", err, ErrClosed)
+	}
+
+	// The listener's raw connection reaches the instance waiting for the next client
+	lrc, err := ln.SyscallConn()
+	if err != nil {
+		t.Fatalf("listener SyscallConn(): %v", err)
+	}
+	if err = lrc.Control(func(fd uintptr) { handle = fd }); err != nil || winapi.Handle(handle) != ln.handle || ln.handle == 0 {
+		t.Fatalf("listener Control() = %v with handle %v", err, handle)
+	}
+	if err = lrc.Read(func(fd uintptr) bool { return true }); err != syscall.EINVAL {
+		t.Fatalf("listener Read() = %v; want %v", err, syscall.EINVAL)
+	}
+	ln.Close()
+	if err = lrc.Control(func(fd uintptr) {}); err != ErrClosed {
+		t.Fatalf("listener Control() after Close() = %v; want %v", err, ErrClosed)
+	}
+	client.Close()
+	checkHandles(t, sim, 0)
+}
+
+func TestSimReadFromWriteTo(t *testing.T) {
+	data := make([]byte, 200000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	for _, mode := range []uint32{PipeTypeByte, PipeTypeMessage | PipeReadModeMessage} {
+		sim := winapi.NewSim()
+		ln := simListen(t, sim, `\\.\pipe\TestSimReadFromWriteTo`, mode)
+		client, server := simPair(t, sim, ln)
+		if err := client.SetReadMode(mode & PipeReadModeMessage); err != nil {
+			t.Fatalf("SetReadMode(): %v", err)
+		}
+
+		// Messages larger than the copy buffer are copied whole
+		sent := make(chan error, 1)
+		go func() {
+			n, err := server.ReadFrom(bytes.NewReader(data))
+			if err == nil && n != int64(len(data)) {
+				err = fmt.Errorf("wrote %d bytes", n)
+			}
+			server.Close()
+			sent <- err
+		}()
+		var buf bytes.Buffer
+		if n, err := client.WriteTo(&buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+			t.Fatalf("WriteTo() = %d, %v", n, err)
+		}
+		if err := <-sent; err != nil {
+			t.Fatalf("ReadFrom(): %v", err)
+		}
+		client.Close()
+		ln.Close()
+		checkHandles(t, sim, 0)
+	}
+}
+
+func TestSimWriteBuffers(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimWriteBuffers`, PipeTypeMessage|PipeReadModeMessage)
+	defer ln.Close()
+	client, server := simPair(t, sim, ln)
+	defer client.Close()
+	defer server.Close()
+	client.SetReadMode(PipeReadModeMessage)
+
+	// Every buffer is a message in message mode
+	v := net.Buffers{[]byte("a"), []byte("bc"), []byte("def")}
+	if n, err := server.WriteBuffers(&v); err != nil || n != 6 || len(v) != 0 {
+		t.Fatalf("WriteBuffers() = %d, %v with %d buffers left", n, err, len(v))
+	}
+	b := make([]byte, 16)
+	for _, want := range []string{"a", "bc", "def"} {
+		if n, err := client.Read(b); err != nil || string(b[:n]) != want {
+			t.Fatalf("Read() = %q, %v; want the message %q", b[:n], err, want)
+		}
+	}
+
+	// Small buffers are batched in byte mode, which the byte mode client can't tell apart
+	client.SetReadMode(PipeReadModeByte)
+	bsim := winapi.NewSim()
+	bln := simListen(t, bsim, `\\.\pipe\TestSimWriteBuffers`, PipeTypeByte)
+	defer bln.Close()
+	bclient, bserver := simPair(t, bsim, bln)
+	defer bclient.Close()
+	defer bserver.Close()
+	large := bytes.Repeat([]byte("x"), copyBufferSize)
+	v = net.Buffers{[]byte("a"), []byte("bc"), large, []byte("def")}
+	done := make(chan error, 1)
+	go func() {
+		_, err := bserver.WriteBuffers(&v)
+		done <- err
+	}()
+	got := make([]byte, 0, 6+len(large))
+	for len(got) < cap(got) {
+		n, err := bclient.Read(b)
+		if err != nil {
+			t.Fatalf("Read(): %v", err)
+		}
+		got = append(got, b[:n]...)
+	}
+	if err := <-done; err != nil || len(v) != 0 {
+		t.Fatalf("WriteBuffers() = %v with %d buffers left", err, len(v))
+	}
+	if want := append(append([]byte("abc"), large...), "def"...); !bytes.Equal(got, want) {
+		t.Fatalf("the client received %d bytes; want %d", len(got), len(want))
+	}
+}
+
+// BenchmarkSimReadFrom compares ReadFrom, which reuses one event for the whole copy, with copying through Write
+func BenchmarkSimReadFrom(b *testing.B) {
+	const size = 1 << 20
+	data := make([]byte, size)
+	run := func(b *testing.B, copy func(dst *winConn, src io.Reader) error) {
+		sim := winapi.NewSim()
+		ln := simListen(b, sim, `\\.\pipe\BenchmarkSimReadFrom`, PipeTypeByte)
+		defer ln.Close()
+		client, server := simPair(b, sim, ln)
+		defer server.Close()
+		go io.Copy(io.Discard, readerOnly{client})
+		defer client.Close()
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			if err := copy(server, readerOnly{bytes.NewReader(data)}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.Run("ReadFrom", func(b *testing.B) {
+		run(b, func(dst *winConn, src io.Reader) error {
+			_, err := dst.ReadFrom(src)
+			return err
+		})
+	})
+	b.Run("Write", func(b *testing.B) {
+		run(b, func(dst *winConn, src io.Reader) error {
+			_, err := io.Copy(writerOnly{dst}, src)
+			return err
+		})
+	})
+}
+
+// TestSimStats tests the counters of the Windows listener and connections: clients that vanish before they are
+// accepted, bytes moved by Read and Write, timeouts, and connections that are closed or disconnected
+func TestSimStats(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimStats`, PipeTypeByte)
+	defer ln.Close()
+
+	gone, err := winDial(sim, ln.addr.String(), 0)
+	if err != nil {
+		t.Fatalf("winDial(): %v", err)
+	}
+	gone.Close()
+	client, server := simPair(t, sim, ln)
+	defer client.Close()
+
+	go func() {
+		b := make([]byte, 16)
+		if _, err := io.ReadFull(server, b[:4]); err == nil {
+			server.Write(b[:4])
+		}
+	}()
+	if _, err = client.Write([]byte("echo")); err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+	b := make([]byte, 16)
+	if _, err = io.ReadFull(client, b[:4]); err != nil {
+		t.Fatalf("Read(): %v", err)
+	}
+	client.SetReadDeadline(time.Now())
+	if _, err = client.Read(b); !isTimeout(err) {
+		t.Fatalf("Read() past the deadline = %v; want a timeout", err)
+	}
+
+	if got, want := client.Stats(), (ConnStats{BytesIn: 4, BytesOut: 4, Timeouts: 1}); got != want {
+		t.Errorf("client.Stats() = %+v; want %+v", got, want)
+	}
+	if got, want := server.Stats(), (ConnStats{BytesIn: 4, BytesOut: 4}); got != want {
+		t.Errorf("server.Stats() = %+v; want %+v", got, want)
+	}
+	if got, want := ln.Stats(), (ListenerStats{Accepts: 1, NoDataDrops: 1, ActiveConns: 1, BytesIn: 4, BytesOut: 4}); got != want {
+		t.Errorf("ln.Stats() = %+v; want %+v", got, want)
+	}
+
+	if err = server.Disconnect(); err != nil {
+		t.Fatalf("Disconnect(): %v", err)
+	}
+	server.Close()
+	if got := ln.Stats().ActiveConns; got != 0 {
+		t.Errorf("ActiveConns = %d after Disconnect; want 0", got)
+	}
+}
+
+// TestSimReuseOps tests that reads and writes reuse the events of the connection instead of creating one per
+// operation, and that the cached events are closed with the connection
+func TestSimReuseOps(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimReuseOps`, PipeTypeByte)
+	client, server := simPair(t, sim, ln)
+	ln.Close()
+
+	b := make([]byte, 4)
+	pingPong := func() {
+		t.Helper()
+		go server.Write([]byte("ping"))
+		if _, err := io.ReadFull(client, b); err != nil {
+			t.Fatalf("client.Read(): %v", err)
+		}
+		// The read pends until the client writes
+		go client.Write([]byte("pong"))
+		if _, err := io.ReadFull(server, b); err != nil {
+			t.Fatalf("server.Read(): %v", err)
+		}
+	}
+	pingPong()
+	// Wait for the writes to return their events
+	time.Sleep(10 * time.Millisecond)
+	handles := sim.OpenHandles()
+	for i := 0; i < 100; i++ {
+		pingPong()
+	}
+	time.Sleep(10 * time.Millisecond)
+	if got := sim.OpenHandles(); got > handles {
+		t.Fatalf("the connections hold %d handles after 100 exchanges; want at most %d", got, handles)
+	}
+
+	client.Close()
+	server.Close()
+	checkHandles(t, sim, 0)
+}
+
+// gatedAPI holds back the completion of aborted operations until release is closed, so a test can change the
+// deadline between the cancellation of an operation and its return
+type gatedAPI struct {
+	*winapi.Sim
+	aborted chan struct{}
+	release chan struct{}
+}
+
+func (g gatedAPI) GetOverlappedResult(handle winapi.Handle, overlapped *winapi.Overlapped, done *uint32, wait bool) error {
+	err := g.Sim.GetOverlappedResult(handle, overlapped, done, wait)
+	if err == winapi.ERROR_OPERATION_ABORTED {
+		g.aborted <- struct{}{}
+		<-g.release
+	}
+	return err
+}
+
+// TestSimDeadlineExtendedAfterExpiry tests that a read cancelled by its deadline reports a timeout even if the deadline
+// was extended before the read returned
+func TestSimDeadlineExtendedAfterExpiry(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimDeadlineExtendedAfterExpiry`, PipeTypeByte)
+	defer ln.Close()
+	client, server := simPair(t, sim, ln)
+	defer client.Close()
+	defer server.Close()
+	gate := gatedAPI{Sim: sim, aborted: make(chan struct{}), release: make(chan struct{})}
+	client.api = gate
+
+	client.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Read(make([]byte, 16))
+		done <- err
+	}()
+	select {
+	case <-gate.aborted:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the deadline to cancel the read")
+	}
+	client.SetReadDeadline(time.Now().Add(time.Hour))
+	close(gate.release)
+	if err := <-done; !isTimeout(err) {
+		t.Fatalf("Read() = %v; want a timeout", err)
+	}
+}
+
+// TestSimDeadlineChange tests that a deadline changed while a read is pending is applied to that read
+func TestSimDeadlineChange(t *testing.T) {
+	sim := winapi.NewSim()
+	ln := simListen(t, sim, `\\.\pipe\TestSimDeadlineChange`, PipeTypeByte)
+	defer ln.Close()
+	client, server := simPair(t, sim, ln)
+	defer client.Close()
+	defer server.Close()
+
+	type result struct {
+		n   int
+		err error
+	}
+	read := func() <-chan result {
+		done := make(chan result, 1)
+		go func() {
+			n, err := client.Read(make([]byte, 16))
+			done <- result{n, err}
+		}()
+		return done
+	}
+
+	// A deadline that is extended while the read is pending does not fire at the old time
+	client.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	done := read()
+	time.Sleep(5 * time.Millisecond)
+	client.SetReadDeadline(time.Now().Add(time.Hour))
+	select {
+	case r := <-done:
+		t.Fatalf("Read() returned %d, %v after its deadline was extended", r.n, r.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := server.Write([]byte("data")); err != nil {
+		t.Fatalf("server.Write(): %v", err)
+	}
+	if r := <-done; r.err != nil || r.n != 4 {
+		t.Fatalf("Read() = %d, %v", r.n, r.err)
+	}
+
+	// A deadline that is set in the past while the read is pending cancels it
+	client.SetReadDeadline(time.Time{})
+	done = read()
+	time.Sleep(5 * time.Millisecond)
+	client.SetReadDeadline(time.Now())
+	select {
+	case r := <-done:
+		if pe, ok := r.err.(PipeError); !ok || !pe.Timeout() {
+			t.Fatalf("expected a timeout PipeError but received %v", r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the read to be cancelled")
+	}
+}
+
+// BenchmarkSimRoundTrip measures the latency of small request and reply exchanges, which is dominated by the
+// overlapped and deadline bookkeeping rather than by the data
+func BenchmarkSimRoundTrip(b *testing.B) {
+	bench.Run(b, "RoundTrip", simpipe.Transport{Sim: winapi.NewSim()}, `\\.\pipe\BenchmarkSimRoundTrip`)
+}
+
+// BenchmarkSimRoundTripDeadline measures small request and reply exchanges that move the deadline before every
+// exchange like an RPC client does, which exercises the reused overlapped structures and deadline timers
+func BenchmarkSimRoundTripDeadline(b *testing.B) {
+	sim := winapi.NewSim()
+	ln := simListen(b, sim, `\\.\pipe\BenchmarkSimRoundTripDeadline`, PipeTypeByte)
+	defer ln.Close()
+	client, server := simPair(b, sim, ln)
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := server.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err = server.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	msg := []byte("ping")
+	buf := make([]byte, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client.SetDeadline(time.Now().Add(time.Hour))
+		if _, err := client.Write(msg); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(client, buf[:len(msg)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSimThroughput measures bulk writes at several buffer sizes
+func BenchmarkSimThroughput(b *testing.B) {
+	bench.Run(b, "Throughput", simpipe.Transport{Sim: winapi.NewSim()}, `\\.\pipe\BenchmarkSimThroughput`)
+}
+
+// BenchmarkSimAccept measures the number of connections per second a listener accepts
+func BenchmarkSimAccept(b *testing.B) {
+	bench.Run(b, "Accept", simpipe.Transport{Sim: winapi.NewSim()}, `\\.\pipe\BenchmarkSimAccept`)
+}
+
+// BenchmarkSimConcurrent measures how round trips scale with the number of concurrent connections
+func BenchmarkSimConcurrent(b *testing.B) {
+	bench.Run(b, "Concurrent", simpipe.Transport{Sim: winapi.NewSim()}, `\\.\pipe\BenchmarkSimConcurrent`)
+}
@@ -0,0 +1,114 @@
+package npipe
+
+import (
+	// Standard
+	"fmt"
+	"io"
+	"net"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe/internal/winapi"
+)
+
+// ReadFrom implements io.ReaderFrom. The data is written through one overlapped structure and event for the whole
+// copy instead of one per Write, and in chunks of up to 64KB. In message mode every Read of r is written as one
+// message.
+func (c *winConn) ReadFrom(r io.Reader) (int64, error) {
+	op, err := c.ops.get(c.api, c.handle)
+	if err != nil {
+		return 0, fmt.Errorf("npipe.PipeConn.ReadFrom(): %s", err)
+	}
+	defer c.ops.put(c.api, op)
+
+	buf := make([]byte, copyBufferSize)
+	var written int64
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			m, err := c.write(buf[:n], op)
+			written += int64(m)
+			if err != nil {
+				return written, err
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+// WriteTo implements io.WriterTo. The data is read through one overlapped structure and event for the whole copy
+// until the peer closes the pipe. Messages larger than the 64KB buffer are copied as they arrive, so ErrMoreData is
+// not returned.
+func (c *winConn) WriteTo(w io.Writer) (int64, error) {
+	op, err := c.ops.get(c.api, c.handle)
+	if err != nil {
+		return 0, fmt.Errorf("npipe.PipeConn.WriteTo(): %s", err)
+	}
+	defer c.ops.put(c.api, op)
+
+	return copyPipe(w, func(b []byte) (int, error) {
+		return c.read(b, op)
+	}, winapi.ERROR_MORE_DATA)
+}
+
+// WriteBuffers writes the contents of v and removes the written data from it like net.Buffers.WriteTo. In byte mode
+// small buffers are batched into writes of up to 64KB; in message mode every buffer is written as one message. One
+// overlapped structure and event are used for all writes.
+func (c *winConn) WriteBuffers(v *net.Buffers) (int64, error) {
+	var flags uint32
+	err := c.api.GetNamedPipeInfo(c.handle, &flags, nil, nil, nil)
+	if err != nil {
+		return 0, fmt.Errorf("npipe.PipeConn.WriteBuffers(): there was an error calling WINAPI GetNamedPipeInfo: %s", err)
+	}
+	op, err := c.ops.get(c.api, c.handle)
+	if err != nil {
+		return 0, fmt.Errorf("npipe.PipeConn.WriteBuffers(): %s", err)
+	}
+	defer c.ops.put(c.api, op)
+
+	var written int64
+	write := func(b []byte) error {
+		n, err := c.write(b, op)
+		written += int64(n)
+		return err
+	}
+	defer func() {
+		consumeBuffers(v, written)
+	}()
+
+	if flags&winapi.PIPE_TYPE_MESSAGE != 0 {
+		for _, b := range *v {
+			if err := write(b); err != nil {
+				return written, err
+			}
+		}
+		return written, nil
+	}
+
+	batch := make([]byte, 0, copyBufferSize)
+	for _, b := range *v {
+		if len(batch)+len(b) > cap(batch) && len(batch) > 0 {
+			if err := write(batch); err != nil {
+				return written, err
+			}
+			batch = batch[:0]
+		}
+		if len(b) >= cap(batch) {
+			if err := write(b); err != nil {
+				return written, err
+			}
+			continue
+		}
+		batch = append(batch, b...)
+	}
+	if len(batch) > 0 {
+		if err := write(batch); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,138 @@
+package npipe
+
+import (
+	// Standard
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe/internal/winapi"
+)
+
+// sendHandles implements PipeConn.SendHandles on Windows. The handles are duplicated into the peer process, whose
+// identifier the pipe reports, and the frame carries the values of the duplicates, which are only valid in the peer.
+// Duplicates the peer will never learn about because the frame could not be written are closed in the peer process.
+func (c *winConn) sendHandles(b []byte, handles []winapi.Handle) (int, error) {
+	if len(handles) > MaxHandles {
+		return 0, fmt.Errorf("npipe.PipeConn.SendHandles(): %d handles exceeds the maximum of %d", len(handles), MaxHandles)
+	}
+
+	frame := appendHandleHeader(make([]byte, 0, handleHeaderSize+8*len(handles)+len(b)), len(handles), len(b))
+	var process winapi.Handle
+	var remote []winapi.Handle
+	// closeRemote closes the duplicates in the peer process when the peer will never learn about them
+	closeRemote := func() {
+		for _, h := range remote {
+			c.api.DuplicateHandle(process, h, 0, nil, 0, false, winapi.DUPLICATE_CLOSE_SOURCE)
+		}
+	}
+
+	if len(handles) > 0 {
+		pid, err := c.peerProcessID()
+		if err != nil {
+			return 0, fmt.Errorf("npipe.PipeConn.SendHandles(): %s", err)
+		}
+		process, err = c.api.OpenProcess(winapi.PROCESS_DUP_HANDLE, pid)
+		if err != nil {
+			return 0, fmt.Errorf("npipe.PipeConn.SendHandles(): there was an error calling WINAPI OpenProcess for PID %d: %s", pid, err)
+		}
+		defer c.api.CloseHandle(process)
+	}
+	for _, h := range handles {
+		var target winapi.Handle
+		err := c.api.DuplicateHandle(winapi.CurrentProcess, h, process, &target, 0, false, winapi.DUPLICATE_SAME_ACCESS)
+		if err != nil {
+			closeRemote()
+			return 0, fmt.Errorf("npipe.PipeConn.SendHandles(): there was an error calling WINAPI DuplicateHandle for handle %d: %s", h, err)
+		}
+		remote = append(remote, target)
+		frame = binary.LittleEndian.AppendUint64(frame, uint64(target))
+	}
+	frame = append(frame, b...)
+
+	n, err := c.Write(frame)
+	if err == nil && n < len(frame) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		closeRemote()
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// recvHandles implements PipeConn.RecvHandles on Windows. The handle values in the frame were duplicated into this
+// process by the sender, so they are returned as they are; they are closed if the data can't be read.
+func (c *winConn) recvHandles(b []byte) (int, []winapi.Handle, error) {
+	if c.rframe.Load() > 0 {
+		return 0, nil, fmt.Errorf("npipe.PipeConn.RecvHandles(): the rest of a partially read frame must be read first")
+	}
+	header := make([]byte, handleHeaderSize)
+	err := c.readFull(header)
+	if err != nil {
+		return 0, nil, err
+	}
+	count, dataLen, err := parseHandleHeader(header)
+	if err != nil {
+		return 0, nil, fmt.Errorf("npipe.PipeConn.RecvHandles(): %s", err)
+	}
+
+	values := make([]byte, 8*count)
+	err = c.readFull(values)
+	if err != nil {
+		return 0, nil, err
+	}
+	handles := make([]winapi.Handle, count)
+	for i := range handles {
+		handles[i] = winapi.Handle(binary.LittleEndian.Uint64(values[i*8:]))
+	}
+
+	if dataLen < len(b) {
+		b = b[:dataLen]
+	}
+	err = c.readFull(b)
+	if err != nil {
+		for _, h := range handles {
+			c.api.CloseHandle(h)
+		}
+		return 0, nil, err
+	}
+	if len(b) < dataLen {
+		c.rframe.Store(int64(dataLen - len(b)))
+		return len(b), handles, winapi.ERROR_MORE_DATA
+	}
+	return len(b), handles, nil
+}
+
+// readFull reads exactly len(b) bytes, continuing across ERROR_MORE_DATA in message mode
+func (c *winConn) readFull(b []byte) error {
+	for read := 0; read < len(b); {
+		n, err := c.Read(b[read:])
+		read += n
+		if err != nil && err != winapi.ERROR_MORE_DATA {
+			return err
+		}
+		if n == 0 && err == nil {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	return nil
+}
+
+// peerProcessID returns the process identifier of the other end of the pipe
+func (c *winConn) peerProcessID() (uint32, error) {
+	var pid uint32
+	if c.server {
+		err := c.api.GetNamedPipeClientProcessId(c.handle, &pid)
+		if err != nil {
+			return 0, fmt.Errorf("there was an error calling WINAPI GetNamedPipeClientProcessId: %s", err)
+		}
+		return pid, nil
+	}
+	err := c.api.GetNamedPipeServerProcessId(c.handle, &pid)
+	if err != nil {
+		return 0, fmt.Errorf("there was an error calling WINAPI GetNamedPipeServerProcessId: %s", err)
+	}
+	return pid, nil
+}
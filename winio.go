@@ -0,0 +1,198 @@
+package npipe
+
+import (
+	// Standard
+	"fmt"
+	"sync"
+	"time"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe/internal/winapi"
+)
+
+// maxCachedOps is the number of completed operations a connection keeps for reuse, enough for a reader, a writer,
+// and a few concurrent callers
+const maxCachedOps = 4
+
+// ioOp is the reusable state of one overlapped operation on a connection: the OVERLAPPED structure with its event
+// and the function that cancels the operation, which deadlines and contexts call while it is pending
+type ioOp struct {
+	overlapped winapi.Overlapped
+	cancel     func()
+}
+
+// opCache keeps the ioOps of a connection's completed operations so Read and Write don't create an event for every
+// operation. Operations beyond maxCachedOps that run concurrently get events that are closed when they complete.
+// The zero value is empty.
+type opCache struct {
+	mu     sync.Mutex
+	free   []*ioOp
+	closed bool
+}
+
+// get returns a cached operation for handle or creates one
+func (p *opCache) get(api winapi.API, handle winapi.Handle) (*ioOp, error) {
+	p.mu.Lock()
+	if n := len(p.free); n > 0 {
+		op := p.free[n-1]
+		p.free = p.free[:n-1]
+		p.mu.Unlock()
+		return op, nil
+	}
+	p.mu.Unlock()
+
+	event, err := api.CreateEvent(true, true)
+	if err != nil {
+		return nil, fmt.Errorf("npipe.opCache.get(): there was an error calling WINAPI CreateEvent: %s", err)
+	}
+	op := &ioOp{overlapped: winapi.Overlapped{HEvent: event}}
+	overlapped := &op.overlapped
+	op.cancel = func() {
+		api.CancelIoEx(handle, overlapped)
+	}
+	return op, nil
+}
+
+// put returns a completed operation to the cache, or closes its event if the cache is full or closed
+func (p *opCache) put(api winapi.API, op *ioOp) {
+	p.mu.Lock()
+	if !p.closed && len(p.free) < maxCachedOps {
+		op.overlapped = winapi.Overlapped{HEvent: op.overlapped.HEvent}
+		p.free = append(p.free, op)
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+	api.CloseHandle(op.overlapped.HEvent)
+}
+
+// close closes the events of the cached operations; operations that complete afterwards close their own
+func (p *opCache) close(api winapi.API) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, op := range p.free {
+		api.CloseHandle(op.overlapped.HEvent)
+	}
+	p.free = nil
+}
+
+// pipeDeadline is a deadline that can be changed while a request is waiting on it, like the deadlines of net.Pipe.
+// The pending operations registered with add are cancelled when it passes. A single timer is reused for every
+// deadline that is set. The zero value has no deadline.
+type pipeDeadline struct {
+	mu       sync.Mutex
+	deadline time.Time
+	timer    *time.Timer
+	cancel   chan struct{} // cancel is closed once the deadline passed
+	// pending holds the operations registered with add; the value is set once the deadline cancelled the operation,
+	// since the deadline may be moved again before the operation returns
+	pending map[*ioOp]bool
+}
+
+// set changes the deadline; the zero time removes it
+func (d *pipeDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.cancel == nil {
+		d.cancel = make(chan struct{})
+	}
+	if d.timer != nil {
+		// An expiry that already started finds the new deadline and ignores it or re-arms the timer
+		d.timer.Stop()
+	}
+	d.deadline = t
+
+	expired := isClosed(d.cancel)
+	if t.IsZero() {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		if d.timer == nil {
+			d.timer = time.AfterFunc(dur, d.expire)
+		} else {
+			d.timer.Reset(dur)
+		}
+		return
+	}
+	d.expireLocked()
+}
+
+// expire runs when the timer fires
+func (d *pipeDeadline) expire() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.deadline.IsZero() {
+		return
+	}
+	if dur := time.Until(d.deadline); dur > 0 {
+		// The deadline was moved while the timer fired
+		d.timer.Reset(dur)
+		return
+	}
+	d.expireLocked()
+}
+
+// expireLocked closes the channel returned by wait and cancels the pending operations. The caller must hold d.mu,
+// which keeps the cancelled operations from being reused before they are cancelled.
+func (d *pipeDeadline) expireLocked() {
+	if !isClosed(d.cancel) {
+		close(d.cancel)
+	}
+	for op := range d.pending {
+		op.cancel()
+		d.pending[op] = true
+	}
+}
+
+// wait returns a channel that is closed once the deadline passed
+func (d *pipeDeadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cancel == nil {
+		d.cancel = make(chan struct{})
+	}
+	return d.cancel
+}
+
+// add registers a pending operation to be cancelled once the deadline passes. It reports false without registering
+// the operation if the deadline already passed.
+func (d *pipeDeadline) add(op *ioOp) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cancel != nil && isClosed(d.cancel) {
+		return false
+	}
+	if d.pending == nil {
+		d.pending = make(map[*ioOp]bool)
+	}
+	d.pending[op] = false
+	return true
+}
+
+// remove unregisters a completed operation and reports whether the deadline cancelled it
+func (d *pipeDeadline) remove(op *ioOp) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cancelled := d.pending[op]
+	delete(d.pending, op)
+	return cancelled
+}
+
+// isClosed reports whether c is closed
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,298 @@
+package npipe
+
+import (
+	// Standard
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+
+	// Internal
+	"github.com/Ne0nd0g/npipe/internal/winapi"
+)
+
+// winListener is the Windows named pipe listener behind PipeListener. It only talks to the kernel through winapi.API
+// so the same code runs against the simulated kernel in tests on every platform.
+type winListener struct {
+	api    winapi.API
+	mu     sync.Mutex
+	addr   PipeAddr
+	handle winapi.Handle
+	closed bool
+
+	// acceptHandle contains the current handle waiting for
+	// an incoming connection or nil.
+	acceptHandle winapi.Handle
+	// acceptOverlapped is set before waiting on a connection.
+	// If not waiting, it is nil.
+	acceptOverlapped *winapi.Overlapped
+
+	// idle holds the instances returned by PipeConn.Disconnect, which Accept reuses before creating new ones
+	idle []winapi.Handle
+
+	// stats counts the accepted connections and their I/O
+	stats listenerCounters
+
+	// config holds the arguments the first instance was created with, which createInstance reuses for every new one
+	config pipeConfig
+}
+
+// pipeConfig holds the CreateNamedPipe arguments of a listener. Every instance of a pipe must be created with the same
+// pipe type, so the instances created by Accept use the configuration of the first one.
+type pipeConfig struct {
+	openMode     uint32
+	pipeMode     uint32
+	maxInstances uint32
+	outBuffer    uint32
+	inBuffer     uint32
+	timeout      uint32
+	// sa is the *windows.SecurityAttributes of the pipe on Windows, or nil for the default security descriptor
+	sa interface{}
+}
+
+// newPipeConfig returns the configuration for the instances created after the first one. FILE_FLAG_FIRST_PIPE_INSTANCE
+// is removed from openMode because the first instance already exists.
+func newPipeConfig(openMode, pipeMode, maxInstances, outBuffer, inBuffer, timeout uint32, sa interface{}) pipeConfig {
+	return pipeConfig{
+		openMode:     openMode &^ winapi.FILE_FLAG_FIRST_PIPE_INSTANCE,
+		pipeMode:     pipeMode,
+		maxInstances: maxInstances,
+		outBuffer:    outBuffer,
+		inBuffer:     inBuffer,
+		timeout:      timeout,
+		sa:           sa,
+	}
+}
+
+// createInstance creates the next instance of the pipe once the instance created by NewPipeListener was accepted
+func (l *winListener) createInstance() (winapi.Handle, error) {
+	c := l.config
+	return l.api.CreateNamedPipe(l.addr.String(), c.openMode, c.pipeMode, c.maxInstances, c.outBuffer, c.inBuffer, c.timeout, c.sa)
+}
+
+// nextInstance returns a disconnected instance from the pool, or creates a new one if the pool is empty.
+// The caller must hold l.mu.
+func (l *winListener) nextInstance() (winapi.Handle, error) {
+	if n := len(l.idle); n > 0 {
+		handle := l.idle[n-1]
+		l.idle = l.idle[:n-1]
+		return handle, nil
+	}
+	return l.createInstance()
+}
+
+// release returns a disconnected instance to the pool, or closes it if the listener was closed
+func (l *winListener) release(handle winapi.Handle) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		l.api.CloseHandle(handle)
+		return
+	}
+	l.idle = append(l.idle, handle)
+}
+
+// accept waits for the next client, ignoring clients that connect and immediately disconnect
+func (l *winListener) accept() (*winConn, error) {
+	c, err := l.acceptPipe()
+	for err == winapi.ERROR_NO_DATA {
+		// Ignore clients that connect and immediately disconnect.
+		c, err = l.acceptPipe()
+	}
+	return c, err
+}
+
+// acceptPipe accepts the next incoming call and returns the new connection.
+// It might return ERROR_NO_DATA if a client connected and immediately cancelled
+// the connection.
+func (l *winListener) acceptPipe() (*winConn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.addr == "" || l.closed {
+		return nil, fmt.Errorf("npipe.PipeListener.AcceptPipe(): the address is empty or the listener is closed")
+	}
+
+	// the first time we call accept, the handle will have been created by the Listen
+	// call. This is to prevent race conditions where the client thinks the server
+	// isn't listening because it hasn't actually called create yet. After the first time, we'll
+	// have to create a new handle each time
+	handle := l.handle
+	if handle == 0 {
+		var err error
+		handle, err = l.nextInstance()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		l.handle = 0
+	}
+
+	overlapped, err := newOverlapped(l.api)
+	if err != nil {
+		l.api.CloseHandle(handle)
+		return nil, err
+	}
+	err = l.api.ConnectNamedPipe(handle, overlapped)
+	if err == winapi.ERROR_IO_INCOMPLETE || err == winapi.ERROR_IO_PENDING {
+		l.acceptOverlapped = overlapped
+		l.acceptHandle = handle
+		// unlock here so close can function correctly while we wait
+		l.mu.Unlock()
+		_, err = waitForCompletion(l.api, handle, overlapped)
+		l.mu.Lock()
+		if l.acceptHandle == 0 {
+			// Close cancelled the request and already closed the handle and event.
+			// Return error compatible to net.Listener.Accept() in case the
+			// listener was closed.
+			return nil, ErrClosed
+		}
+		l.acceptOverlapped = nil
+		l.acceptHandle = 0
+	}
+	l.api.CloseHandle(overlapped.HEvent)
+
+	if err == nil || err == winapi.ERROR_PIPE_CONNECTED {
+		l.stats.accepts.Add(1)
+		l.stats.active.Add(1)
+		c := &winConn{api: l.api, handle: handle, addr: l.addr, server: true, listener: l}
+		c.stats.listener = &l.stats
+		return c, nil
+	}
+	// The instance is of no use once the client is gone, e.g. ERROR_NO_DATA
+	l.api.CloseHandle(handle)
+	switch err {
+	case winapi.ERROR_OPERATION_ABORTED:
+		return nil, ErrClosed
+	case winapi.ERROR_NO_DATA:
+		l.stats.noData.Add(1)
+	default:
+		l.stats.rejected.Add(1)
+	}
+	return nil, err
+}
+
+// waitingInstance returns the instance waiting for the next client, creating it if there is none; the next Accept
+// then uses it. The caller must hold l.mu.
+func (l *winListener) waitingInstance() (winapi.Handle, error) {
+	if l.acceptHandle != 0 {
+		return l.acceptHandle, nil
+	}
+	if l.handle == 0 {
+		handle, err := l.nextInstance()
+		if err != nil {
+			return 0, err
+		}
+		l.handle = handle
+	}
+	return l.handle, nil
+}
+
+// SyscallConn returns a raw connection to the instance waiting for the next client, which is created if there is
+// none. Only Control is supported; Read and Write return syscall.EINVAL like the raw connections of net listeners.
+func (l *winListener) SyscallConn() (syscall.RawConn, error) {
+	return &winRawListener{l: l}, nil
+}
+
+// winRawListener implements syscall.RawConn for the instance of a winListener that waits for the next client
+type winRawListener struct {
+	l *winListener
+}
+
+// Control calls f with the handle of the waiting instance. The listener's lock is held while f runs so Close can't
+// close the handle underneath it; f must not call the listener's methods.
+func (r *winRawListener) Control(f func(fd uintptr)) error {
+	r.l.mu.Lock()
+	defer r.l.mu.Unlock()
+	if r.l.closed {
+		return ErrClosed
+	}
+	handle, err := r.l.waitingInstance()
+	if err != nil {
+		return fmt.Errorf("npipe.PipeListener.SyscallConn(): there was an error calling the WINAPI CreateNamedPipe function: %s", err)
+	}
+	f(uintptr(handle))
+	return nil
+}
+
+// Read returns syscall.EINVAL because listeners can't be read
+func (r *winRawListener) Read(f func(fd uintptr) bool) error {
+	return syscall.EINVAL
+}
+
+// Write returns syscall.EINVAL because listeners can't be written
+func (r *winRawListener) Write(f func(fd uintptr) bool) error {
+	return syscall.EINVAL
+}
+
+// Info describes the pipe from the instance waiting for the next client, which is created if there is none
+func (l *winListener) Info() (HandleInfo, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return HandleInfo{}, fmt.Errorf("npipe.PipeListener.Info(): the listener is closed")
+	}
+	handle, err := l.waitingInstance()
+	if err != nil {
+		return HandleInfo{}, fmt.Errorf("npipe.PipeListener.Info(): there was an error calling the WINAPI CreateNamedPipe function: %s", err)
+	}
+	info, err := handleInfo(l.api, handle)
+	if err != nil {
+		return info, fmt.Errorf("npipe.PipeListener.Info(): %s", err)
+	}
+	return info, nil
+}
+
+// Stats returns the number of accepted, rejected, and open connections and the I/O of the accepted connections
+func (l *winListener) Stats() ListenerStats {
+	return l.stats.snapshot()
+}
+
+// Close stops listening on the address.
+// Already Accepted connections are not closed.
+func (l *winListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	for _, handle := range l.idle {
+		l.api.CloseHandle(handle)
+	}
+	l.idle = nil
+	if l.handle != 0 {
+		err := l.api.DisconnectNamedPipe(l.handle)
+		if err != nil {
+			return err
+		}
+		err = l.api.CloseHandle(l.handle)
+		if err != nil {
+			return err
+		}
+		l.handle = 0
+	}
+	if l.acceptOverlapped != nil && l.acceptHandle != 0 {
+		// Cancel the pending IO. This call does not block, so it is safe
+		// to hold onto the mutex above.
+		if err := l.api.CancelIoEx(l.acceptHandle, l.acceptOverlapped); err != nil {
+			return err
+		}
+		err := l.api.CloseHandle(l.acceptOverlapped.HEvent)
+		if err != nil {
+			return err
+		}
+		l.acceptOverlapped.HEvent = 0
+		err = l.api.CloseHandle(l.acceptHandle)
+		if err != nil {
+			return err
+		}
+		l.acceptHandle = 0
+	}
+	return nil
+}
+
+// Addr returns the listener's network address, a PipeAddr.
+func (l *winListener) Addr() net.Addr { return l.addr }